@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"melon/internal/partition"
+	"melon/internal/service"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+// secretFlags are left out of the configuration dump.
+var secretFlags = map[string]bool{"peer-token": true, "cluster-token": true}
+
+// registerAdminRoutes adds runtime operations that would otherwise need a
+// restart. fs holds the flags the node was started with.
+func registerAdminRoutes(r gin.IRoutes, fs *flag.FlagSet) {
+	r.POST("/snapshot", adminSnapshotHandler)
+	r.POST("/log/rotate", adminRotateHandler)
+	r.GET("/stats", adminStatsHandler)
+	r.GET("/read-only", adminReadOnlyHandler)
+	r.PUT("/read-only", adminSetReadOnlyHandler)
+	r.GET("/log-level", adminLogLevelHandler)
+	r.PUT("/log-level", adminSetLogLevelHandler)
+	r.GET("/config", adminConfigHandler(fs))
+}
+
+// adminSnapshotHandler compacts the transaction log, or in cluster mode
+// snapshots the Raft log.
+func adminSnapshotHandler(c *gin.Context) {
+	if cluster != nil {
+		clusterSnapshotHandler(c)
+		return
+	}
+	stats, err := service.Compact(c.Request.Context())
+	if err != nil {
+		abortWithAdminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// adminRotateHandler archives the transaction log and continues in a
+// compacted copy.
+func adminRotateHandler(c *gin.Context) {
+	archive, stats, err := service.RotateLog(c.Request.Context())
+	if err != nil {
+		abortWithAdminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"archive":       archive,
+		"events_before": stats.Before,
+		"events_after":  stats.After,
+	})
+}
+
+func abortWithAdminError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrorNotSupported) {
+		abortWithError(c, http.StatusNotImplemented, err.Error())
+		return
+	}
+	abortWithError(c, http.StatusInternalServerError, err.Error())
+}
+
+// adminStatsHandler reports the store's size, how its keys would spread
+// over the number of shards in the shards query parameter (default 16, at
+// most 256), and the process's memory use.
+func adminStatsHandler(c *gin.Context) {
+	shards := 16
+	if s := c.Query("shards"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > 256 {
+			abortWithError(c, http.StatusBadRequest, "shards must be between 1 and 256")
+			return
+		}
+		shards = n
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"store": service.StoreStats(shards),
+		"memory": map[string]uint64{
+			"heap_alloc_bytes":  mem.HeapAlloc,
+			"heap_inuse_bytes":  mem.HeapInuse,
+			"sys_bytes":         mem.Sys,
+			"heap_objects":      mem.HeapObjects,
+			"gc_cycles":         uint64(mem.NumGC),
+			"total_alloc_bytes": mem.TotalAlloc,
+		},
+		"goroutines": runtime.NumGoroutine(),
+	})
+}
+
+func adminReadOnlyHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]bool{"read_only": service.ReadOnly()})
+}
+
+// adminSetReadOnlyHandler turns read-only mode on or off for this node only.
+func adminSetReadOnlyHandler(c *gin.Context) {
+	var body struct {
+		ReadOnly *bool `json:"read_only" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	service.SetReadOnly(*body.ReadOnly)
+	adminReadOnlyHandler(c)
+}
+
+func adminLogLevelHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]string{"level": logLevel.String()})
+}
+
+func adminSetLogLevelHandler(c *gin.Context) {
+	var body struct {
+		Level string `json:"level" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := logLevel.UnmarshalText([]byte(body.Level)); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	adminLogLevelHandler(c)
+}
+
+// adminConfigHandler dumps the flags the node was started with, secrets
+// excepted, along with the settings changed since.
+func adminConfigHandler(fs *flag.FlagSet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		flags := make(map[string]string)
+		fs.VisitAll(func(f *flag.Flag) {
+			if secretFlags[f.Name] && f.Value.String() != "" {
+				flags[f.Name] = "<redacted>"
+				return
+			}
+			flags[f.Name] = f.Value.String()
+		})
+		mode := "standalone"
+		switch {
+		case cluster != nil:
+			mode = "cluster"
+		case partition.Enabled():
+			mode = "partitioned"
+		}
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"flags":     flags,
+			"mode":      mode,
+			"read_only": service.ReadOnly(),
+			"log_level": logLevel.String(),
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"melon/internal/auth"
+	"melon/internal/service"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const (
+	principalKey  = "principal" // gin context key holding the authenticated principal
+	maxSignedBody = 64 << 20    // Longest body of an HMAC-signed request, which is read before its caller is known
+)
+
+// authenticator identifies callers; nil leaves the API open, as it was before
+// authentication existed.
+var authenticator auth.Authenticator
+
+// admins may use every key and manage ACLs, cluster membership and
+// replication.
+var admins = map[string]bool{}
+
+// authOptions says where credentials come from and who is an admin.
+type authOptions struct {
+	tokensFile   string
+	hmacKeysFile string
+	mtls         bool
+	admins       string
+}
+
+func authFlags(fs *flag.FlagSet) *authOptions {
+	o := &authOptions{}
+	fs.StringVar(&o.tokensFile, "auth-tokens", "", "file of \"token principal\" lines accepted as bearer tokens")
+	fs.StringVar(&o.hmacKeysFile, "auth-hmac-keys", "", "file of \"key-id secret\" lines accepted for HMAC signed requests")
+	fs.BoolVar(&o.mtls, "auth-mtls", false, "accept the name on a verified client certificate as the principal")
+	fs.StringVar(&o.admins, "auth-admins", "", "comma separated principals allowed to manage ACLs, replication and membership")
+	return o
+}
+
+// setupAuth enables authentication when any credential source is given.
+func setupAuth(o *authOptions) error {
+	var chain auth.Chain
+	if o.tokensFile != "" {
+		a, err := auth.NewTokenAuthenticator(o.tokensFile)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, a)
+	}
+	if o.hmacKeysFile != "" {
+		a, err := auth.NewHMACAuthenticator(o.hmacKeysFile, maxSignedBody)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, a)
+	}
+	if o.mtls {
+		chain = append(chain, auth.MTLSAuthenticator{})
+	}
+	if len(chain) > 0 {
+		authenticator = chain
+	}
+	for _, admin := range splitList(o.admins) {
+		admins[admin] = true
+	}
+	return nil
+}
+
+// authenticate records the caller's principal, rejecting the request if its
+// credentials are missing or wrong.
+func authenticate(c *gin.Context) {
+	if authenticator == nil {
+		c.Next()
+		return
+	}
+	principal, err := authenticator.Authenticate(c.Request)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, errorBody(codeTooLarge, err.Error()))
+		return
+	}
+	if errors.Is(err, auth.ErrorNoCredentials) {
+		c.Header("WWW-Authenticate", `Bearer realm="melon"`)
+		abortWithError(c, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	if err != nil {
+		abortWithError(c, http.StatusUnauthorized, err.Error())
+		return
+	}
+	c.Set(principalKey, principal)
+	c.Next()
+}
+
+// authorize checks that the caller holds p on the requested key.
+func authorize(p service.Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if allowed(c, c.Param("ns"), c.Param("key"), p) {
+			c.Next()
+		}
+	}
+}
+
+// allowed checks that the caller holds p on key in namespace ns, aborting
+// the request if not.
+func allowed(c *gin.Context, ns, key string, p service.Permission) bool {
+	principal := c.GetString(principalKey)
+	if permitted(principal, ns, key, p) {
+		return true
+	}
+	abortWithError(c, http.StatusForbidden, fmt.Sprintf("%s lacks %q permission on key %q", principal, p, key))
+	return false
+}
+
+// permitted reports whether principal holds p on key in namespace ns.
+func permitted(principal, ns, key string, p service.Permission) bool {
+	return authenticator == nil || admins[principal] || service.Allowed(principal, ns, key, p)
+}
+
+// authenticateConn identifies a caller of one of the non-HTTP APIs from the
+// Authorization value it sent, if any, and the TLS state of its connection.
+// HMAC signatures cover HTTP requests, so only tokens and client
+// certificates work here.
+func authenticateConn(authorization string, state *tls.ConnectionState) (string, error) {
+	r := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/"}, Header: make(http.Header), TLS: state}
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	return authenticator.Authenticate(r)
+}
+
+// authenticateNetConn identifies the client of a plain TCP protocol from
+// token, or from its certificate when token is empty.
+func authenticateNetConn(conn net.Conn, token string) (string, error) {
+	var state *tls.ConnectionState
+	if tc, ok := conn.(*tls.Conn); ok {
+		s := tc.ConnectionState()
+		state = &s
+	}
+	authorization := ""
+	if token != "" {
+		authorization = "Bearer " + token
+	}
+	return authenticateConn(authorization, state)
+}
+
+// requireAdmin limits a route to admins.
+func requireAdmin(c *gin.Context) {
+	if authenticator == nil || admins[c.GetString(principalKey)] {
+		c.Next()
+		return
+	}
+	abortWithError(c, http.StatusForbidden, "admin access required")
+}
+
+func registerACLRoutes(r gin.IRoutes) {
+	r.GET("/v1/acl", aclListHandler)
+	r.PUT("/v1/acl/grants", requireLeader, aclGrantHandler)
+	r.DELETE("/v1/acl/grants", requireLeader, aclRevokeHandler)
+}
+
+func aclListHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{"grants": service.Grants()})
+}
+
+// aclGrantHandler gives a principal permissions on a key prefix, replacing
+// any it already had on exactly that prefix.
+func aclGrantHandler(c *gin.Context) {
+	var g service.Grant
+	if err := c.ShouldBindJSON(&g); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if g.Principal == "" || g.Permissions == 0 {
+		abortWithError(c, http.StatusBadRequest, "principal and permissions are required")
+		return
+	}
+	if err := service.Commit(c.Request.Context(), service.GrantEvent(g)); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, g)
+}
+
+func aclRevokeHandler(c *gin.Context) {
+	principal := c.Query("principal")
+	if principal == "" {
+		abortWithError(c, http.StatusBadRequest, "principal is required")
+		return
+	}
+	if err := service.Commit(c.Request.Context(), service.RevokeEvent(principal, c.Query("namespace"), c.Query("prefix"))); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// bearerTransport adds a static API token to every request, for calls this
+// node makes to other nodes.
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+func (t bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(r)
+}
+
+// withToken makes client send token, if there is one.
+func withToken(client *http.Client, token string) *http.Client {
+	if token != "" {
+		client.Transport = bearerTransport{token: token, base: client.Transport}
+	}
+	return client
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"melon/internal/metrics"
+	"melon/internal/raft"
+	"melon/internal/service"
+	"melon/internal/transaction"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const proposeTimeout = 5 * time.Second // How long a write waits for a quorum
+
+// clusterTokenEnv holds the cluster token when -cluster-token is not given,
+// keeping it out of the process list.
+const clusterTokenEnv = "MELON_CLUSTER_TOKEN"
+
+// cluster is this node's Raft member when running in cluster mode.
+var cluster *raft.Node
+
+// raftRPCs holds the Raft node's RPC handler once it has started.
+var raftRPCs atomic.Value
+
+// storeFSM applies committed transaction events to the service store.
+type storeFSM struct{}
+
+func (storeFSM) Apply(data []byte) error {
+	var e transaction.Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return fmt.Errorf("cannot decode event: %w", err)
+	}
+	return service.Apply(context.Background(), e)
+}
+
+// Snapshot also compacts the in-memory transaction log, which would
+// otherwise grow without bound as the Raft log it mirrors is trimmed.
+func (storeFSM) Snapshot() ([]byte, error) {
+	data, err := service.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := service.Compact(context.Background()); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (storeFSM) Restore(snapshot []byte) error {
+	return service.RestoreSnapshot(snapshot)
+}
+
+// parsePeers reads a comma separated list of id=url pairs.
+func parsePeers(s string) (map[string]string, error) {
+	peers := make(map[string]string)
+	if s == "" {
+		return peers, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		id, addr, ok := strings.Cut(pair, "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("invalid peer %q, expected id=url", pair)
+		}
+		peers[id] = addr
+	}
+	return peers, nil
+}
+
+// startCluster makes the Raft log the source of truth: the store is rebuilt
+// from its snapshot and entries, and every write goes through a quorum.
+// The Raft RPCs bypass authentication and ACLs, so the members prove
+// themselves to each other with token.
+func startCluster(id string, peers map[string]string, dir string, client *http.Client, token string) error {
+	if token == "" {
+		token = os.Getenv(clusterTokenEnv)
+	}
+	if token == "" {
+		return fmt.Errorf("cluster mode needs -cluster-token or %s", clusterTokenEnv)
+	}
+	if err := service.InitializeWithLogger(transaction.NewMemoryTransactionLogger()); err != nil {
+		return err
+	}
+	start := time.Now()
+	node, err := raft.NewNode(raft.Options{
+		ID:        id,
+		Peers:     peers,
+		Dir:       dir,
+		Transport: raft.NewHTTPTransport(client, token),
+		Token:     token,
+		FSM:       storeFSM{},
+		Logger:    logger.Named("raft"),
+	})
+	if err != nil {
+		return fmt.Errorf("cannot start raft node: %w", err)
+	}
+	metrics.ReplayDuration.Set(time.Since(start).Seconds()) // Restoring the Raft snapshot is this mode's replay
+	cluster = node
+	raftRPCs.Store(node.Handler())
+	service.SetCommitter(func(ctx context.Context, e transaction.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(ctx, proposeTimeout)
+		defer cancel()
+		return node.Propose(ctx, data)
+	})
+	return nil
+}
+
+// raftHandler serves the Raft RPCs of other members, which a starting
+// node needs to answer before the rest of its API.
+func raftHandler(c *gin.Context) {
+	h, ok := raftRPCs.Load().(http.Handler)
+	if !ok {
+		abortWithError(c, http.StatusServiceUnavailable, "raft node not started")
+		return
+	}
+	h.ServeHTTP(c.Writer, c.Request)
+}
+
+func registerClusterRoutes(r gin.IRoutes) {
+	r.GET("/v1/cluster/status", clusterStatusHandler)
+	r.POST("/v1/cluster/members", clusterAddMemberHandler)
+	r.DELETE("/v1/cluster/members/:id", clusterRemoveMemberHandler)
+	r.POST("/v1/cluster/snapshot", clusterSnapshotHandler)
+	r.POST("/v1/cluster/partition", clusterPartitionHandler)
+	r.DELETE("/v1/cluster/partition", clusterHealHandler)
+}
+
+// abortWithCommitError reports a failed write, pointing the client at the
+// leader when the write was sent to the wrong node.
+func abortWithCommitError(c *gin.Context, err error) {
+	var notLeader *raft.NotLeaderError
+	if errors.As(err, &notLeader) {
+		body := errorBody(codeNotLeader, err.Error())
+		body["leader"] = notLeader.LeaderAddr
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, body)
+		return
+	}
+	if errors.Is(err, service.ErrorQuotaExceeded) {
+		abortWithError(c, http.StatusInsufficientStorage, err.Error())
+		return
+	}
+	if errors.Is(err, service.ErrorReadOnly) {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, errorBody(codeReadOnly, err.Error()))
+		return
+	}
+	requestLog(c).Error("write failed", zap.Error(err))
+	abortWithError(c, http.StatusInternalServerError, err.Error())
+}
+
+func clusterStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, cluster.Status())
+}
+
+func clusterAddMemberHandler(c *gin.Context) {
+	var member struct {
+		ID   string `json:"id" binding:"required"`
+		Addr string `json:"addr" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&member); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := cluster.AddMember(c.Request.Context(), member.ID, member.Addr); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cluster.Status())
+}
+
+func clusterRemoveMemberHandler(c *gin.Context) {
+	if err := cluster.RemoveMember(c.Request.Context(), c.Param("id")); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, cluster.Status())
+}
+
+func clusterSnapshotHandler(c *gin.Context) {
+	if err := cluster.Snapshot(); err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, cluster.Status())
+}
+
+// clusterPartitionHandler cuts this node off from the listed peers, for
+// exercising elections and recovery on a single host.
+func clusterPartitionHandler(c *gin.Context) {
+	var partition struct {
+		Peers []string `json:"peers" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&partition); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	cluster.Isolate(partition.Peers...)
+	c.JSON(http.StatusOK, cluster.Status())
+}
+
+func clusterHealHandler(c *gin.Context) {
+	cluster.Heal()
+	c.JSON(http.StatusOK, cluster.Status())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"io"
+	"melon/internal/service"
+	"net/http"
+	"strconv"
+)
+
+// keyValueCASHandler sets key to the body's new value if it holds its old
+// one, answering 412 if it does not.
+func keyValueCASHandler(c *gin.Context) {
+	ns, key := c.Param("ns"), c.Param("key")
+	var body struct {
+		Old *string `json:"old"`
+		New *string `json:"new"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Old == nil || body.New == nil {
+		abortWithError(c, http.StatusBadRequest, "body must be a JSON object with old and new values")
+		return
+	}
+	swapped, err := service.CompareAndSwap(c.Request.Context(), ns, key, *body.Old, *body.New)
+	if err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	if !swapped {
+		abortWithError(c, http.StatusPreconditionFailed, "key does not hold the old value")
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"status": "updated"})
+}
+
+// keyValuePutIfAbsentHandler sets key to the raw body unless it exists,
+// answering 412 if it does. With ?lease=, the new key is attached to that
+// lease.
+func keyValuePutIfAbsentHandler(c *gin.Context) {
+	ns, key := c.Param("ns"), c.Param("key")
+	lease, err := strconv.ParseInt(c.DefaultQuery("lease", "0"), 10, 64)
+	if err != nil || lease < 0 {
+		abortWithError(c, http.StatusBadRequest, "invalid lease")
+		return
+	}
+	value, err := io.ReadAll(c.Request.Body)
+	defer c.Request.Body.Close()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	put, err := service.PutIfAbsentWithLease(c.Request.Context(), ns, key, string(value), lease)
+	if err != nil {
+		abortWithLeaseError(c, err)
+		return
+	}
+	if !put {
+		abortWithError(c, http.StatusPreconditionFailed, "key already exists")
+		return
+	}
+	c.JSON(http.StatusCreated, map[string]interface{}{"status": "created"})
+}
+
+// keyValueDeleteIfValueHandler deletes key if it holds the raw body,
+// answering 412 if it does not.
+func keyValueDeleteIfValueHandler(c *gin.Context) {
+	ns, key := c.Param("ns"), c.Param("key")
+	value, err := io.ReadAll(c.Request.Body)
+	defer c.Request.Body.Close()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	deleted, err := service.DeleteIfValue(c.Request.Context(), ns, key, string(value))
+	if err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	if !deleted {
+		abortWithError(c, http.StatusPreconditionFailed, "key does not hold the value")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"melon/internal/service"
+	"net/http"
+	"strconv"
+)
+
+// keyValueCounterHandler serves the counter operations on key: incr and
+// decr add or subtract the integer ?by=, 1 by default, and add adds any
+// number. A missing key counts from zero. The result is logged as a put.
+func keyValueCounterHandler(op string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ns, key := c.Param("ns"), c.Param("key")
+		var result interface{}
+		var err error
+		if op == "add" {
+			var sum string
+			sum, err = service.AddFloat(c.Request.Context(), ns, key, c.Query("by"))
+			if errors.Is(err, service.ErrorBadAmount) {
+				abortWithError(c, http.StatusBadRequest, "invalid by")
+				return
+			}
+			result = json.Number(sum)
+		} else {
+			by, perr := strconv.ParseInt(c.DefaultQuery("by", "1"), 10, 64)
+			if perr != nil {
+				abortWithError(c, http.StatusBadRequest, "invalid by")
+				return
+			}
+			if op == "decr" {
+				if by == math.MinInt64 { // The one value that cannot be negated
+					abortWithError(c, http.StatusBadRequest, "invalid by")
+					return
+				}
+				by = -by
+			}
+			result, err = service.Incr(c.Request.Context(), ns, key, by)
+		}
+		if errors.Is(err, service.ErrorNotANumber) {
+			c.AbortWithStatusJSON(http.StatusConflict, errorBody(codeNotANumber, err.Error()))
+			return
+		}
+		if errors.Is(err, service.ErrorOverflow) {
+			abortWithError(c, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			abortWithCommitError(c, err)
+			return
+		}
+		if wantsEnvelope(c) {
+			if value, meta, err := service.GetWithMeta(c.Request.Context(), ns, key); err == nil {
+				c.JSON(http.StatusOK, newKeyEnvelope(ns, key, value, meta))
+				return
+			}
+		}
+		c.JSON(http.StatusOK, map[string]interface{}{
+			"value": result,
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"melon/internal/service"
+	"mime"
+	"net/http"
+)
+
+// abortWithDocumentError ends a request that failed to read or patch a JSON
+// document with err.
+func abortWithDocumentError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrorBadPath), errors.Is(err, service.ErrorBadPatch):
+		abortWithError(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, service.ErrorNotJSON):
+		c.AbortWithStatusJSON(http.StatusConflict, errorBody(codeNotJSON, err.Error()))
+	case errors.Is(err, service.ErrorNoSuchPath), errors.Is(err, service.ErrorPatchTestFailed):
+		c.AbortWithStatusJSON(http.StatusConflict, errorBody(codePatchFailed, err.Error()))
+	default:
+		abortWithTypeError(c, err)
+	}
+}
+
+// keyValuePatchHandler patches the JSON document at key, atomically, with
+// the body: a JSON Merge Patch when sent as application/merge-patch+json
+// (or plain application/json), or a JSON Patch when sent as
+// application/json-patch+json. It answers with the patched document.
+func keyValuePatchHandler(c *gin.Context) {
+	ns, key := c.Param("ns"), c.Param("key")
+	patch, err := io.ReadAll(c.Request.Body)
+	defer c.Request.Body.Close()
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var value string
+	var meta service.KeyMeta
+	switch mediaType, _, _ := mime.ParseMediaType(c.ContentType()); mediaType {
+	case "application/merge-patch+json", "application/json":
+		value, meta, err = service.MergePatch(c.Request.Context(), ns, key, patch)
+	case "application/json-patch+json":
+		value, meta, err = service.JSONPatch(c.Request.Context(), ns, key, patch)
+	default:
+		abortWithError(c, http.StatusUnsupportedMediaType, "send application/merge-patch+json or application/json-patch+json")
+		return
+	}
+	if err != nil {
+		abortWithDocumentError(c, err)
+		return
+	}
+	if wantsEnvelope(c) {
+		c.JSON(http.StatusOK, newKeyEnvelope(ns, key, value, meta))
+		return
+	}
+	c.Data(http.StatusOK, "application/json", []byte(value))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"melon/internal/transaction"
+	"os"
+)
+
+// encryptionKeysEnv holds the encryption keys when no keyfile is given, in
+// the keyfile's format with commas for line breaks.
+const encryptionKeysEnv = "MELON_ENCRYPTION_KEYS"
+
+// setupEncryption turns on encryption of the transaction log with the keys
+// in keyfile, or else in encryptionKeysEnv. With neither, the log is left in
+// plaintext. Keys are refused in cluster mode, where every value would
+// still be written in plaintext to the Raft log and snapshots.
+func setupEncryption(keyfile string, sealKeys, cluster bool) error {
+	data := os.Getenv(encryptionKeysEnv)
+	if keyfile != "" {
+		b, err := os.ReadFile(keyfile)
+		if err != nil {
+			return fmt.Errorf("cannot read encryption keys: %w", err)
+		}
+		data = string(b)
+	}
+	if data == "" {
+		if sealKeys {
+			return fmt.Errorf("-encrypt-keys needs -encryption-keyfile or %s", encryptionKeysEnv)
+		}
+		return nil
+	}
+	if cluster {
+		return fmt.Errorf("encryption at rest is not supported in cluster mode, whose Raft log is not encrypted")
+	}
+	ids, keys, err := transaction.ParseEncryptionKeys(data)
+	if err != nil {
+		return fmt.Errorf("invalid encryption keys: %w", err)
+	}
+	e, err := transaction.NewEncryptor(ids[0], keys, sealKeys)
+	if err != nil {
+		return err
+	}
+	transaction.SetEncryptor(e)
+	return nil
+}
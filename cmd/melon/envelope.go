@@ -0,0 +1,54 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"melon/internal/service"
+	"strings"
+	"time"
+)
+
+// keyEnvelope is the JSON form of a key's value, returned instead of the
+// raw value when the client asks for it; see wantsEnvelope.
+type keyEnvelope struct {
+	Namespace string      `json:"namespace,omitempty"`
+	Key       string      `json:"key"`
+	Value     string      `json:"value"`
+	Version   uint64      `json:"version"` // Puts since the key was created, starting at 1
+	Metadata  keyMetadata `json:"metadata"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"` // Only for keys set to expire
+	Type      string      `json:"type,omitempty"`       // Only for lists, sets and hashes
+}
+
+type keyMetadata struct {
+	Size int `json:"size"` // Length of the value in bytes
+}
+
+func newKeyEnvelope(ns, key, value string, meta service.KeyMeta) keyEnvelope {
+	var expires *time.Time
+	if !meta.ExpiresAt.IsZero() {
+		expires = &meta.ExpiresAt
+	}
+	return keyEnvelope{
+		Namespace: ns,
+		Key:       key,
+		Value:     value,
+		Version:   meta.Version,
+		Metadata:  keyMetadata{Size: len(value)},
+		CreatedAt: meta.CreatedAt,
+		UpdatedAt: meta.UpdatedAt,
+		ExpiresAt: expires,
+		Type:      string(meta.Type),
+	}
+}
+
+// wantsEnvelope reports whether the client asked for key values wrapped in
+// a keyEnvelope, with ?envelope=true or by accepting only JSON.
+func wantsEnvelope(c *gin.Context) bool {
+	if c.Query("envelope") == "true" {
+		return true
+	}
+	accept := strings.TrimSpace(strings.Split(c.GetHeader("Accept"), ";")[0])
+	return accept == "application/json"
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// Error codes sent in the "code" field of every error response. Clients
+// should match on these rather than on the message.
+const (
+	codeInvalidRequest = "invalid_request"
+	codeUnauthorized   = "unauthenticated"
+	codeForbidden      = "forbidden"
+	codeNotFound       = "not_found"
+	codeConflict       = "conflict"
+	codeRateLimited    = "rate_limited"
+	codeInternal       = "internal"
+	codeNotImplemented = "not_implemented"
+	codeBadGateway     = "bad_gateway"
+	codeUnavailable    = "unavailable"
+	codeNotLeader      = "not_leader"
+	codeReadOnly       = "read_only"
+	codeQuotaExceeded  = "quota_exceeded"
+	codeNotANumber     = "not_a_number"
+	codeWrongType      = "wrong_type"
+	codeNotJSON        = "not_json"
+	codePatchFailed    = "patch_failed"
+	codeUnsupported    = "unsupported_media_type"
+	codePrecondition   = "precondition_failed"
+	codeTooLarge       = "too_large"
+)
+
+// statusCodes is the code sent with each status unless the handler picks a
+// more specific one.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           codeInvalidRequest,
+	http.StatusUnauthorized:         codeUnauthorized,
+	http.StatusForbidden:            codeForbidden,
+	http.StatusNotFound:             codeNotFound,
+	http.StatusConflict:             codeConflict,
+	http.StatusPreconditionFailed:   codePrecondition,
+	http.StatusUnsupportedMediaType: codeUnsupported,
+	http.StatusTooManyRequests:      codeRateLimited,
+	http.StatusNotImplemented:       codeNotImplemented,
+	http.StatusBadGateway:           codeBadGateway,
+	http.StatusServiceUnavailable:   codeUnavailable,
+	http.StatusInsufficientStorage:  codeQuotaExceeded,
+}
+
+// errorBody is the JSON body of an error response.
+func errorBody(code, message string) map[string]string {
+	return map[string]string{"error": message, "code": code}
+}
+
+// abortWithError ends the request with status and the standard error body
+// for it.
+func abortWithError(c *gin.Context, status int, message string) {
+	code, ok := statusCodes[status]
+	if !ok {
+		code = codeInternal
+	}
+	c.AbortWithStatusJSON(status, errorBody(code, message))
+}
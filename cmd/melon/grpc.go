@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"melon/internal/auth"
+	"melon/internal/logging"
+	"melon/internal/metrics"
+	"melon/internal/raft"
+	"melon/internal/replication"
+	"melon/internal/service"
+	"melon/internal/transaction"
+	"melon/pkg/melonpb"
+	"net"
+	"strings"
+	"time"
+)
+
+// serveGRPC runs the gRPC API on addr until it fails, with the same TLS
+// settings as the HTTP API.
+func serveGRPC(o *serverOptions, addr string) error {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	}
+	if !o.plaintext {
+		config, err := o.tls()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(config)))
+	}
+	srv := grpc.NewServer(opts...)
+	melonpb.RegisterKVServer(srv, kvServer{})
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("serving gRPC", zap.String("addr", addr))
+	return srv.Serve(lis)
+}
+
+type principalContextKey struct{}
+
+// grpcCall prepares the context of a call: it continues the caller's trace,
+// attaches a logger carrying the request ID, and authenticates the caller.
+// done records the outcome and must be called when the call ends.
+func grpcCall(ctx context.Context, method string) (context.Context, func(error), error) {
+	start := time.Now()
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	ctx, span := httpTracer.Start(ctx, method, trace.WithSpanKind(trace.SpanKindServer))
+
+	id := first(md.Get(strings.ToLower(requestIDHeader)))
+	if id == "" || len(id) > 128 {
+		id = newRequestID()
+	}
+	fields := []zap.Field{zap.String("request_id", id)}
+	if sc := span.SpanContext(); sc.IsSampled() {
+		fields = append(fields, zap.String("trace_id", sc.TraceID().String()))
+	}
+	l := logger.With(fields...)
+	ctx = logging.NewContext(ctx, l)
+
+	principal, authErr := authenticateGRPC(ctx, md)
+	if principal != "" {
+		ctx = context.WithValue(ctx, principalContextKey{}, principal)
+	}
+	done := func(err error) {
+		code := status.Code(err)
+		metrics.GRPCRequestsTotal.WithLabelValues(method, code.String()).Inc()
+		metrics.GRPCRequestDuration.WithLabelValues(method, code.String()).Observe(time.Since(start).Seconds())
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+		access := []zap.Field{
+			zap.String("method", method),
+			zap.String("code", code.String()),
+			zap.Duration("latency", time.Since(start)),
+		}
+		if principal != "" {
+			access = append(access, zap.String("principal", principal))
+		}
+		if p, ok := peer.FromContext(ctx); ok {
+			access = append(access, zap.String("client_ip", p.Addr.String()))
+		}
+		if code == grpccodes.Internal || code == grpccodes.Unknown {
+			l.Warn("grpc request", append(access, zap.Error(err))...)
+		} else {
+			l.Info("grpc request", access...)
+		}
+	}
+	return ctx, done, authErr
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, done, err := grpcCall(ctx, info.FullMethod)
+	if err != nil {
+		done(err)
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	err = grpcError(err)
+	done(err)
+	return resp, err
+}
+
+func grpcStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, done, err := grpcCall(ss.Context(), info.FullMethod)
+	if err != nil {
+		done(err)
+		return err
+	}
+	err = grpcError(handler(srv, contextStream{ss, ctx}))
+	done(err)
+	return err
+}
+
+// contextStream replaces the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateGRPC checks the caller's bearer token or client certificate
+// with the same authenticator as the HTTP API.
+func authenticateGRPC(ctx context.Context, md metadata.MD) (string, error) {
+	if authenticator == nil {
+		return "", nil
+	}
+	var state *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state = &info.State
+		}
+	}
+	principal, err := authenticateConn(first(md.Get("authorization")), state)
+	if errors.Is(err, auth.ErrorNoCredentials) {
+		return "", status.Error(grpccodes.Unauthenticated, "authentication required")
+	}
+	if err != nil {
+		return "", status.Error(grpccodes.Unauthenticated, err.Error())
+	}
+	return principal, nil
+}
+
+// allowedGRPC checks that the caller holds p on key in namespace ns.
+func allowedGRPC(ctx context.Context, ns, key string, p service.Permission) error {
+	principal, _ := ctx.Value(principalContextKey{}).(string)
+	if permitted(principal, ns, key, p) {
+		return nil
+	}
+	return status.Errorf(grpccodes.PermissionDenied, "%s lacks %q permission on key %q", principal, p, key)
+}
+
+// servable checks that this node can serve key: writes need the replication
+// leader, and when partitioned the key must be owned here. Unlike the HTTP
+// API, gRPC calls are not forwarded; clients should go to the owner.
+func servable(ns, key string, write bool) error {
+	if write && !replication.IsLeader() {
+		return status.Errorf(grpccodes.Unavailable, "this node is a read-only follower; the leader is %s", replication.Leader())
+	}
+	if err := ownedElsewhere(ns, key); err != nil {
+		return status.Error(grpccodes.FailedPrecondition, err.Error())
+	}
+	return nil
+}
+
+// grpcError maps the service's errors to gRPC status codes.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	var notLeader *raft.NotLeaderError
+	switch {
+	case errors.As(err, &notLeader):
+		return status.Errorf(grpccodes.Unavailable, "%v; the leader is %s", err, notLeader.LeaderAddr)
+	case errors.Is(err, service.ErrorNoSuchKey):
+		return status.Error(grpccodes.NotFound, err.Error())
+	case errors.Is(err, service.ErrorQuotaExceeded):
+		return status.Error(grpccodes.ResourceExhausted, err.Error())
+	case errors.Is(err, service.ErrorReadOnly):
+		return status.Error(grpccodes.Unavailable, err.Error())
+	case errors.Is(err, service.ErrorUnknownCompare):
+		return status.Error(grpccodes.InvalidArgument, err.Error())
+	case errors.Is(err, service.ErrorWatcherDropped):
+		return status.Error(grpccodes.Aborted, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(grpccodes.DeadlineExceeded, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(grpccodes.Canceled, err.Error())
+	}
+	return status.Error(grpccodes.Internal, err.Error())
+}
+
+// kvServer serves the gRPC API from the service package, as the HTTP
+// handlers do.
+type kvServer struct {
+	melonpb.UnimplementedKVServer
+}
+
+func (kvServer) Get(ctx context.Context, req *melonpb.GetRequest) (*melonpb.GetResponse, error) {
+	if err := checkKey(ctx, req.Namespace, req.Key, service.PermissionRead, false); err != nil {
+		return nil, err
+	}
+	value, meta, err := service.GetWithMeta(ctx, req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &melonpb.GetResponse{Kv: keyValue(req.Namespace, req.Key, value, meta)}, nil
+}
+
+func (kvServer) Put(ctx context.Context, req *melonpb.PutRequest) (*melonpb.PutResponse, error) {
+	if err := checkKey(ctx, req.Namespace, req.Key, service.PermissionWrite, true); err != nil {
+		return nil, err
+	}
+	err := service.Commit(ctx, transaction.Event{EventType: transaction.EventPut, Namespace: req.Namespace, Key: req.Key, Value: string(req.Value)})
+	if err != nil {
+		return nil, err
+	}
+	value, meta, err := service.GetWithMeta(ctx, req.Namespace, req.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &melonpb.PutResponse{Kv: keyValue(req.Namespace, req.Key, value, meta), Created: meta.Version == 1}, nil
+}
+
+func (kvServer) Delete(ctx context.Context, req *melonpb.DeleteRequest) (*melonpb.DeleteResponse, error) {
+	if err := checkKey(ctx, req.Namespace, req.Key, service.PermissionDelete, true); err != nil {
+		return nil, err
+	}
+	if _, err := service.GetIn(ctx, req.Namespace, req.Key); errors.Is(err, service.ErrorNoSuchKey) {
+		return &melonpb.DeleteResponse{}, nil
+	}
+	err := service.Commit(ctx, transaction.Event{EventType: transaction.EventDelete, Namespace: req.Namespace, Key: req.Key})
+	if err != nil {
+		return nil, err
+	}
+	return &melonpb.DeleteResponse{Deleted: true}, nil
+}
+
+// List returns the keys this node holds; when partitioned, that is only the
+// keys it owns.
+func (kvServer) List(ctx context.Context, req *melonpb.ListRequest) (*melonpb.ListResponse, error) {
+	if err := allowedGRPC(ctx, req.Namespace, req.Prefix, service.PermissionRead); err != nil {
+		return nil, err
+	}
+	entries, more := service.List(req.Namespace, req.Prefix, int(req.Limit))
+	resp := &melonpb.ListResponse{Kvs: make([]*melonpb.KeyValue, 0, len(entries)), More: more}
+	for _, e := range entries {
+		kv := keyValue(req.Namespace, e.Key, e.Value, e.Meta)
+		if req.KeysOnly {
+			kv.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	return resp, nil
+}
+
+// Watch streams the writes applied on this node until the client cancels.
+func (kvServer) Watch(req *melonpb.WatchRequest, stream melonpb.KV_WatchServer) error {
+	ctx := stream.Context()
+	if err := allowedGRPC(ctx, req.Namespace, req.Prefix, service.PermissionRead); err != nil {
+		return err
+	}
+	match := func(e transaction.Event) bool {
+		return e.Namespace == req.Namespace && strings.HasPrefix(e.Key, req.Prefix)
+	}
+	return service.Watch(ctx, req.StartSequence, match, func(e transaction.Event) error {
+		ev := &melonpb.WatchEvent{Sequence: e.Sequence, Kv: &melonpb.KeyValue{Namespace: e.Namespace, Key: e.Key}}
+		if e.EventType == transaction.EventDelete {
+			ev.Type = melonpb.WatchEvent_DELETE
+		} else {
+			ev.Kv.Value = []byte(e.Value)
+			ev.Kv.UpdatedAt = timestamppb.New(e.CreatedAt)
+		}
+		return stream.Send(ev)
+	})
+}
+
+// Txn checks every key the transaction may touch, in either branch, before
+// running it, so a refused branch never runs part way.
+func (kvServer) Txn(ctx context.Context, req *melonpb.TxnRequest) (*melonpb.TxnResponse, error) {
+	compares := make([]service.Compare, 0, len(req.Compare))
+	for _, c := range req.Compare {
+		if err := checkKey(ctx, c.Namespace, c.Key, service.PermissionRead, false); err != nil {
+			return nil, err
+		}
+		compares = append(compares, service.Compare{
+			Namespace: c.Namespace,
+			Key:       c.Key,
+			Target:    service.CompareTarget(c.Target),
+			Result:    service.CompareResult(c.Result),
+			Version:   c.Version,
+			Value:     string(c.Value),
+		})
+	}
+	success, err := txnOps(ctx, req.Success)
+	if err != nil {
+		return nil, err
+	}
+	failure, err := txnOps(ctx, req.Failure)
+	if err != nil {
+		return nil, err
+	}
+	succeeded, results, err := service.Txn(ctx, compares, success, failure)
+	if err != nil {
+		return nil, err
+	}
+	ops := req.Success
+	if !succeeded {
+		ops = req.Failure
+	}
+	resp := &melonpb.TxnResponse{Succeeded: succeeded, Results: make([]*melonpb.TxnOpResult, 0, len(results))}
+	for i, r := range results {
+		ns := txnOpNamespace(ops[i])
+		var result melonpb.TxnOpResult
+		switch ops[i].Op.(type) {
+		case *melonpb.TxnOp_Get:
+			get := &melonpb.GetResponse{}
+			if r.Found {
+				get.Kv = keyValue(ns, r.Key, r.Value, r.Meta)
+			}
+			result.Result = &melonpb.TxnOpResult_Get{Get: get}
+		case *melonpb.TxnOp_Put:
+			result.Result = &melonpb.TxnOpResult_Put{Put: &melonpb.PutResponse{
+				Kv:      keyValue(ns, r.Key, r.Value, r.Meta),
+				Created: r.Meta.Version == 1,
+			}}
+		case *melonpb.TxnOp_Delete:
+			result.Result = &melonpb.TxnOpResult_Delete{Delete: &melonpb.DeleteResponse{Deleted: r.Found}}
+		}
+		resp.Results = append(resp.Results, &result)
+	}
+	return resp, nil
+}
+
+// txnOps converts and checks the operations of one branch of a Txn.
+func txnOps(ctx context.Context, ops []*melonpb.TxnOp) ([]service.TxnOp, error) {
+	converted := make([]service.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		var o service.TxnOp
+		var p service.Permission
+		switch op := op.Op.(type) {
+		case *melonpb.TxnOp_Get:
+			o, p = service.TxnOp{Type: service.TxnGet, Namespace: op.Get.Namespace, Key: op.Get.Key}, service.PermissionRead
+		case *melonpb.TxnOp_Put:
+			o, p = service.TxnOp{Type: service.TxnPut, Namespace: op.Put.Namespace, Key: op.Put.Key, Value: string(op.Put.Value)}, service.PermissionWrite
+		case *melonpb.TxnOp_Delete:
+			o, p = service.TxnOp{Type: service.TxnDelete, Namespace: op.Delete.Namespace, Key: op.Delete.Key}, service.PermissionDelete
+		default:
+			return nil, status.Error(grpccodes.InvalidArgument, "empty transaction operation")
+		}
+		if err := checkKey(ctx, o.Namespace, o.Key, p, o.Type != service.TxnGet); err != nil {
+			return nil, err
+		}
+		converted = append(converted, o)
+	}
+	return converted, nil
+}
+
+func txnOpNamespace(op *melonpb.TxnOp) string {
+	switch op := op.Op.(type) {
+	case *melonpb.TxnOp_Get:
+		return op.Get.Namespace
+	case *melonpb.TxnOp_Put:
+		return op.Put.Namespace
+	case *melonpb.TxnOp_Delete:
+		return op.Delete.Namespace
+	}
+	return ""
+}
+
+// checkKey validates a request for key and checks that this node may serve
+// it and the caller holds p on it.
+func checkKey(ctx context.Context, ns, key string, p service.Permission, write bool) error {
+	if key == "" {
+		return status.Error(grpccodes.InvalidArgument, "key is required")
+	}
+	if err := servable(ns, key, write); err != nil {
+		return err
+	}
+	return allowedGRPC(ctx, ns, key, p)
+}
+
+func keyValue(ns, key, value string, meta service.KeyMeta) *melonpb.KeyValue {
+	return &melonpb.KeyValue{
+		Namespace: ns,
+		Key:       key,
+		Value:     []byte(value),
+		Version:   meta.Version,
+		CreatedAt: timestamppb.New(meta.CreatedAt),
+		UpdatedAt: timestamppb.New(meta.UpdatedAt),
+	}
+}
+
+// metadataCarrier lets the trace propagator read gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	return first(metadata.MD(c).Get(key))
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"melon/internal/proxy"
+	"melon/internal/service"
+	"melon/stability_patterns"
+	"net/http"
+)
+
+// started is closed once the node has replayed its log and joined its
+// cluster, leader or partition. Until then only the health probes, metrics
+// and Raft RPCs are served.
+var started = make(chan struct{})
+
+// startupPaths are the routes served while the node starts.
+var startupPaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true, "/raft/*rpc": true}
+
+// awaitStartup answers 503 to requests made while the node starts.
+func awaitStartup(c *gin.Context) {
+	select {
+	case <-started:
+	default:
+		if !startupPaths[c.FullPath()] {
+			abortWithError(c, http.StatusServiceUnavailable, "node is starting")
+		}
+	}
+}
+
+// registerHealthRoutes adds the probes an orchestrator polls. They need no
+// credentials and are not rate limited.
+func registerHealthRoutes(r gin.IRoutes) {
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", readyzHandler)
+}
+
+// healthzHandler reports that the process is alive and serving HTTP.
+func healthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler reports whether the node should receive traffic, with the
+// outcome of each check behind the answer.
+func readyzHandler(c *gin.Context) {
+	ready, checks := service.Ready(c.Request.Context())
+	select {
+	case <-started:
+		checks["startup"] = service.Check{OK: true}
+	default:
+		ready, checks["startup"] = false, service.Check{Error: "node is starting"}
+	}
+	writeReadiness(c, ready, checks)
+}
+
+// proxyReadyzHandler reports the proxy ready while any backend's circuit
+// breaker lets requests through.
+func proxyReadyzHandler(p *proxy.Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ready, checks := false, make(map[string]service.Check)
+		for id, b := range p.Breakers() {
+			if state := b.State(); state == stability_patterns.BreakerOpen {
+				checks["backend-"+id] = service.Check{Error: "circuit breaker " + state.String()}
+			} else {
+				checks["backend-"+id] = service.Check{OK: true}
+				ready = true
+			}
+		}
+		writeReadiness(c, ready, checks)
+	}
+}
+
+func writeReadiness(c *gin.Context, ready bool, checks map[string]service.Check) {
+	status, code := "ok", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+	c.JSON(code, map[string]interface{}{"status": status, "checks": checks})
+}
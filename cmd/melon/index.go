@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"melon/internal/partition"
+	"melon/internal/service"
+	"net/http"
+	"net/url"
+)
+
+func registerIndexAdminRoutes(r gin.IRoutes) {
+	r.GET("/v1/index", indexListHandler)
+	r.PUT("/v1/index/:name", requireLeader, indexCreateHandler)
+	r.DELETE("/v1/index/:name", requireLeader, indexDropHandler)
+}
+
+func indexListHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{"indexes": service.Indexes()})
+}
+
+// indexCreateHandler creates or replaces an index, building it from the
+// keys already stored. When partitioned, every node indexes the keys it
+// owns.
+func indexCreateHandler(c *gin.Context) {
+	var def service.IndexDefinition
+	if err := c.ShouldBindJSON(&def); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	def.Name = c.Param("name")
+	if err := service.ValidateIndex(def); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := service.Commit(c.Request.Context(), service.IndexEvent(def)); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	if partition.Enabled() && c.GetHeader(partition.ForwardedHeader) == "" {
+		body, _ := json.Marshal(def)
+		err := partition.Broadcast(c.Request.Context(), partition.Nodes(), http.MethodPut, "/v1/index/"+url.PathEscape(def.Name), body)
+		if err != nil {
+			abortWithError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	c.JSON(http.StatusOK, def)
+}
+
+func indexDropHandler(c *gin.Context) {
+	name := c.Param("name")
+	if _, err := service.Index(name); err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err := service.Commit(c.Request.Context(), service.DropIndexEvent(name)); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	if partition.Enabled() && c.GetHeader(partition.ForwardedHeader) == "" {
+		err := partition.Broadcast(c.Request.Context(), partition.Nodes(), http.MethodDelete, "/v1/index/"+url.PathEscape(name), nil)
+		if err != nil {
+			abortWithError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// indexLookupHandler lists the keys, with their values, whose indexed field
+// equals eq: the field's string value, or the JSON encoding of any other
+// value, as in eq=42 or eq=true. The caller needs read access to every key
+// the index covers. When partitioned, only the keys this node owns are
+// listed.
+func indexLookupHandler(c *gin.Context) {
+	def, err := service.Index(c.Param("name"))
+	if errors.Is(err, service.ErrorNoSuchIndex) {
+		abortWithError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if !allowed(c, def.Namespace, def.Prefix, service.PermissionRead) {
+		return
+	}
+	term, ok := c.GetQuery("eq")
+	if !ok {
+		abortWithError(c, http.StatusBadRequest, "eq is required")
+		return
+	}
+	entries, err := service.LookupIndex(def.Name, term)
+	if err != nil {
+		abortWithError(c, http.StatusNotFound, err.Error()) // Dropped since
+		return
+	}
+	results := make([]map[string]interface{}, len(entries))
+	for i, e := range entries {
+		results[i] = map[string]interface{}{"key": e.Key, "value": e.Value}
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"index":     def.Name,
+		"namespace": def.Namespace,
+		"entries":   results,
+	})
+}
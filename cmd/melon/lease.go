@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"math"
+	"melon/internal/service"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+func registerLeaseRoutes(r gin.IRoutes) {
+	r.POST("/v1/lease", requireLeader, leaseGrantHandler)
+	r.GET("/v1/lease/:id", leaseHandler)
+	r.POST("/v1/lease/:id/keepalive", requireLeader, leaseKeepAliveHandler)
+	r.DELETE("/v1/lease/:id", requireLeader, leaseRevokeHandler)
+}
+
+// registerLeaseAdminRoutes serves the list of every lease to admins only,
+// since holding a lease's ID is what lets a client use it.
+func registerLeaseAdminRoutes(r gin.IRoutes) {
+	r.GET("/v1/lease", leaseListHandler)
+}
+
+func leaseListHandler(c *gin.Context) {
+	list := make([]map[string]interface{}, 0)
+	for _, l := range service.Leases() {
+		list = append(list, leaseBody(l))
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"leases": list})
+}
+
+// leaseBody is the JSON form of a lease, with the whole seconds it has left.
+func leaseBody(l service.Lease) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         l.ID,
+		"ttl":        l.TTL,
+		"expires_at": l.ExpiresAt,
+		"remaining":  int64(time.Until(l.ExpiresAt) / time.Second),
+	}
+}
+
+// leaseID reads the lease ID from the path, ending the request if it is
+// not a number.
+func leaseID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		abortWithError(c, http.StatusBadRequest, "invalid lease ID")
+		return 0, false
+	}
+	return id, true
+}
+
+// abortWithLeaseError ends a request on a lease that failed with err.
+func abortWithLeaseError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrorNoSuchLease) || errors.Is(err, service.ErrorNoSuchKey) {
+		abortWithError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	abortWithCommitError(c, err)
+}
+
+// leaseGrantHandler starts a lease lasting the body's ttl seconds.
+func leaseGrantHandler(c *gin.Context) {
+	var body struct {
+		TTL int64 `json:"ttl"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.TTL <= 0 || body.TTL > math.MaxInt64/int64(time.Second) {
+		abortWithError(c, http.StatusBadRequest, "body must be a JSON object with a positive ttl in seconds")
+		return
+	}
+	l, err := service.GrantLease(c.Request.Context(), body.TTL)
+	if err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, leaseBody(l))
+}
+
+// leaseHandler describes a lease along with the keys attached to it.
+func leaseHandler(c *gin.Context) {
+	id, ok := leaseID(c)
+	if !ok {
+		return
+	}
+	l, err := service.LeaseInfo(id)
+	if err != nil {
+		abortWithLeaseError(c, err)
+		return
+	}
+	body := leaseBody(l)
+	body["keys"] = service.LeaseKeys(id)
+	c.JSON(http.StatusOK, body)
+}
+
+func leaseKeepAliveHandler(c *gin.Context) {
+	id, ok := leaseID(c)
+	if !ok {
+		return
+	}
+	l, err := service.KeepAlive(c.Request.Context(), id)
+	if err != nil {
+		abortWithLeaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, leaseBody(l))
+}
+
+// leaseRevokeHandler ends a lease now, deleting the keys attached to it. The
+// caller needs permission to delete every one of them.
+func leaseRevokeHandler(c *gin.Context) {
+	id, ok := leaseID(c)
+	if !ok {
+		return
+	}
+	for _, k := range service.LeaseKeys(id) {
+		if !allowed(c, k.Namespace, k.Key, service.PermissionDelete) {
+			return
+		}
+	}
+	if err := service.RevokeLease(c.Request.Context(), id); err != nil {
+		abortWithLeaseError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// keyValueLeaseHandler attaches key to the lease whose ID is in the body, or
+// detaches it from its lease if the ID is 0.
+func keyValueLeaseHandler(c *gin.Context) {
+	var body struct {
+		ID *int64 `json:"id"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.ID == nil || *body.ID < 0 {
+		abortWithError(c, http.StatusBadRequest, "body must be a JSON object with the lease id, or 0 to detach")
+		return
+	}
+	if err := service.AttachLease(c.Request.Context(), c.Param("ns"), c.Param("key"), *body.ID); err != nil {
+		abortWithLeaseError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"status": "updated"})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"melon/internal/logging"
+	"melon/internal/replication"
+	"melon/internal/service"
+	"melon/internal/transaction"
+	"melon/stability_patterns"
+	"net/http"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// logger is the process-wide logger; handlers should use requestLog to get
+// one carrying the request's fields.
+var logger = zap.NewNop()
+
+// logLevel changes the level of logger while running.
+var logLevel = zap.NewAtomicLevel()
+
+type logOptions struct {
+	level  string
+	format string
+}
+
+func loggingFlags(fs *flag.FlagSet) *logOptions {
+	o := &logOptions{}
+	fs.StringVar(&o.level, "log-level", "info", "minimum level logged: debug, info, warn or error")
+	fs.StringVar(&o.format, "log-format", "json", "log encoding: json or console")
+	return o
+}
+
+// setupLogging builds logger and hands it to every package that logs,
+// including gin.
+func setupLogging(o *logOptions) error {
+	l, level, err := logging.New(o.level, o.format)
+	if err != nil {
+		return err
+	}
+	logger, logLevel = l, level
+	service.SetLogger(logger)
+	transaction.SetLogger(logger)
+	replication.SetLogger(logger)
+	stability_patterns.SetLogger(logger)
+	gin.DefaultWriter = zap.NewStdLog(logger.Named("gin")).Writer()
+	gin.DefaultErrorWriter = zap.NewStdLog(logger.Named("gin")).Writer()
+	return nil
+}
+
+// newRouter returns a gin engine that logs through zap rather than gin's own
+// access log.
+func newRouter() *gin.Engine {
+	r := gin.New()
+	r.Use(gin.RecoveryWithWriter(gin.DefaultErrorWriter), traceRequest, requestLogger)
+	r.NoRoute(func(c *gin.Context) {
+		abortWithError(c, http.StatusNotFound, "no such route")
+	})
+	return r
+}
+
+// requestLogger gives every request an ID, kept from the X-Request-Id header
+// when a client or another node sent one, and a logger carrying it, then
+// writes the access log entry.
+func requestLogger(c *gin.Context) {
+	start := time.Now()
+	id := c.GetHeader(requestIDHeader)
+	if id == "" || len(id) > 128 {
+		id = newRequestID()
+	}
+	c.Request.Header.Set(requestIDHeader, id) // Requests forwarded to other nodes keep the ID
+	c.Header(requestIDHeader, id)
+	fields := []zap.Field{zap.String("request_id", id)}
+	if ns := c.Param("ns"); ns != "" {
+		fields = append(fields, zap.String("namespace", ns))
+	}
+	if key := c.Param("key"); key != "" {
+		fields = append(fields, zap.String("key", key))
+	}
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsSampled() {
+		fields = append(fields, zap.String("trace_id", sc.TraceID().String()))
+	}
+	l := logger.With(fields...)
+	c.Request = c.Request.WithContext(logging.NewContext(c.Request.Context(), l))
+
+	c.Next()
+
+	access := []zap.Field{
+		zap.String("method", c.Request.Method),
+		zap.String("path", c.Request.URL.Path),
+		zap.Int("status", c.Writer.Status()),
+		zap.Duration("latency", time.Since(start)),
+		zap.String("client_ip", c.ClientIP()),
+		zap.Int("bytes", c.Writer.Size()),
+	}
+	if principal := c.GetString(principalKey); principal != "" {
+		access = append(access, zap.String("principal", principal))
+	}
+	if len(c.Errors) > 0 {
+		access = append(access, zap.String("errors", c.Errors.String()))
+	}
+	if c.Writer.Status() >= 500 {
+		l.Warn("request", access...)
+	} else {
+		l.Info("request", access...)
+	}
+}
+
+// requestLog returns the logger for the request being served.
+func requestLog(c *gin.Context) *zap.Logger {
+	return logging.Ctx(c.Request.Context(), logger)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -1,28 +1,159 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"io"
-	"log"
+	"melon/internal/partition"
+	"melon/internal/replication"
 	"melon/internal/service"
+	"melon/internal/transaction"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
+	if len(os.Args) > 1 && os.Args[1] == "proxy" {
+		runProxy(os.Args[2:])
+		return
+	}
+	server := serverFlags(flag.CommandLine)
+	logOpts := loggingFlags(flag.CommandLine)
+	traceOpts := tracingFlags(flag.CommandLine)
+	grpcAddr := flag.String("grpc-addr", "", "address to serve the gRPC API on; empty disables it")
+	respAddr := flag.String("resp-addr", "", "address to serve the Redis protocol on; empty disables it")
+	memcacheAddr := flag.String("memcache-addr", "", "address to serve the memcached text protocol on; empty disables it")
+	logFile := flag.String("log", "transaction.log", "transaction log file")
+	encryptionKeyfile := flag.String("encryption-keyfile", "", "file of \"key-id base64-key\" lines for encrypting the transaction log, the first encrypting new events (default $"+encryptionKeysEnv+")")
+	encryptKeys := flag.Bool("encrypt-keys", false, "encrypt keys in the transaction log as well as values")
+	leaderURL := flag.String("follow", "", "base URL of a leader to replicate from; empty runs as leader")
+	leaderInsecure := flag.Bool("follow-insecure", false, "skip verifying the leader's TLS certificate")
+	clusterID := flag.String("cluster-id", "", "this node's ID; enables Raft cluster mode")
+	clusterPeers := flag.String("cluster-peers", "", "initial cluster members as id=url,...; empty to join an existing cluster")
+	clusterDir := flag.String("cluster-dir", "", "directory for the Raft log and snapshots (default raft-<cluster-id>)")
+	clusterInsecure := flag.Bool("cluster-insecure", false, "skip verifying other members' TLS certificates")
+	clusterToken := flag.String("cluster-token", "", "secret shared by the cluster members, required on every Raft RPC (default $"+clusterTokenEnv+")")
+	partitionID := flag.String("partition-id", "", "this node's ID; enables partitioning keys across -partition-nodes")
+	partitionNodes := flag.String("partition-nodes", "", "nodes sharing the key space as id=url,..., including this one")
+	partitionInsecure := flag.Bool("partition-insecure", false, "skip verifying other nodes' TLS certificates")
+	authOpts := authFlags(flag.CommandLine)
+	peerToken := flag.String("peer-token", "", "bearer token this node presents to the leader and to other partition nodes")
+	rateLimitRate := flag.Float64("rate-limit", 0, "key requests per second allowed per client; 0 disables rate limiting")
+	rateLimitBurst := flag.Uint("rate-limit-burst", 0, "key requests a client may make at once (default the per second rate)")
+	rateLimitBy := flag.String("rate-limit-by", "ip", "what identifies a client for rate limiting: ip, principal or namespace")
+	rateLimitClients := flag.Int("rate-limit-clients", 100000, "most clients tracked at once; the least recently seen are forgotten")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated addresses or CIDRs whose X-Forwarded-For header is believed")
+	flag.Parse()
 
-	err := service.InitializeTransactionLog()
+	if err := setupLogging(logOpts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer logger.Sync()
+	shutdownTracing, err := setupTracing(traceOpts, "melon")
 	if err != nil {
-		logger.Info("error initializing the transaction logger",
-			zap.String("err", err.Error()),
-		)
+		logger.Info("error setting up tracing", zap.String("err", err.Error()))
+		return
+	}
+	defer shutdownTracing(context.Background())
+
+	if err := setupAuth(authOpts); err != nil {
+		logger.Info("error loading credentials", zap.String("err", err.Error()))
+		return
+	}
+	if err := setupRateLimit(*rateLimitRate, *rateLimitBurst, *rateLimitBy, *rateLimitClients); err != nil {
+		logger.Info("invalid rate limit", zap.String("err", err.Error()))
+		return
+	}
+	if err := setupEncryption(*encryptionKeyfile, *encryptKeys, *clusterID != ""); err != nil {
+		logger.Info("error setting up encryption", zap.String("err", err.Error()))
 		return
 	}
-	r := gin.Default() // mux router implements the Handler interface
+
+	if *clusterID != "" && *leaderURL != "" {
+		logger.Info("-follow cannot be combined with cluster mode")
+		return
+	}
+	var peers, nodes map[string]string
+	if *clusterID != "" {
+		if peers, err = parsePeers(*clusterPeers); err != nil {
+			logger.Info("invalid -cluster-peers", zap.String("err", err.Error()))
+			return
+		}
+	}
+	if *partitionID != "" {
+		if nodes, err = parsePeers(*partitionNodes); err != nil {
+			logger.Info("invalid -partition-nodes", zap.String("err", err.Error()))
+			return
+		}
+	}
+	r := newRouter() // mux router implements the Handler interface
+	if err := r.SetTrustedProxies(splitList(*trustedProxies)); err != nil {
+		logger.Info("invalid -trusted-proxies", zap.String("err", err.Error()))
+		return
+	}
+	prometheus.MustRegister(storeCollector{})
+	registerRoutes(r, *clusterID != "", *partitionID != "")
+
+	go func() { // The health probes are served meanwhile, reporting the node unready
+		var err error
+		if *clusterID != "" {
+			dir := *clusterDir
+			if dir == "" {
+				dir = "raft-" + *clusterID
+			}
+			err = startCluster(*clusterID, peers, dir, newClient(*clusterInsecure), *clusterToken)
+		} else {
+			err = service.InitializeTransactionLog(*logFile)
+		}
+		if err != nil {
+			logger.Fatal("error initializing the transaction logger", zap.Error(err))
+		}
+		if *leaderURL != "" {
+			client := newClient(*leaderInsecure)
+			replication.Follow(*leaderURL, withToken(client, *peerToken))
+		}
+		if *partitionID != "" {
+			client := newClient(*partitionInsecure)
+			partition.Enable(*partitionID, nodes, withToken(client, *peerToken))
+		}
+		go service.RunExpiry(time.Second, replication.IsLeader)
+		close(started)
+		if *grpcAddr != "" {
+			go func() {
+				logger.Fatal("gRPC server stopped", zap.Error(serveGRPC(server, *grpcAddr)))
+			}()
+		}
+		if *respAddr != "" {
+			go func() {
+				logger.Fatal("Redis protocol server stopped", zap.Error(serveRESP(server, *respAddr)))
+			}()
+		}
+		if *memcacheAddr != "" {
+			go func() {
+				logger.Fatal("memcached protocol server stopped", zap.Error(serveMemcache(server, *memcacheAddr)))
+			}()
+		}
+	}()
+	logger.Fatal("server stopped", zap.Error(serve(server, r)))
+}
+
+// registerRoutes adds the HTTP API to r, with the Raft RPCs and cluster
+// management routes if clustered, and the partition management routes if
+// partitioned.
+func registerRoutes(r *gin.Engine, clustered, partitioned bool) {
+	r.Use(instrument, clientIdentity, awaitStartup)
+	registerHealthRoutes(r)
+	r.GET("/v1/openapi.json", openAPIHandler(r))
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
 			"message": "pong",
@@ -34,60 +165,191 @@ func main() {
 			"message": "Hello gorilla/mux!",
 		})
 	})
-	r.PUT("/v1/key/:key", keyValuePutHandler)
-	r.GET("/v1/key/:key", keyValueGetHandler)
-	r.DELETE("/v1/key/:key/", keyValueDeleteHandler)
-	log.Fatal(http.ListenAndServeTLS(":8080", "./deeksha-cert.pem", "./deeksha-key.pem", r))
+	keys := r.Group("", rateLimitBeforeAuth, authenticate, rateLimit)
+	keys.PUT("/v1/key/:key", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValuePutHandler)
+	keys.GET("/v1/key/:key", authorize(service.PermissionRead), routeToOwner, keyValueGetHandler)
+	keys.PATCH("/v1/key/:key", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValuePatchHandler)
+	keys.GET("/v1/key/:key/history", authorize(service.PermissionRead), routeToOwner, keyValueHistoryHandler)
+	keys.POST("/v1/key/:key/incr", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCounterHandler("incr"))
+	keys.POST("/v1/key/:key/decr", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCounterHandler("decr"))
+	keys.POST("/v1/key/:key/add", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCounterHandler("add"))
+	keys.POST("/v1/key/:key/list/push", authorize(service.PermissionWrite), routeToOwner, requireLeader, listPushHandler)
+	keys.POST("/v1/key/:key/list/pop", authorize(service.PermissionWrite), routeToOwner, requireLeader, listPopHandler)
+	keys.GET("/v1/key/:key/list", authorize(service.PermissionRead), routeToOwner, listRangeHandler)
+	keys.POST("/v1/key/:key/set/add", authorize(service.PermissionWrite), routeToOwner, requireLeader, setAddHandler)
+	keys.POST("/v1/key/:key/set/remove", authorize(service.PermissionWrite), routeToOwner, requireLeader, setRemoveHandler)
+	keys.GET("/v1/key/:key/set", authorize(service.PermissionRead), routeToOwner, setMembersHandler)
+	keys.PUT("/v1/key/:key/hash", authorize(service.PermissionWrite), routeToOwner, requireLeader, hashSetHandler)
+	keys.GET("/v1/key/:key/hash", authorize(service.PermissionRead), routeToOwner, hashGetAllHandler)
+	keys.GET("/v1/key/:key/hash/:field", authorize(service.PermissionRead), routeToOwner, hashGetHandler)
+	keys.DELETE("/v1/key/:key/hash/:field", authorize(service.PermissionWrite), routeToOwner, requireLeader, hashDeleteHandler)
+	keys.POST("/v1/key/:key/cas", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCASHandler)
+	keys.POST("/v1/key/:key/put-if-absent", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValuePutIfAbsentHandler)
+	keys.POST("/v1/key/:key/delete-if-value", authorize(service.PermissionDelete), routeToOwner, requireLeader, keyValueDeleteIfValueHandler)
+	keys.PUT("/v1/key/:key/lease", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueLeaseHandler)
+	keys.DELETE("/v1/key/:key", authorize(service.PermissionDelete), routeToOwner, requireLeader, keyValueDeleteHandler)
+	keys.DELETE("/v1/key/:key/", authorize(service.PermissionDelete), routeToOwner, requireLeader, keyValueDeleteHandler) // Deprecated spelling
+	registerNamespaceRoutes(keys)
+	keys.GET("/v1/index/:name", indexLookupHandler)
+	registerLeaseRoutes(keys)
+
+	admin := r.Group("", authenticate, requireAdmin)
+	registerACLRoutes(admin)
+	registerNamespaceAdminRoutes(admin)
+	registerIndexAdminRoutes(admin)
+	registerLeaseAdminRoutes(admin)
+	registerAdminRoutes(admin.Group("/admin"), flag.CommandLine)
+	admin.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	admin.GET("/v1/replication/events", replicationEventsHandler)
+	admin.GET("/v1/replication/status", replicationStatusHandler)
+	admin.POST("/v1/replication/promote", replicationPromoteHandler)
+	if clustered {
+		r.Any("/raft/*rpc", raftHandler)
+		registerClusterRoutes(admin)
+	}
+	if partitioned {
+		registerPartitionRoutes(admin)
+	}
 }
 
 // keyValuePutHandler expects to be called with a PUT request for // the "/v1/key/{key}" resource.
+// The key handlers also serve "/v1/ns/{ns}/key/{key}"; ns is empty, the
+// default namespace, on the un-namespaced routes.
 func keyValuePutHandler(c *gin.Context) {
-	if c.Request.TLS != nil {
-		fmt.Println("Certificate used by server:")
-		state := c.Request.TLS.ServerName
-		fmt.Println("tls server name", state)
-	}
-	key := c.Param("key")
+	ns, key := c.Param("ns"), c.Param("key")
 
 	value, err := io.ReadAll(c.Request.Body)
 	defer c.Request.Body.Close()
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	err = service.Put(key, string(value))
+	err = service.Commit(c.Request.Context(), transaction.Event{EventType: transaction.EventPut, Namespace: ns, Key: key, Value: string(value)})
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		abortWithCommitError(c, err)
+		return
+	}
+	// Read back for the version, which may already include a later write
+	current, meta, err := service.GetWithMeta(c.Request.Context(), ns, key)
+	status, body := http.StatusOK, "updated"
+	if err == nil && meta.Version == 1 {
+		status, body = http.StatusCreated, "created"
+	}
+	if wantsEnvelope(c) && err == nil {
+		c.JSON(status, newKeyEnvelope(ns, key, current, meta))
 		return
 	}
-	service.WritePut(key, string(value))
-	c.JSON(http.StatusCreated, map[string]interface{}{
-		"status": "created",
+	c.JSON(status, map[string]interface{}{
+		"status": body,
 	})
 }
 
+// keyValueGetHandler returns the current value of key, or the value it held
+// at an earlier point when as_of_seq or as_of (RFC 3339) is given. The value
+// is sent raw unless the client wants an envelope. With path, only that
+// part of a JSON document value is sent.
 func keyValueGetHandler(c *gin.Context) {
-	key := c.Param("key")
-	value, err := service.Get(key) // Get value for key
+	ns, key := c.Param("ns"), c.Param("key")
+	var value string
+	var meta service.KeyMeta
+	var err error
+	if seq, ok := c.GetQuery("as_of_seq"); ok {
+		n, perr := strconv.ParseUint(seq, 10, 64)
+		if perr != nil {
+			abortWithError(c, http.StatusBadRequest, "invalid as_of_seq")
+			return
+		}
+		value, meta, err = service.GetAsOfSequence(ns, key, n)
+	} else if ts, ok := c.GetQuery("as_of"); ok {
+		t, perr := time.Parse(time.RFC3339Nano, ts)
+		if perr != nil {
+			abortWithError(c, http.StatusBadRequest, "invalid as_of")
+			return
+		}
+		value, meta, err = service.GetAsOfTime(ns, key, t)
+	} else {
+		value, meta, err = service.GetWithMeta(c.Request.Context(), ns, key) // Get value for key
+	}
 	if errors.Is(err, service.ErrorNoSuchKey) {
-		c.AbortWithStatusJSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+		abortWithError(c, http.StatusNotFound, err.Error())
 		return
 	}
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if path, ok := c.GetQuery("path"); ok {
+		value, err = service.JSONPath(value, path)
+		if errors.Is(err, service.ErrorNoSuchPath) {
+			abortWithError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			abortWithDocumentError(c, err)
+			return
+		}
+		c.Header("Content-Type", "application/json")
+	}
+	if wantsEnvelope(c) {
+		c.JSON(http.StatusOK, newKeyEnvelope(ns, key, value, meta))
 		return
 	}
-
 	c.Writer.Write([]byte(value))
 }
 
+// keyValueHistoryHandler lists the prior versions of key recorded in the
+// transaction log, oldest first.
+func keyValueHistoryHandler(c *gin.Context) {
+	ns, key := c.Param("ns"), c.Param("key")
+	history, err := service.History(ns, key)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	versions := make([]map[string]interface{}, 0, len(history))
+	for _, e := range history {
+		version := map[string]interface{}{
+			"sequence":  e.Sequence,
+			"timestamp": e.CreatedAt,
+		}
+		switch e.EventType {
+		case transaction.EventPut:
+			version["type"] = "put"
+			version["value"] = e.Value
+		case transaction.EventDelete:
+			version["type"] = "delete"
+		}
+		versions = append(versions, version)
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"key":      key,
+		"versions": versions,
+	})
+}
+
+// keyValueDeleteHandler removes key, answering 404 if it does not exist.
 func keyValueDeleteHandler(c *gin.Context) {
-	key := c.Param("key")
-	err := service.Delete(key)
+	ns, key := c.Param("ns"), c.Param("key")
+	if _, err := service.GetIn(c.Request.Context(), ns, key); errors.Is(err, service.ErrorNoSuchKey) {
+		abortWithError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	err := service.Commit(c.Request.Context(), transaction.Event{EventType: transaction.EventDelete, Namespace: ns, Key: key})
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		abortWithCommitError(c, err)
 		return
 	}
-	service.WriteDelete(key)
+	c.Status(http.StatusNoContent)
+}
+
+// splitList reads a comma separated flag, ignoring empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"melon/internal/metrics"
+	"melon/internal/raft"
+	"melon/internal/replication"
+	"melon/internal/service"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The memcached listener serves memcached's text protocol from the default
+// namespace. Every write is logged, so unlike memcached nothing is lost on
+// restart or evicted. Flags are kept with the key, and the CAS unique of a
+// key is its version.
+
+const (
+	memcacheMaxKey      = 250                 // Longest key accepted, as in memcached
+	memcacheMaxValue    = 64 << 20            // Longest value accepted, in bytes
+	memcacheMaxLogin    = 16 << 10            // Longest data block accepted before the client has authenticated
+	memcacheMaxLine     = 64 << 10            // Longest command line accepted
+	memcacheRelativeTTL = 30 * 24 * time.Hour // Longer exptimes are Unix times, as in memcached
+)
+
+// errMemcacheLine is a malformed request; the connection is closed after
+// replying to it, since the data that may follow cannot be told apart from
+// the next command.
+var errMemcacheLine = errors.New("bad command line format")
+
+// serveMemcache runs the memcached protocol listener on addr until it fails,
+// with the same TLS settings as the HTTP API.
+func serveMemcache(o *serverOptions, addr string) error {
+	lis, err := o.listen(addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("serving the memcached protocol", zap.String("addr", addr))
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go newMemcacheConn(conn).serve()
+	}
+}
+
+// memcacheConn is one client connection.
+type memcacheConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	log       *zap.Logger
+	principal string
+	authed    bool // The client is known, or authentication is off
+}
+
+func newMemcacheConn(conn net.Conn) *memcacheConn {
+	return &memcacheConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		log:  logger.With(zap.String("conn_id", newRequestID()), zap.String("client_ip", conn.RemoteAddr().String())),
+	}
+}
+
+func (c *memcacheConn) serve() {
+	defer c.conn.Close()
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			c.log.Debug("TLS handshake failed", zap.Error(err))
+			return
+		}
+	}
+	c.authenticate("")
+	for {
+		line, err := c.readLine()
+		if errors.Is(err, errMemcacheLine) {
+			c.w.WriteString("CLIENT_ERROR line too long\r\n")
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.log.Debug("connection closed", zap.Error(err))
+			}
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			c.w.WriteString("ERROR\r\n")
+		} else if quit := c.dispatch(args); quit {
+			c.w.Flush()
+			return
+		}
+		if c.r.Buffered() == 0 { // Pipelined commands are answered together
+			if err := c.w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// readLine reads one command line of at most memcacheMaxLine bytes.
+func (c *memcacheConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > memcacheMaxLine {
+			return "", errMemcacheLine
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(line), nil
+	}
+}
+
+// authenticate identifies the client from token, or from its certificate
+// when token is empty.
+func (c *memcacheConn) authenticate(token string) error {
+	if authenticator == nil {
+		c.authed = true
+		return nil
+	}
+	principal, err := authenticateNetConn(c.conn, token)
+	if err != nil {
+		return err
+	}
+	c.principal, c.authed = principal, true
+	return nil
+}
+
+// memcacheCommand is a command handler, returning the reply to send.
+type memcacheCommand struct {
+	write bool // Served only by the leader
+	data  bool // Followed by a data block, which must be read even if the command is refused
+	run   func(ctx context.Context, c *memcacheConn, args []string) (string, error)
+}
+
+var memcacheCommands = map[string]memcacheCommand{
+	"get":     {false, false, memcacheGet},
+	"gets":    {false, false, memcacheGet},
+	"set":     {true, true, memcacheStore},
+	"add":     {true, true, memcacheStore},
+	"replace": {true, true, memcacheStore},
+	"cas":     {true, true, memcacheStore},
+	"delete":  {true, false, memcacheDelete},
+	"incr":    {true, false, memcacheIncr},
+	"decr":    {true, false, memcacheIncr},
+	"version": {false, false, memcacheVersion},
+}
+
+// dispatch runs one command and reports whether the connection should close.
+func (c *memcacheConn) dispatch(args []string) bool {
+	name := args[0]
+	if name == "quit" {
+		return true
+	}
+	cmd, ok := memcacheCommands[name]
+	if !ok {
+		c.w.WriteString("ERROR\r\n")
+		metrics.MemcacheCommandsTotal.WithLabelValues("unknown", "error").Inc()
+		return false
+	}
+	noreply := args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+
+	var reply string
+	var err error
+	switch {
+	case !c.authed && name == "set":
+		reply, err = c.login(args)
+	case !c.authed:
+		err = c.refuse(cmd, args, memcacheClientError("unauthenticated"))
+	case cmd.write && !replication.IsLeader():
+		err = c.refuse(cmd, args, fmt.Errorf("this node is a read-only follower; the leader is %s", replication.Leader()))
+	default:
+		ctx, span := httpTracer.Start(context.Background(), "memcache "+name, trace.WithSpanKind(trace.SpanKindServer))
+		reply, err = cmd.run(ctx, c, args)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+
+	if err != nil {
+		metrics.MemcacheCommandsTotal.WithLabelValues(name, "error").Inc()
+		if errors.Is(err, errMemcacheLine) {
+			c.w.WriteString("CLIENT_ERROR " + err.Error() + "\r\n")
+			return true
+		}
+		if memcacheInternal(err) {
+			c.log.Warn("command failed", zap.String("command", name), zap.Error(err))
+		}
+		if !noreply {
+			c.w.WriteString(memcacheError(err) + "\r\n")
+		}
+		return false
+	}
+	metrics.MemcacheCommandsTotal.WithLabelValues(name, "ok").Inc()
+	if !noreply {
+		c.w.WriteString(reply)
+	}
+	return false
+}
+
+// memcacheClientError is a CLIENT_ERROR reply.
+type memcacheClientError string
+
+func (e memcacheClientError) Error() string {
+	return string(e)
+}
+
+// memcacheError renders err as a memcached error reply.
+func memcacheError(err error) string {
+	var clientErr memcacheClientError
+	if errors.As(err, &clientErr) {
+		return "CLIENT_ERROR " + string(clientErr)
+	}
+	return "SERVER_ERROR " + strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+}
+
+func memcacheInternal(err error) bool {
+	var clientErr memcacheClientError
+	var notLeader *raft.NotLeaderError
+	return !errors.As(err, &clientErr) && !errors.As(err, &notLeader) &&
+		!errors.Is(err, service.ErrorReadOnly) && !errors.Is(err, service.ErrorQuotaExceeded)
+}
+
+// login authenticates with a set whose data is "<user> <token>", as
+// memcached's text protocol authentication does; the user name is ignored.
+func (c *memcacheConn) login(args []string) (string, error) {
+	if len(args) == 5 {
+		if size, err := strconv.Atoi(args[4]); err == nil && size > memcacheMaxLogin {
+			return "", errMemcacheLine
+		}
+	}
+	data, err := c.readData(args, 5)
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(data)
+	if len(fields) != 2 || c.authenticate(fields[1]) != nil {
+		return "", memcacheClientError("authentication failure")
+	}
+	return "STORED\r\n", nil
+}
+
+// refuse answers a command with err without running it, first skipping its
+// data block, so that the data is not taken for the next command.
+func (c *memcacheConn) refuse(cmd memcacheCommand, args []string, err error) error {
+	if !cmd.data {
+		return err
+	}
+	if len(args) < 5 {
+		return errMemcacheLine
+	}
+	size, serr := strconv.Atoi(args[4])
+	if serr != nil || size < 0 {
+		return errMemcacheLine
+	}
+	if _, derr := c.r.Discard(size + 2); derr != nil {
+		return derr
+	}
+	return err
+}
+
+// readData reads the data block of a storage command, whose byte count is
+// args[4]. want is the number of arguments the command takes.
+func (c *memcacheConn) readData(args []string, want int) (string, error) {
+	if len(args) != want {
+		return "", errMemcacheLine
+	}
+	size, err := strconv.Atoi(args[4])
+	if err != nil || size < 0 {
+		return "", errMemcacheLine
+	}
+	if size > memcacheMaxValue {
+		if _, err := c.r.Discard(size + 2); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("object too large for cache")
+	}
+	var b bytes.Buffer // Grown as the data arrives, rather than for the size claimed
+	if _, err := io.CopyN(&b, c.r, int64(size)+2); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if !bytes.HasSuffix(b.Bytes(), []byte("\r\n")) {
+		return "", fmt.Errorf("%w: bad data chunk", errMemcacheLine)
+	}
+	return string(b.Bytes()[:size]), nil
+}
+
+// check makes sure the client holds p on key and that this node owns it.
+func (c *memcacheConn) check(key string, p service.Permission) error {
+	if len(key) > memcacheMaxKey || strings.IndexFunc(key, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		return errMemcacheLine
+	}
+	if !permitted(c.principal, service.DefaultNamespace, key, p) {
+		return memcacheClientError(fmt.Sprintf("%s lacks %q permission on key %q", c.principal, p, key))
+	}
+	return ownedElsewhere(service.DefaultNamespace, key)
+}
+
+// memcacheExpiry converts an exptime: zero for never, up to 30 days as
+// seconds from now, and beyond that as a Unix time, clamped to what the log
+// can hold. A negative exptime expires the key at once.
+func memcacheExpiry(arg string) (time.Time, error) {
+	exptime, err := strconv.ParseInt(arg, 10, 64)
+	switch {
+	case err != nil:
+		return time.Time{}, errMemcacheLine
+	case exptime == 0:
+		return time.Time{}, nil
+	case exptime < 0:
+		return time.Now(), nil
+	case exptime <= int64(memcacheRelativeTTL/time.Second):
+		return time.Now().Add(time.Duration(exptime) * time.Second), nil
+	case exptime > math.MaxInt64/int64(time.Second):
+		return time.Unix(0, math.MaxInt64), nil // The latest expiry a log can hold, in Unix nanoseconds
+	}
+	return time.Unix(exptime, 0), nil
+}
+
+// memcacheGet answers get and gets, which also reports each key's CAS
+// unique.
+func memcacheGet(ctx context.Context, c *memcacheConn, args []string) (string, error) {
+	if len(args) < 2 {
+		return "", errMemcacheLine
+	}
+	for _, key := range args[1:] {
+		if err := c.check(key, service.PermissionRead); err != nil {
+			return "", err
+		}
+	}
+	var b strings.Builder
+	for _, key := range args[1:] {
+		value, meta, err := service.GetWithMeta(ctx, service.DefaultNamespace, key)
+		if errors.Is(err, service.ErrorNoSuchKey) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "VALUE %s %d %d", key, meta.Flags, len(value))
+		if args[0] == "gets" {
+			fmt.Fprintf(&b, " %d", meta.Version)
+		}
+		b.WriteString("\r\n" + value + "\r\n")
+	}
+	b.WriteString("END\r\n")
+	return b.String(), nil
+}
+
+// memcacheStore answers set, add, replace and cas, each a Txn whose
+// compare is the command's condition.
+func memcacheStore(ctx context.Context, c *memcacheConn, args []string) (string, error) {
+	want := 5
+	if args[0] == "cas" {
+		want = 6
+	}
+	if len(args) != want {
+		return "", errMemcacheLine
+	}
+	flags, err := strconv.ParseUint(args[2], 10, 32)
+	if err != nil {
+		return "", errMemcacheLine
+	}
+	expires, err := memcacheExpiry(args[3])
+	if err != nil {
+		return "", err
+	}
+	var compares []service.Compare
+	key := args[1]
+	cmp := service.Compare{Namespace: service.DefaultNamespace, Key: key, Target: service.CompareVersion}
+	switch args[0] {
+	case "add":
+		cmp.Result = service.CompareEqual // Version zero: the key does not exist
+		compares = append(compares, cmp)
+	case "replace":
+		cmp.Result = service.CompareGreater
+		compares = append(compares, cmp)
+	case "cas":
+		cmp.Result = service.CompareEqual
+		if cmp.Version, err = strconv.ParseUint(args[5], 10, 64); err != nil {
+			return "", errMemcacheLine
+		}
+		compares = append(compares, cmp)
+	}
+	value, err := c.readData(args[:5], 5)
+	if err != nil {
+		return "", err
+	}
+	if err := c.check(key, service.PermissionWrite); err != nil {
+		return "", err
+	}
+
+	put := service.TxnOp{Type: service.TxnPut, Namespace: service.DefaultNamespace, Key: key, Value: value, ExpiresAt: expires, Flags: uint32(flags)}
+	get := service.TxnOp{Type: service.TxnGet, Namespace: service.DefaultNamespace, Key: key}
+	succeeded, results, err := service.Txn(ctx, compares, []service.TxnOp{put}, []service.TxnOp{get})
+	switch {
+	case err != nil:
+		return "", err
+	case succeeded:
+		return "STORED\r\n", nil
+	case args[0] != "cas":
+		return "NOT_STORED\r\n", nil
+	case results[0].Found:
+		return "EXISTS\r\n", nil
+	}
+	return "NOT_FOUND\r\n", nil
+}
+
+// memcacheDelete also accepts the zero hold time old clients send.
+func memcacheDelete(ctx context.Context, c *memcacheConn, args []string) (string, error) {
+	if len(args) != 2 && !(len(args) == 3 && args[2] == "0") {
+		return "", memcacheClientError("bad command line format.  Usage: delete <key> [noreply]")
+	}
+	if err := c.check(args[1], service.PermissionDelete); err != nil {
+		return "", err
+	}
+	del := service.TxnOp{Type: service.TxnDelete, Namespace: service.DefaultNamespace, Key: args[1]}
+	_, results, err := service.Txn(ctx, nil, []service.TxnOp{del}, nil)
+	if err != nil {
+		return "", err
+	}
+	if !results[0].Found {
+		return "NOT_FOUND\r\n", nil
+	}
+	return "DELETED\r\n", nil
+}
+
+// memcacheIncr answers incr and decr on a key holding a decimal unsigned
+// 64 bit number. incr wraps around and decr stops at zero, as in memcached;
+// the key keeps its flags and expiry.
+func memcacheIncr(ctx context.Context, c *memcacheConn, args []string) (string, error) {
+	if len(args) != 3 {
+		return "", errMemcacheLine
+	}
+	key := args[1]
+	delta, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		return "", memcacheClientError("invalid numeric delta argument")
+	}
+	if err := c.check(key, service.PermissionWrite); err != nil {
+		return "", err
+	}
+	result, _, err := service.Update(ctx, service.DefaultNamespace, key, func(value string, found bool) (string, error) {
+		if !found {
+			return "", service.ErrorNoSuchKey
+		}
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return "", memcacheClientError("cannot increment or decrement non-numeric value")
+		}
+		switch {
+		case args[0] == "incr":
+			n += delta
+		case delta > n:
+			n = 0
+		default:
+			n -= delta
+		}
+		return strconv.FormatUint(n, 10), nil
+	})
+	if errors.Is(err, service.ErrorNoSuchKey) {
+		return "NOT_FOUND\r\n", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return result + "\r\n", nil
+}
+
+func memcacheVersion(context.Context, *memcacheConn, []string) (string, error) {
+	return "VERSION melon\r\n", nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"melon/internal/replication"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memcacheClient connects a client to a new memcached connection over a
+// pipe.
+func memcacheClient(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	startService(t)
+	client, server := net.Pipe()
+	go newMemcacheConn(server).serve()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, bufio.NewReader(client)
+}
+
+func TestMemcachePipelinedCommands(t *testing.T) {
+	conn, r := memcacheClient(t)
+	send(conn, "set mc-a 5 0 5\r\nhello\r\n"+
+		"get mc-a mc-missing\r\n"+
+		"add mc-a 0 0 1 noreply\r\nx\r\n"+
+		"delete mc-a\r\n"+
+		"delete mc-a\r\n")
+	expectLines(t, r, "STORED", "VALUE mc-a 5 5", "hello", "END", "DELETED", "NOT_FOUND")
+}
+
+func TestMemcacheSkipsDataOfRefusedCommands(t *testing.T) {
+	requireAuth(t)
+	conn, r := memcacheClient(t)
+	// Were the data taken for a command, it would close the connection
+	send(conn, "add mc-b 0 0 4\r\nquit\r\n"+
+		"cas mc-b 0 0 4 1 noreply\r\nquit\r\n"+
+		"get mc-b\r\n")
+	expectLines(t, r, "CLIENT_ERROR unauthenticated", "CLIENT_ERROR unauthenticated")
+}
+
+func TestMemcacheFollowerSkipsDataOfWrites(t *testing.T) {
+	replication.Follow("http://127.0.0.1:1", http.DefaultClient) // Never reached; the node only needs to be a follower
+	t.Cleanup(func() { replication.Promote() })
+	conn, r := memcacheClient(t)
+	send(conn, "set mc-c 0 0 7\r\nversion\r\nget mc-c\r\n")
+	expectLines(t, r, "SERVER_ERROR this node is a read-only follower; the leader is http://127.0.0.1:1", "END")
+}
+
+func TestMemcacheLimitsUnauthenticatedClients(t *testing.T) {
+	requireAuth(t)
+	for name, request := range map[string]string{
+		"login data": "set user 0 0 16385\r\n",
+		"line":       "get " + strings.Repeat("k", memcacheMaxLine) + "\r\n",
+	} {
+		conn, r := memcacheClient(t)
+		send(conn, request)
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "CLIENT_ERROR") {
+			t.Errorf("%s: got %q %v, want a client error", name, line, err)
+		}
+		if _, err := r.ReadString('\n'); err == nil {
+			t.Errorf("%s: the connection stayed open", name)
+		}
+	}
+}
+
+func TestMemcacheFarExptime(t *testing.T) {
+	conn, r := memcacheClient(t)
+	send(conn, "set mc-d 0 99999999999999 1\r\nv\r\nget mc-d\r\n")
+	expectLines(t, r, "STORED", "VALUE mc-d 0 1", "v", "END")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"melon/internal/metrics"
+	"melon/internal/service"
+	"strconv"
+	"time"
+)
+
+// instrument counts and times every request by its route pattern, so that
+// metrics do not grow with the number of keys.
+func instrument(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	status := strconv.Itoa(c.Writer.Status())
+	metrics.RequestsTotal.WithLabelValues(route, c.Request.Method, status).Inc()
+	metrics.RequestDuration.WithLabelValues(route, c.Request.Method, status).Observe(time.Since(start).Seconds())
+}
+
+// storeCollector reports the size of every namespace when scraped.
+type storeCollector struct{}
+
+var (
+	storeKeysDesc = prometheus.NewDesc("melon_store_keys",
+		"Keys held in the store, by namespace.", []string{"namespace"}, nil)
+	storeBytesDesc = prometheus.NewDesc("melon_store_bytes",
+		"Total length of the keys and values held in the store, by namespace.", []string{"namespace"}, nil)
+)
+
+func (storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storeKeysDesc
+	ch <- storeBytesDesc
+}
+
+func (storeCollector) Collect(ch chan<- prometheus.Metric) {
+	namespaces := service.Namespaces()
+	if info, ok := service.Namespace(service.DefaultNamespace); ok {
+		namespaces = append(namespaces, info)
+	}
+	for _, ns := range namespaces {
+		ch <- prometheus.MustNewConstMetric(storeKeysDesc, prometheus.GaugeValue, float64(ns.Keys), ns.Name)
+		ch <- prometheus.MustNewConstMetric(storeBytesDesc, prometheus.GaugeValue, float64(ns.Bytes), ns.Name)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"melon/internal/partition"
+	"melon/internal/service"
+	"net/http"
+	"net/url"
+)
+
+func registerNamespaceRoutes(r gin.IRoutes) {
+	r.PUT("/v1/ns/:ns/key/:key", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValuePutHandler)
+	r.GET("/v1/ns/:ns/key/:key", authorize(service.PermissionRead), routeToOwner, keyValueGetHandler)
+	r.PATCH("/v1/ns/:ns/key/:key", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValuePatchHandler)
+	r.GET("/v1/ns/:ns/key/:key/history", authorize(service.PermissionRead), routeToOwner, keyValueHistoryHandler)
+	r.POST("/v1/ns/:ns/key/:key/incr", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCounterHandler("incr"))
+	r.POST("/v1/ns/:ns/key/:key/decr", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCounterHandler("decr"))
+	r.POST("/v1/ns/:ns/key/:key/add", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCounterHandler("add"))
+	r.POST("/v1/ns/:ns/key/:key/list/push", authorize(service.PermissionWrite), routeToOwner, requireLeader, listPushHandler)
+	r.POST("/v1/ns/:ns/key/:key/list/pop", authorize(service.PermissionWrite), routeToOwner, requireLeader, listPopHandler)
+	r.GET("/v1/ns/:ns/key/:key/list", authorize(service.PermissionRead), routeToOwner, listRangeHandler)
+	r.POST("/v1/ns/:ns/key/:key/set/add", authorize(service.PermissionWrite), routeToOwner, requireLeader, setAddHandler)
+	r.POST("/v1/ns/:ns/key/:key/set/remove", authorize(service.PermissionWrite), routeToOwner, requireLeader, setRemoveHandler)
+	r.GET("/v1/ns/:ns/key/:key/set", authorize(service.PermissionRead), routeToOwner, setMembersHandler)
+	r.PUT("/v1/ns/:ns/key/:key/hash", authorize(service.PermissionWrite), routeToOwner, requireLeader, hashSetHandler)
+	r.GET("/v1/ns/:ns/key/:key/hash", authorize(service.PermissionRead), routeToOwner, hashGetAllHandler)
+	r.GET("/v1/ns/:ns/key/:key/hash/:field", authorize(service.PermissionRead), routeToOwner, hashGetHandler)
+	r.DELETE("/v1/ns/:ns/key/:key/hash/:field", authorize(service.PermissionWrite), routeToOwner, requireLeader, hashDeleteHandler)
+	r.POST("/v1/ns/:ns/key/:key/cas", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueCASHandler)
+	r.POST("/v1/ns/:ns/key/:key/put-if-absent", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValuePutIfAbsentHandler)
+	r.POST("/v1/ns/:ns/key/:key/delete-if-value", authorize(service.PermissionDelete), routeToOwner, requireLeader, keyValueDeleteIfValueHandler)
+	r.PUT("/v1/ns/:ns/key/:key/lease", authorize(service.PermissionWrite), routeToOwner, requireLeader, keyValueLeaseHandler)
+	r.DELETE("/v1/ns/:ns/key/:key", authorize(service.PermissionDelete), routeToOwner, requireLeader, keyValueDeleteHandler)
+	r.GET("/v1/ns/:ns/keys", namespaceKeysHandler)
+}
+
+func registerNamespaceAdminRoutes(r gin.IRoutes) {
+	r.GET("/v1/ns", namespacesHandler)
+	r.GET("/v1/ns/:ns", namespaceHandler)
+	r.PUT("/v1/ns/:ns/quota", requireLeader, namespaceQuotaHandler)
+}
+
+// namespaceKeysHandler lists the keys in a namespace, optionally only those
+// starting with the prefix query parameter. When partitioned, only the keys
+// this node owns are listed.
+func namespaceKeysHandler(c *gin.Context) {
+	ns, prefix := c.Param("ns"), c.Query("prefix")
+	if !allowed(c, ns, prefix, service.PermissionRead) {
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"namespace": ns,
+		"keys":      service.Keys(ns, prefix),
+	})
+}
+
+func namespacesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{"namespaces": service.Namespaces()})
+}
+
+func namespaceHandler(c *gin.Context) {
+	info, ok := service.Namespace(c.Param("ns"))
+	if !ok {
+		abortWithError(c, http.StatusNotFound, "no such namespace")
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+// namespaceQuotaHandler sets a namespace's quota, creating the namespace if
+// needed. A zero limit removes it. When partitioned, every node enforces the
+// quota on the keys it owns.
+func namespaceQuotaHandler(c *gin.Context) {
+	ns := c.Param("ns")
+	var q service.Quota
+	if err := c.ShouldBindJSON(&q); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if q.MaxKeys < 0 || q.MaxBytes < 0 {
+		abortWithError(c, http.StatusBadRequest, "limits cannot be negative")
+		return
+	}
+	if err := service.Commit(c.Request.Context(), service.QuotaEvent(ns, q)); err != nil {
+		abortWithCommitError(c, err)
+		return
+	}
+	if partition.Enabled() && c.GetHeader(partition.ForwardedHeader) == "" {
+		body, _ := json.Marshal(q)
+		err := partition.Broadcast(c.Request.Context(), partition.Nodes(), http.MethodPut, "/v1/ns/"+url.PathEscape(ns)+"/quota", body)
+		if err != nil {
+			abortWithError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	info, _ := service.Namespace(ns)
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// apiOperation documents one route of the public API. Routes without one
+// still appear in the OpenAPI document, with only the standard errors.
+type apiOperation struct {
+	summary   string
+	query     []apiParam
+	body      string         // Request body: "raw" for a raw value, "patch" for a JSON patch, else a schema name
+	responses map[int]string // Response body by status: "raw", "document", a schema name, or empty for none
+}
+
+type apiParam struct {
+	name, typ, description string
+}
+
+var keyReadQuery = []apiParam{
+	{"as_of_seq", "integer", "Read the value as of this sequence number"},
+	{"as_of", "string", "Read the value as of this RFC 3339 time"},
+	{"envelope", "boolean", "Wrap the value in a KeyEnvelope; sending Accept: application/json does the same"},
+	{"path", "string", "Send only this part of a JSON document, as in $.a.b or $.items[0]"},
+}
+
+var counterQuery = []apiParam{
+	{"by", "integer", "The amount, 1 by default"},
+	{"envelope", "boolean", "Answer with the key's KeyEnvelope"},
+}
+
+var addQuery = []apiParam{
+	{"by", "number", "The amount to add; negative to subtract"},
+	{"envelope", "boolean", "Answer with the key's KeyEnvelope"},
+}
+
+var listEndParam = apiParam{"end", "string", "left for the head of the list, or right, the default, for its tail"}
+
+// apiOperations documents each route. The list, set and hash routes, the
+// conditional writes and lease attachment are documented once, for the default namespace, and
+// their /v1/ns/{ns} forms share the same entry.
+var apiOperations = map[string]apiOperation{
+	"PUT /v1/key/{key}": {
+		summary:   "Set a key in the default namespace",
+		query:     []apiParam{{"envelope", "boolean", "Answer with the key's KeyEnvelope"}},
+		body:      "raw",
+		responses: map[int]string{200: "WriteStatus", 201: "WriteStatus", 507: "Error"},
+	},
+	"GET /v1/key/{key}": {
+		summary:   "Get a key from the default namespace",
+		query:     keyReadQuery,
+		responses: map[int]string{200: "document", 404: "Error"},
+	},
+	"PATCH /v1/key/{key}": {
+		summary:   "Patch a JSON document in the default namespace",
+		query:     []apiParam{{"envelope", "boolean", "Answer with the key's KeyEnvelope"}},
+		body:      "patch",
+		responses: map[int]string{200: "document", 409: "Error", 415: "Error"},
+	},
+	"DELETE /v1/key/{key}": {
+		summary:   "Delete a key from the default namespace",
+		responses: map[int]string{204: "", 404: "Error"},
+	},
+	"GET /v1/key/{key}/history": {
+		summary:   "List the logged versions of a key, oldest first",
+		responses: map[int]string{200: "History"},
+	},
+	"PUT /v1/ns/{ns}/key/{key}": {
+		summary:   "Set a key in a namespace",
+		query:     []apiParam{{"envelope", "boolean", "Answer with the key's KeyEnvelope"}},
+		body:      "raw",
+		responses: map[int]string{200: "WriteStatus", 201: "WriteStatus", 507: "Error"},
+	},
+	"GET /v1/ns/{ns}/key/{key}": {
+		summary:   "Get a key from a namespace",
+		query:     keyReadQuery,
+		responses: map[int]string{200: "document", 404: "Error"},
+	},
+	"PATCH /v1/ns/{ns}/key/{key}": {
+		summary:   "Patch a JSON document in a namespace",
+		query:     []apiParam{{"envelope", "boolean", "Answer with the key's KeyEnvelope"}},
+		body:      "patch",
+		responses: map[int]string{200: "document", 409: "Error", 415: "Error"},
+	},
+	"DELETE /v1/ns/{ns}/key/{key}": {
+		summary:   "Delete a key from a namespace",
+		responses: map[int]string{204: "", 404: "Error"},
+	},
+	"GET /v1/ns/{ns}/key/{key}/history": {
+		summary:   "List the logged versions of a key in a namespace, oldest first",
+		responses: map[int]string{200: "History"},
+	},
+	"POST /v1/key/{key}/incr": {
+		summary:   "Add an integer to a counter in the default namespace",
+		query:     counterQuery,
+		responses: map[int]string{200: "Counter", 409: "Error"},
+	},
+	"POST /v1/key/{key}/decr": {
+		summary:   "Subtract an integer from a counter in the default namespace",
+		query:     counterQuery,
+		responses: map[int]string{200: "Counter", 409: "Error"},
+	},
+	"POST /v1/key/{key}/add": {
+		summary:   "Add a number to a key in the default namespace",
+		query:     addQuery,
+		responses: map[int]string{200: "Counter", 409: "Error"},
+	},
+	"POST /v1/ns/{ns}/key/{key}/incr": {
+		summary:   "Add an integer to a counter in a namespace",
+		query:     counterQuery,
+		responses: map[int]string{200: "Counter", 409: "Error"},
+	},
+	"POST /v1/ns/{ns}/key/{key}/decr": {
+		summary:   "Subtract an integer from a counter in a namespace",
+		query:     counterQuery,
+		responses: map[int]string{200: "Counter", 409: "Error"},
+	},
+	"POST /v1/ns/{ns}/key/{key}/add": {
+		summary:   "Add a number to a key in a namespace",
+		query:     addQuery,
+		responses: map[int]string{200: "Counter", 409: "Error"},
+	},
+	"POST /v1/key/{key}/list/push": {
+		summary:   "Push strings onto a list",
+		query:     []apiParam{listEndParam},
+		body:      "Strings",
+		responses: map[int]string{200: "ListLength", 409: "Error"},
+	},
+	"POST /v1/key/{key}/list/pop": {
+		summary:   "Remove and return elements from the end of a list, nearest the end first",
+		query:     []apiParam{listEndParam, {"count", "integer", "How many to pop, 1 by default"}},
+		responses: map[int]string{200: "ListValues", 409: "Error"},
+	},
+	"GET /v1/key/{key}/list": {
+		summary: "Get a range of a list",
+		query: []apiParam{
+			{"start", "integer", "The first index, 0 by default; negative counts back from the tail"},
+			{"stop", "integer", "The last index, inclusive, -1 by default"},
+		},
+		responses: map[int]string{200: "ListValues", 409: "Error"},
+	},
+	"POST /v1/key/{key}/set/add": {
+		summary:   "Add members to a set",
+		body:      "Strings",
+		responses: map[int]string{200: "SetAdded", 409: "Error"},
+	},
+	"POST /v1/key/{key}/set/remove": {
+		summary:   "Remove members from a set",
+		body:      "Strings",
+		responses: map[int]string{200: "SetRemoved", 409: "Error"},
+	},
+	"GET /v1/key/{key}/set": {
+		summary:   "Get the members of a set, sorted",
+		responses: map[int]string{200: "SetMembers", 409: "Error"},
+	},
+	"PUT /v1/key/{key}/hash": {
+		summary:   "Set fields of a hash, leaving the others alone",
+		body:      "HashFields",
+		responses: map[int]string{200: "SetAdded", 409: "Error"},
+	},
+	"GET /v1/key/{key}/hash": {
+		summary:   "Get every field of a hash",
+		responses: map[int]string{200: "Hash", 409: "Error"},
+	},
+	"GET /v1/key/{key}/hash/{field}": {
+		summary:   "Get one field of a hash",
+		responses: map[int]string{200: "raw", 404: "Error", 409: "Error"},
+	},
+	"DELETE /v1/key/{key}/hash/{field}": {
+		summary:   "Delete one field of a hash",
+		responses: map[int]string{204: "", 404: "Error", 409: "Error"},
+	},
+	"POST /v1/key/{key}/cas": {
+		summary:   "Set a key only if it holds a given value",
+		body:      "CompareAndSwap",
+		responses: map[int]string{200: "WriteStatus", 412: "Error"},
+	},
+	"POST /v1/key/{key}/put-if-absent": {
+		summary:   "Set a key only if it does not exist",
+		query:     []apiParam{{"lease", "integer", "Attach the new key to this lease"}},
+		body:      "raw",
+		responses: map[int]string{201: "WriteStatus", 404: "Error", 412: "Error"},
+	},
+	"PUT /v1/key/{key}/lease": {
+		summary:   "Attach a key to a lease, or detach it",
+		body:      "LeaseAttach",
+		responses: map[int]string{200: "WriteStatus", 404: "Error"},
+	},
+	"POST /v1/key/{key}/delete-if-value": {
+		summary:   "Delete a key only if it holds the value sent",
+		body:      "raw",
+		responses: map[int]string{204: "", 412: "Error"},
+	},
+	"GET /v1/ns/{ns}/keys": {
+		summary:   "List the keys in a namespace",
+		query:     []apiParam{{"prefix", "string", "Only list keys starting with this"}},
+		responses: map[int]string{200: "KeyList"},
+	},
+	"GET /v1/ns": {
+		summary:   "Describe every namespace",
+		responses: map[int]string{200: "NamespaceList"},
+	},
+	"GET /v1/ns/{ns}": {
+		summary:   "Describe a namespace",
+		responses: map[int]string{200: "Namespace", 404: "Error"},
+	},
+	"PUT /v1/ns/{ns}/quota": {
+		summary:   "Set a namespace's quota",
+		body:      "Quota",
+		responses: map[int]string{200: "Namespace"},
+	},
+	"GET /v1/index": {
+		summary:   "List the secondary indexes",
+		responses: map[int]string{200: "IndexList"},
+	},
+	"PUT /v1/index/{name}": {
+		summary:   "Create or replace a secondary index on a field of JSON values",
+		body:      "IndexDefinition",
+		responses: map[int]string{200: "IndexDefinition"},
+	},
+	"DELETE /v1/index/{name}": {
+		summary:   "Drop a secondary index",
+		responses: map[int]string{204: "", 404: "Error"},
+	},
+	"GET /v1/index/{name}": {
+		summary:   "Find the keys whose indexed field has a value",
+		query:     []apiParam{{"eq", "string", "The field's string value, or the JSON encoding of any other value"}},
+		responses: map[int]string{200: "IndexEntries", 404: "Error"},
+	},
+	"GET /v1/lease": {
+		summary:   "List every lease not yet revoked",
+		responses: map[int]string{200: "LeaseList"},
+	},
+	"POST /v1/lease": {
+		summary:   "Grant a lease, which deletes the keys attached to it when it ends",
+		body:      "LeaseGrant",
+		responses: map[int]string{201: "Lease"},
+	},
+	"GET /v1/lease/{id}": {
+		summary:   "Describe a lease and the keys attached to it",
+		responses: map[int]string{200: "Lease", 404: "Error"},
+	},
+	"POST /v1/lease/{id}/keepalive": {
+		summary:   "Extend a lease to end its TTL from now",
+		responses: map[int]string{200: "Lease", 404: "Error"},
+	},
+	"DELETE /v1/lease/{id}": {
+		summary:   "Revoke a lease now, deleting the keys attached to it",
+		responses: map[int]string{204: "", 404: "Error"},
+	},
+	"GET /healthz": {
+		summary:   "Report that the process is alive",
+		responses: map[int]string{200: "Liveness"},
+	},
+	"GET /readyz": {
+		summary:   "Report whether the node should receive traffic",
+		responses: map[int]string{200: "Readiness", 503: "Readiness"},
+	},
+}
+
+// deprecatedRoutes are still served but left out of new clients.
+var deprecatedRoutes = map[string]bool{"DELETE /v1/key/{key}/": true}
+
+// apiSchemas are the schemas referred to by apiOperations.
+var apiSchemas = map[string]interface{}{
+	"Error": object(map[string]interface{}{
+		"error": prop("string", "A message for people"),
+		"code": map[string]interface{}{
+			"type":        "string",
+			"description": "A stable code for programs to match on",
+			"enum": []string{
+				codeInvalidRequest, codeUnauthorized, codeForbidden, codeNotFound, codeConflict,
+				codeRateLimited, codeInternal, codeNotImplemented, codeBadGateway, codeUnavailable,
+				codeNotLeader, codeReadOnly, codeQuotaExceeded, codeNotANumber, codeWrongType,
+				codeNotJSON, codePatchFailed, codeUnsupported, codePrecondition, codeTooLarge,
+			},
+		},
+		"leader": prop("string", "With not_leader, the address of the node to retry at"),
+	}, "error", "code"),
+	"KeyEnvelope": object(map[string]interface{}{
+		"namespace":  prop("string", "Omitted for the default namespace"),
+		"key":        prop("string", ""),
+		"value":      prop("string", ""),
+		"version":    prop("integer", "Puts since the key was created, starting at 1"),
+		"metadata":   object(map[string]interface{}{"size": prop("integer", "Length of the value in bytes")}, "size"),
+		"created_at": map[string]interface{}{"type": "string", "format": "date-time"},
+		"updated_at": map[string]interface{}{"type": "string", "format": "date-time"},
+		"expires_at": map[string]interface{}{"type": "string", "format": "date-time", "description": "Only for keys set to expire"},
+		"type":       map[string]interface{}{"type": "string", "enum": []string{"list", "set", "hash"}, "description": "Only for keys holding a list, set or hash, whose value is then its JSON encoding"},
+	}, "key", "value", "version", "metadata", "created_at", "updated_at"),
+	"WriteStatus": map[string]interface{}{
+		"oneOf": []interface{}{
+			object(map[string]interface{}{
+				"status": map[string]interface{}{"type": "string", "enum": []string{"created", "updated"}},
+			}, "status"),
+			ref("KeyEnvelope"),
+		},
+	},
+	"History": object(map[string]interface{}{
+		"key": prop("string", ""),
+		"versions": map[string]interface{}{
+			"type": "array",
+			"items": object(map[string]interface{}{
+				"sequence":  prop("integer", ""),
+				"timestamp": map[string]interface{}{"type": "string", "format": "date-time"},
+				"type":      map[string]interface{}{"type": "string", "enum": []string{"put", "delete"}},
+				"value":     prop("string", "Only for puts"),
+			}, "sequence", "timestamp", "type"),
+		},
+	}, "key", "versions"),
+	"Counter": map[string]interface{}{
+		"oneOf": []interface{}{
+			object(map[string]interface{}{"value": prop("number", "The key's value after the operation")}, "value"),
+			ref("KeyEnvelope"),
+		},
+	},
+	"Strings":    map[string]interface{}{"type": "array", "items": prop("string", ""), "minItems": 1},
+	"ListLength": object(map[string]interface{}{"length": prop("integer", "The list's length afterwards")}, "length"),
+	"ListValues": object(map[string]interface{}{
+		"values": map[string]interface{}{"type": "array", "items": prop("string", "")},
+	}, "values"),
+	"SetAdded":   object(map[string]interface{}{"added": prop("integer", "How many members or fields were new")}, "added"),
+	"SetRemoved": object(map[string]interface{}{"removed": prop("integer", "How many members were there")}, "removed"),
+	"SetMembers": object(map[string]interface{}{
+		"members": map[string]interface{}{"type": "array", "items": prop("string", "")},
+	}, "members"),
+	"HashFields": map[string]interface{}{"type": "object", "additionalProperties": prop("string", "")},
+	"Hash":       object(map[string]interface{}{"fields": ref("HashFields")}, "fields"),
+	"CompareAndSwap": object(map[string]interface{}{
+		"old": prop("string", "The value the key must hold"),
+		"new": prop("string", "The value to set"),
+	}, "old", "new"),
+	"KeyList": object(map[string]interface{}{
+		"namespace": prop("string", ""),
+		"keys":      map[string]interface{}{"type": "array", "items": prop("string", "")},
+	}, "namespace", "keys"),
+	"Quota": object(map[string]interface{}{
+		"max_keys":  prop("integer", "Zero or omitted for no limit"),
+		"max_bytes": prop("integer", "Total length of every key and value; zero or omitted for no limit"),
+	}),
+	"Namespace": object(map[string]interface{}{
+		"name":  prop("string", ""),
+		"keys":  prop("integer", ""),
+		"bytes": prop("integer", ""),
+		"quota": ref("Quota"),
+	}, "name", "keys", "bytes", "quota"),
+	"NamespaceList": object(map[string]interface{}{
+		"namespaces": map[string]interface{}{"type": "array", "items": ref("Namespace")},
+	}, "namespaces"),
+	"IndexDefinition": object(map[string]interface{}{
+		"name":      prop("string", "Taken from the path when creating"),
+		"namespace": prop("string", "Omitted for the default namespace"),
+		"prefix":    prop("string", "Only keys starting with this are indexed"),
+		"path":      prop("string", "The indexed field, as a JSON path such as $.email"),
+	}, "prefix", "path"),
+	"IndexList": object(map[string]interface{}{
+		"indexes": map[string]interface{}{"type": "array", "items": ref("IndexDefinition")},
+	}, "indexes"),
+	"IndexEntries": object(map[string]interface{}{
+		"index":     prop("string", ""),
+		"namespace": prop("string", ""),
+		"entries": map[string]interface{}{
+			"type":  "array",
+			"items": object(map[string]interface{}{"key": prop("string", ""), "value": prop("string", "")}, "key", "value"),
+		},
+	}, "index", "namespace", "entries"),
+	"LeaseGrant":  object(map[string]interface{}{"ttl": prop("integer", "Seconds until the lease ends unless kept alive")}, "ttl"),
+	"LeaseAttach": object(map[string]interface{}{"id": prop("integer", "The lease ID, or 0 to detach the key")}, "id"),
+	"Lease": object(map[string]interface{}{
+		"id":         prop("integer", ""),
+		"ttl":        prop("integer", "Seconds"),
+		"expires_at": map[string]interface{}{"type": "string", "format": "date-time"},
+		"remaining":  prop("integer", "Whole seconds left"),
+		"keys": map[string]interface{}{
+			"type":        "array",
+			"description": "Only when describing a single lease",
+			"items":       object(map[string]interface{}{"namespace": prop("string", ""), "key": prop("string", "")}, "key"),
+		},
+	}, "id", "ttl", "expires_at", "remaining"),
+	"LeaseList": object(map[string]interface{}{
+		"leases": map[string]interface{}{"type": "array", "items": ref("Lease")},
+	}, "leases"),
+	"Liveness": object(map[string]interface{}{
+		"status": map[string]interface{}{"type": "string", "enum": []string{"ok"}},
+	}, "status"),
+	"Readiness": object(map[string]interface{}{
+		"status": map[string]interface{}{"type": "string", "enum": []string{"ok", "unavailable"}},
+		"checks": map[string]interface{}{
+			"type": "object",
+			"additionalProperties": object(map[string]interface{}{
+				"ok":    prop("boolean", ""),
+				"error": prop("string", ""),
+			}, "ok"),
+		},
+	}, "status", "checks"),
+}
+
+func object(properties map[string]interface{}, required ...string) map[string]interface{} {
+	o := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		o["required"] = required
+	}
+	return o
+}
+
+func prop(typ, description string) map[string]interface{} {
+	p := map[string]interface{}{"type": typ}
+	if description != "" {
+		p["description"] = description
+	}
+	return p
+}
+
+func ref(schema string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + schema}
+}
+
+// openAPIHandler serves an OpenAPI 3 document describing every /v1 route
+// registered on r, along with the health probes. It is generated on first
+// request, once every route is in place.
+func openAPIHandler(r *gin.Engine) gin.HandlerFunc {
+	var once sync.Once
+	var doc map[string]interface{}
+	return func(c *gin.Context) {
+		once.Do(func() { doc = openAPIDocument(r.Routes()) })
+		c.JSON(http.StatusOK, doc)
+	}
+}
+
+func openAPIDocument(routes gin.RoutesInfo) map[string]interface{} {
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Path < routes[j].Path })
+	paths := make(map[string]map[string]interface{})
+	for _, route := range routes {
+		if !strings.HasPrefix(route.Path, "/v1/") && route.Path != "/healthz" && route.Path != "/readyz" {
+			continue
+		}
+		path, params := openAPIPath(route.Path)
+		id := route.Method + " " + path
+		if paths[path] == nil {
+			paths[path] = make(map[string]interface{})
+		}
+		paths[path][strings.ToLower(route.Method)] = openAPIOperation(id, params)
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "melon",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": apiSchemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+}
+
+// openAPIPath turns gin's :param segments into OpenAPI's {param}.
+func openAPIPath(path string) (string, []string) {
+	var params []string
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if strings.HasPrefix(s, ":") || strings.HasPrefix(s, "*") {
+			params = append(params, s[1:])
+			segments[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), params
+}
+
+func openAPIOperation(id string, pathParams []string) map[string]interface{} {
+	op, documented := apiOperations[id]
+	if !documented {
+		op, documented = apiOperations[strings.TrimSuffix(id, "/")]
+	}
+	if !documented {
+		op = apiOperations[strings.Replace(id, "/v1/ns/{ns}/key/", "/v1/key/", 1)]
+	}
+	var parameters []interface{}
+	for _, name := range pathParams {
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "path", "required": true, "schema": prop("string", ""),
+		})
+	}
+	for _, q := range op.query {
+		parameters = append(parameters, map[string]interface{}{
+			"name": q.name, "in": "query", "description": q.description, "schema": prop(q.typ, ""),
+		})
+	}
+
+	responses := map[string]interface{}{
+		"400":     response("Error"),
+		"401":     response("Error"),
+		"403":     response("Error"),
+		"429":     response("Error"),
+		"503":     response("Error"),
+		"default": response("Error"),
+	}
+	if len(op.responses) == 0 {
+		responses["200"] = map[string]interface{}{"description": "OK"}
+	}
+	for status, schema := range op.responses {
+		responses[strconv.Itoa(status)] = response(schema)
+	}
+
+	o := map[string]interface{}{
+		"operationId": id,
+		"responses":   responses,
+	}
+	if op.summary != "" {
+		o["summary"] = op.summary
+	}
+	if len(parameters) > 0 {
+		o["parameters"] = parameters
+	}
+	switch op.body {
+	case "":
+	case "raw":
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}}},
+		}
+	case "patch":
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/merge-patch+json": map[string]interface{}{"schema": map[string]interface{}{"description": "A JSON Merge Patch (RFC 7396)"}},
+				"application/json-patch+json": map[string]interface{}{"schema": map[string]interface{}{
+					"type":  "array",
+					"items": object(map[string]interface{}{"op": prop("string", ""), "path": prop("string", ""), "from": prop("string", ""), "value": map[string]interface{}{}}, "op", "path"),
+				}},
+			},
+		}
+	default:
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": ref(op.body)}},
+		}
+	}
+	if deprecatedRoutes[id] {
+		o["deprecated"] = true
+	}
+	if id == "GET /healthz" || id == "GET /readyz" {
+		o["security"] = []interface{}{}
+	}
+	return o
+}
+
+func response(schema string) map[string]interface{} {
+	switch schema {
+	case "":
+		return map[string]interface{}{"description": "No content"}
+	case "raw":
+		return map[string]interface{}{
+			"description": "The raw value, or a KeyEnvelope when one was asked for",
+			"content": map[string]interface{}{
+				"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				"application/json":         map[string]interface{}{"schema": ref("KeyEnvelope")},
+			},
+		}
+	case "document":
+		return map[string]interface{}{
+			"description": "The raw value; a JSON document, or the part of one chosen by path; or a KeyEnvelope when one was asked for",
+			"content": map[string]interface{}{
+				"application/octet-stream": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+				"application/json": map[string]interface{}{"schema": map[string]interface{}{
+					"anyOf": []interface{}{ref("KeyEnvelope"), map[string]interface{}{"description": "A JSON document"}},
+				}},
+			},
+		}
+	}
+	return map[string]interface{}{
+		"description": schema,
+		"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": ref(schema)}},
+	}
+}
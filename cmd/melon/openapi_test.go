@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"melon/internal/service"
+	"melon/internal/transaction"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var serviceOnce sync.Once
+
+// startService starts the store over an in-memory log, once for every test.
+func startService(t *testing.T) {
+	t.Helper()
+	serviceOnce.Do(func() {
+		gin.SetMode(gin.TestMode)
+		if err := service.InitializeWithLogger(transaction.NewMemoryTransactionLogger()); err != nil {
+			t.Fatal(err)
+		}
+		close(started)
+	})
+}
+
+// contractRouter is the node's router over an in-memory store, started.
+func contractRouter(t *testing.T) *gin.Engine {
+	t.Helper()
+	startService(t)
+	r := newRouter()
+	registerRoutes(r, false, false)
+	return r
+}
+
+type contractRequest struct {
+	method, path, body, contentType string
+}
+
+// contractRequests exercise every documented route, successes and
+// failures. {lease} is replaced by the ID of the lease granted first.
+var contractRequests = []contractRequest{
+	{"GET", "/healthz", "", ""},
+	{"GET", "/readyz", "", ""},
+
+	{"PUT", "/v1/key/contract-a", "hello", ""},
+	{"PUT", "/v1/key/contract-a", "hello again", ""},
+	{"PUT", "/v1/key/contract-a?envelope=true", "hello", ""},
+	{"GET", "/v1/key/contract-a", "", ""},
+	{"GET", "/v1/key/contract-a?envelope=true", "", ""},
+	{"GET", "/v1/key/contract-a?as_of_seq=1", "", ""},
+	{"GET", "/v1/key/contract-a?as_of=nonsense", "", ""},
+	{"GET", "/v1/key/contract-missing", "", ""},
+	{"GET", "/v1/key/contract-a/history", "", ""},
+
+	{"PUT", "/v1/key/contract-doc", `{"a":{"b":1}}`, ""},
+	{"GET", "/v1/key/contract-doc?path=$.a", "", ""},
+	{"PATCH", "/v1/key/contract-doc", `{"c":2}`, "application/merge-patch+json"},
+	{"PATCH", "/v1/key/contract-doc?envelope=true", `[{"op":"add","path":"/d","value":3}]`, "application/json-patch+json"},
+	{"PATCH", "/v1/key/contract-doc", `{}`, "text/plain"},
+	{"PATCH", "/v1/key/contract-a", `{"c":2}`, "application/merge-patch+json"},
+
+	{"POST", "/v1/key/contract-n/incr?by=2", "", ""},
+	{"POST", "/v1/key/contract-n/decr", "", ""},
+	{"POST", "/v1/key/contract-n/add?by=1.5&envelope=true", "", ""},
+	{"POST", "/v1/key/contract-n/add?by=0.5", "", ""},
+	{"POST", "/v1/key/contract-a/incr", "", ""},
+	{"POST", "/v1/key/contract-n/incr?by=x", "", ""},
+
+	{"POST", "/v1/key/contract-list/list/push", `["x","y","z"]`, "application/json"},
+	{"POST", "/v1/key/contract-list/list/pop?end=left", "", ""},
+	{"GET", "/v1/key/contract-list/list?start=0&stop=-1", "", ""},
+	{"POST", "/v1/key/contract-set/set/add", `["b","a"]`, "application/json"},
+	{"POST", "/v1/key/contract-set/set/remove", `["a"]`, "application/json"},
+	{"GET", "/v1/key/contract-set/set", "", ""},
+	{"GET", "/v1/key/contract-set/list", "", ""},
+	{"PUT", "/v1/key/contract-hash/hash", `{"f":"1","g":"2"}`, "application/json"},
+	{"GET", "/v1/key/contract-hash/hash", "", ""},
+	{"GET", "/v1/key/contract-hash/hash/f", "", ""},
+	{"GET", "/v1/key/contract-hash/hash/missing", "", ""},
+	{"DELETE", "/v1/key/contract-hash/hash/g", "", ""},
+
+	{"POST", "/v1/key/contract-a/cas", `{"old":"hello","new":"bye"}`, "application/json"},
+	{"POST", "/v1/key/contract-a/cas", `{"old":"hello","new":"bye"}`, "application/json"},
+	{"POST", "/v1/key/contract-a/delete-if-value", "wrong", ""},
+	{"POST", "/v1/key/contract-gone/put-if-absent", "v", ""},
+	{"POST", "/v1/key/contract-gone/put-if-absent", "v", ""},
+	{"POST", "/v1/key/contract-gone/delete-if-value", "v", ""},
+
+	{"POST", "/v1/lease", `{"ttl":60}`, "application/json"},
+	{"POST", "/v1/lease", `{"ttl":-1}`, "application/json"},
+	{"GET", "/v1/lease", "", ""},
+	{"GET", "/v1/lease/{lease}", "", ""},
+	{"GET", "/v1/lease/1", "", ""},
+	{"POST", "/v1/lease/{lease}/keepalive", "", ""},
+	{"PUT", "/v1/key/contract-a/lease", `{"id":{lease}}`, "application/json"},
+	{"POST", "/v1/key/contract-lock/put-if-absent?lease={lease}", "held", ""},
+	{"DELETE", "/v1/lease/{lease}", "", ""},
+
+	{"PUT", "/v1/ns/contract/key/k", "v", ""},
+	{"GET", "/v1/ns/contract/key/k?envelope=true", "", ""},
+	{"GET", "/v1/ns/contract/key/k/history", "", ""},
+	{"POST", "/v1/ns/contract/key/n/incr", "", ""},
+	{"GET", "/v1/ns/contract/keys?prefix=k", "", ""},
+	{"PUT", "/v1/ns/contract/quota", `{"max_keys":10}`, "application/json"},
+	{"GET", "/v1/ns", "", ""},
+	{"GET", "/v1/ns/contract", "", ""},
+	{"GET", "/v1/ns/contract-none", "", ""},
+	{"DELETE", "/v1/ns/contract/key/k", "", ""},
+
+	{"PUT", "/v1/index/contract-email", `{"prefix":"contract-user-","path":"$.email"}`, "application/json"},
+	{"PUT", "/v1/key/contract-user-1", `{"email":"a@example.com"}`, ""},
+	{"GET", "/v1/index", "", ""},
+	{"GET", "/v1/index/contract-email?eq=a@example.com", "", ""},
+	{"DELETE", "/v1/index/contract-email", "", ""},
+	{"DELETE", "/v1/index/contract-email", "", ""},
+
+	{"DELETE", "/v1/key/contract-a", "", ""},
+	{"DELETE", "/v1/key/contract-a", "", ""},
+}
+
+// TestResponsesMatchOpenAPIDocument sends contractRequests through the
+// router and checks each answer against the OpenAPI document it serves: the
+// route and status must be documented, and a JSON body must match the
+// documented schema.
+func TestResponsesMatchOpenAPIDocument(t *testing.T) {
+	r := contractRouter(t)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("cannot decode the OpenAPI document: %v", err)
+	}
+
+	var lease string
+	for _, req := range contractRequests {
+		path := strings.ReplaceAll(req.path, "{lease}", lease)
+		body := strings.ReplaceAll(req.body, "{lease}", lease)
+		name := req.method + " " + path
+		hr := httptest.NewRequest(req.method, path, strings.NewReader(body))
+		if req.contentType != "" {
+			hr.Header.Set("Content-Type", req.contentType)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, hr)
+
+		op, err := operation(doc, req.method, hr.URL.Path)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if err := checkResponse(doc, op, w); err != nil {
+			t.Errorf("%s: answered %d %s: %v", name, w.Code, w.Body.String(), err)
+		}
+		if lease == "" && req.method == "POST" && path == "/v1/lease" && w.Code == http.StatusCreated {
+			var l struct{ ID int64 }
+			json.Unmarshal(w.Body.Bytes(), &l)
+			lease = strconv.FormatInt(l.ID, 10)
+		}
+	}
+}
+
+// operation finds the documented operation serving method on path.
+func operation(doc map[string]interface{}, method, path string) (map[string]interface{}, error) {
+	paths := doc["paths"].(map[string]interface{})
+	templates := make([]string, 0, len(paths))
+	for template := range paths {
+		templates = append(templates, template)
+	}
+	sort.Strings(templates) // Literal segments sort before {params}
+	for _, template := range templates {
+		if !matchTemplate(template, path) {
+			continue
+		}
+		if op, ok := paths[template].(map[string]interface{})[strings.ToLower(method)]; ok {
+			return op.(map[string]interface{}), nil
+		}
+	}
+	return nil, fmt.Errorf("no documented operation")
+}
+
+// matchTemplate reports whether path fits template, whose {param} segments
+// match any one segment.
+func matchTemplate(template, path string) bool {
+	want, got := strings.Split(template, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != got[i] && !(strings.HasPrefix(want[i], "{") && got[i] != "") {
+			return false
+		}
+	}
+	return true
+}
+
+func checkResponse(doc, op map[string]interface{}, w *httptest.ResponseRecorder) error {
+	spec, ok := op["responses"].(map[string]interface{})[strconv.Itoa(w.Code)].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("status %d is not documented", w.Code)
+	}
+	content, _ := spec["content"].(map[string]interface{})
+	if len(content) == 0 {
+		if w.Body.Len() > 0 {
+			return fmt.Errorf("documented without a body")
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if mediaType != "application/json" {
+		if _, ok := content["application/octet-stream"]; !ok {
+			return fmt.Errorf("%s is not documented", mediaType)
+		}
+		return nil // A raw value
+	}
+	media, ok := content["application/json"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("JSON is not documented")
+	}
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return validate(doc, media["schema"], body, "body")
+}
+
+// validate checks v against the subset of JSON Schema the document uses.
+// Properties not described are refused unless the schema allows them, so
+// that the document keeps up with the handlers.
+func validate(doc map[string]interface{}, schema interface{}, v interface{}, at string) error {
+	s, _ := schema.(map[string]interface{})
+	if ref, ok := s["$ref"].(string); ok {
+		name := strings.TrimPrefix(ref, "#/components/schemas/")
+		return validate(doc, doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name], v, at)
+	}
+	if options, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, option := range options {
+			if validate(doc, option, v, at) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fmt.Errorf("%s matches %d of the schemas in oneOf, want 1", at, matched)
+		}
+		return nil
+	}
+	if options, ok := s["anyOf"].([]interface{}); ok {
+		for _, option := range options {
+			if validate(doc, option, v, at) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s matches none of the schemas in anyOf", at)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			return fmt.Errorf("%s is %v, not one of %v", at, v, enum)
+		}
+	}
+	switch s["type"] {
+	case "object":
+		o, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is %T, want an object", at, v)
+		}
+		required, _ := s["required"].([]interface{})
+		for _, name := range required {
+			if _, ok := o[name.(string)]; !ok {
+				return fmt.Errorf("%s lacks %s", at, name)
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		for name, value := range o {
+			p, ok := properties[name]
+			if !ok {
+				p, ok = s["additionalProperties"]
+			}
+			if !ok {
+				return fmt.Errorf("%s has undocumented property %s", at, name)
+			}
+			if err := validate(doc, p, value, at+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		a, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s is %T, want an array", at, v)
+		}
+		for i, item := range a {
+			if err := validate(doc, s["items"], item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s is %T, want a string", at, v)
+		}
+		if s["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				return fmt.Errorf("%s is not a date-time: %w", at, err)
+			}
+		}
+	case "integer":
+		n, ok := v.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s is %v, want an integer", at, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s is %T, want a number", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s is %T, want a boolean", at, v)
+		}
+	}
+	return nil
+}
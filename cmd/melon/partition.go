@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"melon/internal/partition"
+	"melon/internal/service"
+	"net/http"
+	"time"
+)
+
+const rebalanceTimeout = 5 * time.Minute
+
+// routeToOwner serves a key request locally if this node owns the key and
+// proxies it to the owner otherwise.
+func routeToOwner(c *gin.Context) {
+	if !partition.Enabled() || c.GetHeader(partition.ForwardedHeader) != "" {
+		c.Next()
+		return
+	}
+	_, addr, local := partition.Owner(partition.PlacementKey(c.Param("ns"), c.Param("key")))
+	if local {
+		c.Next()
+		return
+	}
+	if err := partition.Forward(c.Writer, c.Request, addr); err != nil {
+		abortWithError(c, http.StatusBadGateway, err.Error())
+		return
+	}
+	c.Abort()
+}
+
+// ownedElsewhere reports, for the protocols that do not forward requests,
+// the node that owns key if it is not this one.
+func ownedElsewhere(ns, key string) error {
+	if !partition.Enabled() {
+		return nil
+	}
+	if id, addr, local := partition.Owner(partition.PlacementKey(ns, key)); !local {
+		return fmt.Errorf("key %q is owned by node %s at %s", key, id, addr)
+	}
+	return nil
+}
+
+func registerPartitionRoutes(r gin.IRoutes) {
+	r.GET("/v1/partition/ring", partitionRingHandler)
+	r.POST("/v1/partition/nodes", partitionJoinHandler)
+	r.DELETE("/v1/partition/nodes/:id", partitionLeaveHandler)
+	r.POST("/v1/partition/rebalance", partitionRebalanceHandler)
+	r.PUT(partition.ImportPath, requireLeader, partitionImportHandler)
+}
+
+func partitionRingHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"self":  partition.Self(),
+		"nodes": partition.Nodes(),
+	})
+}
+
+// partitionJoinHandler adds a node to the ring on every node, then has each
+// of them move the keys the new node now owns.
+func partitionJoinHandler(c *gin.Context) {
+	var node struct {
+		ID   string `json:"id" binding:"required"`
+		Addr string `json:"addr" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&node); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	partition.Join(node.ID, node.Addr)
+	if c.GetHeader(partition.ForwardedHeader) == "" {
+		body, _ := json.Marshal(node)
+		err := partition.Broadcast(c.Request.Context(), partition.Nodes(), http.MethodPost, "/v1/partition/nodes", body)
+		if err != nil {
+			abortWithError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	go rebalance()
+	partitionRingHandler(c)
+}
+
+// partitionLeaveHandler removes a node from the ring on every node,
+// including the leaving node, which then hands all of its keys over.
+func partitionLeaveHandler(c *gin.Context) {
+	nodes := partition.Nodes() // Broadcast to the ring as it was, so the leaving node hears too
+	partition.Leave(c.Param("id"))
+	if c.GetHeader(partition.ForwardedHeader) == "" {
+		err := partition.Broadcast(c.Request.Context(), nodes, http.MethodDelete, "/v1/partition/nodes/"+c.Param("id"), nil)
+		if err != nil {
+			abortWithError(c, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+	go rebalance()
+	partitionRingHandler(c)
+}
+
+func partitionRebalanceHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), rebalanceTimeout)
+	defer cancel()
+	moved, err := partition.Rebalance(ctx)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "code": codeInternal, "moved": moved})
+		return
+	}
+	c.JSON(http.StatusOK, map[string]int{"moved": moved})
+}
+
+// partitionImportHandler stores a key moved here by another node's
+// rebalance, with its type, expiry and flags.
+func partitionImportHandler(c *gin.Context) {
+	var k partition.MovedKey
+	if err := c.ShouldBindJSON(&k); err != nil {
+		abortWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := service.Import(c.Request.Context(), k.Namespace, k.Key, k.Value, k.Meta); err != nil {
+		if errors.Is(err, service.ErrorLeased) || errors.Is(err, service.ErrorBadImport) {
+			abortWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		abortWithCommitError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func rebalance() {
+	ctx, cancel := context.WithTimeout(context.Background(), rebalanceTimeout)
+	defer cancel()
+	if _, err := partition.Rebalance(ctx); err != nil {
+		logger.Error("partition rebalance failed", zap.Error(err))
+	}
+}
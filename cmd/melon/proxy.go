@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"melon/internal/metrics"
+	"melon/internal/partition"
+	"melon/internal/proxy"
+	"melon/stability_patterns"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+)
+
+// runProxy is the entry point of "melon proxy": a stateless front end that
+// routes every key to the backend owning it.
+func runProxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	server := serverFlags(fs)
+	logOpts := loggingFlags(fs)
+	traceOpts := tracingFlags(fs)
+	authOpts := authFlags(fs)
+	backends := fs.String("backends", "", "backend melon nodes as id=url,...")
+	workers := fs.Int("workers", 8, "concurrent backend requests per multi-key request")
+	insecure := fs.Bool("insecure", false, "skip verifying the backends' TLS certificates")
+	breakerThreshold := fs.Uint("breaker-threshold", 5, "consecutive failures after which a backend is given a rest")
+	fs.Parse(args)
+
+	if err := setupLogging(logOpts); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	defer logger.Sync()
+	shutdownTracing, err := setupTracing(traceOpts, "melon-proxy")
+	if err != nil {
+		logger.Info("error setting up tracing", zap.String("err", err.Error()))
+		return
+	}
+	defer shutdownTracing(context.Background())
+
+	if err := setupAuth(authOpts); err != nil {
+		logger.Info("error loading credentials", zap.String("err", err.Error()))
+		return
+	}
+	nodes, err := parsePeers(*backends)
+	if err != nil || len(nodes) == 0 {
+		logger.Info("-backends must list at least one id=url")
+		return
+	}
+	client := newClient(*insecure)
+	p := proxy.New(nodes, client, *workers, *breakerThreshold)
+	for id, b := range p.Breakers() {
+		b := b
+		metrics.BreakerState.Set("backend-"+id, func() float64 { return float64(b.State()) })
+	}
+
+	r := newRouter()
+	r.Use(instrument, clientIdentity)
+	r.GET("/metrics", authenticate, requireAdmin, gin.WrapH(promhttp.Handler())) // Key requests are authenticated by the backends
+	r.GET("/healthz", healthzHandler)
+	r.GET("/readyz", proxyReadyzHandler(p))
+	r.GET("/v1/openapi.json", openAPIHandler(r))
+	r.GET("/ping", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"message": "pong",
+		})
+	})
+	forward := proxyForwardHandler(p)
+	r.PUT("/v1/key/:key", forward)
+	r.GET("/v1/key/:key", forward)
+	r.PATCH("/v1/key/:key", forward)
+	r.GET("/v1/key/:key/history", forward)
+	r.POST("/v1/key/:key/incr", forward)
+	r.POST("/v1/key/:key/decr", forward)
+	r.POST("/v1/key/:key/add", forward)
+	r.POST("/v1/key/:key/list/push", forward)
+	r.POST("/v1/key/:key/list/pop", forward)
+	r.GET("/v1/key/:key/list", forward)
+	r.POST("/v1/key/:key/set/add", forward)
+	r.POST("/v1/key/:key/set/remove", forward)
+	r.GET("/v1/key/:key/set", forward)
+	r.PUT("/v1/key/:key/hash", forward)
+	r.GET("/v1/key/:key/hash", forward)
+	r.GET("/v1/key/:key/hash/:field", forward)
+	r.DELETE("/v1/key/:key/hash/:field", forward)
+	r.POST("/v1/key/:key/cas", forward)
+	r.POST("/v1/key/:key/put-if-absent", forward)
+	r.POST("/v1/key/:key/delete-if-value", forward)
+	r.PUT("/v1/key/:key/lease", forward)
+	r.DELETE("/v1/key/:key", forward)
+	r.DELETE("/v1/key/:key/", forward)
+	r.PUT("/v1/ns/:ns/key/:key", forward)
+	r.GET("/v1/ns/:ns/key/:key", forward)
+	r.PATCH("/v1/ns/:ns/key/:key", forward)
+	r.GET("/v1/ns/:ns/key/:key/history", forward)
+	r.POST("/v1/ns/:ns/key/:key/incr", forward)
+	r.POST("/v1/ns/:ns/key/:key/decr", forward)
+	r.POST("/v1/ns/:ns/key/:key/add", forward)
+	r.POST("/v1/ns/:ns/key/:key/list/push", forward)
+	r.POST("/v1/ns/:ns/key/:key/list/pop", forward)
+	r.GET("/v1/ns/:ns/key/:key/list", forward)
+	r.POST("/v1/ns/:ns/key/:key/set/add", forward)
+	r.POST("/v1/ns/:ns/key/:key/set/remove", forward)
+	r.GET("/v1/ns/:ns/key/:key/set", forward)
+	r.PUT("/v1/ns/:ns/key/:key/hash", forward)
+	r.GET("/v1/ns/:ns/key/:key/hash", forward)
+	r.GET("/v1/ns/:ns/key/:key/hash/:field", forward)
+	r.DELETE("/v1/ns/:ns/key/:key/hash/:field", forward)
+	r.POST("/v1/ns/:ns/key/:key/cas", forward)
+	r.POST("/v1/ns/:ns/key/:key/put-if-absent", forward)
+	r.POST("/v1/ns/:ns/key/:key/delete-if-value", forward)
+	r.PUT("/v1/ns/:ns/key/:key/lease", forward)
+	r.DELETE("/v1/ns/:ns/key/:key", forward)
+	r.GET("/v1/keys", proxyGetManyHandler(p))
+	r.PUT("/v1/keys", proxyPutManyHandler(p))
+	logger.Fatal("server stopped", zap.Error(serve(server, r)))
+}
+
+// proxyForwardHandler passes a single-key request through to the owner.
+func proxyForwardHandler(p *proxy.Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, addr, ok := p.Owner(partition.PlacementKey(c.Param("ns"), c.Param("key")))
+		if !ok {
+			abortWithError(c, http.StatusServiceUnavailable, "no backends configured")
+			return
+		}
+		target, err := url.Parse(addr)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		rp := httputil.NewSingleHostReverseProxy(target)
+		rp.Transport = p.Client().Transport
+		c.Request.Header.Set(partition.ForwardedHeader, "proxy")
+		_, err = p.Breakers()[id].Do(c.Request.Context(), func(context.Context) (string, error) {
+			var failure error
+			rp.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+				failure = err
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			rp.ModifyResponse = func(resp *http.Response) error {
+				if resp.StatusCode >= 500 {
+					failure = fmt.Errorf("backend responded %s", resp.Status)
+				}
+				return nil
+			}
+			rp.ServeHTTP(c.Writer, c.Request)
+			return "", failure
+		})
+		if errors.Is(err, stability_patterns.ErrorServiceUnreachable) {
+			abortWithError(c, http.StatusServiceUnavailable, "backend "+id+" is unavailable")
+		}
+	}
+}
+
+// proxyGetManyHandler serves GET /v1/keys?key=a&key=b by reading every key
+// from its backend concurrently.
+func proxyGetManyHandler(p *proxy.Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys := c.QueryArray("key")
+		if len(keys) == 0 {
+			abortWithError(c, http.StatusBadRequest, "at least one key is required")
+			return
+		}
+		results, err := p.GetMany(c.Request.Context(), keys, c.GetHeader("Authorization"))
+		if err != nil {
+			abortWithError(c, http.StatusGatewayTimeout, err.Error())
+			return
+		}
+		values := make(map[string]string)
+		missing := make([]string, 0)
+		errs := make(map[string]string)
+		for _, r := range results {
+			switch {
+			case r.Err != nil:
+				errs[r.Value.Key] = r.Err.Error()
+			case r.Value.Found:
+				values[r.Value.Key] = r.Value.Value
+			default:
+				missing = append(missing, r.Value.Key)
+			}
+		}
+		sort.Strings(missing)
+		status := http.StatusOK
+		if len(errs) > 0 {
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, map[string]interface{}{
+			"values":  values,
+			"missing": missing,
+			"errors":  errs,
+		})
+	}
+}
+
+// proxyPutManyHandler serves PUT /v1/keys with a JSON object of keys to
+// values, writing each to its backend concurrently.
+func proxyPutManyHandler(p *proxy.Proxy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		values := make(map[string]string)
+		if err := c.ShouldBindJSON(&values); err != nil {
+			abortWithError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		results, err := p.PutMany(c.Request.Context(), values, c.GetHeader("Authorization"))
+		if err != nil {
+			abortWithError(c, http.StatusGatewayTimeout, err.Error())
+			return
+		}
+		written := make([]string, 0, len(results))
+		errs := make(map[string]string)
+		for _, r := range results {
+			if r.Err != nil {
+				errs[r.Value.Key] = r.Err.Error()
+			} else {
+				written = append(written, r.Value.Key)
+			}
+		}
+		sort.Strings(written)
+		status := http.StatusCreated
+		if len(errs) > 0 {
+			status = http.StatusBadGateway
+		}
+		c.JSON(status, map[string]interface{}{
+			"written": written,
+			"errors":  errs,
+		})
+	}
+}
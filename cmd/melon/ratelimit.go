@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"melon/stability_patterns"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// limiter throttles key requests per client; nil leaves them unlimited.
+var limiter *stability_patterns.KeyedThrottle
+
+// rateLimitKey picks the bucket a request is charged to.
+var rateLimitKey func(c *gin.Context) string
+
+// rateLimitByIP is set when buckets are picked without the principal, so
+// requests are charged before authenticating and failed attempts count too.
+var rateLimitByIP bool
+
+// setupRateLimit allows each client burst requests at once, refilling at
+// rate requests per second. by chooses what identifies a client: "ip",
+// "principal" (the API token's or certificate's owner, falling back to the
+// IP for anonymous requests) or "namespace" (charging requests to the
+// default namespace as "principal" does).
+func setupRateLimit(rate float64, burst uint, by string, maxClients int) error {
+	if rate <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval <= 0 || math.IsNaN(rate) {
+		return fmt.Errorf("-rate-limit %g is more than one request per nanosecond", rate)
+	}
+	switch by {
+	case "ip":
+		rateLimitKey = func(c *gin.Context) string { return c.ClientIP() }
+		rateLimitByIP = true
+	case "principal":
+		rateLimitKey = principalBucket
+	case "namespace":
+		rateLimitKey = func(c *gin.Context) string {
+			if ns := c.Param("ns"); ns != "" {
+				return "namespace:" + ns
+			}
+			return principalBucket(c)
+		}
+	default:
+		return fmt.Errorf("unknown -rate-limit-by %q, expected ip, principal or namespace", by)
+	}
+	if burst == 0 {
+		burst = uint(math.Ceil(rate))
+	}
+	limiter = stability_patterns.NewKeyedThrottle(burst, 1, interval, maxClients)
+	return nil
+}
+
+// principalBucket charges a request to its principal, or to its IP when
+// anonymous.
+func principalBucket(c *gin.Context) string {
+	if principal := c.GetString(principalKey); principal != "" {
+		return "principal:" + principal
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// rateLimitBeforeAuth charges requests when limiting by IP. It goes before
+// authenticate, so that requests failing authentication are limited too.
+func rateLimitBeforeAuth(c *gin.Context) {
+	if limiter == nil || !rateLimitByIP {
+		c.Next()
+		return
+	}
+	charge(c)
+}
+
+// rateLimit charges requests when limiting by principal or namespace, once
+// authenticate has found the principal.
+func rateLimit(c *gin.Context) {
+	if limiter == nil || rateLimitByIP {
+		c.Next()
+		return
+	}
+	charge(c)
+}
+
+// charge rejects requests from clients that have used up their tokens,
+// telling them when to retry.
+func charge(c *gin.Context) {
+	ok, wait := limiter.Allow(rateLimitKey(c))
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		abortWithError(c, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+	c.Next()
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSetupRateLimitRejectsRatesAboveOnePerNanosecond(t *testing.T) {
+	t.Cleanup(func() { limiter, rateLimitKey, rateLimitByIP = nil, nil, false })
+	for _, rate := range []float64{2e9, math.Inf(1), math.NaN()} {
+		if err := setupRateLimit(rate, 0, "ip", 10); err == nil {
+			t.Errorf("accepted a rate of %g", rate)
+		}
+	}
+	if err := setupRateLimit(1e9, 0, "ip", 10); err != nil {
+		t.Errorf("rejected one request per nanosecond: %v", err)
+	}
+}
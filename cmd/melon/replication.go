@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"melon/internal/replication"
+	"net/http"
+	"strconv"
+)
+
+// requireLeader rejects writes on a follower, pointing the client at the
+// leader instead.
+func requireLeader(c *gin.Context) {
+	if replication.IsLeader() {
+		c.Next()
+		return
+	}
+	body := errorBody(codeNotLeader, "this node is a read-only follower")
+	body["leader"] = replication.Leader()
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, body)
+}
+
+// replicationEventsHandler streams the transaction log from the sequence
+// number given by ?from= and keeps the connection open for new events.
+func replicationEventsHandler(c *gin.Context) {
+	from, err := strconv.ParseUint(c.DefaultQuery("from", "1"), 10, 64)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid from")
+		return
+	}
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	err = replication.Stream(c.Request.Context(), from, c.Writer, c.Writer.Flush)
+	if err != nil && c.Request.Context().Err() == nil {
+		c.Error(err)
+	}
+}
+
+func replicationStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, replication.CurrentStatus())
+}
+
+// replicationPromoteHandler turns a follower into a leader. The old leader is
+// not told; it is up to the operator to fence it off first.
+func replicationPromoteHandler(c *gin.Context) {
+	err := replication.Promote()
+	if errors.Is(err, replication.ErrorNotFollower) {
+		abortWithError(c, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, replication.CurrentStatus())
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"melon/internal/replication"
+	"melon/internal/service"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The replication test runs its follower as a second process, since a node's
+// store is global to the process. These are set in the follower's
+// environment.
+const (
+	followerLeaderEnv = "MELON_TEST_FOLLOW"
+	followerLogEnv    = "MELON_TEST_FOLLOWER_LOG"
+)
+
+func TestMain(m *testing.M) {
+	if leader := os.Getenv(followerLeaderEnv); leader != "" {
+		runFollower(leader, os.Getenv(followerLogEnv))
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runFollower serves the API as a follower of leader, logging to logFile,
+// and prints the URL it serves on. It returns once stdin is closed.
+func runFollower(leader, logFile string) {
+	gin.SetMode(gin.TestMode)
+	if err := service.InitializeTransactionLog(logFile); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	replication.Follow(leader, http.DefaultClient)
+	close(started)
+	r := newRouter()
+	registerRoutes(r, false, false)
+	srv := httptest.NewServer(r)
+	fmt.Println("serving on", srv.URL)
+	io.Copy(io.Discard, os.Stdin)
+}
+
+// follower is a follower process started by startFollower.
+type follower struct {
+	url  string
+	stop func() // Kills the process, as a crash would
+}
+
+func startFollower(t *testing.T, leader, logFile string) follower {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), followerLeaderEnv+"="+leader, followerLogEnv+"="+logFile)
+	cmd.Stderr = os.Stderr
+	if _, err := cmd.StdinPipe(); err != nil { // Left open until the process is killed
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			cmd.Process.Kill()
+			cmd.Wait()
+		})
+	}
+	t.Cleanup(stop)
+
+	urls := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "serving on ") {
+				urls <- strings.TrimPrefix(line, "serving on ")
+			}
+		}
+	}()
+	select {
+	case url := <-urls:
+		return follower{url: url, stop: stop}
+	case <-time.After(10 * time.Second):
+		t.Fatal("follower did not start")
+		return follower{}
+	}
+}
+
+// eventually fails the test unless f reports true within a few seconds.
+func eventually(t *testing.T, what string, f func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !f(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func request(t *testing.T, method, url, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+// holds reports whether key reads as value at the node at url.
+func holds(t *testing.T, url, key, value string) bool {
+	status, body := request(t, http.MethodGet, url+"/v1/key/"+key, "")
+	return status == http.StatusOK && body == value
+}
+
+func TestReplication(t *testing.T) {
+	router := contractRouter(t)
+	var mu sync.Mutex
+	var froms []string // The ?from= of every replication stream requested
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/replication/events" {
+			mu.Lock()
+			froms = append(froms, r.URL.Query().Get("from"))
+			mu.Unlock()
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(leader.Close) // After the followers stop, as it waits for their streams to end
+	request(t, http.MethodPut, leader.URL+"/v1/key/replicated-a", "1")
+	request(t, http.MethodPut, leader.URL+"/v1/key/replicated-b", "2")
+
+	logFile := filepath.Join(t.TempDir(), "follower.log")
+	f := startFollower(t, leader.URL, logFile)
+	eventually(t, "the follower to catch up", func() bool {
+		return holds(t, f.url, "replicated-a", "1") && holds(t, f.url, "replicated-b", "2")
+	})
+
+	status, body := request(t, http.MethodPut, f.url+"/v1/key/replicated-c", "x")
+	if status != http.StatusServiceUnavailable || !strings.Contains(body, codeNotLeader) {
+		t.Errorf("write to the follower got %d %s, want %d %s", status, body, http.StatusServiceUnavailable, codeNotLeader)
+	}
+	if status, _ := request(t, http.MethodGet, leader.URL+"/v1/key/replicated-c", ""); status != http.StatusNotFound {
+		t.Errorf("write refused by the follower reached the leader: %d", status)
+	}
+
+	// Stop the follower once it has logged everything, as a crash would.
+	var applied uint64
+	eventually(t, "the follower to apply every event", func() bool {
+		_, body := request(t, http.MethodGet, f.url+"/v1/replication/status", "")
+		var s replication.Status
+		if err := json.Unmarshal([]byte(body), &s); err != nil {
+			t.Fatal(err)
+		}
+		applied = s.LastSequence
+		return applied == service.LastSequence()
+	})
+	eventually(t, "the follower to log every event", func() bool {
+		data, _ := os.ReadFile(logFile)
+		lines := bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n"))
+		return bytes.HasPrefix(lines[len(lines)-1], []byte(strconv.FormatUint(applied, 10)+"\t"))
+	})
+	f.stop()
+	mu.Lock()
+	restarted := len(froms)
+	mu.Unlock()
+
+	request(t, http.MethodPut, leader.URL+"/v1/key/replicated-c", "3")
+	f = startFollower(t, leader.URL, logFile)
+	eventually(t, "the restarted follower to catch up", func() bool {
+		return holds(t, f.url, "replicated-c", "3")
+	})
+	if !holds(t, f.url, "replicated-a", "1") {
+		t.Error("the restarted follower lost what it had replicated")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := strconv.FormatUint(applied+1, 10); froms[restarted] != want {
+		t.Errorf("restarted follower asked for events from %s, want %s", froms[restarted], want)
+	}
+}
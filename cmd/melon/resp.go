@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"melon/internal/metrics"
+	"melon/internal/raft"
+	"melon/internal/replication"
+	"melon/internal/service"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Redis protocol listener serves a subset of Redis's commands from the
+// default namespace, so that redis-cli and Redis client libraries work
+// against melon. Writes go through service.Commit like any other.
+
+const (
+	respMaxBulk          = 64 << 20 // Longest bulk string accepted, in bytes
+	respMaxArray         = 1 << 20  // Most arguments accepted in one command
+	respMaxUnauthedBulk  = 16 << 10 // respMaxBulk before the client has authenticated, as Redis
+	respMaxUnauthedArray = 10       // respMaxArray before the client has authenticated, as Redis
+	respMaxInline        = 64 << 10 // Longest line accepted, inline command or header
+)
+
+// errRESPProtocol is a malformed request; the connection is closed after
+// replying to it.
+var errRESPProtocol = errors.New("protocol error")
+
+// serveRESP runs the Redis protocol listener on addr until it fails, with
+// the same TLS settings as the HTTP API.
+func serveRESP(o *serverOptions, addr string) error {
+	lis, err := o.listen(addr)
+	if err != nil {
+		return err
+	}
+	logger.Info("serving the Redis protocol", zap.String("addr", addr))
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go newRESPConn(conn).serve()
+	}
+}
+
+// respConn is one client connection.
+type respConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	log       *zap.Logger
+	principal string
+	authed    bool // The client is known, or authentication is off
+}
+
+func newRESPConn(conn net.Conn) *respConn {
+	return &respConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+		log:  logger.With(zap.String("conn_id", newRequestID()), zap.String("client_ip", conn.RemoteAddr().String())),
+	}
+}
+
+func (c *respConn) serve() {
+	defer c.conn.Close()
+	if tc, ok := c.conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			c.log.Debug("TLS handshake failed", zap.Error(err))
+			return
+		}
+	}
+	c.authenticate("")
+	for {
+		args, err := c.readCommand()
+		if errors.Is(err, errRESPProtocol) {
+			c.writeError("ERR " + err.Error())
+			c.w.Flush()
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				c.log.Debug("connection closed", zap.Error(err))
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := c.dispatch(args)
+		if c.r.Buffered() == 0 || quit { // Pipelined commands are answered together
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// authenticate identifies the client from token, or from its certificate
+// when token is empty.
+func (c *respConn) authenticate(token string) error {
+	if authenticator == nil {
+		c.authed = true
+		return nil
+	}
+	principal, err := authenticateNetConn(c.conn, token)
+	if err != nil {
+		return err
+	}
+	c.principal, c.authed = principal, true
+	return nil
+}
+
+// readCommand reads a command sent as an array of bulk strings, as client
+// libraries do, or inline as words on a line, as typed into telnet. Until
+// the client authenticates, commands are held to a few short arguments, and
+// a bulk string's buffer only grows as its bytes arrive, so that an unknown
+// client cannot make the server allocate much.
+func (c *respConn) readCommand() ([]string, error) {
+	line, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	maxArray, maxBulk := respMaxArray, respMaxBulk
+	if !c.authed {
+		maxArray, maxBulk = respMaxUnauthedArray, respMaxUnauthedBulk
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArray {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	var args []string
+	for i := 0; i < n; i++ {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		var b bytes.Buffer
+		if _, err := io.CopyN(&b, c.r, int64(size)+2); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if !bytes.HasSuffix(b.Bytes(), []byte("\r\n")) {
+			return nil, fmt.Errorf("%w: bulk string not terminated", errRESPProtocol)
+		}
+		args = append(args, string(b.Bytes()[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads one line of at most respMaxInline bytes.
+func (c *respConn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > respMaxInline {
+			return "", fmt.Errorf("%w: too big inline request", errRESPProtocol)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+func (c *respConn) writeSimple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respConn) writeError(s string) {
+	c.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (c *respConn) writeInt(n int64) {
+	c.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (c *respConn) writeBulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respConn) writeNil() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respConn) writeArrayLen(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *respConn) writeStrings(values []string) {
+	c.writeArrayLen(len(values))
+	for _, v := range values {
+		c.writeBulk(v)
+	}
+}
+
+// respCommand is a command handler. arity is the number of arguments
+// including the command name, or its negation for a minimum, as in Redis.
+type respCommand struct {
+	arity int
+	write bool // Served only by the leader
+	run   func(ctx context.Context, c *respConn, args []string) error
+}
+
+var respCommands = map[string]respCommand{
+	"PING":        {-1, false, respPing},
+	"ECHO":        {2, false, respEcho},
+	"QUIT":        {1, false, respQuit},
+	"AUTH":        {-2, false, respAuth},
+	"SELECT":      {2, false, respSelect},
+	"COMMAND":     {-1, false, respCommandList},
+	"GET":         {2, false, respGet},
+	"MGET":        {-2, false, respMGet},
+	"EXISTS":      {-2, false, respExists},
+	"TTL":         {2, false, respTTL},
+	"PTTL":        {2, false, respTTL},
+	"KEYS":        {2, false, respKeys},
+	"SCAN":        {-2, false, respScan},
+	"SET":         {-3, true, respSet},
+	"MSET":        {-3, true, respMSet},
+	"DEL":         {-2, true, respDel},
+	"INCR":        {2, true, respIncr},
+	"DECR":        {2, true, respIncr},
+	"INCRBY":      {3, true, respIncr},
+	"DECRBY":      {3, true, respIncr},
+	"INCRBYFLOAT": {3, true, respIncrByFloat},
+}
+
+// dispatch runs one command and reports whether the connection should close.
+func (c *respConn) dispatch(args []string) bool {
+	name := strings.ToUpper(args[0])
+	cmd, ok := respCommands[name]
+	if !ok {
+		c.writeError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		metrics.RESPCommandsTotal.WithLabelValues("unknown", "error").Inc()
+		return false
+	}
+	if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+		c.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		metrics.RESPCommandsTotal.WithLabelValues(name, "error").Inc()
+		return false
+	}
+	if !c.authed && name != "AUTH" && name != "PING" && name != "QUIT" {
+		c.writeError("NOAUTH Authentication required.")
+		metrics.RESPCommandsTotal.WithLabelValues(name, "error").Inc()
+		return false
+	}
+	if cmd.write && !replication.IsLeader() {
+		c.writeError("READONLY You can't write against a read only replica. The leader is " + replication.Leader())
+		metrics.RESPCommandsTotal.WithLabelValues(name, "error").Inc()
+		return false
+	}
+
+	ctx, span := httpTracer.Start(context.Background(), "RESP "+name, trace.WithSpanKind(trace.SpanKindServer))
+	err := cmd.run(ctx, c, args)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		c.writeError(respError(err))
+		if respInternal(err) {
+			c.log.Warn("command failed", zap.String("command", name), zap.Error(err))
+		}
+		metrics.RESPCommandsTotal.WithLabelValues(name, "error").Inc()
+	} else {
+		metrics.RESPCommandsTotal.WithLabelValues(name, "ok").Inc()
+	}
+	span.End()
+	return name == "QUIT" && err == nil
+}
+
+// respReplyError is an error reply already in Redis's form, with its prefix.
+type respReplyError string
+
+func (e respReplyError) Error() string {
+	return string(e)
+}
+
+var errRESPSyntax = respReplyError("ERR syntax error")
+
+// respError renders err as a Redis error reply.
+func respError(err error) string {
+	var reply respReplyError
+	var notLeader *raft.NotLeaderError
+	switch {
+	case errors.As(err, &reply):
+		return string(reply)
+	case errors.As(err, &notLeader):
+		return "READONLY " + err.Error()
+	case errors.Is(err, service.ErrorReadOnly):
+		return "READONLY " + err.Error()
+	case errors.Is(err, service.ErrorQuotaExceeded):
+		return "OOM " + err.Error()
+	case errors.Is(err, service.ErrorNotANumber):
+		return "ERR value is not a valid number"
+	case errors.Is(err, service.ErrorOverflow):
+		return "ERR increment or decrement would overflow"
+	}
+	return "ERR " + err.Error()
+}
+
+func respInternal(err error) bool {
+	var reply respReplyError
+	var notLeader *raft.NotLeaderError
+	return !errors.As(err, &reply) && !errors.As(err, &notLeader) &&
+		!errors.Is(err, service.ErrorReadOnly) && !errors.Is(err, service.ErrorQuotaExceeded) &&
+		!errors.Is(err, service.ErrorNotANumber) && !errors.Is(err, service.ErrorOverflow)
+}
+
+// check makes sure the client holds p on key and that this node owns it.
+func (c *respConn) check(key string, p service.Permission) error {
+	if !permitted(c.principal, service.DefaultNamespace, key, p) {
+		return respReplyError(fmt.Sprintf("NOPERM %s lacks %q permission on key %q", c.principal, p, key))
+	}
+	if err := ownedElsewhere(service.DefaultNamespace, key); err != nil {
+		return respReplyError("ERR " + err.Error())
+	}
+	return nil
+}
+
+func respPing(_ context.Context, c *respConn, args []string) error {
+	switch len(args) {
+	case 1:
+		c.writeSimple("PONG")
+	case 2:
+		c.writeBulk(args[1])
+	default:
+		return respReplyError("ERR wrong number of arguments for 'ping' command")
+	}
+	return nil
+}
+
+func respEcho(_ context.Context, c *respConn, args []string) error {
+	c.writeBulk(args[1])
+	return nil
+}
+
+func respQuit(_ context.Context, c *respConn, _ []string) error {
+	c.writeSimple("OK")
+	return nil
+}
+
+// respAuth takes a token, optionally after a user name, which is ignored:
+// the token alone identifies the principal.
+func respAuth(_ context.Context, c *respConn, args []string) error {
+	if len(args) > 3 {
+		return errRESPSyntax
+	}
+	if authenticator == nil {
+		return respReplyError("ERR AUTH called without any credentials configured")
+	}
+	if err := c.authenticate(args[len(args)-1]); err != nil {
+		return respReplyError("WRONGPASS invalid token")
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// respSelect accepts only database 0, the default namespace, which clients
+// often select on connecting.
+func respSelect(_ context.Context, c *respConn, args []string) error {
+	if args[1] != "0" {
+		return respReplyError("ERR DB index is out of range")
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// respCommandList answers redis-cli's startup COMMAND DOCS with nothing,
+// so it falls back to plain input.
+func respCommandList(_ context.Context, c *respConn, _ []string) error {
+	c.writeArrayLen(0)
+	return nil
+}
+
+func respGet(ctx context.Context, c *respConn, args []string) error {
+	if err := c.check(args[1], service.PermissionRead); err != nil {
+		return err
+	}
+	value, err := service.GetIn(ctx, service.DefaultNamespace, args[1])
+	if errors.Is(err, service.ErrorNoSuchKey) {
+		c.writeNil()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c.writeBulk(value)
+	return nil
+}
+
+func respMGet(ctx context.Context, c *respConn, args []string) error {
+	for _, key := range args[1:] {
+		if err := c.check(key, service.PermissionRead); err != nil {
+			return err
+		}
+	}
+	values := make([]*string, 0, len(args)-1)
+	for _, key := range args[1:] {
+		value, err := service.GetIn(ctx, service.DefaultNamespace, key)
+		if errors.Is(err, service.ErrorNoSuchKey) {
+			values = append(values, nil)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		values = append(values, &value)
+	}
+	c.writeArrayLen(len(values))
+	for _, v := range values {
+		if v == nil {
+			c.writeNil()
+		} else {
+			c.writeBulk(*v)
+		}
+	}
+	return nil
+}
+
+// respExists counts the keys that exist, counting a key named twice twice.
+func respExists(ctx context.Context, c *respConn, args []string) error {
+	var n int64
+	for _, key := range args[1:] {
+		if err := c.check(key, service.PermissionRead); err != nil {
+			return err
+		}
+		if _, err := service.GetIn(ctx, service.DefaultNamespace, key); err == nil {
+			n++
+		}
+	}
+	c.writeInt(n)
+	return nil
+}
+
+// respTTL answers TTL in seconds and PTTL in milliseconds: -2 for a missing
+// key and -1 for one that does not expire.
+func respTTL(ctx context.Context, c *respConn, args []string) error {
+	if err := c.check(args[1], service.PermissionRead); err != nil {
+		return err
+	}
+	_, meta, err := service.GetWithMeta(ctx, service.DefaultNamespace, args[1])
+	switch {
+	case errors.Is(err, service.ErrorNoSuchKey):
+		c.writeInt(-2)
+	case err != nil:
+		return err
+	case meta.ExpiresAt.IsZero():
+		c.writeInt(-1)
+	case strings.EqualFold(args[0], "PTTL"):
+		c.writeInt(time.Until(meta.ExpiresAt).Milliseconds())
+	default:
+		c.writeInt(int64((time.Until(meta.ExpiresAt) + time.Second/2) / time.Second))
+	}
+	return nil
+}
+
+// respKeys lists the keys matching a glob pattern that the client may read.
+// When partitioned, only the keys this node owns are listed.
+func respKeys(_ context.Context, c *respConn, args []string) error {
+	c.writeStrings(c.matchingKeys(args[1], service.Keys(service.DefaultNamespace, globPrefix(args[1]))))
+	return nil
+}
+
+func (c *respConn) matchingKeys(pattern string, keys []string) []string {
+	matched := make([]string, 0)
+	for _, k := range keys {
+		if globMatch(pattern, k) && permitted(c.principal, service.DefaultNamespace, k, service.PermissionRead) {
+			matched = append(matched, k)
+		}
+	}
+	return matched
+}
+
+// respScan pages through the keys in order. The cursor is a position in
+// the sorted keys, so a key deleted between calls can make the next page
+// skip one that was present throughout.
+func respScan(_ context.Context, c *respConn, args []string) error {
+	cursor, err := strconv.Atoi(args[1])
+	if err != nil || cursor < 0 {
+		return respReplyError("ERR invalid cursor")
+	}
+	pattern, count, typ := "*", 10, "string"
+	for i := 2; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errRESPSyntax
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return errRESPSyntax
+			}
+		case "TYPE":
+			typ = strings.ToLower(args[i+1])
+		default:
+			return errRESPSyntax
+		}
+	}
+	keys := service.Keys(service.DefaultNamespace, globPrefix(pattern))
+	if cursor > len(keys) {
+		cursor = len(keys)
+	}
+	end := cursor + count
+	if end >= len(keys) {
+		end = 0
+	}
+	page := keys[cursor:]
+	if end != 0 {
+		page = keys[cursor:end]
+	}
+	matched := c.matchingKeys(pattern, page)
+	if typ != "string" {
+		matched = nil // Every value is a string
+	}
+	c.writeArrayLen(2)
+	c.writeBulk(strconv.Itoa(end))
+	c.writeStrings(matched)
+	return nil
+}
+
+// respSet supports the EX and PX options, which set an expiry in seconds or
+// milliseconds. Without either, SET clears any expiry the key had.
+func respSet(ctx context.Context, c *respConn, args []string) error {
+	key, value := args[1], args[2]
+	var expires time.Time
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(args[i])
+		if (opt != "EX" && opt != "PX") || i+1 >= len(args) || !expires.IsZero() {
+			return errRESPSyntax
+		}
+		n, err := strconv.ParseInt(args[i+1], 10, 64)
+		if err != nil || n <= 0 {
+			return respReplyError("ERR invalid expire time in 'set' command")
+		}
+		unit := time.Second
+		if opt == "PX" {
+			unit = time.Millisecond
+		}
+		expires = time.Now().Add(time.Duration(n) * unit)
+		i++
+	}
+	if err := c.check(key, service.PermissionWrite); err != nil {
+		return err
+	}
+	if err := service.PutWithExpiry(ctx, service.DefaultNamespace, key, value, expires); err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// respMSet sets every key with no other write landing in between.
+func respMSet(ctx context.Context, c *respConn, args []string) error {
+	if len(args)%2 == 0 {
+		return respReplyError("ERR wrong number of arguments for 'mset' command")
+	}
+	ops := make([]service.TxnOp, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		if err := c.check(args[i], service.PermissionWrite); err != nil {
+			return err
+		}
+		ops = append(ops, service.TxnOp{Type: service.TxnPut, Namespace: service.DefaultNamespace, Key: args[i], Value: args[i+1]})
+	}
+	if _, _, err := service.Txn(ctx, nil, ops, nil); err != nil {
+		return err
+	}
+	c.writeSimple("OK")
+	return nil
+}
+
+// respDel deletes the keys and counts those that existed.
+func respDel(ctx context.Context, c *respConn, args []string) error {
+	ops := make([]service.TxnOp, 0, len(args)-1)
+	for _, key := range args[1:] {
+		if err := c.check(key, service.PermissionDelete); err != nil {
+			return err
+		}
+		ops = append(ops, service.TxnOp{Type: service.TxnDelete, Namespace: service.DefaultNamespace, Key: key})
+	}
+	_, results, err := service.Txn(ctx, nil, ops, nil)
+	if err != nil {
+		return err
+	}
+	var n int64
+	for _, r := range results {
+		if r.Found {
+			n++
+		}
+	}
+	c.writeInt(n)
+	return nil
+}
+
+// respIncr serves INCR, DECR, INCRBY and DECRBY.
+func respIncr(ctx context.Context, c *respConn, args []string) error {
+	by := int64(1)
+	if len(args) == 3 {
+		var err error
+		if by, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+			return respReplyError("ERR value is not an integer or out of range")
+		}
+	}
+	if name := strings.ToUpper(args[0]); name == "DECR" || name == "DECRBY" {
+		if by == math.MinInt64 {
+			return respReplyError("ERR decrement would overflow")
+		}
+		by = -by
+	}
+	if err := c.check(args[1], service.PermissionWrite); err != nil {
+		return err
+	}
+	n, err := service.Incr(ctx, service.DefaultNamespace, args[1], by)
+	if err != nil {
+		return err
+	}
+	c.writeInt(n)
+	return nil
+}
+
+func respIncrByFloat(ctx context.Context, c *respConn, args []string) error {
+	if err := c.check(args[1], service.PermissionWrite); err != nil {
+		return err
+	}
+	sum, err := service.AddFloat(ctx, service.DefaultNamespace, args[1], args[2])
+	if errors.Is(err, service.ErrorBadAmount) {
+		return respReplyError("ERR value is not a valid float")
+	}
+	if err != nil {
+		return err
+	}
+	c.writeBulk(sum)
+	return nil
+}
+
+// globPrefix returns the literal start of a glob pattern, which every
+// matching key begins with.
+func globPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// globMatch matches s against a Redis style glob pattern: * matches any
+// run of bytes, ? any one byte, [abc], [^abc] and [a-z] one byte from a
+// class, and \ escapes the byte after it.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0 // Where the pattern resumes after the last *, and where in s it last did
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			for p < len(pattern) && pattern[p] == '*' {
+				p++
+			}
+			star, mark = p, i
+			continue
+		}
+		if p < len(pattern) {
+			if width, ok := globMatchByte(pattern[p:], s[i]); ok {
+				p, i = p+width, i+1
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		mark++ // Let the last * swallow one more byte and try again
+		p, i = star, mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// globMatchByte matches b against the element pattern starts with, other
+// than *, and returns how many bytes of pattern that element takes.
+func globMatchByte(pattern string, b byte) (int, bool) {
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			return 1, b == '[' // An unclosed [ is literal
+		}
+		return end + 2, matchClass(pattern[1:end+1], b)
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == b
+		}
+	}
+	return 1, pattern[0] == b
+}
+
+func matchClass(class string, b byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (b >= lo && b <= hi)
+			i += 2
+			continue
+		}
+		matched = matched || class[i] == b
+	}
+	return matched != negate
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"melon/internal/auth"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respClient connects a client to a new RESP connection over a pipe.
+func respClient(t *testing.T) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	startService(t)
+	client, server := net.Pipe()
+	go newRESPConn(server).serve()
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, bufio.NewReader(client)
+}
+
+// requireAuth turns token authentication on for the test, with token
+// belonging to admin principal alice.
+func requireAuth(t *testing.T) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(file, []byte("token alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.NewTokenAuthenticator(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator, admins["alice"] = a, true
+	t.Cleanup(func() {
+		authenticator = nil
+		delete(admins, "alice")
+	})
+}
+
+// send writes s from its own goroutine, as a pipe blocks the writer until
+// the server reads, and the server may first want its replies read.
+func send(conn net.Conn, s string) {
+	go conn.Write([]byte(s))
+}
+
+// expectLines reads a line for every one of want and compares them.
+func expectLines(t *testing.T, r *bufio.Reader, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading %q: %v", w, err)
+		}
+		if got := strings.TrimRight(line, "\r\n"); got != w {
+			t.Fatalf("got %q, want %q", got, w)
+		}
+	}
+}
+
+func TestRESPPipelinedCommands(t *testing.T) {
+	conn, r := respClient(t)
+	send(conn, "*3\r\n$3\r\nSET\r\n$6\r\nresp-a\r\n$5\r\nhello\r\n"+
+		"*2\r\n$3\r\nGET\r\n$6\r\nresp-a\r\n"+
+		"PING\r\n"+
+		"*2\r\n$6\r\nEXISTS\r\n$12\r\nresp-missing\r\n")
+	expectLines(t, r, "+OK", "$5", "hello", "+PONG", ":0")
+}
+
+func TestRESPLimitsUnauthenticatedClients(t *testing.T) {
+	requireAuth(t)
+	for name, request := range map[string]string{
+		"arguments":   "*11\r\n",
+		"bulk string": "*2\r\n$4\r\nAUTH\r\n$16385\r\n",
+		"inline":      strings.Repeat("a", respMaxInline+1) + "\r\n",
+	} {
+		conn, r := respClient(t)
+		send(conn, request)
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "-ERR protocol error") {
+			t.Errorf("%s: got %q %v, want a protocol error", name, line, err)
+		}
+	}
+
+	conn, r := respClient(t)
+	value := strings.Repeat("v", respMaxUnauthedBulk+1)
+	send(conn, "*2\r\n$4\r\nAUTH\r\n$5\r\ntoken\r\n"+
+		"*3\r\n$3\r\nSET\r\n$6\r\nresp-b\r\n$16385\r\n"+value+"\r\n")
+	expectLines(t, r, "+OK", "+OK")
+}
+
+func TestRESPRejectsCommandsBeforeAuth(t *testing.T) {
+	requireAuth(t)
+	conn, r := respClient(t)
+	send(conn, "*2\r\n$3\r\nGET\r\n$6\r\nresp-a\r\nPING\r\n")
+	expectLines(t, r, "-NOAUTH Authentication required.", "+PONG")
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"a*", "abc", true},
+		{"*c", "abc", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"a[bx]c", "abc", true},
+		{"a[^b]c", "abc", false},
+		{"a[a-c]c", "abc", true},
+		{"a[b", "a[b", true},
+		{`a\*c`, "a*c", true},
+		{`a\*c`, "abc", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 100), false}, // Exponential when backtracking recursively
+	} {
+		if got := globMatch(tc.pattern, tc.s); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v, want %v", tc.pattern, tc.s, got, tc.want)
+		}
+	}
+}
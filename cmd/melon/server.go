@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"melon/internal/certs"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	certCheckInterval = 10 * time.Second  // How often certificate files are checked for changes
+	clientIdentityKey = "client_identity" // gin context key holding the verified client certificate name
+)
+
+// serverOptions says where and how the HTTP API listens.
+type serverOptions struct {
+	addr               string
+	plaintext          bool
+	certFile, keyFile  string
+	clientCAFile       string
+	optionalClientCert bool
+
+	tlsOnce   sync.Once
+	tlsConfig *tls.Config // Shared by every server of the node
+	tlsErr    error
+}
+
+func serverFlags(fs *flag.FlagSet) *serverOptions {
+	o := &serverOptions{}
+	fs.StringVar(&o.addr, "addr", ":8080", "address to listen on")
+	fs.BoolVar(&o.plaintext, "plaintext", false, "serve plain HTTP instead of TLS; for local development only")
+	fs.StringVar(&o.certFile, "tls-cert", "./deeksha-cert.pem", "TLS certificate file")
+	fs.StringVar(&o.keyFile, "tls-key", "./deeksha-key.pem", "TLS private key file")
+	fs.StringVar(&o.clientCAFile, "tls-client-ca", "", "CA bundle for verifying client certificates; enables mutual TLS")
+	fs.BoolVar(&o.optionalClientCert, "tls-client-optional", false, "with -tls-client-ca, also accept clients without a certificate")
+	return o
+}
+
+// serve runs handler until the server fails. With TLS, certificates are
+// reloaded when their files change or on SIGHUP.
+func serve(o *serverOptions, handler http.Handler) error {
+	srv := &http.Server{Addr: o.addr, Handler: handler}
+	if o.plaintext {
+		return srv.ListenAndServe()
+	}
+	config, err := o.tls()
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = config
+	return srv.ListenAndServeTLS("", "")
+}
+
+// listen opens a listener for one of the non-HTTP protocols on addr, with
+// the same TLS settings as the HTTP API.
+func (o *serverOptions) listen(addr string) (net.Listener, error) {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil || o.plaintext {
+		return lis, err
+	}
+	config, err := o.tls()
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return tls.NewListener(lis, config), nil
+}
+
+// tls loads the certificates on first use and watches them for changes, so
+// every server of the node shares one reloader.
+func (o *serverOptions) tls() (*tls.Config, error) {
+	o.tlsOnce.Do(func() {
+		reloader, err := certs.NewReloader(o.certFile, o.keyFile, o.clientCAFile, o.optionalClientCert)
+		if err != nil {
+			o.tlsErr = err
+			return
+		}
+		reloader.Watch(context.Background(), certCheckInterval, func(err error) {
+			if err != nil {
+				logger.Error("certificate reload failed, keeping the previous one", zap.Error(err))
+				return
+			}
+			logger.Info("certificates reloaded")
+		})
+		o.tlsConfig = reloader.TLSConfig()
+	})
+	return o.tlsConfig, o.tlsErr
+}
+
+// clientIdentity makes the verified client certificate's name available to
+// handlers under clientIdentityKey.
+func clientIdentity(c *gin.Context) {
+	if id, ok := certs.Identity(c.Request.TLS); ok {
+		c.Set(clientIdentityKey, id)
+	}
+	c.Next()
+}
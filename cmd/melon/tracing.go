@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"melon/internal/tracing"
+	"net/http"
+	"strconv"
+)
+
+var httpTracer = otel.Tracer("melon/cmd/melon")
+
+type traceOptions struct {
+	exporter string
+	endpoint string
+	ratio    float64
+}
+
+func tracingFlags(fs *flag.FlagSet) *traceOptions {
+	o := &traceOptions{}
+	fs.StringVar(&o.exporter, "trace-exporter", "none", "where spans are sent: none, stdout or otlp")
+	fs.StringVar(&o.endpoint, "trace-endpoint", "localhost:4318", "host:port of the OTLP/HTTP collector, with -trace-exporter otlp")
+	fs.Float64Var(&o.ratio, "trace-sample-ratio", 1, "fraction of new traces recorded")
+	return o
+}
+
+func setupTracing(o *traceOptions, serviceName string) (func(context.Context) error, error) {
+	return tracing.Setup(o.exporter, o.endpoint, o.ratio, serviceName)
+}
+
+// traceRequest starts a span for every request, continuing the caller's
+// trace when it sent one.
+func traceRequest(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := httpTracer.Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethod(c.Request.Method),
+			semconv.HTTPRoute(route),
+			semconv.HTTPTarget(c.Request.URL.RequestURI()),
+		))
+	defer span.End()
+	c.Request = c.Request.WithContext(ctx)
+
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPStatusCode(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, strconv.Itoa(status))
+	}
+}
+
+// newClient returns a client for calling other melon nodes, traced so that
+// the calls join the trace of the request that made them.
+func newClient(insecure bool) *http.Client {
+	return &http.Client{Transport: tracing.Transport(&http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure},
+	})}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"melon/internal/service"
+	"net/http"
+	"strconv"
+)
+
+// abortWithTypeError ends a request on a list, set or hash that failed with
+// err.
+func abortWithTypeError(c *gin.Context, err error) {
+	if errors.Is(err, service.ErrorWrongType) {
+		c.AbortWithStatusJSON(http.StatusConflict, errorBody(codeWrongType, err.Error()))
+		return
+	}
+	abortWithCommitError(c, err)
+}
+
+// listEnd reads ?end=, which picks the head ("left") or the tail ("right",
+// the default) of a list.
+func listEnd(c *gin.Context) (left bool, ok bool) {
+	switch c.DefaultQuery("end", "right") {
+	case "left":
+		return true, true
+	case "right":
+		return false, true
+	}
+	abortWithError(c, http.StatusBadRequest, "end must be left or right")
+	return false, false
+}
+
+// bindStrings reads a request body holding a non-empty JSON array of
+// strings.
+func bindStrings(c *gin.Context) ([]string, bool) {
+	var values []string
+	if err := c.ShouldBindJSON(&values); err != nil || len(values) == 0 {
+		abortWithError(c, http.StatusBadRequest, "body must be a non-empty JSON array of strings")
+		return nil, false
+	}
+	return values, true
+}
+
+// listPushHandler pushes the strings in the body onto the list at key, at
+// the end given by ?end=.
+func listPushHandler(c *gin.Context) {
+	left, ok := listEnd(c)
+	if !ok {
+		return
+	}
+	values, ok := bindStrings(c)
+	if !ok {
+		return
+	}
+	length, err := service.ListPush(c.Request.Context(), c.Param("ns"), c.Param("key"), left, values...)
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"length": length})
+}
+
+// listPopHandler pops ?count= elements, 1 by default, from the end of the
+// list at key given by ?end=.
+func listPopHandler(c *gin.Context) {
+	left, ok := listEnd(c)
+	if !ok {
+		return
+	}
+	count, err := strconv.Atoi(c.DefaultQuery("count", "1"))
+	if err != nil || count < 1 {
+		abortWithError(c, http.StatusBadRequest, "invalid count")
+		return
+	}
+	values, err := service.ListPop(c.Request.Context(), c.Param("ns"), c.Param("key"), left, count)
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"values": values})
+}
+
+// listRangeHandler returns the elements of the list at key from ?start= to
+// ?stop= inclusive, the whole list by default. Negative indexes count back
+// from the tail.
+func listRangeHandler(c *gin.Context) {
+	start, err := strconv.Atoi(c.DefaultQuery("start", "0"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid start")
+		return
+	}
+	stop, err := strconv.Atoi(c.DefaultQuery("stop", "-1"))
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid stop")
+		return
+	}
+	values, err := service.ListRange(c.Request.Context(), c.Param("ns"), c.Param("key"), start, stop)
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"values": values})
+}
+
+// setAddHandler adds the members in the body to the set at key.
+func setAddHandler(c *gin.Context) {
+	members, ok := bindStrings(c)
+	if !ok {
+		return
+	}
+	added, err := service.SetAdd(c.Request.Context(), c.Param("ns"), c.Param("key"), members...)
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"added": added})
+}
+
+// setRemoveHandler removes the members in the body from the set at key.
+func setRemoveHandler(c *gin.Context) {
+	members, ok := bindStrings(c)
+	if !ok {
+		return
+	}
+	removed, err := service.SetRemove(c.Request.Context(), c.Param("ns"), c.Param("key"), members...)
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"removed": removed})
+}
+
+func setMembersHandler(c *gin.Context) {
+	members, err := service.SetMembers(c.Request.Context(), c.Param("ns"), c.Param("key"))
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"members": members})
+}
+
+// hashSetHandler sets the fields in the body, a JSON object of strings, in
+// the hash at key, leaving its other fields alone.
+func hashSetHandler(c *gin.Context) {
+	var fields map[string]string
+	if err := c.ShouldBindJSON(&fields); err != nil || len(fields) == 0 {
+		abortWithError(c, http.StatusBadRequest, "body must be a non-empty JSON object of strings")
+		return
+	}
+	added, err := service.HashSet(c.Request.Context(), c.Param("ns"), c.Param("key"), fields)
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"added": added})
+}
+
+func hashGetAllHandler(c *gin.Context) {
+	fields, err := service.HashGetAll(c.Request.Context(), c.Param("ns"), c.Param("key"))
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"fields": fields})
+}
+
+// hashGetHandler returns the raw value of one field of the hash at key.
+func hashGetHandler(c *gin.Context) {
+	value, err := service.HashGet(c.Request.Context(), c.Param("ns"), c.Param("key"), c.Param("field"))
+	if errors.Is(err, service.ErrorNoSuchField) {
+		abortWithError(c, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	c.String(http.StatusOK, value)
+}
+
+func hashDeleteHandler(c *gin.Context) {
+	removed, err := service.HashDelete(c.Request.Context(), c.Param("ns"), c.Param("key"), c.Param("field"))
+	if err != nil {
+		abortWithTypeError(c, err)
+		return
+	}
+	if removed == 0 {
+		abortWithError(c, http.StatusNotFound, service.ErrorNoSuchField.Error())
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
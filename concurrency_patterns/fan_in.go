@@ -1,13 +1,23 @@
 package concurrency_patterns
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
 )
 
-func Funnel(sources ...<-chan int) <-chan int {
-	dest := make(chan int) // The shared output channel
+// Result carries a value produced by a concurrent stage along with the error,
+// if any, that stage hit, so errors travel down the same channel as values.
+type Result[T any] struct {
+	Value T
+	Err   error
+}
+
+// Funnel merges sources into a single channel. The returned channel is closed
+// once every source has closed, or as soon as ctx is done.
+func Funnel[T any](ctx context.Context, sources ...<-chan T) <-chan T {
+	dest := make(chan T) // The shared output channel
 
 	// Used to automatically close dest
 	// when all sources are closed
@@ -18,11 +28,23 @@ func Funnel(sources ...<-chan int) <-chan int {
 
 	// Start a goroutine for each source
 	for _, ch := range sources {
-		go func(c <-chan int) {
+		go func(c <-chan T) {
 			defer wg.Done() // Notify WaitGroup when c closes
 
-			for n := range c {
-				dest <- n
+			for {
+				select {
+				case n, ok := <-c:
+					if !ok {
+						return
+					}
+					select {
+					case dest <- n:
+					case <-ctx.Done(): // Nobody is reading any more
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
 			}
 		}(ch)
 	}
@@ -48,7 +70,7 @@ func TestingFanIn() {
 			}
 		}()
 	}
-	dest := Funnel(sources...)
+	dest := Funnel(context.Background(), sources...)
 	for d := range dest {
 		fmt.Println(d)
 	}
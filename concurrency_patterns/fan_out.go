@@ -1,24 +1,40 @@
 package concurrency_patterns
 
 import (
+	"context"
 	"fmt"
 	"sync"
 )
 
-func Split(source <-chan int, n int) []<-chan int {
-	dests := make([]<-chan int, 0) // Create the dests slice
+// Split spreads the values from source over n channels, each of which gets
+// the next value as soon as it is ready for one. The channels are closed once
+// source closes or ctx is done.
+func Split[T any](ctx context.Context, source <-chan T, n int) []<-chan T {
+	dests := make([]<-chan T, 0) // Create the dests slice
 
 	for i := 0; i < n; i++ { // Create n destination channels
 
-		ch := make(chan int)
+		ch := make(chan T)
 		dests = append(dests, ch)
 
 		// Each channel gets a dedicated
 		// goroutine that competes for reads
 		go func() {
 			defer close(ch)
-			for val := range source {
-				ch <- val
+			for {
+				select {
+				case val, ok := <-source:
+					if !ok {
+						return
+					}
+					select {
+					case ch <- val:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
 			}
 		}()
 	}
@@ -26,8 +42,8 @@ func Split(source <-chan int, n int) []<-chan int {
 }
 
 func TestingFanOut() {
-	source := make(chan int)  // The input channel
-	dests := Split(source, 5) // Retrieve 5 output channels
+	source := make(chan int)                        // The input channel
+	dests := Split(context.Background(), source, 5) // Retrieve 5 output channels
 	go func() {
 		for i := 1; i <= 10; i++ { // Send the number 1..10 to source
 			source <- i
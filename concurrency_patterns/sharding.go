@@ -45,12 +45,17 @@ func NewShardedMap(nshards int) ShardedMap {
 }
 
 func (m ShardedMap) getShardIndex(key string) int {
+	return ShardIndex(key, len(m))
+}
+
+// ShardIndex returns the shard out of nshards that a ShardedMap keeps key in.
+func ShardIndex(key string, nshards int) int {
 	checksum := sha1.Sum([]byte(key)) // Use Sum from "crypto/sha1"
 
 	// this will only create 255 shards if you want more use
 	// hash := int(sum[13]) << 8 | int(sum[17])
 	hash := int(checksum[17]) // Pick an arbitrary byte as the hash
-	return hash % len(m)      // Mod by len(m) to get index
+	return hash % nshards     // Mod by nshards to get index
 }
 
 func (m ShardedMap) getShard(key string) *Shard {
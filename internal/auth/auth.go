@@ -0,0 +1,64 @@
+// Package auth works out which principal sent a request. Each
+// Authenticator recognizes one kind of credential; a Chain tries them in
+// turn.
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	ErrorNoCredentials      = errors.New("no credentials")
+	ErrorInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator returns the principal behind r. It returns
+// ErrorNoCredentials when r carries no credential of its kind, so the next
+// authenticator can be tried.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// Chain tries each authenticator in order and uses the first one that finds
+// credentials it understands.
+type Chain []Authenticator
+
+func (c Chain) Authenticate(r *http.Request) (string, error) {
+	for _, a := range c {
+		principal, err := a.Authenticate(r)
+		if errors.Is(err, ErrorNoCredentials) {
+			continue
+		}
+		return principal, err
+	}
+	return "", ErrorNoCredentials
+}
+
+// loadPairs reads a file of whitespace separated pairs, one per line,
+// skipping blank lines and # comments.
+func loadPairs(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pairs := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected two fields", filename, n)
+		}
+		pairs[fields[0]] = fields[1]
+	}
+	return pairs, scanner.Err()
+}
@@ -0,0 +1,75 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	KeyIDHeader     = "X-Melon-Key-Id"
+	DateHeader      = "X-Melon-Date" // RFC 3339
+	SignatureHeader = "X-Melon-Signature"
+
+	maxClockSkew = 5 * time.Minute // How far a request's date may be from ours
+)
+
+// HMACAuthenticator accepts requests signed with a shared secret. The
+// principal is the key ID.
+type HMACAuthenticator struct {
+	secrets map[string][]byte // Key ID to secret
+	maxBody int64             // Longest body hashed, as it is read before the caller is known
+}
+
+// NewHMACAuthenticator reads "key-id secret" lines from filename. Requests
+// with bodies longer than maxBody are refused with an *http.MaxBytesError.
+func NewHMACAuthenticator(filename string, maxBody int64) (*HMACAuthenticator, error) {
+	pairs, err := loadPairs(filename)
+	if err != nil {
+		return nil, err
+	}
+	secrets := make(map[string][]byte, len(pairs))
+	for id, secret := range pairs {
+		secrets[id] = []byte(secret)
+	}
+	return &HMACAuthenticator{secrets: secrets, maxBody: maxBody}, nil
+}
+
+// Sign returns the hex HMAC-SHA256 of the request line, date and body hash,
+// one per line, which clients send in SignatureHeader.
+func Sign(secret []byte, method, uri, date string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, method+"\n"+uri+"\n"+date+"\n"+hex.EncodeToString(bodyHash[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (a *HMACAuthenticator) Authenticate(r *http.Request) (string, error) {
+	id := r.Header.Get(KeyIDHeader)
+	if id == "" {
+		return "", ErrorNoCredentials
+	}
+	secret, ok := a.secrets[id]
+	if !ok {
+		return "", ErrorInvalidCredentials
+	}
+	date := r.Header.Get(DateHeader)
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil || time.Since(t) > maxClockSkew || time.Until(t) > maxClockSkew {
+		return "", ErrorInvalidCredentials // Stale or missing dates would allow replays
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, a.maxBody))
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body)) // Leave the body for the handler
+	want := Sign(secret, r.Method, r.URL.RequestURI(), date, body)
+	if !hmac.Equal([]byte(want), []byte(r.Header.Get(SignatureHeader))) {
+		return "", ErrorInvalidCredentials
+	}
+	return id, nil
+}
@@ -0,0 +1,18 @@
+package auth
+
+import (
+	"melon/internal/certs"
+	"net/http"
+)
+
+// MTLSAuthenticator uses the name on a verified client certificate as the
+// principal. The identity does not survive a proxy hop, so requests forwarded
+// between partitioned nodes need one of the other credentials.
+type MTLSAuthenticator struct{}
+
+func (MTLSAuthenticator) Authenticate(r *http.Request) (string, error) {
+	if id, ok := certs.Identity(r.TLS); ok {
+		return id, nil
+	}
+	return "", ErrorNoCredentials
+}
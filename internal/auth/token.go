@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// TokenAuthenticator accepts static API tokens sent as
+// "Authorization: Bearer <token>".
+type TokenAuthenticator struct {
+	tokens map[string]string // Token to principal
+}
+
+// NewTokenAuthenticator reads "token principal" lines from filename.
+func NewTokenAuthenticator(filename string) (*TokenAuthenticator, error) {
+	tokens, err := loadPairs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenAuthenticator{tokens: tokens}, nil
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if header == "" || token == header {
+		return "", ErrorNoCredentials
+	}
+	for candidate, principal := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+			return principal, nil
+		}
+	}
+	return "", ErrorInvalidCredentials
+}
@@ -0,0 +1,165 @@
+// Package certs serves TLS certificates that can be swapped without a
+// restart, and optionally verifies client certificates against a CA bundle.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Reloader holds the server certificate and client CA pool loaded from disk.
+type Reloader struct {
+	certFile, keyFile string
+	clientCAFile      string // Empty disables client certificate verification
+	clientAuth        tls.ClientAuthType
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+// NewReloader loads the certificate and key, and the client CA bundle when
+// clientCAFile is set. optionalClientCert accepts clients that present no
+// certificate at all, while still verifying those that do.
+func NewReloader(certFile, keyFile, clientCAFile string, optionalClientCert bool) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile, clientAuth: tls.NoClientCert}
+	if clientCAFile != "" {
+		r.clientAuth = tls.RequireAndVerifyClientCert
+		if optionalClientCert {
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads every file again. On error the previous certificates stay in
+// use.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("cannot read client CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA bundle contains no certificates")
+		}
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.modTimes = r.statFiles()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *Reloader) statFiles() map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, f := range r.files() {
+		if fi, err := os.Stat(f); err == nil {
+			times[f] = fi.ModTime()
+		}
+	}
+	return times
+}
+
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for f, t := range r.statFiles() {
+		if !t.Equal(r.modTimes[f]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads whenever one of the files changes, checking every interval,
+// and whenever the process receives SIGHUP, until ctx is done. onReload is
+// told the outcome of every attempt.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration, onReload func(error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer signal.Stop(hup)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				onReload(r.Reload())
+			case <-ticker.C:
+				if r.changed() {
+					onReload(r.Reload())
+				}
+			}
+		}
+	}()
+}
+
+// TLSConfig returns a server configuration that always presents the most
+// recently loaded certificate and trusts the most recently loaded client CAs.
+// It offers HTTP/2 and HTTP/1.1 over ALPN; each handshake gets a clone of it,
+// so settings made on it before serving, such as NextProtos, are kept.
+func (r *Reloader) TLSConfig() *tls.Config {
+	base := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"}}
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.Certificates = []tls.Certificate{*r.cert}
+		config.ClientAuth = r.clientAuth
+		config.ClientCAs = r.clientCAs
+		return config, nil
+	}
+	return base
+}
+
+// Identity returns the name of the verified client certificate on a
+// connection: its common name, or failing that its first DNS, URI or email
+// subject alternative name.
+func Identity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case leaf.Subject.CommonName != "":
+		return leaf.Subject.CommonName, true
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0], true
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String(), true
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0], true
+	}
+	return "", false
+}
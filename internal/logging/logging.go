@@ -0,0 +1,52 @@
+// Package logging builds melon's zap loggers and carries request-scoped
+// loggers through contexts.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// New returns a logger writing to stderr at level, encoded as format, either
+// "json" or "console". The level can be changed later through the returned
+// AtomicLevel.
+func New(level, format string) (*zap.Logger, zap.AtomicLevel, error) {
+	atom := zap.NewAtomicLevel()
+	if err := atom.UnmarshalText([]byte(level)); err != nil {
+		return nil, atom, fmt.Errorf("bad log level %q: %w", level, err)
+	}
+	var config zap.Config
+	switch format {
+	case "json":
+		config = zap.NewProductionConfig()
+	case "console":
+		config = zap.NewDevelopmentConfig()
+	default:
+		return nil, atom, fmt.Errorf("bad log format %q, expected json or console", format)
+	}
+	config.Level = atom
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	logger, err := config.Build()
+	if err != nil {
+		return nil, atom, err
+	}
+	return logger, atom, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// Ctx returns the logger carried by ctx, such as one holding a request's ID,
+// or fallback when ctx has none.
+func Ctx(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if l, ok := ctx.Value(contextKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return fallback
+}
@@ -0,0 +1,108 @@
+// Package metrics holds melon's Prometheus instruments. It depends on nothing
+// else in melon, so any package can record into it.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+)
+
+var (
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "melon_http_requests_total",
+		Help: "HTTP requests served, by route, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "melon_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	GRPCRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "melon_grpc_requests_total",
+		Help: "gRPC calls served, by method and status code.",
+	}, []string{"method", "code"})
+
+	GRPCRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "melon_grpc_request_duration_seconds",
+		Help:    "Time taken to serve gRPC calls, by method and status code. Streams are timed until they end.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	RESPCommandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "melon_resp_commands_total",
+		Help: "Redis protocol commands served, by command and whether they succeeded.",
+	}, []string{"command", "result"})
+
+	MemcacheCommandsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "melon_memcache_commands_total",
+		Help: "Memcached protocol commands served, by command and whether they succeeded.",
+	}, []string{"command", "result"})
+
+	LogWriteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "melon_transaction_log_write_duration_seconds",
+		Help:    "Time taken to append an event to the transaction log, by logger.",
+		Buckets: []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"logger"})
+
+	ReplayDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "melon_transaction_log_replay_duration_seconds",
+		Help: "Time taken to rebuild the store from the transaction log at startup.",
+	})
+
+	LogQueueDepth = newFuncGaugeVec(
+		"melon_transaction_log_queue_depth",
+		"Events waiting in the transaction log's channel to be written, by logger.",
+		"logger")
+
+	BreakerState = newFuncGaugeVec(
+		"melon_circuit_breaker_state",
+		"State of each circuit breaker: 0 closed, 1 open, 2 half-open.",
+		"breaker")
+)
+
+// FuncGaugeVec is a gauge whose values are read from functions at scrape
+// time, one function per label value.
+type FuncGaugeVec struct {
+	desc *prometheus.Desc
+
+	mu  sync.RWMutex
+	fns map[string]func() float64
+}
+
+func newFuncGaugeVec(name, help, label string) *FuncGaugeVec {
+	v := &FuncGaugeVec{
+		desc: prometheus.NewDesc(name, help, []string{label}, nil),
+		fns:  make(map[string]func() float64),
+	}
+	prometheus.MustRegister(v)
+	return v
+}
+
+// Set reads the gauge for label from f, replacing any earlier function.
+func (v *FuncGaugeVec) Set(label string, f func() float64) {
+	v.mu.Lock()
+	v.fns[label] = f
+	v.mu.Unlock()
+}
+
+// Delete stops reporting label.
+func (v *FuncGaugeVec) Delete(label string) {
+	v.mu.Lock()
+	delete(v.fns, label)
+	v.mu.Unlock()
+}
+
+func (v *FuncGaugeVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *FuncGaugeVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	for label, f := range v.fns {
+		ch <- prometheus.MustNewConstMetric(v.desc, prometheus.GaugeValue, f(), label)
+	}
+}
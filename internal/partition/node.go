@@ -0,0 +1,256 @@
+package partition
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"melon/internal/service"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+)
+
+// ForwardedHeader marks a request that has already been routed by another
+// node, so it is served locally instead of being forwarded again.
+const ForwardedHeader = "X-Melon-Forwarded"
+
+// state holds this node's place in the partitioned cluster. Partitioning is
+// off until Enable is called.
+var state = struct {
+	sync.RWMutex
+	self   string
+	ring   *Ring
+	client *http.Client
+}{}
+
+// Enable makes this node, known as self, one of nodes sharing the key space.
+// client is used to forward requests and move keys between nodes.
+func Enable(self string, nodes map[string]string, client *http.Client) {
+	state.Lock()
+	defer state.Unlock()
+	state.self = self
+	state.ring = NewRing(nodes)
+	state.client = client
+}
+
+func Enabled() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.ring != nil
+}
+
+func Self() string {
+	state.RLock()
+	defer state.RUnlock()
+	return state.self
+}
+
+func Nodes() map[string]string {
+	return currentRing().Nodes()
+}
+
+func currentRing() *Ring {
+	state.RLock()
+	defer state.RUnlock()
+	return state.ring
+}
+
+// Owner returns the node that owns key and whether that is this node.
+func Owner(key string) (id, addr string, local bool) {
+	id, addr, ok := currentRing().Owner(key)
+	return id, addr, !ok || id == Self()
+}
+
+// PlacementKey is what a key in namespace ns is placed on the ring by. Keys
+// in the default namespace are placed by the key alone.
+func PlacementKey(ns, key string) string {
+	if ns == service.DefaultNamespace {
+		return key
+	}
+	return ns + "/" + key
+}
+
+// Forward proxies r to the node at addr and copies its response to w.
+func Forward(w http.ResponseWriter, r *http.Request, addr string) error {
+	target, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("bad node address %q: %w", addr, err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	state.RLock()
+	proxy.Transport = state.client.Transport
+	state.RUnlock()
+	r.Header.Set(ForwardedHeader, Self())
+	proxy.ServeHTTP(w, r)
+	return nil
+}
+
+// Join adds a node to this node's ring. Call Rebalance afterwards to hand it
+// its keys.
+func Join(id, addr string) {
+	currentRing().Add(id, addr)
+}
+
+// Leave removes a node from this node's ring. On the leaving node itself,
+// Rebalance then hands every key to the remaining nodes.
+func Leave(id string) {
+	currentRing().Remove(id)
+}
+
+// Broadcast sends a ring change to every node in nodes other than this one,
+// marked as forwarded so they apply it without broadcasting it again.
+func Broadcast(ctx context.Context, nodes map[string]string, method, path string, body []byte) error {
+	state.RLock()
+	self, client := state.self, state.client
+	state.RUnlock()
+	for id, addr := range nodes {
+		if id == self {
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, method, addr+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(ForwardedHeader, self)
+		resp, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("cannot reach %s: %w", id, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s responded %s", id, resp.Status)
+		}
+	}
+	return nil
+}
+
+// ImportPath is where a node accepts a key moved to it by Rebalance.
+const ImportPath = "/v1/partition/keys"
+
+// MovedKey is a key as Rebalance sends it to its new owner: its value and
+// the type, expiry and flags in its meta.
+type MovedKey struct {
+	Namespace string          `json:"namespace"`
+	Key       string          `json:"key" binding:"required"`
+	Value     string          `json:"value"`
+	Meta      service.KeyMeta `json:"meta"`
+}
+
+// Rebalance moves every local key that this node no longer owns to its
+// owner, deleting it locally once the owner has accepted it. Keys attached
+// to a lease stay, as the lease only holds here; they are reported in the
+// error once the other keys have moved. It returns the number of keys
+// moved.
+func Rebalance(ctx context.Context) (int, error) {
+	state.RLock()
+	client := state.client
+	state.RUnlock()
+
+	namespaces := []string{service.DefaultNamespace}
+	for _, ns := range service.Namespaces() {
+		namespaces = append(namespaces, ns.Name)
+	}
+	moved, leased := 0, 0
+	for _, ns := range namespaces {
+		for key := range service.DumpIn(ns) {
+			id, addr, local := Owner(PlacementKey(ns, key))
+			if local {
+				continue
+			}
+			err := moveKey(ctx, client, addr, ns, key)
+			if errors.Is(err, service.ErrorLeased) {
+				leased++
+				continue
+			}
+			if err != nil {
+				return moved, fmt.Errorf("cannot move %q to %s: %w", PlacementKey(ns, key), id, err)
+			}
+			moved++
+		}
+	}
+	if leased > 0 {
+		return moved, fmt.Errorf("%d keys attached to leases were not moved", leased)
+	}
+	return moved, nil
+}
+
+// moveKey moves key to the node at addr. The local copy is only deleted if
+// it still holds the value moved; a write made meanwhile is moved in turn,
+// and a delete made meanwhile is made on the owner too.
+func moveKey(ctx context.Context, client *http.Client, addr, ns, key string) error {
+	for sent := false; ; sent = true {
+		value, meta, err := service.GetWithMeta(ctx, ns, key)
+		if errors.Is(err, service.ErrorNoSuchKey) {
+			if !sent {
+				return nil // Deleted or expired before it could move
+			}
+			return remove(ctx, client, addr+keyPath(ns, key))
+		}
+		if err != nil {
+			return err
+		}
+		if meta.Lease != 0 {
+			return service.ErrorLeased
+		}
+		if err := move(ctx, client, addr, MovedKey{Namespace: ns, Key: key, Value: value, Meta: meta}); err != nil {
+			return err
+		}
+		deleted, err := service.DeleteIfValue(ctx, ns, key, value)
+		if err != nil || deleted {
+			return err
+		}
+	}
+}
+
+// keyPath is the API path of key in namespace ns.
+func keyPath(ns, key string) string {
+	if ns == service.DefaultNamespace {
+		return "/v1/key/" + url.PathEscape(key)
+	}
+	return "/v1/ns/" + url.PathEscape(ns) + "/key/" + url.PathEscape(key)
+}
+
+// remove deletes keyURL on another node, where it may already be missing.
+func remove(ctx context.Context, client *http.Client, keyURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, keyURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ForwardedHeader, Self())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusNotFound {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// move imports k on the node at addr.
+func move(ctx context.Context, client *http.Client, addr string, k MovedKey) error {
+	body, err := json.Marshal(k)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, addr+ImportPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedHeader, Self())
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
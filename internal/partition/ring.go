@@ -0,0 +1,98 @@
+// Package partition spreads the key space over several melon nodes with a
+// consistent hash ring, so adding or removing a node only moves the keys
+// next to it on the ring.
+package partition
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const virtualNodes = 64 // Points each node gets on the ring, to even out the split
+
+// Ring maps keys to the node that owns them.
+type Ring struct {
+	sync.RWMutex
+	nodes  map[string]string // Node ID to base URL
+	points []uint32          // Sorted hashes of every virtual node
+	owners map[uint32]string // Virtual node hash to node ID
+}
+
+func NewRing(nodes map[string]string) *Ring {
+	r := &Ring{nodes: make(map[string]string)}
+	for id, addr := range nodes {
+		r.nodes[id] = addr
+	}
+	r.rebuild()
+	return r
+}
+
+func hash(s string) uint32 {
+	checksum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(checksum[:4])
+}
+
+// rebuild recomputes the ring points; the caller holds the write lock.
+func (r *Ring) rebuild() {
+	r.points = r.points[:0]
+	r.owners = make(map[uint32]string, len(r.nodes)*virtualNodes)
+	for id := range r.nodes {
+		for i := 0; i < virtualNodes; i++ {
+			h := hash(id + "#" + strconv.Itoa(i))
+			if owner, taken := r.owners[h]; taken {
+				if id < owner {
+					r.owners[h] = id // A collision; the smaller ID keeps the point on every node
+				}
+				continue
+			}
+			r.owners[h] = id
+			r.points = append(r.points, h)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Owner returns the ID and base URL of the node that owns key. ok is false if
+// the ring is empty.
+func (r *Ring) Owner(key string) (id, addr string, ok bool) {
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.points) == 0 {
+		return "", "", false
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0 // Wrap around
+	}
+	id = r.owners[r.points[i]]
+	return id, r.nodes[id], true
+}
+
+func (r *Ring) Add(id, addr string) {
+	r.Lock()
+	defer r.Unlock()
+	r.nodes[id] = addr
+	r.rebuild()
+}
+
+func (r *Ring) Remove(id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.nodes, id)
+	r.rebuild()
+}
+
+// Nodes returns a copy of the ring's members.
+func (r *Ring) Nodes() map[string]string {
+	r.RLock()
+	defer r.RUnlock()
+	nodes := make(map[string]string, len(r.nodes))
+	for id, addr := range r.nodes {
+		nodes[id] = addr
+	}
+	return nodes
+}
@@ -0,0 +1,181 @@
+// Package proxy fronts several melon backends: single-key requests go to the
+// backend owning the key, and multi-key requests are scattered over the
+// backends concurrently and gathered back into one response.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"melon/concurrency_patterns"
+	"melon/internal/partition"
+	"melon/stability_patterns"
+	"net/http"
+	"net/url"
+)
+
+// KeyResult is the outcome of one key of a multi-key request.
+type KeyResult struct {
+	Key   string
+	Value string
+	Found bool
+}
+
+type Proxy struct {
+	ring     *partition.Ring
+	client   *http.Client
+	workers  int                                           // Concurrent backend requests per multi-key request
+	breakers map[string]*stability_patterns.CircuitBreaker // By backend ID
+}
+
+// New returns a proxy spreading keys over backends, an ID to base URL map,
+// with the same consistent hashing the nodes themselves use. A backend that
+// fails failureThreshold requests in a row is not sent any more until its
+// circuit breaker lets a trial request through.
+func New(backends map[string]string, client *http.Client, workers int, failureThreshold uint) *Proxy {
+	if workers < 1 {
+		workers = 1
+	}
+	breakers := make(map[string]*stability_patterns.CircuitBreaker, len(backends))
+	for id := range backends {
+		breakers[id] = stability_patterns.NewCircuitBreaker(failureThreshold)
+	}
+	return &Proxy{ring: partition.NewRing(backends), client: client, workers: workers, breakers: breakers}
+}
+
+// Owner returns the ID and base URL of the backend that owns key.
+func (p *Proxy) Owner(key string) (id, addr string, ok bool) {
+	return p.ring.Owner(key)
+}
+
+// Breakers returns the circuit breaker of every backend, by ID.
+func (p *Proxy) Breakers() map[string]*stability_patterns.CircuitBreaker {
+	return p.breakers
+}
+
+// Client is the HTTP client used to reach the backends.
+func (p *Proxy) Client() *http.Client {
+	return p.client
+}
+
+// GetMany reads keys from their backends concurrently, sending each the
+// client's Authorization header, authorization, when not empty. Keys that
+// could not be read carry an error in their Result.
+func (p *Proxy) GetMany(ctx context.Context, keys []string, authorization string) ([]concurrency_patterns.Result[KeyResult], error) {
+	return p.scatter(ctx, keys, func(ctx context.Context, key string) (KeyResult, error) {
+		resp, err := p.do(ctx, http.MethodGet, key, nil, authorization)
+		if err != nil {
+			return KeyResult{Key: key}, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return KeyResult{Key: key}, err
+		}
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return KeyResult{Key: key, Value: string(body), Found: true}, nil
+		case http.StatusNotFound:
+			return KeyResult{Key: key}, nil
+		}
+		return KeyResult{Key: key}, fmt.Errorf("backend responded %s", resp.Status)
+	})
+}
+
+// PutMany writes values to their backends concurrently, with the client's
+// Authorization header as GetMany.
+func (p *Proxy) PutMany(ctx context.Context, values map[string]string, authorization string) ([]concurrency_patterns.Result[KeyResult], error) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	return p.scatter(ctx, keys, func(ctx context.Context, key string) (KeyResult, error) {
+		resp, err := p.do(ctx, http.MethodPut, key, []byte(values[key]), authorization)
+		if err != nil {
+			return KeyResult{Key: key}, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return KeyResult{Key: key}, fmt.Errorf("backend responded %s", resp.Status)
+		}
+		return KeyResult{Key: key, Value: values[key], Found: true}, nil
+	})
+}
+
+// do sends a request for key to its backend through the backend's circuit
+// breaker, on behalf of the client whose credentials are authorization.
+// Server errors count as failures.
+func (p *Proxy) do(ctx context.Context, method, key string, body []byte, authorization string) (*http.Response, error) {
+	id, addr, ok := p.Owner(key)
+	if !ok {
+		return nil, fmt.Errorf("no backends configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, addr+"/v1/key/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(partition.ForwardedHeader, "proxy") // The proxy already picked the owner
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	var resp *http.Response
+	_, err = p.breakers[id].Do(ctx, func(ctx context.Context) (string, error) {
+		var err error
+		resp, err = p.client.Do(req)
+		if err == nil && resp.StatusCode >= 500 {
+			resp.Body.Close()
+			return "", fmt.Errorf("backend responded %s", resp.Status)
+		}
+		return "", err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// scatter splits keys over the proxy's workers, runs fetch for each key and
+// funnels the results back. It stops early, returning what it has, when ctx
+// is done.
+func (p *Proxy) scatter(ctx context.Context, keys []string,
+	fetch func(context.Context, string) (KeyResult, error)) ([]concurrency_patterns.Result[KeyResult], error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	source := make(chan string)
+	go func() {
+		defer close(source)
+		for _, key := range keys {
+			select {
+			case source <- key:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	workers := concurrency_patterns.Split(ctx, source, p.workers)
+	outputs := make([]<-chan concurrency_patterns.Result[KeyResult], 0, len(workers))
+	for _, in := range workers {
+		out := make(chan concurrency_patterns.Result[KeyResult])
+		outputs = append(outputs, out)
+		go func(in <-chan string) {
+			defer close(out)
+			for key := range in {
+				value, err := fetch(ctx, key)
+				select {
+				case out <- concurrency_patterns.Result[KeyResult]{Value: value, Err: err}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(in)
+	}
+
+	results := make([]concurrency_patterns.Result[KeyResult], 0, len(keys))
+	for r := range concurrency_patterns.Funnel(ctx, outputs...) {
+		results = append(results, r)
+	}
+	return results, ctx.Err()
+}
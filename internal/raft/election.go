@@ -0,0 +1,115 @@
+package raft
+
+import (
+	"context"
+	"go.uber.org/zap"
+)
+
+type RequestVoteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type RequestVoteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+// startElectionLocked becomes a candidate for the next term and asks every
+// other member for its vote.
+func (n *Node) startElectionLocked() {
+	n.role = Candidate
+	n.term++
+	n.votedFor = n.opts.ID
+	n.leaderID = ""
+	n.persistStateLocked()
+	n.opts.Logger.Debug("starting election", zap.Uint64("term", n.term))
+	n.resetElectionDeadline()
+
+	term := n.term
+	req := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  n.opts.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeaderLocked()
+		return
+	}
+	for id, addr := range n.config {
+		if id == n.opts.ID || n.isolated[id] {
+			continue
+		}
+		go func(addr string) {
+			ctx, cancel := context.WithTimeout(context.Background(), n.opts.ElectionTimeout)
+			defer cancel()
+			resp, err := n.opts.Transport.RequestVote(ctx, addr, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.becomeFollowerLocked(resp.Term, "")
+				return
+			}
+			if n.role != Candidate || n.term != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeaderLocked()
+			}
+		}(addr)
+	}
+}
+
+func (n *Node) becomeLeaderLocked() {
+	n.role = Leader
+	n.leaderID = n.opts.ID
+	n.opts.Logger.Info("became leader", zap.Uint64("term", n.term))
+	for id := range n.config {
+		n.nextIndex[id] = n.lastIndex() + 1
+		n.matchIndex[id] = 0
+	}
+	// Entries from earlier terms can only be committed alongside one from
+	// the current term, so start the term with a no-op.
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: EntryNoop}
+	if err := n.appendLocked(e); err != nil {
+		n.becomeFollowerLocked(n.term, "")
+		return
+	}
+	n.matchIndex[n.opts.ID] = e.Index
+	n.advanceCommitLocked()
+	n.broadcastLocked()
+}
+
+// HandleRequestVote answers a candidate's request for our vote. It returns
+// nil if the candidate is isolated from us.
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isolated[req.CandidateID] {
+		return nil
+	}
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term, "")
+	}
+	resp := &RequestVoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		n.persistStateLocked()
+		n.resetElectionDeadline()
+		resp.VoteGranted = true
+	}
+	return resp
+}
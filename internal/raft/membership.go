@@ -0,0 +1,60 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// AddMember adds a node to the cluster. The new node should be started with
+// no peers so it waits for the leader to bring it up to date.
+func (n *Node) AddMember(ctx context.Context, id, addr string) error {
+	return n.changeMembership(ctx, func(config map[string]string) error {
+		if config[id] == addr {
+			return fmt.Errorf("%s is already a member", id)
+		}
+		config[id] = addr
+		return nil
+	})
+}
+
+// RemoveMember removes a node from the cluster. Removing the leader makes it
+// step down once the change commits.
+func (n *Node) RemoveMember(ctx context.Context, id string) error {
+	return n.changeMembership(ctx, func(config map[string]string) error {
+		if _, ok := config[id]; !ok {
+			return fmt.Errorf("%s is not a member", id)
+		}
+		delete(config, id)
+		return nil
+	})
+}
+
+// changeMembership commits a new configuration that differs from the current
+// one by a single member, so old and new majorities always overlap.
+func (n *Node) changeMembership(ctx context.Context, change func(map[string]string) error) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		err := n.notLeaderLocked()
+		n.mu.Unlock()
+		return err
+	}
+	if n.configIndex > n.commitIndex {
+		n.mu.Unlock()
+		return ErrorConfigPending
+	}
+	config := make(map[string]string, len(n.config)+1)
+	for id, addr := range n.config {
+		config[id] = addr
+	}
+	if err := change(config); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	data, err := json.Marshal(config)
+	n.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return n.propose(ctx, EntryConfig, data)
+}
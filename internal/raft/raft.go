@@ -0,0 +1,558 @@
+// Package raft replicates an append-only log across a small cluster of nodes
+// using the Raft consensus algorithm. Entries are committed once a quorum of
+// the current members has stored them, and are then applied, in order, to a
+// state machine on every node.
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "follower"
+	case Candidate:
+		return "candidate"
+	case Leader:
+		return "leader"
+	}
+	return "unknown"
+}
+
+type EntryType byte
+
+const (
+	EntryNoop    EntryType = iota // Appended by a new leader to commit earlier terms
+	EntryCommand                  // Applied to the state machine
+	EntryConfig                   // A new cluster membership
+)
+
+// Entry is a single record of the replicated log.
+type Entry struct {
+	Index uint64    `json:"index"`
+	Term  uint64    `json:"term"`
+	Type  EntryType `json:"type"`
+	Data  []byte    `json:"data,omitempty"`
+}
+
+// FSM is the state machine the log is applied to.
+type FSM interface {
+	Apply(data []byte) error       // Apply a committed command
+	Snapshot() ([]byte, error)     // Serialize the whole state
+	Restore(snapshot []byte) error // Replace the whole state
+}
+
+var (
+	ErrorLeadershipLost = errors.New("leadership lost before the entry was committed")
+	ErrorConfigPending  = errors.New("a membership change is already in progress")
+	ErrorStopped        = errors.New("raft node stopped")
+)
+
+// NotLeaderError is returned for writes made on a node that is not the leader.
+type NotLeaderError struct {
+	LeaderID   string
+	LeaderAddr string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.LeaderID == "" {
+		return "not the leader; no leader is known"
+	}
+	return fmt.Sprintf("not the leader; leader is %s at %s", e.LeaderID, e.LeaderAddr)
+}
+
+// Options configures a Node.
+type Options struct {
+	ID                string            // This node's ID
+	Peers             map[string]string // Initial members, ID to address, including this node; empty to join an existing cluster
+	Dir               string            // Where the log, state and snapshots are kept
+	Transport         Transport
+	Token             string // Secret every RPC served by Handler must carry; Handler refuses all RPCs without one
+	FSM               FSM
+	HeartbeatInterval time.Duration // Defaults to 75ms
+	ElectionTimeout   time.Duration // Minimum; the actual timeout is randomized up to twice this. Defaults to 300ms
+	SnapshotThreshold uint64        // Applied entries kept in the log before a snapshot is taken. Defaults to 1024
+	MaxAppendEntries  int           // Entries sent per AppendEntries call. Defaults to 256
+	Logger            *zap.Logger   // Defaults to discarding everything
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// Node is a single member of a Raft cluster.
+type Node struct {
+	opts    Options
+	storage *storage
+
+	applyMu sync.Mutex // Held while the FSM is being changed; always taken before mu
+	mu      sync.Mutex
+
+	role     Role
+	term     uint64
+	votedFor string
+	leaderID string
+
+	log         []Entry // log[0] stands for the last entry in the snapshot
+	commitIndex uint64
+	lastApplied uint64
+
+	config         map[string]string // Current members, ID to address
+	configIndex    uint64            // Log index of the entry that set config; 0 if it predates the log
+	snapshotConfig map[string]string // Membership as of the snapshot
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+
+	electionDeadline time.Time
+	lastBroadcast    time.Time
+	isolated         map[string]bool // Peers we pretend are unreachable
+
+	waiters map[uint64]waiter
+	notify  chan struct{}
+	stop    chan struct{}
+}
+
+// NewNode restores a node from opts.Dir and starts its background
+// goroutines.
+func NewNode(opts Options) (*Node, error) {
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = 75 * time.Millisecond
+	}
+	if opts.ElectionTimeout == 0 {
+		opts.ElectionTimeout = 300 * time.Millisecond
+	}
+	if opts.SnapshotThreshold == 0 {
+		opts.SnapshotThreshold = 1024
+	}
+	if opts.MaxAppendEntries == 0 {
+		opts.MaxAppendEntries = 256
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	opts.Logger = opts.Logger.With(zap.String("node", opts.ID))
+	st, err := openStorage(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		opts:       opts,
+		storage:    st,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		isolated:   make(map[string]bool),
+		waiters:    make(map[uint64]waiter),
+		notify:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+	if err := n.restore(); err != nil {
+		return nil, err
+	}
+	n.resetElectionDeadline()
+	go n.tick()
+	go n.applyLoop()
+	return n, nil
+}
+
+// restore loads the snapshot, persistent state and log from storage.
+func (n *Node) restore() error {
+	n.log = []Entry{{}}
+	snap, err := n.storage.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	if snap != nil {
+		if err := n.opts.FSM.Restore(snap.Data); err != nil {
+			return fmt.Errorf("cannot restore snapshot: %w", err)
+		}
+		n.log[0] = Entry{Index: snap.Index, Term: snap.Term}
+		n.snapshotConfig = snap.Config
+		n.commitIndex, n.lastApplied = snap.Index, snap.Index
+	}
+	if n.term, n.votedFor, err = n.storage.loadState(); err != nil {
+		return err
+	}
+	entries, err := n.storage.loadLog()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Index <= n.log[0].Index {
+			continue // Already covered by the snapshot
+		}
+		if e.Index != n.lastIndex()+1 {
+			return fmt.Errorf("raft log has a gap before entry %d", e.Index)
+		}
+		n.log = append(n.log, e)
+	}
+	n.recomputeConfig()
+	// Drop anything the snapshot covers and any torn write at the tail.
+	return n.storage.rewriteLog(n.log[1:])
+}
+
+// Stop halts the node's background work. It does not tell the other members.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.stop:
+	default:
+		close(n.stop)
+		n.failWaiters(ErrorStopped)
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[0].Index + uint64(len(n.log)) - 1
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// entry returns the log entry at index, which must be at least the snapshot
+// index and at most lastIndex.
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.log[0].Index]
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.opts.ElectionTimeout + time.Duration(rand.Int63n(int64(n.opts.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) signalApply() {
+	select {
+	case n.notify <- struct{}{}:
+	default:
+	}
+}
+
+// tick drives elections and heartbeats.
+func (n *Node) tick() {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+		n.mu.Lock()
+		switch {
+		case n.role == Leader:
+			if time.Since(n.lastBroadcast) >= n.opts.HeartbeatInterval {
+				n.broadcastLocked()
+			}
+		case time.Now().After(n.electionDeadline):
+			if _, member := n.config[n.opts.ID]; member {
+				n.startElectionLocked()
+			} else {
+				n.resetElectionDeadline() // Not a voter until a leader adds us
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// becomeFollowerLocked steps down to follower in term.
+func (n *Node) becomeFollowerLocked(term uint64, leaderID string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistStateLocked()
+	}
+	if n.role == Leader {
+		n.opts.Logger.Info("stepping down", zap.Uint64("term", n.term), zap.String("leader", leaderID))
+		n.failWaiters(ErrorLeadershipLost)
+	}
+	n.role = Follower
+	n.leaderID = leaderID
+}
+
+func (n *Node) failWaiters(err error) {
+	for index, w := range n.waiters {
+		w.done <- err
+		delete(n.waiters, index)
+	}
+}
+
+func (n *Node) persistStateLocked() {
+	if err := n.storage.saveState(n.term, n.votedFor); err != nil {
+		panic(fmt.Sprintf("raft: cannot persist state: %v", err)) // Continuing could violate safety
+	}
+}
+
+func (n *Node) quorum() int {
+	return len(n.config)/2 + 1
+}
+
+// Propose appends a command to the log and waits until it has been committed
+// and applied on this node.
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	return n.propose(ctx, EntryCommand, data)
+}
+
+func (n *Node) propose(ctx context.Context, t EntryType, data []byte) error {
+	n.mu.Lock()
+	if n.role != Leader {
+		err := n.notLeaderLocked()
+		n.mu.Unlock()
+		return err
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Type: t, Data: data}
+	if err := n.appendLocked(e); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, done: done}
+	n.matchIndex[n.opts.ID] = e.Index
+	n.advanceCommitLocked() // A single node cluster commits straight away
+	n.broadcastLocked()
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (n *Node) notLeaderLocked() error {
+	return &NotLeaderError{LeaderID: n.leaderID, LeaderAddr: n.config[n.leaderID]}
+}
+
+// appendLocked adds entries to the end of the log and persists them.
+func (n *Node) appendLocked(entries ...Entry) error {
+	if err := n.storage.appendLog(entries); err != nil {
+		return fmt.Errorf("cannot persist raft log: %w", err)
+	}
+	n.log = append(n.log, entries...)
+	for _, e := range entries {
+		if e.Type == EntryConfig {
+			n.setConfigLocked(e)
+		}
+	}
+	return nil
+}
+
+// truncateLocked drops every entry from index onwards.
+func (n *Node) truncateLocked(index uint64) error {
+	n.log = n.log[:index-n.log[0].Index]
+	if err := n.storage.rewriteLog(n.log[1:]); err != nil {
+		return fmt.Errorf("cannot persist raft log: %w", err)
+	}
+	if n.configIndex >= index {
+		n.recomputeConfig()
+	}
+	return nil
+}
+
+func (n *Node) setConfigLocked(e Entry) {
+	var config map[string]string
+	if err := json.Unmarshal(e.Data, &config); err != nil {
+		return
+	}
+	n.config = config
+	n.configIndex = e.Index
+}
+
+// recomputeConfig finds the latest membership in the log, falling back to
+// the snapshot and then to the bootstrap peers.
+func (n *Node) recomputeConfig() {
+	for i := len(n.log) - 1; i > 0; i-- {
+		if n.log[i].Type == EntryConfig {
+			n.setConfigLocked(n.log[i])
+			return
+		}
+	}
+	n.configIndex = 0
+	switch {
+	case n.snapshotConfig != nil:
+		n.config = n.snapshotConfig
+	case n.opts.Peers != nil:
+		n.config = n.opts.Peers
+	default:
+		n.config = map[string]string{}
+	}
+}
+
+// configAt returns the membership in effect once index was applied.
+func (n *Node) configAt(index uint64) map[string]string {
+	for i := index; i > n.log[0].Index; i-- {
+		if e := n.entry(i); e.Type == EntryConfig {
+			var config map[string]string
+			if json.Unmarshal(e.Data, &config) == nil {
+				return config
+			}
+		}
+	}
+	if n.snapshotConfig != nil {
+		return n.snapshotConfig
+	}
+	return n.opts.Peers
+}
+
+// applyLoop applies committed entries to the FSM in order.
+func (n *Node) applyLoop() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.notify:
+		}
+		n.applyCommitted()
+	}
+}
+
+func (n *Node) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	var pending []Entry
+	for i := n.lastApplied + 1; i <= n.commitIndex; i++ {
+		pending = append(pending, n.entry(i))
+	}
+	n.mu.Unlock()
+
+	for _, e := range pending {
+		var err error
+		if e.Type == EntryCommand {
+			err = n.opts.FSM.Apply(e.Data)
+		}
+		n.mu.Lock()
+		n.lastApplied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			if w.term != e.Term {
+				err = ErrorLeadershipLost // Our entry was overwritten by another leader
+			}
+			w.done <- err
+			delete(n.waiters, e.Index)
+		}
+		if e.Type == EntryConfig && n.role == Leader {
+			if _, member := n.config[n.opts.ID]; !member {
+				n.becomeFollowerLocked(n.term, "") // We have been removed
+			}
+		}
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	due := n.lastApplied-n.log[0].Index >= n.opts.SnapshotThreshold
+	n.mu.Unlock()
+	if due {
+		if err := n.snapshotLocked(); err != nil {
+			n.opts.Logger.Error("snapshot failed", zap.Error(err))
+		}
+	}
+}
+
+// Snapshot captures the FSM and compacts the log up to the last applied entry.
+func (n *Node) Snapshot() error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	return n.snapshotLocked()
+}
+
+// snapshotLocked requires applyMu, so the FSM matches lastApplied.
+func (n *Node) snapshotLocked() error {
+	data, err := n.opts.FSM.Snapshot()
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.lastApplied
+	if index <= n.log[0].Index {
+		return nil
+	}
+	snap := &snapshot{Index: index, Term: n.entry(index).Term, Config: n.configAt(index), Data: data}
+	if err := n.storage.saveSnapshot(snap); err != nil {
+		return err
+	}
+	n.log = append([]Entry{{Index: snap.Index, Term: snap.Term}}, n.log[index-n.log[0].Index+1:]...)
+	n.snapshotConfig = snap.Config
+	return n.storage.rewriteLog(n.log[1:])
+}
+
+// Status is a point in time view of a node.
+type Status struct {
+	ID            string            `json:"id"`
+	Role          string            `json:"role"`
+	Term          uint64            `json:"term"`
+	Leader        string            `json:"leader"`
+	Members       map[string]string `json:"members"`
+	LastIndex     uint64            `json:"last_index"`
+	CommitIndex   uint64            `json:"commit_index"`
+	LastApplied   uint64            `json:"last_applied"`
+	SnapshotIndex uint64            `json:"snapshot_index"`
+	Isolated      []string          `json:"isolated,omitempty"`
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := make(map[string]string, len(n.config))
+	for id, addr := range n.config {
+		members[id] = addr
+	}
+	var isolated []string
+	for id := range n.isolated {
+		isolated = append(isolated, id)
+	}
+	return Status{
+		ID:            n.opts.ID,
+		Role:          n.role.String(),
+		Term:          n.term,
+		Leader:        n.leaderID,
+		Members:       members,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		LastApplied:   n.lastApplied,
+		SnapshotIndex: n.log[0].Index,
+		Isolated:      isolated,
+	}
+}
+
+// Isolate drops all traffic to and from the given peers, simulating a
+// network partition.
+func (n *Node) Isolate(ids ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, id := range ids {
+		n.isolated[id] = true
+	}
+}
+
+// Heal undoes every Isolate.
+func (n *Node) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated = make(map[string]bool)
+}
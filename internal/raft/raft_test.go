@@ -0,0 +1,355 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testToken = "test-token"
+
+// testFSM records every applied command.
+type testFSM struct {
+	mu      sync.Mutex
+	applied []string
+}
+
+func (f *testFSM) Apply(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = append(f.applied, string(data))
+	return nil
+}
+
+func (f *testFSM) Snapshot() ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Marshal(f.applied)
+}
+
+func (f *testFSM) Restore(snapshot []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.applied = nil
+	return json.Unmarshal(snapshot, &f.applied)
+}
+
+func (f *testFSM) commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.applied...)
+}
+
+// testCluster is a set of nodes talking over HTTP on localhost.
+type testCluster struct {
+	t     *testing.T
+	ids   []string
+	peers map[string]string
+	dirs  map[string]string
+	nodes map[string]*Node
+	fsms  map[string]*testFSM
+	mu    sync.Mutex // Guards nodes, which the servers read
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	c := &testCluster{
+		t:     t,
+		ids:   ids,
+		peers: make(map[string]string),
+		dirs:  make(map[string]string),
+		nodes: make(map[string]*Node),
+		fsms:  make(map[string]*testFSM),
+	}
+	for _, id := range ids {
+		id := id
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.mu.Lock()
+			n := c.nodes[id]
+			c.mu.Unlock()
+			if n == nil {
+				http.Error(w, "stopped", http.StatusServiceUnavailable)
+				return
+			}
+			n.Handler().ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+		c.peers[id] = srv.URL
+		c.dirs[id] = t.TempDir()
+	}
+	for _, id := range ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, id := range c.ids {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+func (c *testCluster) start(id string) {
+	fsm := &testFSM{}
+	n, err := NewNode(Options{
+		ID:                id,
+		Peers:             c.peers,
+		Dir:               c.dirs[id],
+		Transport:         NewHTTPTransport(http.DefaultClient, testToken),
+		Token:             testToken,
+		FSM:               fsm,
+		HeartbeatInterval: 20 * time.Millisecond,
+		ElectionTimeout:   100 * time.Millisecond,
+	})
+	if err != nil {
+		c.t.Fatalf("cannot start %s: %v", id, err)
+	}
+	c.mu.Lock()
+	c.nodes[id], c.fsms[id] = n, fsm
+	c.mu.Unlock()
+}
+
+func (c *testCluster) stop(id string) {
+	c.mu.Lock()
+	n := c.nodes[id]
+	delete(c.nodes, id)
+	c.mu.Unlock()
+	if n != nil {
+		n.Stop()
+	}
+}
+
+// partition cuts the nodes in side off from every other node, both ways.
+func (c *testCluster) partition(side ...string) {
+	in := make(map[string]bool)
+	for _, id := range side {
+		in[id] = true
+	}
+	var rest []string
+	for _, id := range c.ids {
+		if !in[id] {
+			rest = append(rest, id)
+		}
+	}
+	for _, id := range side {
+		c.nodes[id].Isolate(rest...)
+	}
+	for _, id := range rest {
+		c.nodes[id].Isolate(side...)
+	}
+}
+
+func (c *testCluster) heal() {
+	for _, n := range c.nodes {
+		n.Heal()
+	}
+}
+
+// leader waits for exactly one of the given nodes to lead.
+func (c *testCluster) leader(among ...string) string {
+	c.t.Helper()
+	if len(among) == 0 {
+		among = c.ids
+	}
+	var leader string
+	waitFor(c.t, "a single leader", func() bool {
+		leader = ""
+		for _, id := range among {
+			if c.nodes[id].Status().Role == Leader.String() {
+				if leader != "" {
+					return false
+				}
+				leader = id
+			}
+		}
+		return leader != ""
+	})
+	return leader
+}
+
+// settled waits for every node to follow the same leader in the same term.
+func (c *testCluster) settled() string {
+	c.t.Helper()
+	var leader string
+	waitFor(c.t, "every node to agree on the leader", func() bool {
+		first := c.nodes[c.ids[0]].Status()
+		leader = first.Leader
+		for _, id := range c.ids[1:] {
+			s := c.nodes[id].Status()
+			if s.Leader != first.Leader || s.Term != first.Term {
+				return false
+			}
+		}
+		return leader != ""
+	})
+	return leader
+}
+
+func (c *testCluster) propose(id, command string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	return c.nodes[id].Propose(ctx, []byte(command))
+}
+
+// converged waits for every running node to have applied want.
+func (c *testCluster) converged(want ...string) {
+	c.t.Helper()
+	waitFor(c.t, "every node to apply "+strings.Join(want, ","), func() bool {
+		for id := range c.nodes {
+			if !reflect.DeepEqual(c.fsms[id].commands(), want) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicatesToEveryNode(t *testing.T) {
+	c := newTestCluster(t, "a", "b", "c")
+	leader := c.leader()
+	for _, cmd := range []string{"x", "y", "z"} {
+		if err := c.propose(leader, cmd); err != nil {
+			t.Fatalf("propose %s: %v", cmd, err)
+		}
+	}
+	c.converged("x", "y", "z")
+}
+
+func TestFollowerRejectsProposals(t *testing.T) {
+	c := newTestCluster(t, "a", "b", "c")
+	leader := c.settled()
+	for _, id := range c.ids {
+		if id == leader {
+			continue
+		}
+		err := c.propose(id, "x")
+		notLeader, ok := err.(*NotLeaderError)
+		if !ok {
+			t.Fatalf("propose on follower %s: got %v, want a NotLeaderError", id, err)
+		}
+		if notLeader.LeaderID != leader {
+			t.Errorf("follower %s points at %q, want %q", id, notLeader.LeaderID, leader)
+		}
+	}
+}
+
+func TestMajorityElectsNewLeaderWhenLeaderIsPartitioned(t *testing.T) {
+	c := newTestCluster(t, "a", "b", "c")
+	old := c.leader()
+	if err := c.propose(old, "before"); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	c.converged("before")
+
+	c.partition(old)
+	var majority []string
+	for _, id := range c.ids {
+		if id != old {
+			majority = append(majority, id)
+		}
+	}
+	leader := c.leader(majority...)
+	if err := c.propose(leader, "during"); err != nil {
+		t.Fatalf("propose on the majority: %v", err)
+	}
+	if err := c.propose(old, "lost"); err == nil {
+		t.Fatal("the isolated leader committed an entry without a quorum")
+	}
+
+	c.heal()
+	waitFor(t, "the old leader to step down", func() bool {
+		return c.nodes[old].Status().Role == Follower.String()
+	})
+	c.converged("before", "during")
+}
+
+func TestMinorityCannotElectLeader(t *testing.T) {
+	c := newTestCluster(t, "a", "b", "c")
+	leader := c.leader()
+	var follower string
+	for _, id := range c.ids {
+		if id != leader {
+			follower = id
+			break
+		}
+	}
+	term := c.nodes[follower].Status().Term
+	c.partition(follower)
+	waitFor(t, "the isolated follower to start elections", func() bool {
+		return c.nodes[follower].Status().Term > term
+	})
+	if role := c.nodes[follower].Status().Role; role == Leader.String() {
+		t.Fatalf("isolated follower became %s", role)
+	}
+	if err := c.propose(leader, "x"); err != nil {
+		t.Fatalf("the majority should still commit: %v", err)
+	}
+
+	// The follower's higher term makes the leader step down once healed,
+	// so wait for the cluster to settle on a leader again.
+	c.heal()
+	leader = c.settled()
+	if err := c.propose(leader, "y"); err != nil {
+		t.Fatalf("propose after healing: %v", err)
+	}
+	c.converged("x", "y")
+}
+
+func TestRestartRestoresFromSnapshotAndLog(t *testing.T) {
+	c := newTestCluster(t, "a", "b", "c")
+	leader := c.leader()
+	if err := c.propose(leader, "x"); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	c.converged("x")
+	for _, id := range c.ids {
+		if err := c.nodes[id].Snapshot(); err != nil {
+			t.Fatalf("snapshot %s: %v", id, err)
+		}
+	}
+	if err := c.propose(leader, "y"); err != nil {
+		t.Fatalf("propose: %v", err)
+	}
+	c.converged("x", "y")
+
+	for _, id := range c.ids {
+		c.stop(id)
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	c.converged("x", "y")
+	if err := c.propose(c.leader(), "z"); err != nil {
+		t.Fatalf("propose after restart: %v", err)
+	}
+	c.converged("x", "y", "z")
+}
+
+func TestHandlerRequiresClusterToken(t *testing.T) {
+	c := newTestCluster(t, "a")
+	for _, token := range []string{"", "wrong"} {
+		transport := NewHTTPTransport(http.DefaultClient, token)
+		_, err := transport.RequestVote(context.Background(), c.peers["a"], &RequestVoteRequest{Term: 100, CandidateID: "intruder"})
+		if err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("vote with token %q: got %v, want 401", token, err)
+		}
+	}
+	if term := c.nodes["a"].Status().Term; term >= 100 {
+		t.Errorf("an unauthenticated vote request moved the term to %d", term)
+	}
+}
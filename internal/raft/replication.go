@@ -0,0 +1,295 @@
+package raft
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+type AppendEntriesRequest struct {
+	Term         uint64  `json:"term"`
+	LeaderID     string  `json:"leader_id"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// ConflictIndex is where the leader should resume sending from after a
+	// failed consistency check.
+	ConflictIndex uint64 `json:"conflict_index,omitempty"`
+}
+
+type InstallSnapshotRequest struct {
+	Term     uint64            `json:"term"`
+	LeaderID string            `json:"leader_id"`
+	Index    uint64            `json:"index"`
+	LastTerm uint64            `json:"last_term"`
+	Config   map[string]string `json:"config"`
+	Data     []byte            `json:"data"`
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// broadcastLocked sends every other member whatever it is missing, or a
+// heartbeat if it is up to date.
+func (n *Node) broadcastLocked() {
+	n.lastBroadcast = time.Now()
+	for id, addr := range n.config {
+		if id == n.opts.ID || n.inflight[id] || n.isolated[id] {
+			continue
+		}
+		if _, ok := n.nextIndex[id]; !ok {
+			n.nextIndex[id] = n.lastIndex() + 1 // A member added during our term
+		}
+		n.inflight[id] = true
+		if n.nextIndex[id] <= n.log[0].Index {
+			go n.sendSnapshot(id, addr)
+		} else {
+			go n.sendEntries(id, addr, n.appendRequestLocked(id))
+		}
+	}
+}
+
+func (n *Node) appendRequestLocked(id string) *AppendEntriesRequest {
+	next := n.nextIndex[id]
+	req := &AppendEntriesRequest{
+		Term:         n.term,
+		LeaderID:     n.opts.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.entry(next - 1).Term,
+		LeaderCommit: n.commitIndex,
+	}
+	for i := next; i <= n.lastIndex() && len(req.Entries) < n.opts.MaxAppendEntries; i++ {
+		req.Entries = append(req.Entries, n.entry(i))
+	}
+	return req
+}
+
+func (n *Node) sendEntries(id, addr string, req *AppendEntriesRequest) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.ElectionTimeout)
+	defer cancel()
+	resp, err := n.opts.Transport.AppendEntries(ctx, addr, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[id] = false
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "")
+		n.resetElectionDeadline()
+		return
+	}
+	if n.role != Leader || n.term != req.Term {
+		return
+	}
+	if resp.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[id] {
+			n.matchIndex[id] = match
+		}
+		n.nextIndex[id] = n.matchIndex[id] + 1
+		n.advanceCommitLocked()
+	} else {
+		next := resp.ConflictIndex
+		if next == 0 || next > req.PrevLogIndex {
+			next = req.PrevLogIndex
+		}
+		if next < 1 {
+			next = 1
+		}
+		n.nextIndex[id] = next
+	}
+	if n.nextIndex[id] <= n.lastIndex() {
+		// More to send; don't wait for the next heartbeat.
+		n.inflight[id] = true
+		if n.nextIndex[id] <= n.log[0].Index {
+			go n.sendSnapshot(id, addr)
+		} else {
+			go n.sendEntries(id, addr, n.appendRequestLocked(id))
+		}
+	}
+}
+
+func (n *Node) sendSnapshot(id, addr string) {
+	snap, err := n.storage.loadSnapshot()
+	n.mu.Lock()
+	if err != nil || snap == nil || n.role != Leader {
+		n.inflight[id] = false
+		n.mu.Unlock()
+		return
+	}
+	req := &InstallSnapshotRequest{
+		Term:     n.term,
+		LeaderID: n.opts.ID,
+		Index:    snap.Index,
+		LastTerm: snap.Term,
+		Config:   snap.Config,
+		Data:     snap.Data,
+	}
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.opts.ElectionTimeout)
+	defer cancel()
+	resp, err := n.opts.Transport.InstallSnapshot(ctx, addr, req)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.inflight[id] = false
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "")
+		n.resetElectionDeadline()
+		return
+	}
+	if n.role != Leader || n.term != req.Term {
+		return
+	}
+	if req.Index > n.matchIndex[id] {
+		n.matchIndex[id] = req.Index
+	}
+	n.nextIndex[id] = n.matchIndex[id] + 1
+	n.advanceCommitLocked()
+}
+
+// advanceCommitLocked commits the highest entry of the current term that a
+// quorum of members has stored.
+func (n *Node) advanceCommitLocked() {
+	matches := make([]uint64, 0, len(n.config))
+	for id := range n.config {
+		if id == n.opts.ID {
+			matches = append(matches, n.lastIndex())
+		} else {
+			matches = append(matches, n.matchIndex[id])
+		}
+	}
+	if len(matches) == 0 {
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i] > matches[j] })
+	committed := matches[n.quorum()-1]
+	if committed > n.commitIndex && committed > n.log[0].Index && n.entry(committed).Term == n.term {
+		n.commitIndex = committed
+		n.signalApply()
+	}
+}
+
+// HandleAppendEntries stores entries sent by the leader. It returns nil if the
+// leader is isolated from us.
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isolated[req.LeaderID] {
+		return nil
+	}
+	resp := &AppendEntriesResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp
+	}
+	n.becomeFollowerLocked(req.Term, req.LeaderID)
+	n.resetElectionDeadline()
+	resp.Term = n.term
+
+	if req.PrevLogIndex > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp
+	}
+	entries := req.Entries
+	if req.PrevLogIndex < n.log[0].Index {
+		// The start of the request is already in our snapshot; skip it.
+		skip := n.log[0].Index - req.PrevLogIndex
+		if skip >= uint64(len(entries)) {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+	} else if term := n.entry(req.PrevLogIndex).Term; term != req.PrevLogTerm {
+		// Skip back over the whole conflicting term in one go.
+		i := req.PrevLogIndex
+		for i > n.log[0].Index+1 && n.entry(i-1).Term == term {
+			i--
+		}
+		resp.ConflictIndex = i
+		return resp
+	}
+
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.entry(e.Index).Term == e.Term {
+				continue
+			}
+			if err := n.truncateLocked(e.Index); err != nil {
+				return resp
+			}
+		}
+		if err := n.appendLocked(entries[i:]...); err != nil {
+			return resp
+		}
+		break
+	}
+
+	lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+	if req.LeaderCommit > n.commitIndex {
+		commit := req.LeaderCommit
+		if lastNew < commit {
+			commit = lastNew
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.signalApply()
+		}
+	}
+	resp.Success = true
+	return resp
+}
+
+// HandleInstallSnapshot replaces our state with the leader's snapshot. It
+// returns nil if the leader is isolated from us.
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isolated[req.LeaderID] {
+		return nil
+	}
+	if req.Term < n.term {
+		return &InstallSnapshotResponse{Term: n.term}
+	}
+	n.becomeFollowerLocked(req.Term, req.LeaderID)
+	n.resetElectionDeadline()
+	resp := &InstallSnapshotResponse{Term: n.term}
+	if req.Index <= n.lastApplied {
+		return resp // Nothing new in it
+	}
+
+	snap := &snapshot{Index: req.Index, Term: req.LastTerm, Config: req.Config, Data: req.Data}
+	if err := n.storage.saveSnapshot(snap); err != nil {
+		return resp
+	}
+	if err := n.opts.FSM.Restore(req.Data); err != nil {
+		return resp
+	}
+	if req.Index <= n.lastIndex() && n.entry(req.Index).Term == req.LastTerm {
+		n.log = append([]Entry{{Index: req.Index, Term: req.LastTerm}}, n.log[req.Index-n.log[0].Index+1:]...)
+	} else {
+		n.log = []Entry{{Index: req.Index, Term: req.LastTerm}}
+	}
+	n.snapshotConfig = req.Config
+	n.recomputeConfig()
+	_ = n.storage.rewriteLog(n.log[1:])
+	n.lastApplied = req.Index
+	if n.commitIndex < req.Index {
+		n.commitIndex = req.Index
+	}
+	return resp
+}
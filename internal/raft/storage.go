@@ -0,0 +1,202 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFile    = "state.json"
+	logFile      = "raft.log"
+	snapshotFile = "snapshot.json"
+)
+
+// snapshot is the state machine as of Index, along with the membership at
+// that point.
+type snapshot struct {
+	Index  uint64            `json:"index"`
+	Term   uint64            `json:"term"`
+	Config map[string]string `json:"config"`
+	Data   []byte            `json:"data"`
+}
+
+// storage keeps a node's durable state in a directory: the current term and
+// vote, the log as one JSON entry per line, and the latest snapshot.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create raft directory: %w", err)
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open raft log: %w", err)
+	}
+	s := &storage{dir: dir, log: log}
+	if err := s.syncDir(); err != nil { // The log may have just been created
+		log.Close()
+		return nil, fmt.Errorf("cannot sync raft directory: %w", err)
+	}
+	return s, nil
+}
+
+func (s *storage) saveState(term uint64, votedFor string) error {
+	data, err := json.Marshal(struct {
+		Term     uint64 `json:"term"`
+		VotedFor string `json:"voted_for"`
+	}{term, votedFor})
+	if err != nil {
+		return err
+	}
+	return s.writeAtomically(stateFile, data)
+}
+
+func (s *storage) loadState() (uint64, string, error) {
+	var state struct {
+		Term     uint64 `json:"term"`
+		VotedFor string `json:"voted_for"`
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, stateFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, "", fmt.Errorf("corrupt raft state: %w", err)
+	}
+	return state.Term, state.VotedFor, nil
+}
+
+func (s *storage) appendLog(entries []Entry) error {
+	w := bufio.NewWriter(s.log)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+func (s *storage) loadLog() ([]Entry, error) {
+	if _, err := s.log.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	scanner := bufio.NewScanner(s.log)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break // A torn write at the tail; everything before it is intact
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// rewriteLog replaces the log file with exactly entries.
+func (s *storage) rewriteLog(entries []Entry) error {
+	tmp := filepath.Join(s.dir, logFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, filepath.Join(s.dir, logFile)); err != nil {
+		return err
+	}
+	if err := s.syncDir(); err != nil {
+		return err
+	}
+	s.log.Close()
+	s.log, err = os.OpenFile(filepath.Join(s.dir, logFile), os.O_RDWR|os.O_APPEND, 0600)
+	return err
+}
+
+func (s *storage) saveSnapshot(snap *snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	return s.writeAtomically(snapshotFile, data)
+}
+
+// loadSnapshot returns nil if no snapshot has been taken yet.
+func (s *storage) loadSnapshot() (*snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("corrupt raft snapshot: %w", err)
+	}
+	return &snap, nil
+}
+
+// writeAtomically replaces the file name with data, syncing both the file
+// and the directory so that the new contents survive a power loss.
+func (s *storage) writeAtomically(name string, data []byte) error {
+	tmp := filepath.Join(s.dir, name+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, name)); err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// syncDir makes renames inside the directory durable.
+func (s *storage) syncDir() error {
+	d, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,136 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Transport carries RPCs between nodes. addr is the member's address as
+// recorded in the cluster configuration.
+type Transport interface {
+	RequestVote(ctx context.Context, addr string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(ctx context.Context, addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(ctx context.Context, addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// HTTPTransport sends RPCs as JSON POSTs to the paths served by Handler,
+// under addr, which is a base URL such as https://localhost:8080. Every
+// call carries Token, the secret shared by the members of the cluster.
+type HTTPTransport struct {
+	Client *http.Client
+	Token  string
+}
+
+func NewHTTPTransport(client *http.Client, token string) *HTTPTransport {
+	return &HTTPTransport{Client: client, Token: token}
+}
+
+func (t *HTTPTransport) RequestVote(ctx context.Context, addr string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	resp := &RequestVoteResponse{}
+	return resp, t.call(ctx, addr+"/raft/vote", req, resp)
+}
+
+func (t *HTTPTransport) AppendEntries(ctx context.Context, addr string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	resp := &AppendEntriesResponse{}
+	return resp, t.call(ctx, addr+"/raft/append", req, resp)
+}
+
+func (t *HTTPTransport) InstallSnapshot(ctx context.Context, addr string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	resp := &InstallSnapshotResponse{}
+	return resp, t.call(ctx, addr+"/raft/snapshot", req, resp)
+}
+
+func (t *HTTPTransport) call(ctx context.Context, url string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+t.Token)
+	res, err := t.Client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// Handler serves the RPCs sent by HTTPTransport. Requests without the
+// cluster token are refused, and those from isolated peers are answered
+// with 503 so the sender sees them as lost.
+func (n *Node) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/raft/vote", func(w http.ResponseWriter, r *http.Request) {
+		var req RequestVoteRequest
+		if decodeRPC(w, r, &req) {
+			if resp := n.HandleRequestVote(&req); resp != nil {
+				writeRPC(w, resp)
+			} else {
+				http.Error(w, "partitioned", http.StatusServiceUnavailable)
+			}
+		}
+	})
+	mux.HandleFunc("/raft/append", func(w http.ResponseWriter, r *http.Request) {
+		var req AppendEntriesRequest
+		if decodeRPC(w, r, &req) {
+			if resp := n.HandleAppendEntries(&req); resp != nil {
+				writeRPC(w, resp)
+			} else {
+				http.Error(w, "partitioned", http.StatusServiceUnavailable)
+			}
+		}
+	})
+	mux.HandleFunc("/raft/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		var req InstallSnapshotRequest
+		if decodeRPC(w, r, &req) {
+			if resp := n.HandleInstallSnapshot(&req); resp != nil {
+				writeRPC(w, resp)
+			} else {
+				http.Error(w, "partitioned", http.StatusServiceUnavailable)
+			}
+		}
+	})
+	return n.requireToken(mux)
+}
+
+// requireToken rejects requests not carrying the cluster token, so that
+// only members can vote, append entries or install snapshots.
+func (n *Node) requireToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + n.opts.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if n.opts.Token == "" || subtle.ConstantTimeCompare(got, want) != 1 {
+			http.Error(w, "cluster token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func decodeRPC(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeRPC(w http.ResponseWriter, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
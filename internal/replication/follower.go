@@ -0,0 +1,195 @@
+package replication
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"melon/internal/service"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const reconnectDelay = time.Second // Pause between attempts to reach the leader
+
+type Role string
+
+const (
+	RoleLeader   Role = "leader"
+	RoleFollower Role = "follower"
+)
+
+var ErrorNotFollower = errors.New("node is not a follower")
+
+// log receives replication diagnostics; see SetLogger.
+var log = zap.NewNop()
+
+// SetLogger makes replication report to l.
+func SetLogger(l *zap.Logger) {
+	log = l.Named("replication")
+}
+
+// state is this node's view of replication. A node starts as a leader unless
+// Follow is called.
+var state = struct {
+	sync.RWMutex
+	role           Role
+	leader         string // Base URL of the leader, when following
+	applied        uint64 // Last leader sequence applied locally
+	leaderSequence uint64 // Last sequence the leader reported
+	lastContact    time.Time
+	stop           context.CancelFunc
+}{role: RoleLeader}
+
+// Status describes this node's replication role and, for a follower, how far
+// it trails the leader.
+type Status struct {
+	Role           Role       `json:"role"`
+	Leader         string     `json:"leader,omitempty"`
+	LastSequence   uint64     `json:"last_sequence"`
+	LeaderSequence uint64     `json:"leader_sequence,omitempty"`
+	Lag            uint64     `json:"lag_events"`
+	LastContact    *time.Time `json:"last_contact,omitempty"`
+}
+
+func CurrentStatus() Status {
+	state.RLock()
+	defer state.RUnlock()
+	if state.role == RoleLeader {
+		return Status{Role: RoleLeader, LastSequence: service.LastSequence()}
+	}
+	s := Status{
+		Role:           RoleFollower,
+		Leader:         state.leader,
+		LastSequence:   state.applied,
+		LeaderSequence: state.leaderSequence,
+	}
+	if state.leaderSequence > state.applied {
+		s.Lag = state.leaderSequence - state.applied
+	}
+	if !state.lastContact.IsZero() {
+		lastContact := state.lastContact
+		s.LastContact = &lastContact
+	}
+	return s
+}
+
+// IsLeader reports whether this node accepts writes.
+func IsLeader() bool {
+	state.RLock()
+	defer state.RUnlock()
+	return state.role == RoleLeader
+}
+
+// Leader returns the base URL of the leader this node follows, if any.
+func Leader() string {
+	state.RLock()
+	defer state.RUnlock()
+	return state.leader
+}
+
+// Follow turns this node into a read-only follower of the leader at
+// leaderURL and starts streaming its events in the background. It must be
+// called after the local transaction log has been replayed.
+func Follow(leaderURL string, client *http.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	state.Lock()
+	state.role = RoleFollower
+	state.leader = leaderURL
+	state.applied = service.LastSequence()
+	state.stop = cancel
+	state.Unlock()
+
+	go func() {
+		for ctx.Err() == nil {
+			if err := follow(ctx, leaderURL, client); err != nil && ctx.Err() == nil {
+				log.Warn("replication interrupted; reconnecting", zap.String("leader", leaderURL), zap.Error(err))
+			}
+			select {
+			case <-time.After(reconnectDelay):
+			case <-ctx.Done():
+			}
+		}
+	}()
+}
+
+// Promote stops following the leader and makes this node accept writes.
+func Promote() error {
+	state.Lock()
+	defer state.Unlock()
+	if state.role != RoleFollower {
+		return ErrorNotFollower
+	}
+	state.stop()
+	state.role = RoleLeader
+	state.leader = ""
+	state.stop = nil
+	log.Info("promoted to leader", zap.Uint64("sequence", state.applied))
+	return nil
+}
+
+// follow streams events from the leader until the connection drops or ctx is
+// cancelled.
+func follow(ctx context.Context, leaderURL string, client *http.Client) error {
+	state.RLock()
+	from := state.applied + 1
+	state.RUnlock()
+
+	url := leaderURL + "/v1/replication/events?from=" + strconv.FormatUint(from, 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach leader: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded %s", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024) // Values may be large
+	for scanner.Scan() {
+		var m Message
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			return fmt.Errorf("bad replication message: %w", err)
+		}
+		if err := apply(m); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("replication stream broken: %w", err)
+	}
+	return errors.New("leader closed the replication stream")
+}
+
+func apply(m Message) error {
+	state.Lock()
+	defer state.Unlock()
+	if state.role != RoleFollower {
+		return ErrorNotFollower // Promoted while this message was in flight
+	}
+	state.lastContact = time.Now()
+	state.leaderSequence = m.LeaderSequence
+	if m.Event == nil {
+		return nil
+	}
+	// A compacted leader log skips the sequence numbers of superseded
+	// events, so only going backwards is an error.
+	if m.Event.Sequence <= state.applied {
+		return fmt.Errorf("expected an event after %d, leader sent %d", state.applied, m.Event.Sequence)
+	}
+	if err := service.Apply(context.Background(), *m.Event); err != nil {
+		return fmt.Errorf("cannot apply event %d: %w", m.Event.Sequence, err)
+	}
+	state.applied = m.Event.Sequence
+	log.Debug("event applied", zap.Uint64("sequence", m.Event.Sequence), zap.String("key", m.Event.Key))
+	return nil
+}
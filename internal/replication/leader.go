@@ -0,0 +1,79 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"melon/internal/service"
+	"melon/internal/transaction"
+	"time"
+)
+
+const heartbeatInterval = time.Second // How often an idle stream reports the leader's position
+
+// ErrorSubscriberDropped is returned when a follower falls too far behind the
+// live feed; it is expected to reconnect from its last applied sequence.
+var ErrorSubscriberDropped = errors.New("replication subscriber fell behind")
+
+// Message is a single line of the replication stream. Heartbeats carry no
+// event and only report how far the leader's log has advanced.
+type Message struct {
+	Event          *transaction.Event `json:"event,omitempty"`
+	LeaderSequence uint64             `json:"leader_sequence"`
+}
+
+// Stream writes every event from sequence number from onwards to w as
+// newline delimited JSON, first from the log and then live as new events are
+// written, until ctx is done. flush is called after every message.
+func Stream(ctx context.Context, from uint64, w io.Writer, flush func()) error {
+	live, cancel := service.Subscribe() // Subscribe first so no event slips between backlog and feed
+	defer cancel()
+
+	enc := json.NewEncoder(w)
+	send := func(m Message) error {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		flush()
+		return nil
+	}
+
+	next := from
+	events, errs := service.ReadEventsFrom(from)
+	for e := range events {
+		e := e
+		if err := send(Message{Event: &e, LeaderSequence: service.LastSequence()}); err != nil {
+			return err
+		}
+		next = e.Sequence + 1
+	}
+	if err := <-errs; err != nil {
+		return fmt.Errorf("cannot read backlog: %w", err)
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-live:
+			if !ok {
+				return ErrorSubscriberDropped
+			}
+			if e.Sequence < next { // Already sent from the backlog
+				continue
+			}
+			if err := send(Message{Event: &e, LeaderSequence: service.LastSequence()}); err != nil {
+				return err
+			}
+			next = e.Sequence + 1
+		case <-ticker.C:
+			if err := send(Message{LeaderSequence: service.LastSequence()}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"melon/internal/transaction"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Permission is a set of operations a principal may perform on keys.
+type Permission uint8
+
+const (
+	PermissionRead Permission = 1 << iota
+	PermissionWrite
+	PermissionDelete
+)
+
+var permissionLetters = []struct {
+	p      Permission
+	letter byte
+}{{PermissionRead, 'r'}, {PermissionWrite, 'w'}, {PermissionDelete, 'd'}}
+
+// String renders p as letters, e.g. "rw" for read and write.
+func (p Permission) String() string {
+	var b strings.Builder
+	for _, l := range permissionLetters {
+		if p&l.p != 0 {
+			b.WriteByte(l.letter)
+		}
+	}
+	return b.String()
+}
+
+func (p Permission) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Permission) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParsePermission(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// ParsePermission reads letters written by Permission.String.
+func ParsePermission(s string) (Permission, error) {
+	var p Permission
+next:
+	for i := 0; i < len(s); i++ {
+		for _, l := range permissionLetters {
+			if s[i] == l.letter {
+				p |= l.p
+				continue next
+			}
+		}
+		return 0, fmt.Errorf("unknown permission %q", s[i])
+	}
+	return p, nil
+}
+
+// Grant allows Principal to perform Permissions on every key in Namespace
+// starting with Prefix. An empty prefix covers every key in the namespace.
+type Grant struct {
+	Principal   string     `json:"principal"`
+	Namespace   string     `json:"namespace,omitempty"`
+	Prefix      string     `json:"prefix"`
+	Permissions Permission `json:"permissions"`
+}
+
+// scope is the set of keys a grant covers.
+type scope struct {
+	namespace string
+	prefix    string
+}
+
+// grantValue is how a grant is recorded in the Value of a transaction event.
+type grantValue struct {
+	Prefix      string `json:"prefix"`
+	Permissions string `json:"permissions,omitempty"`
+}
+
+var acl = struct {
+	sync.RWMutex
+	grants map[string]map[scope]Permission // Principal to scope to permissions
+}{grants: make(map[string]map[scope]Permission)}
+
+// GrantEvent builds the event that gives g to its principal.
+func GrantEvent(g Grant) transaction.Event {
+	value, _ := json.Marshal(grantValue{Prefix: g.Prefix, Permissions: g.Permissions.String()})
+	return transaction.Event{EventType: transaction.EventGrant, Namespace: g.Namespace, Key: g.Principal, Value: string(value)}
+}
+
+// RevokeEvent builds the event that takes every permission on prefix in
+// namespace ns away from principal.
+func RevokeEvent(principal, ns, prefix string) transaction.Event {
+	value, _ := json.Marshal(grantValue{Prefix: prefix})
+	return transaction.Event{EventType: transaction.EventRevoke, Namespace: ns, Key: principal, Value: string(value)}
+}
+
+func applyGrant(e transaction.Event) error {
+	var v grantValue
+	if err := json.Unmarshal([]byte(e.Value), &v); err != nil {
+		return fmt.Errorf("bad grant: %w", err)
+	}
+	p, err := ParsePermission(v.Permissions)
+	if err != nil {
+		return err
+	}
+	acl.Lock()
+	defer acl.Unlock()
+	if acl.grants[e.Key] == nil {
+		acl.grants[e.Key] = make(map[scope]Permission)
+	}
+	acl.grants[e.Key][scope{e.Namespace, v.Prefix}] = p
+	return nil
+}
+
+func applyRevoke(e transaction.Event) error {
+	var v grantValue
+	if err := json.Unmarshal([]byte(e.Value), &v); err != nil {
+		return fmt.Errorf("bad revoke: %w", err)
+	}
+	acl.Lock()
+	defer acl.Unlock()
+	delete(acl.grants[e.Key], scope{e.Namespace, v.Prefix})
+	if len(acl.grants[e.Key]) == 0 {
+		delete(acl.grants, e.Key)
+	}
+	return nil
+}
+
+// Allowed reports whether principal holds p on key in namespace ns through
+// any grant.
+func Allowed(principal, ns, key string, p Permission) bool {
+	acl.RLock()
+	defer acl.RUnlock()
+	for s, granted := range acl.grants[principal] {
+		if granted&p == p && s.namespace == ns && strings.HasPrefix(key, s.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Grants returns every grant, ordered by principal, namespace and prefix.
+func Grants() []Grant {
+	acl.RLock()
+	defer acl.RUnlock()
+	grants := make([]Grant, 0)
+	for principal, scopes := range acl.grants {
+		for s, p := range scopes {
+			grants = append(grants, Grant{Principal: principal, Namespace: s.namespace, Prefix: s.prefix, Permissions: p})
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Principal != grants[j].Principal {
+			return grants[i].Principal < grants[j].Principal
+		}
+		if grants[i].Namespace != grants[j].Namespace {
+			return grants[i].Namespace < grants[j].Namespace
+		}
+		return grants[i].Prefix < grants[j].Prefix
+	})
+	return grants
+}
+
+// restoreGrants replaces every grant with grants.
+func restoreGrants(grants []Grant) {
+	acl.Lock()
+	defer acl.Unlock()
+	acl.grants = make(map[string]map[scope]Permission)
+	for _, g := range grants {
+		if acl.grants[g.Principal] == nil {
+			acl.grants[g.Principal] = make(map[scope]Permission)
+		}
+		acl.grants[g.Principal][scope{g.Namespace, g.Prefix}] = g.Permissions
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"melon/concurrency_patterns"
+	"melon/internal/transaction"
+	"sync"
+)
+
+var (
+	ErrorReadOnly     = errors.New("store is read-only")
+	ErrorNotSupported = errors.New("not supported by this transaction log")
+)
+
+var readOnly = struct {
+	sync.RWMutex
+	on bool
+}{}
+
+// SetReadOnly makes Commit refuse every write while on. Events committed
+// elsewhere, such as by a Raft leader, are still applied.
+func SetReadOnly(on bool) {
+	readOnly.Lock()
+	readOnly.on = on
+	readOnly.Unlock()
+	log.Info("read-only mode changed", zap.Bool("read_only", on))
+}
+
+func ReadOnly() bool {
+	readOnly.RLock()
+	defer readOnly.RUnlock()
+	return readOnly.on
+}
+
+// Compact drops the logged events no longer needed to rebuild the store.
+func Compact(ctx context.Context) (transaction.CompactStats, error) {
+	c, ok := logger.(transaction.Compactor)
+	if !ok {
+		return transaction.CompactStats{}, ErrorNotSupported
+	}
+	return c.Compact(ctx)
+}
+
+// RotateLog archives the log and continues in a compacted copy, returning
+// where the archive was written.
+func RotateLog(ctx context.Context) (string, transaction.CompactStats, error) {
+	r, ok := logger.(transaction.Rotator)
+	if !ok {
+		return "", transaction.CompactStats{}, ErrorNotSupported
+	}
+	return r.Rotate(ctx)
+}
+
+// Stats summarizes the size of the store.
+type Stats struct {
+	Keys       int          `json:"keys"`
+	Bytes      int64        `json:"bytes"` // Total length of every key and value
+	Namespaces int          `json:"namespaces"`
+	Sequence   uint64       `json:"last_sequence"`
+	Shards     ShardBalance `json:"shards"`
+}
+
+// ShardBalance is how evenly the keys would spread over a sharded map.
+type ShardBalance struct {
+	Counts    []int   `json:"counts"` // Keys per shard
+	Min       int     `json:"min"`
+	Max       int     `json:"max"`
+	Imbalance float64 `json:"imbalance"` // Largest shard over the mean; 1 is perfectly even
+}
+
+// StoreStats counts the keys in every namespace, and spreads them over
+// nshards as a concurrency_patterns.ShardedMap would.
+func StoreStats(nshards int) Stats {
+	s := Stats{Shards: ShardBalance{Counts: make([]int, nshards)}}
+	store.RLock()
+	for name, n := range store.ns {
+		if name != DefaultNamespace {
+			s.Namespaces++
+		}
+		s.Keys += len(n.m)
+		s.Bytes += n.bytes
+		for key := range n.m {
+			if name != DefaultNamespace {
+				key = name + "/" + key
+			}
+			s.Shards.Counts[concurrency_patterns.ShardIndex(key, nshards)]++
+		}
+	}
+	store.RUnlock()
+	if logger != nil {
+		s.Sequence = logger.LastSequence()
+	}
+
+	b := &s.Shards
+	b.Min = b.Counts[0]
+	for _, c := range b.Counts {
+		if c < b.Min {
+			b.Min = c
+		}
+		if c > b.Max {
+			b.Max = c
+		}
+	}
+	if s.Keys > 0 {
+		b.Imbalance = float64(b.Max) / (float64(s.Keys) / float64(nshards))
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel/attribute"
+	"melon/internal/transaction"
+)
+
+// commitBatch commits events as one batch, so that they are logged,
+// replicated and applied together or not at all, at the time of the first.
+// A single event is committed as it is. It must be called with txnMu held.
+func commitBatch(ctx context.Context, events []transaction.Event) error {
+	if len(events) == 1 {
+		return commit(ctx, events[0])
+	}
+	batch := transaction.BatchEvent(events)
+	batch.CreatedAt = events[0].CreatedAt
+	return commit(ctx, batch)
+}
+
+// applyBatch checks that every event of the batch e can be applied before
+// applying any, then applies them all under one lock of the store, so that
+// readers see either none of them or all of them.
+func applyBatch(ctx context.Context, e transaction.Event) error {
+	_, span := startSpan(ctx, "service.Batch", attribute.Int64("melon.sequence", int64(e.Sequence)))
+	defer span.End()
+	events, err := e.Events()
+	if err != nil {
+		return err
+	}
+	steps := make([]func(), len(events))
+	cleared := make(map[txnKey]bool) // Keys whose last event so far is a delete
+	for i, e := range events {
+		k := txnKey{e.Namespace, e.Key}
+		if steps[i], err = batchStep(e, cleared[k]); err != nil {
+			return fmt.Errorf("event %d of batch: %w", i, err)
+		}
+		cleared[k] = e.EventType == transaction.EventDelete
+	}
+	store.Lock()
+	defer store.Unlock()
+	for _, step := range steps {
+		step()
+	}
+	return nil
+}
+
+// batchStep returns what applies e, to be called with the store locked.
+// Only puts and deletes, and the expiries, flags and leases of keys, can be
+// batched, and operations on lists, sets and hashes right after a delete of
+// their key, when their outcome does not depend on what the key held.
+func batchStep(e transaction.Event, cleared bool) (func(), error) {
+	if isTypedEvent(e.EventType) && cleared {
+		return typedStep(e)
+	}
+	switch e.EventType {
+	case transaction.EventPut:
+		return func() { putLocked(e.Namespace, e.Key, e.Value, e.CreatedAt) }, nil
+	case transaction.EventDelete:
+		return func() { deleteLocked(e.Namespace, e.Key) }, nil
+	case transaction.EventExpire:
+		t, err := parseExpiry(e.Value)
+		return func() { expireLocked(e.Namespace, e.Key, t) }, err
+	case transaction.EventFlags:
+		flags, err := parseFlags(e.Value)
+		return func() { flagsLocked(e.Namespace, e.Key, flags) }, err
+	case transaction.EventLeaseAttach:
+		id, err := parseLeaseID(e.Value)
+		return func() { attachLocked(e.Namespace, e.Key, id) }, err
+	}
+	return nil, fmt.Errorf("event type %d cannot be batched", e.EventType)
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"melon/internal/transaction"
+	"testing"
+	"time"
+)
+
+func TestPutWithExpiryIsOneEvent(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	start := LastSequence()
+	expires := time.Now().Add(time.Hour)
+	if err := PutWithExpiry(ctx, "", "batched-put", "v", expires); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, start+1)
+	if seq := LastSequence(); seq != start+1 {
+		t.Fatalf("logged %d events, want 1", seq-start)
+	}
+	_, meta, err := GetWithMeta(ctx, "", "batched-put")
+	if err != nil || !meta.ExpiresAt.Equal(expires) {
+		t.Errorf("got %+v %v, want the put to expire at %v", meta, err, expires)
+	}
+	history, err := History("", "batched-put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := history[len(history)-1] // Earlier runs of the test left versions too
+	if last.Sequence != start+1 || last.EventType != transaction.EventPut || last.Value != "v" {
+		t.Errorf("latest version is %+v, want the put", last)
+	}
+}
+
+func TestBadBatchAppliesNothing(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	batch := transaction.BatchEvent([]transaction.Event{
+		{EventType: transaction.EventPut, Key: "half-batch", Value: "v"},
+		{EventType: transaction.EventFlags, Key: "half-batch", Value: "not a number"},
+	})
+	if err := Apply(ctx, batch); err == nil {
+		t.Fatal("applied a batch with bad flags")
+	}
+	if _, err := GetIn(ctx, "", "half-batch"); err != ErrorNoSuchKey {
+		t.Errorf("the put of a failed batch was applied: %v", err)
+	}
+}
+
+func TestImportKeepsTypeExpiryAndFlags(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	if err := PutIn(ctx, "", "imported-list", "was a string"); err != nil {
+		t.Fatal(err)
+	}
+	start := LastSequence()
+	expires := time.Now().Add(time.Hour)
+	meta := KeyMeta{Type: TypeList, ExpiresAt: expires, Flags: 7}
+	if err := Import(ctx, "", "imported-list", `["a","b"]`, meta); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, start+1)
+	if seq := LastSequence(); seq != start+1 {
+		t.Fatalf("logged %d events, want 1", seq-start)
+	}
+	list, err := ListRange(ctx, "", "imported-list", 0, -1)
+	if err != nil || len(list) != 2 || list[0] != "a" || list[1] != "b" {
+		t.Errorf("got list %q %v, want [a b]", list, err)
+	}
+	_, got, err := GetWithMeta(ctx, "", "imported-list")
+	if err != nil || got.Type != TypeList || !got.ExpiresAt.Equal(expires) || got.Flags != 7 {
+		t.Errorf("got %+v %v, want %+v", got, err, meta)
+	}
+	if err := Import(ctx, "", "imported-list", "v", KeyMeta{Lease: 1}); err != ErrorLeased {
+		t.Errorf("imported a leased key: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+)
+
+// CompareAndSwap sets key in namespace ns to new if it currently holds old,
+// reporting whether it did. Like a put, it clears any expiry and flags.
+func CompareAndSwap(ctx context.Context, ns, key, old, new string) (bool, error) {
+	swapped, _, err := Txn(ctx,
+		[]Compare{{Namespace: ns, Key: key, Target: CompareValue, Result: CompareEqual, Value: old}},
+		[]TxnOp{{Type: TxnPut, Namespace: ns, Key: key, Value: new}}, nil)
+	return swapped, err
+}
+
+// PutIfAbsent sets key in namespace ns to value unless it exists, reporting
+// whether it did.
+func PutIfAbsent(ctx context.Context, ns, key, value string) (bool, error) {
+	return PutIfAbsentWithLease(ctx, ns, key, value, 0)
+}
+
+// PutIfAbsentWithLease is PutIfAbsent attaching the new key to lease, so
+// that it is deleted when the lease ends: the usual way to take a lock. It
+// fails with ErrorNoSuchLease if the lease has ended.
+func PutIfAbsentWithLease(ctx context.Context, ns, key, value string, lease int64) (bool, error) {
+	if lease != 0 {
+		if _, err := LeaseInfo(lease); err != nil {
+			return false, err
+		}
+	}
+	put, _, err := Txn(ctx,
+		[]Compare{{Namespace: ns, Key: key, Target: CompareVersion, Result: CompareEqual, Version: 0}},
+		[]TxnOp{{Type: TxnPut, Namespace: ns, Key: key, Value: value, Lease: lease}}, nil)
+	return put, err
+}
+
+// DeleteIfValue deletes key from namespace ns if it holds value, reporting
+// whether it did.
+func DeleteIfValue(ctx context.Context, ns, key, value string) (bool, error) {
+	deleted, _, err := Txn(ctx,
+		[]Compare{{Namespace: ns, Key: key, Target: CompareValue, Result: CompareEqual, Value: value}},
+		[]TxnOp{{Type: TxnDelete, Namespace: ns, Key: key}}, nil)
+	return deleted, err
+}
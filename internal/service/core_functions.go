@@ -1,37 +1,224 @@
 package service
 
 import (
+	"context"
 	"errors"
+	"go.opentelemetry.io/otel/attribute"
 	"sync"
+	"time"
 )
 
+// DefaultNamespace holds the keys written through the un-namespaced API.
+const DefaultNamespace = ""
+
+// namespace is the contents of one namespace, with running totals for
+// enforcing its quota.
+type namespace struct {
+	m        map[string]string
+	meta     map[string]KeyMeta
+	expiring map[string]bool // Keys with an expiry, for RunExpiry to check
+	bytes    int64           // Total length of every key and value
+	quota    Quota
+}
+
+func newNamespace() *namespace {
+	return &namespace{m: make(map[string]string), meta: make(map[string]KeyMeta), expiring: make(map[string]bool)}
+}
+
+// KeyMeta describes the current value of a key.
+type KeyMeta struct {
+	Version   uint64    `json:"version"` // Puts since the key was created, starting at 1
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	ExpiresAt time.Time `json:"expires_at"`      // Zero if the key does not expire
+	Flags     uint32    `json:"flags,omitempty"` // Opaque to melon; set by memcached clients
+	Type      ValueType `json:"type,omitempty"`  // Empty for a plain string
+	Lease     int64     `json:"lease,omitempty"` // The lease whose revocation deletes the key; zero for none
+}
+
 var store = struct {
 	sync.RWMutex
-	m map[string]string
-}{m: make(map[string]string)}
+	ns      map[string]*namespace
+	indexes map[string]*index // Kept in step with ns under the same lock
+}{ns: make(map[string]*namespace), indexes: make(map[string]*index)}
 
 func Put(key string, value string) error {
-	store.Lock()
-	store.m[key] = value
-	store.Unlock()
-	return nil
+	return PutIn(context.Background(), DefaultNamespace, key, value)
 }
 
 var ErrorNoSuchKey = errors.New("no such key") // sentinel error
 
 func Get(key string) (string, error) {
-	store.RLock()
-	value, ok := store.m[key]
-	store.RUnlock()
+	return GetIn(context.Background(), DefaultNamespace, key)
+}
+
+func Delete(key string) error {
+	return DeleteIn(context.Background(), DefaultNamespace, key)
+}
+
+// PutIn sets key in namespace ns, creating the namespace if needed.
+func PutIn(ctx context.Context, ns, key, value string) error {
+	return put(ctx, ns, key, value, time.Now())
+}
+
+// put sets key as written at t.
+func put(ctx context.Context, ns, key, value string, t time.Time) error {
+	_, span := startSpan(ctx, "service.Put", attribute.String("melon.namespace", ns), attribute.String("melon.key", key))
+	defer span.End()
+	store.Lock()
+	defer store.Unlock()
+	putLocked(ns, key, value, t)
+	return nil
+}
+
+// putLocked is put with the store already locked.
+func putLocked(ns, key, value string, t time.Time) {
+	n := store.ns[ns]
+	if n == nil {
+		n = newNamespace()
+		store.ns[ns] = n
+	}
+	if old, ok := n.m[key]; ok {
+		n.bytes -= int64(len(key) + len(old))
+		unindex(ns, key, old)
+	}
+	meta, ok := n.meta[key]
 	if !ok {
-		return "", ErrorNoSuchKey
+		meta.CreatedAt = t
 	}
-	return value, nil
+	meta.Version++
+	meta.UpdatedAt = t
+	meta.ExpiresAt = time.Time{} // Overwriting a key clears its expiry, flags and lease
+	meta.Flags = 0
+	meta.Lease = 0
+	meta.Type = TypeString
+	delete(n.expiring, key)
+	n.meta[key] = meta
+	n.m[key] = value
+	n.bytes += int64(len(key) + len(value))
+	reindex(ns, key, value)
 }
 
-func Delete(key string) error {
+func GetIn(ctx context.Context, ns, key string) (string, error) {
+	value, _, err := GetWithMeta(ctx, ns, key)
+	return value, err
+}
+
+// GetWithMeta returns the value of key in namespace ns along with its
+// version and timestamps.
+func GetWithMeta(ctx context.Context, ns, key string) (string, KeyMeta, error) {
+	_, span := startSpan(ctx, "service.Get", attribute.String("melon.namespace", ns), attribute.String("melon.key", key))
+	defer span.End()
+	store.RLock()
+	defer store.RUnlock()
+	n := store.ns[ns]
+	if n == nil {
+		return "", KeyMeta{}, ErrorNoSuchKey
+	}
+	value, ok := n.m[key]
+	if !ok || expired(n.meta[key], time.Now()) {
+		return "", KeyMeta{}, ErrorNoSuchKey
+	}
+	return value, n.meta[key], nil
+}
+
+// DeleteIn removes key from namespace ns. A namespace disappears with its
+// last key unless it has a quota.
+func DeleteIn(ctx context.Context, ns, key string) error {
+	_, span := startSpan(ctx, "service.Delete", attribute.String("melon.namespace", ns), attribute.String("melon.key", key))
+	defer span.End()
 	store.Lock()
-	delete(store.m, key)
-	store.Unlock()
+	defer store.Unlock()
+	deleteLocked(ns, key)
 	return nil
 }
+
+// deleteLocked is DeleteIn with the store already locked.
+func deleteLocked(ns, key string) {
+	n := store.ns[ns]
+	if n == nil {
+		return
+	}
+	if old, ok := n.m[key]; ok {
+		n.bytes -= int64(len(key) + len(old))
+		unindex(ns, key, old)
+		delete(n.m, key)
+		delete(n.meta, key)
+		delete(n.expiring, key)
+	}
+	if len(n.m) == 0 && n.quota == (Quota{}) {
+		delete(store.ns, ns)
+	}
+}
+
+// Dump returns a copy of every key and value in the default namespace.
+func Dump() map[string]string {
+	return DumpIn(DefaultNamespace)
+}
+
+// DumpIn returns a copy of every key and value in namespace ns.
+func DumpIn(ns string) map[string]string {
+	store.RLock()
+	defer store.RUnlock()
+	m := make(map[string]string)
+	if n := store.ns[ns]; n != nil {
+		for k, v := range n.m {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// Restore replaces the whole contents of the store with namespaces, which
+// maps each namespace to its keys and values. Every key starts again at
+// version 1; see restoreMeta.
+func Restore(namespaces map[string]map[string]string) {
+	store.Lock()
+	store.ns = make(map[string]*namespace, len(namespaces))
+	for name, m := range namespaces {
+		n := newNamespace()
+		for k, v := range m {
+			n.m[k] = v
+			n.meta[k] = KeyMeta{Version: 1}
+			n.bytes += int64(len(k) + len(v))
+		}
+		store.ns[name] = n
+	}
+	for _, idx := range store.indexes {
+		rebuild(idx)
+	}
+	store.Unlock()
+}
+
+// dumpMeta returns a copy of the metadata of every key in every namespace.
+func dumpMeta() map[string]map[string]KeyMeta {
+	store.RLock()
+	defer store.RUnlock()
+	meta := make(map[string]map[string]KeyMeta, len(store.ns))
+	for name, n := range store.ns {
+		m := make(map[string]KeyMeta, len(n.meta))
+		for k, v := range n.meta {
+			m[k] = v
+		}
+		meta[name] = m
+	}
+	return meta
+}
+
+// restoreMeta sets the metadata of keys restored by Restore.
+func restoreMeta(meta map[string]map[string]KeyMeta) {
+	store.Lock()
+	defer store.Unlock()
+	for name, m := range meta {
+		if n := store.ns[name]; n != nil {
+			for k, v := range m {
+				if _, ok := n.m[k]; ok {
+					n.meta[k] = v
+					if !v.ExpiresAt.IsZero() {
+						n.expiring[k] = true
+					}
+				}
+			}
+		}
+	}
+}
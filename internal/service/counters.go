@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrorNotANumber = errors.New("value is not a number")
+	ErrorBadAmount  = errors.New("invalid amount")
+	ErrorOverflow   = errors.New("increment would overflow")
+	ErrorInexact    = fmt.Errorf("%w: result cannot be represented exactly", ErrorOverflow)
+)
+
+// maxDecimalExponent bounds the exponent of the numbers AddFloat adds, well
+// past those of float64, so that building them exactly stays cheap.
+const maxDecimalExponent = 400
+
+// Incr adds by, which may be negative, to the integer held by key in
+// namespace ns and returns the result. A missing key counts from zero.
+func Incr(ctx context.Context, ns, key string, by int64) (int64, error) {
+	var n int64
+	_, _, err := Update(ctx, ns, key, func(value string, found bool) (string, error) {
+		n = 0
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", ErrorNotANumber
+			}
+		}
+		if (by > 0 && n > math.MaxInt64-by) || (by < 0 && n < math.MinInt64-by) {
+			return "", ErrorOverflow
+		}
+		n += by
+		return strconv.FormatInt(n, 10), nil
+	})
+	return n, err
+}
+
+// AddFloat adds by, a decimal number, to the number held by key in
+// namespace ns and returns the result as stored. A missing key counts from
+// zero. When both are integers they are added exactly, as Incr does;
+// otherwise they are added as decimals, so that 0.1 and 0.2 make 0.3, and
+// a sum with more digits than a float64 tells apart is refused.
+func AddFloat(ctx context.Context, ns, key string, by string) (string, error) {
+	byInt, intErr := strconv.ParseInt(by, 10, 64)
+	byDecimal, ok := parseDecimal(by)
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrorBadAmount, by)
+	}
+	var result string
+	_, _, err := Update(ctx, ns, key, func(value string, found bool) (string, error) {
+		if !found {
+			value = "0"
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && intErr == nil {
+			if (byInt > 0 && n > math.MaxInt64-byInt) || (byInt < 0 && n < math.MinInt64-byInt) {
+				return "", ErrorOverflow
+			}
+			result = strconv.FormatInt(n+byInt, 10)
+			return result, nil
+		}
+		n, ok := parseDecimal(value)
+		if !ok {
+			return "", ErrorNotANumber
+		}
+		sum := n.Add(n, byDecimal)
+		f, _ := sum.Float64()
+		formatted := strconv.FormatFloat(f, 'f', -1, 64)
+		if exact, _ := parseDecimal(formatted); exact == nil || exact.Cmp(sum) != 0 {
+			return "", ErrorInexact
+		}
+		result = formatted
+		return result, nil
+	})
+	return result, err
+}
+
+// parseDecimal reads s exactly if it is a decimal number float64 can hold,
+// in plain or exponent notation.
+func parseDecimal(s string) (*big.Rat, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || strings.ContainsAny(s, "xX_") {
+		return nil, false
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		exp, err := strconv.Atoi(s[i+1:])
+		if err != nil || exp > maxDecimalExponent || exp < -maxDecimalExponent {
+			return nil, false
+		}
+	}
+	return new(big.Rat).SetString(s)
+}
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestAddFloatKeepsIntegersExact(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		value, by, want string
+		err             error
+	}{
+		{"9007199254740993", "2", "9007199254740995", nil},
+		{"9223372036854775806", "1", "9223372036854775807", nil},
+		{"9223372036854775807", "1", "", ErrorOverflow},
+		{"1.5", "2", "3.5", nil},
+		{"2", "0.25", "2.25", nil},
+		{"0.1", "0.2", "0.3", nil},
+		{"1.1", "-3.3", "-2.2", nil},
+		{"0.1", "1e-20", "", ErrorInexact},
+		{"1e-99999999", "1", "", ErrorNotANumber},
+		{"9007199254740993", "0.5", "", ErrorInexact},
+		{"1", "1e300", "", ErrorInexact},
+		{"abc", "1", "", ErrorNotANumber},
+	} {
+		if err := PutIn(ctx, "", "add-float", tc.value); err != nil {
+			t.Fatal(err)
+		}
+		got, err := AddFloat(ctx, "", "add-float", tc.by)
+		if got != tc.want || !errors.Is(err, tc.err) {
+			t.Errorf("%s + %s = %q, %v; want %q, %v", tc.value, tc.by, got, err, tc.want, tc.err)
+		}
+	}
+}
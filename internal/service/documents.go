@@ -0,0 +1,409 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrorNotJSON         = errors.New("value is not a JSON document")
+	ErrorBadPath         = errors.New("invalid JSON path")
+	ErrorNoSuchPath      = errors.New("no such path in document")
+	ErrorBadPatch        = errors.New("invalid patch")
+	ErrorPatchTestFailed = errors.New("patch test failed")
+)
+
+// JSONPath returns the part of the JSON document value selected by path,
+// encoded as JSON. Paths start with $, the whole document, followed by
+// members as .name or ['name'] and array elements as [index], as in
+// $.users[0].email.
+func JSONPath(value, path string) (string, error) {
+	doc, err := decodeDocument(value)
+	if err != nil {
+		return "", err
+	}
+	segments, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range segments {
+		if doc, err = child(doc, s); err != nil {
+			return "", fmt.Errorf("%w: %s", err, path)
+		}
+	}
+	return encodeDocument(doc), nil
+}
+
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("%w: %q must start with $", ErrorBadPath, path)
+	}
+	var segments []string
+	for rest := path[1:]; rest != ""; {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w: %q has an empty member name", ErrorBadPath, path)
+			}
+			segments, rest = append(segments, rest[1:end+1]), rest[end+1:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest[2:], rest[1:2]+"]")
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q has an unterminated member name", ErrorBadPath, path)
+			}
+			segments, rest = append(segments, rest[2:end+2]), rest[end+4:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q has an unterminated index", ErrorBadPath, path)
+			}
+			if _, err := strconv.ParseUint(rest[1:end], 10, 31); err != nil {
+				return nil, fmt.Errorf("%w: %q has a bad index", ErrorBadPath, path)
+			}
+			segments, rest = append(segments, rest[1:end]), rest[end+1:]
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q in %q", ErrorBadPath, rest[:1], path)
+		}
+	}
+	return segments, nil
+}
+
+// child returns the member named s of an object, or the element at index s
+// of an array.
+func child(doc interface{}, s string) (interface{}, error) {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		if v, ok := d[s]; ok {
+			return v, nil
+		}
+	case []interface{}:
+		if i, err := strconv.Atoi(s); err == nil && i >= 0 && i < len(d) && s == strconv.Itoa(i) {
+			return d[i], nil
+		}
+	}
+	return nil, ErrorNoSuchPath
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to the document at key
+// in namespace ns, creating it if the key is missing, and returns the
+// result. The patched document is logged as a put.
+func MergePatch(ctx context.Context, ns, key string, patch []byte) (string, KeyMeta, error) {
+	p, err := decodeDocument(string(patch))
+	if err != nil {
+		return "", KeyMeta{}, fmt.Errorf("%w: %v", ErrorBadPatch, err)
+	}
+	return patchDocument(ctx, ns, key, func(doc interface{}) (interface{}, error) {
+		return mergePatch(doc, p), nil
+	})
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for name, v := range p {
+		if v == nil {
+			delete(t, name)
+		} else {
+			t[name] = mergePatch(t[name], v)
+		}
+	}
+	return t
+}
+
+// patchOp is one operation of a JSON Patch.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"` // Empty if missing, unlike null
+}
+
+// JSONPatch applies a JSON Patch (RFC 6902) to the document at key in
+// namespace ns and returns the result. A missing key is patched as null.
+// Either every operation applies or none does; the patched document is
+// logged as a put.
+func JSONPatch(ctx context.Context, ns, key string, patch []byte) (string, KeyMeta, error) {
+	var ops []patchOp
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return "", KeyMeta{}, fmt.Errorf("%w: %v", ErrorBadPatch, err)
+	}
+	for i, op := range ops {
+		if op.Path == nil {
+			return "", KeyMeta{}, fmt.Errorf("%w: operation %d has no path", ErrorBadPatch, i)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return "", KeyMeta{}, fmt.Errorf("%w: operation %d has no value", ErrorBadPatch, i)
+			}
+		case "move", "copy":
+			if op.From == nil {
+				return "", KeyMeta{}, fmt.Errorf("%w: operation %d has no from", ErrorBadPatch, i)
+			}
+		case "remove":
+		default:
+			return "", KeyMeta{}, fmt.Errorf("%w: operation %d has unknown op %q", ErrorBadPatch, i, op.Op)
+		}
+	}
+	return patchDocument(ctx, ns, key, func(doc interface{}) (interface{}, error) {
+		var err error
+		for i, op := range ops {
+			if doc, err = applyPatchOp(doc, op); err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+		}
+		return doc, nil
+	})
+}
+
+func applyPatchOp(doc interface{}, op patchOp) (interface{}, error) {
+	path, err := parsePointer(*op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	if len(op.Value) > 0 {
+		if value, err = decodeDocument(string(op.Value)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrorBadPatch, err)
+		}
+	}
+	var from []string
+	if op.From != nil {
+		if from, err = parsePointer(*op.From); err != nil {
+			return nil, err
+		}
+	}
+	switch op.Op {
+	case "add":
+		return addAt(doc, path, value)
+	case "remove":
+		return removeAt(doc, path)
+	case "replace":
+		if doc, err = removeAt(doc, path); err != nil {
+			return nil, err
+		}
+		return addAt(doc, path, value)
+	case "move":
+		if len(path) > len(from) && strings.HasPrefix(*op.Path, *op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move %s into itself", ErrorBadPatch, *op.From)
+		}
+		if value, err = valueAt(doc, from); err != nil {
+			return nil, err
+		}
+		if doc, err = removeAt(doc, from); err != nil {
+			return nil, err
+		}
+		return addAt(doc, path, value)
+	case "copy":
+		if value, err = valueAt(doc, from); err != nil {
+			return nil, err
+		}
+		value, _ = decodeDocument(encodeDocument(value)) // A copy, not a second reference
+		return addAt(doc, path, value)
+	}
+	current, err := valueAt(doc, path)
+	if err != nil {
+		return nil, err
+	}
+	if !jsonEqual(current, value) {
+		return nil, fmt.Errorf("%w: %s", ErrorPatchTestFailed, *op.Path)
+	}
+	return doc, nil
+}
+
+// parsePointer splits a JSON Pointer (RFC 6901) into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", ErrorBadPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+func valueAt(doc interface{}, path []string) (interface{}, error) {
+	var err error
+	for _, t := range path {
+		if doc, err = child(doc, t); err != nil {
+			return nil, fmt.Errorf("%w: /%s", err, strings.Join(path, "/"))
+		}
+	}
+	return doc, nil
+}
+
+// within calls f with the container holding the last token of path, and
+// puts what f returns in its place.
+func within(doc interface{}, path []string, f func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	c, err := child(doc, path[0])
+	if err != nil {
+		return nil, err
+	}
+	if c, err = within(c, path[1:], f); err != nil {
+		return nil, err
+	}
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		d[path[0]] = c
+	case []interface{}:
+		i, _ := strconv.Atoi(path[0])
+		d[i] = c
+	}
+	return doc, nil
+}
+
+func addAt(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	doc, err := within(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[token] = value
+			return c, nil
+		case []interface{}:
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i > len(c) || token != strconv.Itoa(i) {
+				return nil, ErrorNoSuchPath
+			}
+			return append(c[:i], append([]interface{}{value}, c[i:]...)...), nil
+		}
+		return nil, ErrorNoSuchPath
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: /%s", err, strings.Join(path, "/"))
+	}
+	return doc, nil
+}
+
+func removeAt(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	doc, err := within(doc, path, func(container interface{}, token string) (interface{}, error) {
+		if _, err := child(container, token); err != nil {
+			return nil, err
+		}
+		switch c := container.(type) {
+		case map[string]interface{}:
+			delete(c, token)
+			return c, nil
+		case []interface{}:
+			i, _ := strconv.Atoi(token)
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, ErrorNoSuchPath
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: /%s", err, strings.Join(path, "/"))
+	}
+	return doc, nil
+}
+
+// jsonEqual compares decoded documents, treating numbers as equal when
+// their values are, however they were written.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, v := range a {
+			if w, ok := b[name]; !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, xok := new(big.Rat).SetString(a.String())
+		y, yok := new(big.Rat).SetString(b.String())
+		return xok && yok && x.Cmp(y) == 0
+	}
+	return a == b
+}
+
+// patchDocument replaces the document at key with what f makes of it. A
+// missing key is passed to f as null.
+func patchDocument(ctx context.Context, ns, key string, f func(doc interface{}) (interface{}, error)) (string, KeyMeta, error) {
+	return Update(ctx, ns, key, func(value string, found bool) (string, error) {
+		var doc interface{}
+		if found {
+			if _, meta, err := GetWithMeta(ctx, ns, key); err == nil && meta.Type != TypeString {
+				return "", fmt.Errorf("%w: %q is a %s", ErrorWrongType, key, typeName(meta.Type))
+			}
+			var err error
+			if doc, err = decodeDocument(value); err != nil {
+				return "", err
+			}
+		}
+		doc, err := f(doc)
+		if err != nil {
+			return "", err
+		}
+		return encodeDocument(doc), nil
+	})
+}
+
+// decodeDocument decodes a JSON document, keeping numbers as written.
+func decodeDocument(value string) (interface{}, error) {
+	d := json.NewDecoder(strings.NewReader(value))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorNotJSON, err)
+	}
+	if d.More() {
+		return nil, fmt.Errorf("%w: trailing data", ErrorNotJSON)
+	}
+	return doc, nil
+}
+
+func encodeDocument(doc interface{}) string {
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	e.Encode(doc)
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// seedDocument stores doc at key, or deletes key if doc is empty.
+func seedDocument(t *testing.T, key, doc string) {
+	t.Helper()
+	ctx := context.Background()
+	if doc == "" {
+		if err := DeleteIn(ctx, "", key); err != nil && !errors.Is(err, ErrorNoSuchKey) {
+			t.Fatal(err)
+		}
+		return
+	}
+	if err := PutIn(ctx, "", key, doc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sameDocument reports whether the JSON documents a and b are equal.
+func sameDocument(t *testing.T, a, b string) bool {
+	t.Helper()
+	x, err := decodeDocument(a)
+	if err != nil {
+		t.Fatalf("%q: %v", a, err)
+	}
+	y, err := decodeDocument(b)
+	if err != nil {
+		t.Fatalf("%q: %v", b, err)
+	}
+	return jsonEqual(x, y)
+}
+
+func TestMergePatch(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	start, patched := LastSequence(), uint64(0)
+	for i, tc := range []struct {
+		doc, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		{``, `{"a":1,"b":null}`, `{"a":1}`},
+	} {
+		key := fmt.Sprintf("merge-patch-%d", i)
+		seedDocument(t, key, tc.doc)
+		got, _, err := MergePatch(ctx, "", key, []byte(tc.patch))
+		if err == nil {
+			patched++
+		}
+		if err != nil || !sameDocument(t, got, tc.want) {
+			t.Errorf("%s merged with %s = %s, %v; want %s", tc.doc, tc.patch, got, err, tc.want)
+		}
+	}
+	settle(t, start+patched) // Each patch is logged as one put
+}
+
+func TestMergePatchRejectsBadPatches(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	seedDocument(t, "merge-patch-bad", `{"a":1}`)
+	if _, _, err := MergePatch(ctx, "", "merge-patch-bad", []byte(`{"a":`)); !errors.Is(err, ErrorBadPatch) {
+		t.Errorf("got %v, want %v", err, ErrorBadPatch)
+	}
+	seedDocument(t, "merge-patch-not-json", `not json`)
+	if _, _, err := MergePatch(ctx, "", "merge-patch-not-json", []byte(`{"a":1}`)); !errors.Is(err, ErrorNotJSON) {
+		t.Errorf("got %v, want %v", err, ErrorNotJSON)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	start, patched := LastSequence(), uint64(0)
+	for i, tc := range []struct {
+		doc, patch, want string
+		err              error // When set, the document must be left as it was
+	}{
+		// add
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`, nil},
+		{`{"a":1}`, `[{"op":"add","path":"/a","value":2}]`, `{"a":2}`, nil},
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":null}]`, `{"a":1,"b":null}`, nil},
+		{`{"a":[1,3]}`, `[{"op":"add","path":"/a/1","value":2}]`, `{"a":[1,2,3]}`, nil},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/2","value":3}]`, `{"a":[1,2,3]}`, nil},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/-","value":2}]`, `{"a":[1,2]}`, nil},
+		{`{"a":[]}`, `[{"op":"add","path":"/a/-","value":{"b":1}}]`, `{"a":[{"b":1}]}`, nil},
+		{`{"a":{"b":[1]}}`, `[{"op":"add","path":"/a/b/-","value":2}]`, `{"a":{"b":[1,2]}}`, nil},
+		{`{"a":1}`, `[{"op":"add","path":"","value":[1]}]`, `[1]`, nil},
+		{``, `[{"op":"add","path":"","value":{"a":1}}]`, `{"a":1}`, nil},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/2","value":2}]`, ``, ErrorNoSuchPath},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/01","value":2}]`, ``, ErrorNoSuchPath},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/-1","value":2}]`, ``, ErrorNoSuchPath},
+		{`{"a":1}`, `[{"op":"add","path":"/b/c","value":2}]`, ``, ErrorNoSuchPath},
+		{`{"a":1}`, `[{"op":"add","path":"/b"}]`, ``, ErrorBadPatch},
+
+		// remove
+		{`{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`, nil},
+		{`{"a":[1,2,3]}`, `[{"op":"remove","path":"/a/1"}]`, `{"a":[1,3]}`, nil},
+		{`{"a":{"b":{"c":1}}}`, `[{"op":"remove","path":"/a/b/c"}]`, `{"a":{"b":{}}}`, nil},
+		{`{"a":1}`, `[{"op":"remove","path":"/b"}]`, ``, ErrorNoSuchPath},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/1"}]`, ``, ErrorNoSuchPath},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/-"}]`, ``, ErrorNoSuchPath},
+
+		// replace
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":{"b":2}}]`, `{"a":{"b":2}}`, nil},
+		{`{"a":[1,2]}`, `[{"op":"replace","path":"/a/0","value":3}]`, `{"a":[3,2]}`, nil},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":"b"}]`, `"b"`, nil},
+		{`{"a":1}`, `[{"op":"replace","path":"/b","value":2}]`, ``, ErrorNoSuchPath},
+
+		// move
+		{`{"a":{"b":1},"c":{}}`, `[{"op":"move","from":"/a/b","path":"/c/d"}]`, `{"a":{},"c":{"d":1}}`, nil},
+		{`{"a":[1,2,3]}`, `[{"op":"move","from":"/a/0","path":"/a/-"}]`, `{"a":[2,3,1]}`, nil},
+		{`{"a":1}`, `[{"op":"move","from":"/a","path":"/a"}]`, `{"a":1}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"move","from":"/a","path":"/a/c"}]`, ``, ErrorBadPatch},
+		{`{"a":1}`, `[{"op":"move","from":"/b","path":"/c"}]`, ``, ErrorNoSuchPath},
+		{`{"a":1}`, `[{"op":"move","path":"/c"}]`, ``, ErrorBadPatch},
+
+		// copy
+		{`{"a":[1]}`, `[{"op":"copy","from":"/a","path":"/b"}]`, `{"a":[1],"b":[1]}`, nil},
+		{`{"a":[1]}`, `[{"op":"copy","from":"/a","path":"/b"},{"op":"add","path":"/b/-","value":2}]`, `{"a":[1],"b":[1,2]}`, nil},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a/b","path":"/a/c"}]`, `{"a":{"b":1,"c":1}}`, nil},
+		{`{"a":1}`, `[{"op":"copy","from":"/b","path":"/c"}]`, ``, ErrorNoSuchPath},
+
+		// test
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":1}]`, `{"a":1}`, nil},
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":1.0}]`, `{"a":1}`, nil},
+		{`{"a":{"b":[1,"c"]}}`, `[{"op":"test","path":"/a","value":{"b":[1,"c"]}}]`, `{"a":{"b":[1,"c"]}}`, nil},
+		{`{"a":null}`, `[{"op":"test","path":"/a","value":null}]`, `{"a":null}`, nil},
+		{`{"a":1}`, `[{"op":"test","path":"/a","value":"1"}]`, ``, ErrorPatchTestFailed},
+		{`{"a":[1,2]}`, `[{"op":"test","path":"/a","value":[2,1]}]`, ``, ErrorPatchTestFailed},
+		{`{"a":1}`, `[{"op":"test","path":"/b","value":1}]`, ``, ErrorNoSuchPath},
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"test","path":"/a","value":2}]`, ``, ErrorPatchTestFailed},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/0"},{"op":"add","path":"/c","value":3},{"op":"test","path":"/c","value":4}]`, ``, ErrorPatchTestFailed},
+
+		// ~0 and ~1 escapes
+		{`{"a/b":1}`, `[{"op":"replace","path":"/a~1b","value":2}]`, `{"a/b":2}`, nil},
+		{`{"m~n":1}`, `[{"op":"remove","path":"/m~0n"}]`, `{}`, nil},
+		{`{"~1":1}`, `[{"op":"test","path":"/~01","value":1},{"op":"replace","path":"/~01","value":2}]`, `{"~1":2}`, nil},
+		{`{}`, `[{"op":"add","path":"/~0~1","value":1}]`, `{"~/":1}`, nil},
+		{`{"a/b":{"c~d":1}}`, `[{"op":"move","from":"/a~1b/c~0d","path":"/e"}]`, `{"a/b":{},"e":1}`, nil},
+
+		// Malformed patches
+		{`{"a":1}`, `[{"op":"frobnicate","path":"/a"}]`, ``, ErrorBadPatch},
+		{`{"a":1}`, `[{"op":"remove"}]`, ``, ErrorBadPatch},
+		{`{"a":1}`, `[{"op":"remove","path":"a"}]`, ``, ErrorBadPatch},
+		{`{"a":1}`, `{"op":"remove","path":"/a"}`, ``, ErrorBadPatch},
+	} {
+		key := fmt.Sprintf("json-patch-%d", i)
+		seedDocument(t, key, tc.doc)
+		got, _, err := JSONPatch(ctx, "", key, []byte(tc.patch))
+		if err == nil {
+			patched++
+		}
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("%s patched with %s: got %v, want %v", tc.doc, tc.patch, err, tc.err)
+			}
+			if value, _ := GetIn(ctx, "", key); value != tc.doc {
+				t.Errorf("%s patched with %s left %s", tc.doc, tc.patch, value)
+			}
+			continue
+		}
+		if err != nil || !sameDocument(t, got, tc.want) {
+			t.Errorf("%s patched with %s = %s, %v; want %s", tc.doc, tc.patch, got, err, tc.want)
+		}
+	}
+	settle(t, start+patched)
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"melon/internal/transaction"
+	"strconv"
+	"time"
+)
+
+// expired reports whether a key with meta has expired by now. Expired keys
+// read as missing until the leader logs their deletion; see RunExpiry.
+func expired(meta KeyMeta, now time.Time) bool {
+	return !meta.ExpiresAt.IsZero() && !meta.ExpiresAt.After(now)
+}
+
+// ExpireEvent builds the event that makes key in namespace ns expire at t,
+// or never expire if t is zero.
+func ExpireEvent(ns, key string, t time.Time) transaction.Event {
+	e := transaction.Event{EventType: transaction.EventExpire, Namespace: ns, Key: key}
+	if !t.IsZero() {
+		e.Value = strconv.FormatInt(t.UnixNano(), 10)
+	}
+	return e
+}
+
+func applyExpire(e transaction.Event) error {
+	t, err := parseExpiry(e.Value)
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	expireLocked(e.Namespace, e.Key, t)
+	return nil
+}
+
+// parseExpiry reads the value of an expire event.
+func parseExpiry(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	nanos, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad expiry: %w", err)
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// expireLocked sets the expiry of key with the store already locked.
+func expireLocked(ns, key string, t time.Time) {
+	if n := store.ns[ns]; n != nil {
+		if meta, ok := n.meta[key]; ok {
+			meta.ExpiresAt = t
+			n.meta[key] = meta
+			if t.IsZero() {
+				delete(n.expiring, key)
+			} else {
+				n.expiring[key] = true
+			}
+		}
+	}
+}
+
+// PutWithExpiry sets key in namespace ns to expire at t, with no other write
+// landing between the put and the expiry. A zero t is a plain put, which
+// clears any earlier expiry.
+func PutWithExpiry(ctx context.Context, ns, key, value string, t time.Time) error {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	return putWithAttributes(ctx, ns, key, value, t, 0, 0)
+}
+
+// Expire makes the existing key in namespace ns expire at t, or never expire
+// if t is zero. It fails with ErrorNoSuchKey if the key does not exist.
+func Expire(ctx context.Context, ns, key string, t time.Time) error {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	if _, _, err := GetWithMeta(ctx, ns, key); err != nil {
+		return err
+	}
+	return commit(ctx, ExpireEvent(ns, key, t))
+}
+
+// RunExpiry deletes expired keys and revokes ended leases every interval for
+// as long as the process runs, on whichever node leader reports to be the
+// leader at the time; the deletes reach other nodes like any other write.
+func RunExpiry(interval time.Duration, leader func() bool) {
+	for range time.Tick(interval) {
+		if leader() && !ReadOnly() {
+			deleteExpired(context.Background())
+			revokeExpiredLeases(context.Background())
+		}
+	}
+}
+
+func deleteExpired(ctx context.Context) {
+	type key struct{ ns, key string }
+	var due []key
+	now := time.Now()
+	store.RLock()
+	for name, n := range store.ns {
+		for k := range n.expiring {
+			if expired(n.meta[k], now) {
+				due = append(due, key{name, k})
+			}
+		}
+	}
+	store.RUnlock()
+
+	for _, k := range due {
+		txnMu.Lock()
+		err := deleteIfExpired(ctx, k.ns, k.key)
+		txnMu.Unlock()
+		if err != nil {
+			log.Warn("cannot delete expired key", zap.String("namespace", k.ns), zap.String("key", k.key), zap.Error(err))
+			return
+		}
+	}
+}
+
+// deleteIfExpired must be called with txnMu held, so that a put made since
+// the key was found expired is not deleted.
+func deleteIfExpired(ctx context.Context, ns, key string) error {
+	store.RLock()
+	var meta KeyMeta
+	ok := false
+	if n := store.ns[ns]; n != nil {
+		meta, ok = n.meta[key]
+	}
+	store.RUnlock()
+	if !ok || !expired(meta, time.Now()) {
+		return nil
+	}
+	return commit(ctx, transaction.Event{EventType: transaction.EventDelete, Namespace: ns, Key: key})
+}
@@ -0,0 +1,43 @@
+package service
+
+import (
+	"fmt"
+	"melon/internal/transaction"
+	"strconv"
+)
+
+// FlagsEvent builds the event that sets the client flags of key in
+// namespace ns.
+func FlagsEvent(ns, key string, flags uint32) transaction.Event {
+	return transaction.Event{EventType: transaction.EventFlags, Namespace: ns, Key: key, Value: strconv.FormatUint(uint64(flags), 10)}
+}
+
+func applyFlags(e transaction.Event) error {
+	flags, err := parseFlags(e.Value)
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	flagsLocked(e.Namespace, e.Key, flags)
+	return nil
+}
+
+// parseFlags reads the value of a flags event.
+func parseFlags(value string) (uint32, error) {
+	flags, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad flags: %w", err)
+	}
+	return uint32(flags), nil
+}
+
+// flagsLocked sets the flags of key with the store already locked.
+func flagsLocked(ns, key string, flags uint32) {
+	if n := store.ns[ns]; n != nil {
+		if meta, ok := n.meta[key]; ok {
+			meta.Flags = flags
+			n.meta[key] = meta
+		}
+	}
+}
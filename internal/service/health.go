@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"melon/internal/transaction"
+	"sync"
+	"time"
+)
+
+// Check is the outcome of one readiness check.
+type Check struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// pingTimeout bounds how long a readiness check waits for the database.
+const pingTimeout = 2 * time.Second
+
+var health = struct {
+	sync.RWMutex
+	replayed  bool  // The log has been replayed into the store
+	replayErr error // Why replay failed
+	logErr    error // The first write failure the logger reported
+}{}
+
+func setReplayed(err error) {
+	health.Lock()
+	defer health.Unlock()
+	health.replayed, health.replayErr = err == nil, err
+}
+
+// watchLogErrors records the first failure reported on errs. A failed write
+// may have lost an event, so the node stays unready until restarted.
+func watchLogErrors(errs <-chan error) {
+	for err := range errs {
+		health.Lock()
+		if health.logErr == nil {
+			health.logErr = err
+		}
+		health.Unlock()
+	}
+}
+
+// Ready reports whether the node can serve requests: the log has been
+// replayed, the logger has not failed a write and, for loggers writing to a
+// database, the database answers a ping. Each check's outcome is returned by
+// name.
+func Ready(ctx context.Context) (bool, map[string]Check) {
+	health.RLock()
+	l := logger
+	checks := map[string]Check{
+		"replay":          {OK: health.replayed},
+		"transaction_log": {OK: l != nil && health.logErr == nil},
+	}
+	if health.replayErr != nil {
+		checks["replay"] = Check{Error: health.replayErr.Error()}
+	} else if !health.replayed {
+		checks["replay"] = Check{Error: "transaction log not yet replayed"}
+	}
+	if l == nil {
+		checks["transaction_log"] = Check{Error: "transaction log not started"}
+	} else if health.logErr != nil {
+		checks["transaction_log"] = Check{Error: health.logErr.Error()}
+	}
+	health.RUnlock()
+
+	if p, ok := l.(transaction.Pinger); ok {
+		ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			checks["database"] = Check{Error: err.Error()}
+		} else {
+			checks["database"] = Check{OK: true}
+		}
+	}
+	ready := true
+	for _, c := range checks {
+		ready = ready && c.OK
+	}
+	return ready, checks
+}
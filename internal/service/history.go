@@ -0,0 +1,156 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"melon/internal/transaction"
+	"strconv"
+	"time"
+)
+
+// History returns the logged versions of key in namespace ns, oldest first.
+// Each is a put of the whole value the key held after the event, or a
+// delete. Operations on lists, sets and hashes are logged as small changes,
+// so each is folded into the value it left, and one leaving the value empty
+// is a delete. The events of a batch on key each count, with the batch's
+// sequence number.
+func History(ns, key string) ([]transaction.Event, error) {
+	versions, err := foldHistory(ns, key)
+	if err != nil {
+		return nil, err
+	}
+	history := make([]transaction.Event, len(versions))
+	for i, v := range versions {
+		history[i] = v.Event
+	}
+	return history, nil
+}
+
+// version is a put or delete in the history of a key, and the type of the
+// value it left.
+type version struct {
+	transaction.Event
+	Type ValueType
+}
+
+func foldHistory(ns, key string) ([]version, error) {
+	logged, err := logger.History(ns, key)
+	if err != nil {
+		return nil, err
+	}
+	events, err := keyEvents(logged, ns, key)
+	if err != nil {
+		return nil, err
+	}
+	var history []version
+	var value string
+	var vt ValueType
+	var expires time.Time
+	for _, e := range events {
+		switch e.EventType {
+		case transaction.EventPut:
+			value, vt, expires = e.Value, TypeString, time.Time{}
+		case transaction.EventDelete:
+			value, vt, expires = "", TypeString, time.Time{}
+		case transaction.EventExpire:
+			expires = time.Time{}
+			if nanos, err := strconv.ParseInt(e.Value, 10, 64); err == nil {
+				expires = time.Unix(0, nanos)
+			}
+			continue
+		case transaction.EventListPush, transaction.EventListPop, transaction.EventSetAdd,
+			transaction.EventSetRemove, transaction.EventHashSet, transaction.EventHashDelete:
+			var op typedOp
+			if err := json.Unmarshal([]byte(e.Value), &op); err != nil {
+				return nil, fmt.Errorf("event %d: bad operation: %w", e.Sequence, err)
+			}
+			t := valueType(e.EventType)
+			if vt != t || (!expires.IsZero() && !expires.After(e.CreatedAt)) {
+				value, expires = "", time.Time{} // As applyTyped, an expired key starts again empty
+			}
+			if value, _, err = edit(t, value, e.EventType, op); err != nil {
+				return nil, fmt.Errorf("event %d: %w", e.Sequence, err)
+			}
+			vt = t
+		default:
+			continue // Flags and lease attachments
+		}
+		v := version{Event: e, Type: vt}
+		switch {
+		case e.EventType == transaction.EventDelete:
+			v.Value = ""
+		case value == "" && vt != TypeString: // Emptied, which deletes the key
+			v.EventType, v.Value, v.Type, vt = transaction.EventDelete, "", TypeString, TypeString
+		default:
+			v.EventType, v.Value = transaction.EventPut, value
+		}
+		history = append(history, v)
+	}
+	return history, nil
+}
+
+// keyEvents expands the batches among events into their events on key in
+// namespace ns.
+func keyEvents(events []transaction.Event, ns, key string) ([]transaction.Event, error) {
+	expanded := make([]transaction.Event, 0, len(events))
+	for _, e := range events {
+		if e.EventType != transaction.EventBatch {
+			expanded = append(expanded, e)
+			continue
+		}
+		batch, err := e.Events()
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %w", e.Sequence, err)
+		}
+		for _, b := range batch {
+			if b.Namespace == ns && b.Key == key {
+				expanded = append(expanded, b)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// GetAsOfSequence returns the value key in namespace ns held once the event
+// with sequence number seq had been applied, and its metadata at the time.
+func GetAsOfSequence(ns, key string, seq uint64) (string, KeyMeta, error) {
+	return getAsOf(ns, key, func(e transaction.Event) bool { return e.Sequence <= seq })
+}
+
+// GetAsOfTime returns the value key in namespace ns held at t, and its
+// metadata at the time.
+func GetAsOfTime(ns, key string, t time.Time) (string, KeyMeta, error) {
+	return getAsOf(ns, key, func(e transaction.Event) bool { return !e.CreatedAt.After(t) })
+}
+
+// getAsOf replays the history of key up to the last applied event. Versions
+// are counted from the start of the logged history, so after a compaction
+// they can be lower than the key's current version implies.
+func getAsOf(ns, key string, applied func(transaction.Event) bool) (string, KeyMeta, error) {
+	history, err := foldHistory(ns, key)
+	if err != nil {
+		return "", KeyMeta{}, err
+	}
+	var value string
+	var meta KeyMeta
+	for _, v := range history {
+		if !applied(v.Event) {
+			break
+		}
+		if v.EventType == transaction.EventDelete {
+			meta = KeyMeta{}
+			continue
+		}
+		if meta.Version == 0 {
+			meta.CreatedAt = v.CreatedAt
+		}
+		meta.Version++
+		meta.UpdatedAt = v.CreatedAt
+		meta.Type = v.Type
+		value = v.Value
+	}
+	if meta.Version == 0 {
+		return "", KeyMeta{}, ErrorNoSuchKey
+	}
+	return value, meta, nil
+}
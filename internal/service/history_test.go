@@ -0,0 +1,125 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"melon/internal/transaction"
+	"sync"
+	"testing"
+	"time"
+)
+
+var initOnce sync.Once
+
+// setup gives the tests an in-memory log. The store is shared, so every
+// test uses keys of its own.
+func setup(t *testing.T) {
+	t.Helper()
+	initOnce.Do(func() {
+		if err := InitializeWithLogger(transaction.NewMemoryTransactionLogger()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// settle waits for the log to catch up with the writes made so far, as
+// the memory logger writes in the background.
+func settle(t *testing.T, seq uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for LastSequence() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("log stuck at %d, want %d", LastSequence(), seq)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHistoryFoldsListOperations(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	start := LastSequence()
+	if _, err := ListPush(ctx, "", "history-list", false, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListPush(ctx, "", "history-list", false, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListPop(ctx, "", "history-list", true, 2); err != nil {
+		t.Fatal(err)
+	}
+	settle(t, start+3)
+
+	history, err := History("", "history-list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		t     transaction.EventType
+		value string
+	}{
+		{transaction.EventPut, `["a"]`},
+		{transaction.EventPut, `["a","b"]`},
+		{transaction.EventDelete, ""},
+	}
+	if len(history) < len(want) {
+		t.Fatalf("got %d versions, want %d: %+v", len(history), len(want), history)
+	}
+	history = history[len(history)-len(want):] // Earlier runs of the test left versions too
+	for i, w := range want {
+		if history[i].EventType != w.t || history[i].Value != w.value {
+			t.Errorf("version %d is %d %q, want %d %q", i, history[i].EventType, history[i].Value, w.t, w.value)
+		}
+	}
+
+	value, meta, err := GetAsOfSequence("", "history-list", history[1].Sequence)
+	if err != nil || value != `["a","b"]` || meta.Type != TypeList {
+		t.Errorf("as of the second push got %q %+v %v", value, meta, err)
+	}
+	if _, _, err := GetAsOfSequence("", "history-list", history[2].Sequence); !errors.Is(err, ErrorNoSuchKey) {
+		t.Errorf("as of the pop got %v, want ErrorNoSuchKey", err)
+	}
+}
+
+func TestWatchSendsWholeTypedValues(t *testing.T) {
+	setup(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	got := make(chan transaction.Event, 10)
+	done := make(chan error, 1)
+	match := func(e transaction.Event) bool { return e.Key == "watched-set" }
+	go func() {
+		done <- Watch(ctx, 0, match, func(e transaction.Event) error {
+			got <- e
+			return nil
+		})
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the watcher subscribe
+
+	if _, err := SetAdd(ctx, "", "watched-set", "y", "x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetRemove(ctx, "", "watched-set", "x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		t     transaction.EventType
+		value string
+	}{
+		{transaction.EventPut, `["x","y"]`},
+		{transaction.EventDelete, ""},
+	} {
+		select {
+		case e := <-got:
+			if e.EventType != want.t || e.Value != want.value {
+				t.Errorf("watched %d %q, want %d %q", e.EventType, e.Value, want.t, want.value)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a watch event")
+		}
+	}
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("watch ended with %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"melon/internal/transaction"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrorNoSuchIndex = errors.New("no such index")
+
+// IndexDefinition declares a secondary index: every key in Namespace
+// starting with Prefix whose value is a JSON document is indexed by the
+// part of it selected by Path, a JSON path as taken by JSONPath.
+type IndexDefinition struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Prefix    string `json:"prefix"`
+	Path      string `json:"path"`
+}
+
+// index maps each indexed term to the keys holding it.
+type index struct {
+	def      IndexDefinition
+	segments []string
+	keys     map[string]map[string]bool
+}
+
+// ValidateIndex reports whether def can be created.
+func ValidateIndex(def IndexDefinition) error {
+	if def.Name == "" {
+		return errors.New("index name cannot be empty")
+	}
+	_, err := parseJSONPath(def.Path)
+	return err
+}
+
+// IndexEvent builds the event that creates def, replacing any index of the
+// same name.
+func IndexEvent(def IndexDefinition) transaction.Event {
+	value, _ := json.Marshal(def)
+	return transaction.Event{EventType: transaction.EventIndex, Key: def.Name, Value: string(value)}
+}
+
+// DropIndexEvent builds the event that drops the index called name.
+func DropIndexEvent(name string) transaction.Event {
+	return transaction.Event{EventType: transaction.EventIndex, Key: name}
+}
+
+func applyIndex(e transaction.Event) error {
+	store.Lock()
+	defer store.Unlock()
+	if e.Value == "" {
+		delete(store.indexes, e.Key)
+		return nil
+	}
+	var def IndexDefinition
+	if err := json.Unmarshal([]byte(e.Value), &def); err != nil {
+		return fmt.Errorf("bad index: %w", err)
+	}
+	return createIndex(def)
+}
+
+// createIndex must be called with the store locked.
+func createIndex(def IndexDefinition) error {
+	segments, err := parseJSONPath(def.Path)
+	if err != nil {
+		return err
+	}
+	idx := &index{def: def, segments: segments}
+	rebuild(idx)
+	store.indexes[def.Name] = idx
+	return nil
+}
+
+// rebuild indexes every key idx covers from scratch. It must be called with
+// the store locked.
+func rebuild(idx *index) {
+	idx.keys = make(map[string]map[string]bool)
+	if n := store.ns[idx.def.Namespace]; n != nil {
+		for k, v := range n.m {
+			if strings.HasPrefix(k, idx.def.Prefix) {
+				idx.add(k, v)
+			}
+		}
+	}
+}
+
+// term returns what value is indexed under: the string selected by the
+// index's path, or the JSON encoding of any other value. Values that are
+// not JSON documents, or lack the path, are not indexed.
+func (idx *index) term(value string) (string, bool) {
+	doc, err := decodeDocument(value)
+	if err != nil {
+		return "", false
+	}
+	for _, s := range idx.segments {
+		if doc, err = child(doc, s); err != nil {
+			return "", false
+		}
+	}
+	if s, ok := doc.(string); ok {
+		return s, true
+	}
+	return encodeDocument(doc), true
+}
+
+func (idx *index) add(key, value string) {
+	if t, ok := idx.term(value); ok {
+		if idx.keys[t] == nil {
+			idx.keys[t] = make(map[string]bool)
+		}
+		idx.keys[t][key] = true
+	}
+}
+
+func (idx *index) remove(key, value string) {
+	if t, ok := idx.term(value); ok {
+		delete(idx.keys[t], key)
+		if len(idx.keys[t]) == 0 {
+			delete(idx.keys, t)
+		}
+	}
+}
+
+// reindex adds key, now holding value, to every index covering it, and
+// unindex removes it while it still holds value. Both must be called with
+// the store locked.
+func reindex(ns, key, value string) {
+	for _, idx := range store.indexes {
+		if idx.def.Namespace == ns && strings.HasPrefix(key, idx.def.Prefix) {
+			idx.add(key, value)
+		}
+	}
+}
+
+func unindex(ns, key, value string) {
+	for _, idx := range store.indexes {
+		if idx.def.Namespace == ns && strings.HasPrefix(key, idx.def.Prefix) {
+			idx.remove(key, value)
+		}
+	}
+}
+
+// Indexes returns the definition of every index, ordered by name.
+func Indexes() []IndexDefinition {
+	store.RLock()
+	defer store.RUnlock()
+	defs := make([]IndexDefinition, 0, len(store.indexes))
+	for _, idx := range store.indexes {
+		defs = append(defs, idx.def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// Index returns the definition of the index called name.
+func Index(name string) (IndexDefinition, error) {
+	store.RLock()
+	defer store.RUnlock()
+	idx := store.indexes[name]
+	if idx == nil {
+		return IndexDefinition{}, ErrorNoSuchIndex
+	}
+	return idx.def, nil
+}
+
+// LookupIndex returns the entries whose value is indexed under term by the
+// index called name, ordered by key, leaving out expired keys not yet
+// deleted.
+func LookupIndex(name, term string) ([]Entry, error) {
+	store.RLock()
+	defer store.RUnlock()
+	idx := store.indexes[name]
+	if idx == nil {
+		return nil, ErrorNoSuchIndex
+	}
+	entries := make([]Entry, 0, len(idx.keys[term]))
+	n, now := store.ns[idx.def.Namespace], time.Now()
+	for k := range idx.keys[term] {
+		if !expired(n.meta[k], now) {
+			entries = append(entries, Entry{Key: k, Value: n.m[k], Meta: n.meta[k]})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// restoreIndexes replaces every index with those defined by defs. They are
+// left empty until the next Restore.
+func restoreIndexes(defs []IndexDefinition) {
+	store.Lock()
+	defer store.Unlock()
+	store.indexes = make(map[string]*index, len(defs))
+	for _, def := range defs {
+		if segments, err := parseJSONPath(def.Path); err == nil {
+			store.indexes[def.Name] = &index{def: def, segments: segments, keys: make(map[string]map[string]bool)}
+		}
+	}
+}
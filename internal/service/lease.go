@@ -0,0 +1,282 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"melon/internal/transaction"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrorNoSuchLease = errors.New("no such lease")
+
+// Lease is a time limit that keys can be attached to. Unless kept alive it
+// ends TTL seconds after it was granted or last kept alive, and the leader
+// then revokes it, deleting every key attached to it. When partitioned, a
+// lease lives on the node that granted it and can only hold keys that node
+// owns.
+type Lease struct {
+	ID        int64     `json:"id"`
+	TTL       int64     `json:"ttl"` // Seconds
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// LeaseKey is a key attached to a lease.
+type LeaseKey struct {
+	Namespace string `json:"namespace,omitempty"`
+	Key       string `json:"key"`
+}
+
+var leases = struct {
+	sync.RWMutex
+	m map[int64]Lease
+}{m: make(map[int64]Lease)}
+
+func (l Lease) expired(now time.Time) bool {
+	return !l.ExpiresAt.After(now)
+}
+
+// LeaseEvent builds the event that grants l, or renews it to its ExpiresAt.
+func LeaseEvent(l Lease) transaction.Event {
+	value, _ := json.Marshal(l)
+	return transaction.Event{EventType: transaction.EventLease, Key: strconv.FormatInt(l.ID, 10), Value: string(value)}
+}
+
+// LeaseRevokeEvent builds the event that ends the lease id. The keys attached
+// to it are deleted by events of their own.
+func LeaseRevokeEvent(id int64) transaction.Event {
+	return transaction.Event{EventType: transaction.EventLeaseRevoke, Key: strconv.FormatInt(id, 10)}
+}
+
+// LeaseAttachEvent builds the event that attaches key in namespace ns to the
+// lease id, or detaches it if id is zero.
+func LeaseAttachEvent(ns, key string, id int64) transaction.Event {
+	e := transaction.Event{EventType: transaction.EventLeaseAttach, Namespace: ns, Key: key}
+	if id != 0 {
+		e.Value = strconv.FormatInt(id, 10)
+	}
+	return e
+}
+
+func applyLease(e transaction.Event) error {
+	var l Lease
+	if err := json.Unmarshal([]byte(e.Value), &l); err != nil {
+		return fmt.Errorf("bad lease: %w", err)
+	}
+	leases.Lock()
+	defer leases.Unlock()
+	leases.m[l.ID] = l
+	return nil
+}
+
+func applyLeaseRevoke(e transaction.Event) error {
+	id, err := strconv.ParseInt(e.Key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad lease ID: %w", err)
+	}
+	leases.Lock()
+	defer leases.Unlock()
+	delete(leases.m, id)
+	return nil
+}
+
+func applyLeaseAttach(e transaction.Event) error {
+	id, err := parseLeaseID(e.Value)
+	if err != nil {
+		return err
+	}
+	store.Lock()
+	defer store.Unlock()
+	attachLocked(e.Namespace, e.Key, id)
+	return nil
+}
+
+// parseLeaseID reads the value of a lease attach event.
+func parseLeaseID(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad lease ID: %w", err)
+	}
+	return id, nil
+}
+
+// attachLocked attaches key to the lease id with the store already locked.
+func attachLocked(ns, key string, id int64) {
+	if n := store.ns[ns]; n != nil {
+		if meta, ok := n.meta[key]; ok {
+			meta.Lease = id
+			n.meta[key] = meta
+		}
+	}
+}
+
+// GrantLease starts a lease ending ttl seconds from now.
+func GrantLease(ctx context.Context, ttl int64) (Lease, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Lease{}, fmt.Errorf("cannot pick a lease ID: %w", err)
+	}
+	l := Lease{
+		ID:        int64(binary.BigEndian.Uint64(b[:]) >> 1), // Positive, and unguessable so that only its holder can use it
+		TTL:       ttl,
+		ExpiresAt: time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+	if l.ID == 0 {
+		l.ID = 1
+	}
+	return l, Commit(ctx, LeaseEvent(l))
+}
+
+// KeepAlive extends the lease id to end its TTL from now. It fails with
+// ErrorNoSuchLease once the lease has ended, even if the leader has yet to
+// revoke it.
+func KeepAlive(ctx context.Context, id int64) (Lease, error) {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	l, err := LeaseInfo(id)
+	if err != nil {
+		return Lease{}, err
+	}
+	l.ExpiresAt = time.Now().Add(time.Duration(l.TTL) * time.Second)
+	return l, commit(ctx, LeaseEvent(l))
+}
+
+// RevokeLease ends the lease id now, deleting every key attached to it.
+func RevokeLease(ctx context.Context, id int64) error {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	leases.RLock()
+	_, ok := leases.m[id]
+	leases.RUnlock()
+	if !ok {
+		return ErrorNoSuchLease
+	}
+	return revokeLease(ctx, id)
+}
+
+// revokeLease must be called with txnMu held.
+func revokeLease(ctx context.Context, id int64) error {
+	for _, k := range LeaseKeys(id) {
+		if err := commit(ctx, transaction.Event{EventType: transaction.EventDelete, Namespace: k.Namespace, Key: k.Key}); err != nil {
+			return err
+		}
+	}
+	return commit(ctx, LeaseRevokeEvent(id))
+}
+
+// AttachLease attaches the existing key in namespace ns to the lease id, or
+// detaches it from its lease if id is zero.
+func AttachLease(ctx context.Context, ns, key string, id int64) error {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	if _, _, err := GetWithMeta(ctx, ns, key); err != nil {
+		return err
+	}
+	if id != 0 {
+		if _, err := LeaseInfo(id); err != nil {
+			return err
+		}
+	}
+	return commit(ctx, LeaseAttachEvent(ns, key, id))
+}
+
+// LeaseInfo returns the lease id, failing with ErrorNoSuchLease if it has
+// ended.
+func LeaseInfo(id int64) (Lease, error) {
+	leases.RLock()
+	defer leases.RUnlock()
+	l, ok := leases.m[id]
+	if !ok || l.expired(time.Now()) {
+		return Lease{}, ErrorNoSuchLease
+	}
+	return l, nil
+}
+
+// Leases returns every lease not yet revoked, ordered by ID.
+func Leases() []Lease {
+	leases.RLock()
+	defer leases.RUnlock()
+	list := make([]Lease, 0, len(leases.m))
+	for _, l := range leases.m {
+		list = append(list, l)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// LeaseKeys returns the keys attached to the lease id, ordered by namespace
+// and key.
+func LeaseKeys(id int64) []LeaseKey {
+	store.RLock()
+	defer store.RUnlock()
+	keys := make([]LeaseKey, 0)
+	for name, n := range store.ns {
+		for k, meta := range n.meta {
+			if meta.Lease == id {
+				keys = append(keys, LeaseKey{Namespace: name, Key: k})
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	return keys
+}
+
+// revokeExpiredLeases revokes every lease that has ended; see RunExpiry.
+func revokeExpiredLeases(ctx context.Context) {
+	var due []int64
+	now := time.Now()
+	leases.RLock()
+	for id, l := range leases.m {
+		if l.expired(now) {
+			due = append(due, id)
+		}
+	}
+	leases.RUnlock()
+
+	for _, id := range due {
+		txnMu.Lock()
+		err := revokeIfExpired(ctx, id)
+		txnMu.Unlock()
+		if err != nil {
+			log.Warn("cannot revoke expired lease", zap.Int64("lease", id), zap.Error(err))
+			return
+		}
+	}
+}
+
+// revokeIfExpired must be called with txnMu held, so that a lease kept alive
+// since it was found expired is not revoked.
+func revokeIfExpired(ctx context.Context, id int64) error {
+	leases.RLock()
+	l, ok := leases.m[id]
+	leases.RUnlock()
+	if !ok || !l.expired(time.Now()) {
+		return nil
+	}
+	return revokeLease(ctx, id)
+}
+
+// restoreLeases replaces every lease with those in list.
+func restoreLeases(list []Lease) {
+	leases.Lock()
+	defer leases.Unlock()
+	leases.m = make(map[int64]Lease, len(list))
+	for _, l := range list {
+		leases.m[l.ID] = l
+	}
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"melon/internal/transaction"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorQuotaExceeded = errors.New("namespace quota exceeded")
+
+// Quota limits the size of a namespace. Zero fields are unlimited.
+type Quota struct {
+	MaxKeys  int   `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"` // Total length of every key and value
+}
+
+// NamespaceInfo describes a namespace's usage and quota.
+type NamespaceInfo struct {
+	Name  string `json:"name"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+	Quota Quota  `json:"quota"`
+}
+
+// Namespaces describes every namespace other than the default one, ordered
+// by name.
+func Namespaces() []NamespaceInfo {
+	store.RLock()
+	defer store.RUnlock()
+	infos := make([]NamespaceInfo, 0, len(store.ns))
+	for name, n := range store.ns {
+		if name != DefaultNamespace {
+			infos = append(infos, NamespaceInfo{Name: name, Keys: len(n.m), Bytes: n.bytes, Quota: n.quota})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Namespace describes namespace ns, reporting false if it holds no keys and
+// has no quota.
+func Namespace(ns string) (NamespaceInfo, bool) {
+	store.RLock()
+	defer store.RUnlock()
+	n := store.ns[ns]
+	if n == nil {
+		return NamespaceInfo{Name: ns}, false
+	}
+	return NamespaceInfo{Name: ns, Keys: len(n.m), Bytes: n.bytes, Quota: n.quota}, true
+}
+
+// Keys lists the keys in namespace ns starting with prefix, in order,
+// leaving out expired keys not yet deleted.
+func Keys(ns, prefix string) []string {
+	store.RLock()
+	defer store.RUnlock()
+	keys := make([]string, 0)
+	now := time.Now()
+	if n := store.ns[ns]; n != nil {
+		for k := range n.m {
+			if strings.HasPrefix(k, prefix) && !expired(n.meta[k], now) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Entry is a key with its value and metadata.
+type Entry struct {
+	Key   string
+	Value string
+	Meta  KeyMeta
+}
+
+// List returns the keys in namespace ns starting with prefix, in order, with
+// their values. A positive limit caps the number returned, and more reports
+// whether it cut the list short.
+func List(ns, prefix string, limit int) (entries []Entry, more bool) {
+	store.RLock()
+	defer store.RUnlock()
+	entries = make([]Entry, 0)
+	n := store.ns[ns]
+	if n == nil {
+		return entries, false
+	}
+	now := time.Now()
+	for k, v := range n.m {
+		if strings.HasPrefix(k, prefix) && !expired(n.meta[k], now) {
+			entries = append(entries, Entry{Key: k, Value: v, Meta: n.meta[k]})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	if limit > 0 && len(entries) > limit {
+		return entries[:limit], true
+	}
+	return entries, false
+}
+
+// QuotaEvent builds the event that sets the quota of namespace ns.
+func QuotaEvent(ns string, q Quota) transaction.Event {
+	value, _ := json.Marshal(q)
+	return transaction.Event{EventType: transaction.EventQuota, Namespace: ns, Value: string(value)}
+}
+
+func applyQuota(e transaction.Event) error {
+	var q Quota
+	if err := json.Unmarshal([]byte(e.Value), &q); err != nil {
+		return fmt.Errorf("bad quota: %w", err)
+	}
+	store.Lock()
+	defer store.Unlock()
+	setQuota(e.Namespace, q)
+	return nil
+}
+
+// setQuota must be called with the store locked.
+func setQuota(ns string, q Quota) {
+	n := store.ns[ns]
+	if n == nil {
+		n = newNamespace()
+		store.ns[ns] = n
+	}
+	n.quota = q
+	if len(n.m) == 0 && q == (Quota{}) {
+		delete(store.ns, ns)
+	}
+}
+
+// quotaMu makes checking a write against its namespace's quota and
+// committing it one step, so concurrent writes cannot overshoot the quota
+// together.
+var quotaMu sync.Mutex
+
+// checkQuota reports whether putting value at key in namespace ns would keep
+// the namespace within its quota.
+func checkQuota(ns, key, value string) error {
+	return checkQuotas([]transaction.Event{{EventType: transaction.EventPut, Namespace: ns, Key: key, Value: value}})
+}
+
+// checkQuotas reports whether the puts and deletes in events, made in
+// order, would leave every namespace they write within its quota.
+func checkQuotas(events []transaction.Event) error {
+	store.RLock()
+	defer store.RUnlock()
+	type usage struct {
+		keys  int
+		bytes int64
+		seen  map[string]*string // Values written so far, nil once deleted
+	}
+	usages := make(map[string]*usage)
+	for _, e := range events {
+		n := store.ns[e.Namespace]
+		if n == nil || n.quota == (Quota{}) || (e.EventType != transaction.EventPut && e.EventType != transaction.EventDelete) {
+			continue
+		}
+		u := usages[e.Namespace]
+		if u == nil {
+			u = &usage{keys: len(n.m), bytes: n.bytes, seen: make(map[string]*string)}
+			usages[e.Namespace] = u
+		}
+		old, ok := u.seen[e.Key]
+		if !ok {
+			if v, exists := n.m[e.Key]; exists {
+				old = &v
+			}
+		}
+		if old != nil {
+			u.keys, u.bytes = u.keys-1, u.bytes-int64(len(e.Key)+len(*old))
+		}
+		u.seen[e.Key] = nil
+		if e.EventType == transaction.EventPut {
+			value := e.Value
+			u.keys, u.bytes = u.keys+1, u.bytes+int64(len(e.Key)+len(value))
+			u.seen[e.Key] = &value
+		}
+	}
+	for ns, u := range usages {
+		q := store.ns[ns].quota
+		if q.MaxKeys > 0 && u.keys > q.MaxKeys {
+			return fmt.Errorf("%w: %q is limited to %d keys", ErrorQuotaExceeded, ns, q.MaxKeys)
+		}
+		if q.MaxBytes > 0 && u.bytes > q.MaxBytes {
+			return fmt.Errorf("%w: %q is limited to %d bytes", ErrorQuotaExceeded, ns, q.MaxBytes)
+		}
+	}
+	return nil
+}
+
+func hasQuota(ns string) bool {
+	store.RLock()
+	defer store.RUnlock()
+	n := store.ns[ns]
+	return n != nil && n.quota != (Quota{})
+}
+
+// putsUnderQuota reports whether any of events is a put into a namespace
+// with a quota.
+func putsUnderQuota(events []transaction.Event) bool {
+	for _, e := range events {
+		if e.EventType == transaction.EventPut && hasQuota(e.Namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+// quotas returns the quota of every namespace that has one.
+func quotas() map[string]Quota {
+	store.RLock()
+	defer store.RUnlock()
+	q := make(map[string]Quota)
+	for name, n := range store.ns {
+		if n.quota != (Quota{}) {
+			q[name] = n.quota
+		}
+	}
+	return q
+}
+
+// restoreQuotas sets the quota of each namespace in q.
+func restoreQuotas(q map[string]Quota) {
+	store.Lock()
+	defer store.Unlock()
+	for name, quota := range q {
+		setQuota(name, quota)
+	}
+}
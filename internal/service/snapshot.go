@@ -0,0 +1,46 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// snapshot is every piece of state rebuilt from the transaction log.
+type snapshot struct {
+	Store      map[string]string             `json:"store"`                // The default namespace
+	Namespaces map[string]map[string]string  `json:"namespaces,omitempty"` // Every other namespace
+	Quotas     map[string]Quota              `json:"quotas,omitempty"`
+	Meta       map[string]map[string]KeyMeta `json:"meta,omitempty"` // Key versions and timestamps, by namespace
+	Grants     []Grant                       `json:"grants"`
+	Indexes    []IndexDefinition             `json:"indexes,omitempty"`
+	Leases     []Lease                       `json:"leases,omitempty"`
+}
+
+// Snapshot serializes the whole state, for restoring with RestoreSnapshot
+// instead of replaying the log.
+func Snapshot() ([]byte, error) {
+	s := snapshot{Store: Dump(), Namespaces: make(map[string]map[string]string), Quotas: quotas(), Meta: dumpMeta(), Grants: Grants(), Indexes: Indexes(), Leases: Leases()}
+	for _, ns := range Namespaces() {
+		s.Namespaces[ns.Name] = DumpIn(ns.Name)
+	}
+	return json.Marshal(s)
+}
+
+// RestoreSnapshot replaces the whole state with one taken by Snapshot.
+func RestoreSnapshot(data []byte) error {
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("cannot decode snapshot: %w", err)
+	}
+	namespaces := map[string]map[string]string{DefaultNamespace: s.Store}
+	for name, m := range s.Namespaces {
+		namespaces[name] = m
+	}
+	restoreIndexes(s.Indexes) // Before Restore, which builds them
+	Restore(namespaces)
+	restoreMeta(s.Meta)
+	restoreQuotas(s.Quotas)
+	restoreGrants(s.Grants)
+	restoreLeases(s.Leases)
+	return nil
+}
@@ -1,35 +1,76 @@
 package service
 
 import (
+	"context"
 	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"melon/internal/metrics"
 	"melon/internal/transaction"
+	"time"
 )
 
 var logger transaction.TransactionLogger
 
-func InitializeTransactionLog() error {
-	var err error
-	logger, err = transaction.NewFileTransactionLogger("transaction.log")
+// log receives the service's diagnostics; see SetLogger.
+var log = zap.NewNop()
+
+var tracer = otel.Tracer("melon/internal/service")
+
+// startSpan starts a child of the span in ctx. Work done without one, such
+// as replaying the log at startup, is not traced.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// SetLogger makes the service report to l.
+func SetLogger(l *zap.Logger) {
+	log = l.Named("service")
+}
+
+func InitializeTransactionLog(filename string) error {
+	l, err := transaction.NewFileTransactionLogger(filename)
 	// logger, err = NewPostgresTransactionLogger("localhost") // TODO test it by runnin postgeryy
 	if err != nil {
 		return fmt.Errorf("failed to create event logger: %w", err)
 	}
+	return InitializeWithLogger(l)
+}
 
+// InitializeWithLogger replays the events already in l into the store and
+// starts writing new events to it.
+func InitializeWithLogger(l transaction.TransactionLogger) error {
+	var err error
+	health.Lock() // Ready may be polled meanwhile
+	logger = l
+	health.Unlock()
+	start := time.Now()
 	events, errors := logger.ReadEvents()
-	e, ok := transaction.Event{}, true
+	e, ok, replayed := transaction.Event{}, true, 0
 	for ok && err == nil {
 		select {
 		case err, ok = <-errors:
 		case e, ok = <-events:
-			switch e.EventType {
-			case transaction.EventDelete:
-				err = Delete(e.Key)
-			case transaction.EventPut:
-				err = Put(e.Key, e.Value)
+			if ok {
+				err = replay(context.Background(), e)
+				replayed++
 			}
 		}
 	}
+	if err != nil {
+		log.Error("replay failed", zap.Uint64("sequence", e.Sequence), zap.Error(err))
+	} else {
+		log.Info("transaction log replayed", zap.Int("events", replayed), zap.Duration("took", time.Since(start)))
+	}
+	metrics.ReplayDuration.Set(time.Since(start).Seconds())
 	logger.Run()
+	go watchLogErrors(logger.Err())
+	setReplayed(err)
 	return err
 }
 
@@ -40,3 +81,118 @@ func WritePut(key, value string) {
 func WriteDelete(key string) {
 	logger.WriteDelete(key)
 }
+
+// LastSequence returns the sequence number of the last event written to the log.
+func LastSequence() uint64 {
+	return logger.LastSequence()
+}
+
+// ReadEventsFrom streams the logged events from sequence number seq onwards.
+func ReadEventsFrom(seq uint64) (<-chan transaction.Event, <-chan error) {
+	return logger.ReadEventsFrom(seq)
+}
+
+// Subscribe returns a live feed of events as they are written to the log.
+func Subscribe() (<-chan transaction.Event, func()) {
+	return logger.Subscribe()
+}
+
+// committer, when set, replicates every write before it is applied; see
+// SetCommitter.
+var committer func(context.Context, transaction.Event) error
+
+// SetCommitter routes writes made through Commit to commit instead of applying
+// them locally. commit is expected to call Apply on every node once the event
+// is durable.
+func SetCommitter(commit func(context.Context, transaction.Event) error) {
+	committer = commit
+}
+
+// Commit makes a write on behalf of a client: the event is applied to the
+// store and logged, or handed to the committer when one is set. Puts that
+// would take a namespace over its quota fail with ErrorQuotaExceeded, and
+// every write fails with ErrorReadOnly in read-only mode.
+func Commit(ctx context.Context, e transaction.Event) error {
+	txnMu.RLock()
+	defer txnMu.RUnlock()
+	return commit(ctx, e)
+}
+
+func commit(ctx context.Context, e transaction.Event) error {
+	if err := ctx.Err(); err != nil {
+		return err // The caller gave up, perhaps at its deadline
+	}
+	if ReadOnly() {
+		return ErrorReadOnly
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now() // Before replicating, so every node records the same time
+	}
+	events, err := e.Events() // A batch's puts are checked together
+	if err != nil {
+		return err
+	}
+	if putsUnderQuota(events) {
+		quotaMu.Lock()
+		defer quotaMu.Unlock()
+		if err := checkQuotas(events); err != nil {
+			return err
+		}
+	}
+	if committer != nil {
+		return committer(ctx, e)
+	}
+	return Apply(ctx, e)
+}
+
+// Apply applies e to the store and appends it to the local log. Followers and
+// cluster members call it for events that were committed elsewhere.
+func Apply(ctx context.Context, e transaction.Event) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	if err := replay(ctx, e); err != nil {
+		return err
+	}
+	_, span := startSpan(ctx, "transaction.enqueue", attribute.String("melon.key", e.Key))
+	defer span.End()
+	logger.WriteEvent(e.WithContext(ctx)) // Blocks while the logger's queue is full
+	return nil
+}
+
+// replay applies e to the in-memory state without logging it.
+func replay(ctx context.Context, e transaction.Event) error {
+	switch e.EventType {
+	case transaction.EventDelete:
+		return DeleteIn(ctx, e.Namespace, e.Key)
+	case transaction.EventPut:
+		if e.CreatedAt.IsZero() {
+			e.CreatedAt = time.Now() // Logged before timestamps were recorded
+		}
+		return put(ctx, e.Namespace, e.Key, e.Value, e.CreatedAt)
+	case transaction.EventGrant:
+		return applyGrant(e)
+	case transaction.EventRevoke:
+		return applyRevoke(e)
+	case transaction.EventQuota:
+		return applyQuota(e)
+	case transaction.EventExpire:
+		return applyExpire(e)
+	case transaction.EventFlags:
+		return applyFlags(e)
+	case transaction.EventListPush, transaction.EventListPop, transaction.EventSetAdd,
+		transaction.EventSetRemove, transaction.EventHashSet, transaction.EventHashDelete:
+		return applyTyped(e)
+	case transaction.EventIndex:
+		return applyIndex(e)
+	case transaction.EventLease:
+		return applyLease(e)
+	case transaction.EventLeaseRevoke:
+		return applyLeaseRevoke(e)
+	case transaction.EventLeaseAttach:
+		return applyLeaseAttach(e)
+	case transaction.EventBatch:
+		return applyBatch(ctx, e)
+	}
+	return fmt.Errorf("unknown event type %d", e.EventType)
+}
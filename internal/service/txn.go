@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"melon/internal/transaction"
+	"strings"
+	"sync"
+	"time"
+)
+
+// txnMu is held for reading by every Commit and for writing by Txn, so no
+// write lands between a transaction's compares and its operations.
+var txnMu sync.RWMutex
+
+// CompareTarget is what a Compare looks at.
+type CompareTarget int
+
+const (
+	CompareVersion CompareTarget = iota // The key's version, zero when it does not exist
+	CompareValue
+)
+
+// CompareResult is the relation a Compare expects between the key and its
+// operand.
+type CompareResult int
+
+const (
+	CompareEqual CompareResult = iota
+	CompareNotEqual
+	CompareLess
+	CompareGreater
+)
+
+// Compare is a condition on a key checked by Txn.
+type Compare struct {
+	Namespace, Key string
+	Target         CompareTarget
+	Result         CompareResult
+	Version        uint64 // Operand for CompareVersion
+	Value          string // Operand for CompareValue
+}
+
+// TxnOpType is the kind of a TxnOp.
+type TxnOpType int
+
+const (
+	TxnGet TxnOpType = iota
+	TxnPut
+	TxnDelete
+)
+
+// TxnOp is an operation run by Txn.
+type TxnOp struct {
+	Type           TxnOpType
+	Namespace, Key string
+	Value          string    // For TxnPut
+	ExpiresAt      time.Time // For TxnPut: when the key expires; zero for never
+	Flags          uint32    // For TxnPut: see KeyMeta
+	Lease          int64     // For TxnPut: the lease to attach the key to; zero for none
+}
+
+// TxnResult is the outcome of a TxnOp: the key as it is after the
+// operation, or as it was before a delete. Found is false if the key did
+// not exist.
+type TxnResult struct {
+	Entry
+	Found bool
+}
+
+var ErrorUnknownCompare = errors.New("unknown compare")
+
+// Txn checks every compare and runs success if they all hold, failure
+// otherwise, returning which ran and each operation's result. No other write
+// on this node lands in between, and the writes are committed as one batch,
+// so that they are applied, on every node and on replay, all or none.
+func Txn(ctx context.Context, compares []Compare, success, failure []TxnOp) (bool, []TxnResult, error) {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	succeeded := true
+	for _, cmp := range compares {
+		ok, err := holds(ctx, cmp)
+		if err != nil {
+			return false, nil, err
+		}
+		succeeded = succeeded && ok
+	}
+	ops := success
+	if !succeeded {
+		ops = failure
+	}
+	t := txnView{keys: make(map[txnKey]TxnResult), now: time.Now()}
+	results := make([]TxnResult, 0, len(ops))
+	for _, op := range ops {
+		r, err := t.run(ctx, op)
+		if err != nil {
+			return succeeded, nil, err
+		}
+		results = append(results, r)
+	}
+	if len(t.events) > 0 {
+		if err := commitBatch(ctx, t.events); err != nil {
+			return succeeded, nil, err
+		}
+	}
+	return succeeded, results, nil
+}
+
+func holds(ctx context.Context, cmp Compare) (bool, error) {
+	value, meta, err := GetWithMeta(ctx, cmp.Namespace, cmp.Key)
+	if err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		return false, err
+	}
+	var c int
+	switch cmp.Target {
+	case CompareVersion:
+		switch {
+		case meta.Version < cmp.Version:
+			c = -1
+		case meta.Version > cmp.Version:
+			c = 1
+		}
+	case CompareValue:
+		if errors.Is(err, ErrorNoSuchKey) {
+			return false, nil // A missing key has no value to compare
+		}
+		c = strings.Compare(value, cmp.Value)
+	default:
+		return false, ErrorUnknownCompare
+	}
+	switch cmp.Result {
+	case CompareEqual:
+		return c == 0, nil
+	case CompareNotEqual:
+		return c != 0, nil
+	case CompareLess:
+		return c < 0, nil
+	case CompareGreater:
+		return c > 0, nil
+	}
+	return false, ErrorUnknownCompare
+}
+
+// txnView is the store as a transaction's operations have left it so far,
+// before any of their writes is committed.
+type txnView struct {
+	keys   map[txnKey]TxnResult // Keys written so far
+	events []transaction.Event  // The writes, in order
+	now    time.Time            // When the writes are made
+}
+
+type txnKey struct{ ns, key string }
+
+func (t *txnView) get(ctx context.Context, ns, key string) (TxnResult, error) {
+	if r, ok := t.keys[txnKey{ns, key}]; ok {
+		return r, nil
+	}
+	r := TxnResult{Entry: Entry{Key: key}}
+	value, meta, err := GetWithMeta(ctx, ns, key)
+	if err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		return r, err
+	}
+	r.Found = err == nil
+	r.Value, r.Meta = value, meta
+	return r, nil
+}
+
+// run adds the writes of op to t and returns its result, working out the
+// key's metadata after a put as the put will leave it.
+func (t *txnView) run(ctx context.Context, op TxnOp) (TxnResult, error) {
+	r, err := t.get(ctx, op.Namespace, op.Key)
+	if err != nil {
+		return r, err
+	}
+	k := txnKey{op.Namespace, op.Key}
+	switch op.Type {
+	case TxnPut:
+		if !r.Found {
+			r.Meta = KeyMeta{CreatedAt: t.now}
+		}
+		r.Found, r.Value = true, op.Value
+		r.Meta.Version++
+		r.Meta.UpdatedAt = t.now
+		r.Meta.ExpiresAt, r.Meta.Flags, r.Meta.Lease, r.Meta.Type = op.ExpiresAt, op.Flags, op.Lease, TypeString
+		for _, e := range putEvents(op.Namespace, op.Key, op.Value, op.ExpiresAt, op.Flags, op.Lease) {
+			e.CreatedAt = t.now
+			t.events = append(t.events, e)
+		}
+		t.keys[k] = r
+	case TxnDelete:
+		if !r.Found {
+			return r, nil
+		}
+		t.events = append(t.events, transaction.Event{EventType: transaction.EventDelete, Namespace: op.Namespace, Key: op.Key, CreatedAt: t.now})
+		t.keys[k] = TxnResult{Entry: Entry{Key: op.Key}}
+	}
+	return r, nil
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"melon/internal/transaction"
+	"testing"
+)
+
+func TestTxnCommitsOneBatch(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	start := LastSequence()
+	if err := Commit(ctx, transaction.Event{EventType: transaction.EventPut, Key: "txn-c", Value: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	start++
+	settle(t, start)
+
+	ok, results, err := Txn(ctx, nil, []TxnOp{
+		{Type: TxnPut, Key: "txn-a", Value: "1", Flags: 7},
+		{Type: TxnGet, Key: "txn-a"},
+		{Type: TxnPut, Key: "txn-a", Value: "2"},
+		{Type: TxnDelete, Key: "txn-c"},
+		{Type: TxnGet, Key: "txn-c"},
+	}, nil)
+	if err != nil || !ok {
+		t.Fatalf("got %v %v", ok, err)
+	}
+	settle(t, start+1)
+	if seq := LastSequence(); seq != start+1 {
+		t.Errorf("logged %d events, want 1", seq-start)
+	}
+
+	if r := results[1]; !r.Found || r.Value != "1" || r.Meta.Flags != 7 {
+		t.Errorf("get after the first put saw %+v", r)
+	}
+	if r := results[2]; r.Value != "2" || r.Meta.Version != results[1].Meta.Version+1 || r.Meta.Flags != 0 {
+		t.Errorf("second put left %+v", r)
+	}
+	if r := results[3]; !r.Found || r.Value != "old" {
+		t.Errorf("delete saw %+v, want the value before it", r)
+	}
+	if results[4].Found {
+		t.Errorf("get after the delete found %+v", results[4])
+	}
+
+	value, meta, err := GetWithMeta(ctx, "", "txn-a")
+	if err != nil || value != "2" || meta != results[2].Meta {
+		t.Errorf("store holds %q %+v %v, want what the txn reported, %+v", value, meta, err, results[2].Meta)
+	}
+	if _, err := GetIn(ctx, "", "txn-c"); err != ErrorNoSuchKey {
+		t.Errorf("txn-c was not deleted: %v", err)
+	}
+}
@@ -0,0 +1,394 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"melon/internal/transaction"
+	"sort"
+	"time"
+)
+
+// ValueType is the kind of value a key holds. Lists, sets and hashes are
+// stored as their JSON encoding, so that every read of a key still sees a
+// string, but are changed in place by their own operations, each logged as
+// a small event of its own rather than as the whole new value.
+type ValueType string
+
+const (
+	TypeString ValueType = ""
+	TypeList   ValueType = "list" // A JSON array, in order
+	TypeSet    ValueType = "set"  // A JSON array of distinct members, sorted
+	TypeHash   ValueType = "hash" // A JSON object
+)
+
+var (
+	ErrorWrongType   = errors.New("operation against a key holding the wrong kind of value")
+	ErrorNoSuchField = errors.New("no such field")
+)
+
+// typedOp is the logged form of an operation on a list, set or hash.
+type typedOp struct {
+	Left   bool              `json:"left,omitempty"`   // Push or pop at the head of a list rather than its tail
+	Values []string          `json:"values,omitempty"` // Elements pushed, members added or removed, or fields deleted
+	Count  int               `json:"count,omitempty"`  // Elements popped
+	Fields map[string]string `json:"fields,omitempty"` // Fields set
+}
+
+// typedResult is what an operation did.
+type typedResult struct {
+	Changed int      // Elements pushed, members added or removed, or fields added or deleted
+	Popped  []string // Elements popped
+	Length  int      // Size of the value afterwards
+}
+
+// isTypedEvent reports whether events of type t are operations on a list,
+// set or hash.
+func isTypedEvent(t transaction.EventType) bool {
+	switch t {
+	case transaction.EventListPush, transaction.EventListPop, transaction.EventSetAdd,
+		transaction.EventSetRemove, transaction.EventHashSet, transaction.EventHashDelete:
+		return true
+	}
+	return false
+}
+
+func valueType(t transaction.EventType) ValueType {
+	switch t {
+	case transaction.EventListPush, transaction.EventListPop:
+		return TypeList
+	case transaction.EventSetAdd, transaction.EventSetRemove:
+		return TypeSet
+	}
+	return TypeHash
+}
+
+// edit applies op, of event type t, to the encoded value of a key of type
+// vt, returning the new encoding, or "" once the value is empty.
+func edit(vt ValueType, value string, t transaction.EventType, op typedOp) (string, typedResult, error) {
+	var r typedResult
+	switch vt {
+	case TypeList:
+		var list []string
+		if err := decodeTyped(value, &list); err != nil {
+			return "", r, err
+		}
+		switch {
+		case t == transaction.EventListPush && op.Left:
+			for _, v := range op.Values {
+				list = append([]string{v}, list...) // Each goes to the head in turn, as with Redis's LPUSH
+			}
+			r.Changed = len(op.Values)
+		case t == transaction.EventListPush:
+			list = append(list, op.Values...)
+			r.Changed = len(op.Values)
+		default:
+			n := op.Count
+			if n > len(list) {
+				n = len(list)
+			}
+			r.Popped = make([]string, 0, n)
+			for i := 0; i < n; i++ {
+				if op.Left {
+					r.Popped, list = append(r.Popped, list[0]), list[1:]
+				} else {
+					r.Popped, list = append(r.Popped, list[len(list)-1]), list[:len(list)-1]
+				}
+			}
+			r.Changed = n
+		}
+		r.Length = len(list)
+		return encodeTyped(r.Length, list), r, nil
+	case TypeSet:
+		var members []string
+		if err := decodeTyped(value, &members); err != nil {
+			return "", r, err
+		}
+		set := make(map[string]bool, len(members))
+		for _, m := range members {
+			set[m] = true
+		}
+		for _, m := range op.Values {
+			if set[m] != (t == transaction.EventSetAdd) {
+				set[m] = t == transaction.EventSetAdd
+				r.Changed++
+			}
+		}
+		members = members[:0]
+		for m, in := range set {
+			if in {
+				members = append(members, m)
+			}
+		}
+		sort.Strings(members)
+		r.Length = len(members)
+		return encodeTyped(r.Length, members), r, nil
+	case TypeHash:
+		hash := make(map[string]string)
+		if err := decodeTyped(value, &hash); err != nil {
+			return "", r, err
+		}
+		for f, v := range op.Fields {
+			if _, ok := hash[f]; !ok {
+				r.Changed++
+			}
+			hash[f] = v
+		}
+		for _, f := range op.Values {
+			if _, ok := hash[f]; ok {
+				delete(hash, f)
+				r.Changed++
+			}
+		}
+		r.Length = len(hash)
+		return encodeTyped(r.Length, hash), r, nil
+	}
+	return "", r, ErrorWrongType
+}
+
+func decodeTyped(value string, v interface{}) error {
+	if value == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		return fmt.Errorf("bad stored value: %w", err)
+	}
+	return nil
+}
+
+func encodeTyped(length int, v interface{}) string {
+	if length == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// applyTyped replays an operation on a list, set or hash. A key that had
+// expired by the time of the operation starts again empty, and one left
+// empty is deleted.
+func applyTyped(e transaction.Event) error {
+	var op typedOp
+	if err := json.Unmarshal([]byte(e.Value), &op); err != nil {
+		return fmt.Errorf("bad operation: %w", err)
+	}
+	vt := valueType(e.EventType)
+	store.Lock()
+	defer store.Unlock()
+	n := store.ns[e.Namespace]
+	if n == nil {
+		n = newNamespace()
+		store.ns[e.Namespace] = n
+	}
+	old, exists := n.m[e.Key]
+	meta := n.meta[e.Key]
+	if exists && expired(meta, e.CreatedAt) {
+		old, exists, meta = "", false, KeyMeta{}
+	}
+	if exists && meta.Type != vt {
+		return fmt.Errorf("%w: %q is a %s", ErrorWrongType, e.Key, typeName(meta.Type))
+	}
+	value, _, err := edit(vt, old, e.EventType, op)
+	if err != nil {
+		return err
+	}
+	if current, ok := n.m[e.Key]; ok {
+		n.bytes -= int64(len(e.Key) + len(current))
+		unindex(e.Namespace, e.Key, current)
+	}
+	if value == "" {
+		delete(n.m, e.Key)
+		delete(n.meta, e.Key)
+		delete(n.expiring, e.Key)
+		if len(n.m) == 0 && n.quota == (Quota{}) {
+			delete(store.ns, e.Namespace)
+		}
+		return nil
+	}
+	if !exists {
+		meta = KeyMeta{CreatedAt: e.CreatedAt, Type: vt}
+		delete(n.expiring, e.Key)
+	}
+	meta.Version++
+	meta.UpdatedAt = e.CreatedAt
+	n.m[e.Key] = value
+	n.meta[e.Key] = meta
+	n.bytes += int64(len(e.Key) + len(value))
+	reindex(e.Namespace, e.Key, value)
+	return nil
+}
+
+// typedStep returns what applies the operation e to its key once deleted,
+// to be called with the store locked; see batchStep.
+func typedStep(e transaction.Event) (func(), error) {
+	var op typedOp
+	if err := json.Unmarshal([]byte(e.Value), &op); err != nil {
+		return nil, fmt.Errorf("bad operation: %w", err)
+	}
+	vt := valueType(e.EventType)
+	value, _, err := edit(vt, "", e.EventType, op)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if value == "" {
+			return // An empty value is no key, as the delete before left it
+		}
+		putLocked(e.Namespace, e.Key, value, e.CreatedAt)
+		meta := store.ns[e.Namespace].meta[e.Key]
+		meta.Type = vt
+		store.ns[e.Namespace].meta[e.Key] = meta
+	}, nil
+}
+
+func typeName(t ValueType) string {
+	if t == TypeString {
+		return "string"
+	}
+	return string(t)
+}
+
+// commitTyped checks op against the current value of key and commits it,
+// returning what it did. Operations that would change nothing are not
+// logged.
+func commitTyped(ctx context.Context, ns, key string, t transaction.EventType, op typedOp) (typedResult, error) {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	value, meta, err := GetWithMeta(ctx, ns, key)
+	if err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		return typedResult{}, err
+	}
+	vt := valueType(t)
+	if err == nil && meta.Type != vt {
+		return typedResult{}, fmt.Errorf("%w: %q is a %s", ErrorWrongType, key, typeName(meta.Type))
+	}
+	updated, r, err := edit(vt, value, t, op)
+	if err != nil || updated == value {
+		return r, err
+	}
+	if updated != "" && hasQuota(ns) {
+		if err := checkQuota(ns, key, updated); err != nil { // txnMu keeps every other write out meanwhile
+			return typedResult{}, err
+		}
+	}
+	encoded, _ := json.Marshal(op)
+	err = commit(ctx, transaction.Event{EventType: t, Namespace: ns, Key: key, Value: string(encoded), CreatedAt: time.Now()})
+	return r, err
+}
+
+// readTyped decodes the value of key, which must be of type vt, into v. A
+// missing key reads as empty.
+func readTyped(ctx context.Context, ns, key string, vt ValueType, v interface{}) error {
+	value, meta, err := GetWithMeta(ctx, ns, key)
+	if errors.Is(err, ErrorNoSuchKey) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if meta.Type != vt {
+		return fmt.Errorf("%w: %q is a %s", ErrorWrongType, key, typeName(meta.Type))
+	}
+	return decodeTyped(value, v)
+}
+
+// ListPush adds values to the tail of the list at key in namespace ns, or
+// to its head if left is set, creating the list if needed. It returns the
+// length of the list afterwards.
+func ListPush(ctx context.Context, ns, key string, left bool, values ...string) (int, error) {
+	r, err := commitTyped(ctx, ns, key, transaction.EventListPush, typedOp{Left: left, Values: values})
+	return r.Length, err
+}
+
+// ListPop removes and returns up to count elements from the tail of the list
+// at key, or from its head if left is set, nearest the end first. The list
+// is deleted once empty.
+func ListPop(ctx context.Context, ns, key string, left bool, count int) ([]string, error) {
+	r, err := commitTyped(ctx, ns, key, transaction.EventListPop, typedOp{Left: left, Count: count})
+	if r.Popped == nil {
+		r.Popped = []string{}
+	}
+	return r.Popped, err
+}
+
+// ListRange returns the elements of the list at key from start to stop
+// inclusive. Negative indexes count back from the tail, so 0 to -1 is the
+// whole list.
+func ListRange(ctx context.Context, ns, key string, start, stop int) ([]string, error) {
+	var list []string
+	if err := readTyped(ctx, ns, key, TypeList, &list); err != nil {
+		return nil, err
+	}
+	if start < 0 {
+		start += len(list)
+	}
+	if stop < 0 {
+		stop += len(list)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= len(list) {
+		stop = len(list) - 1
+	}
+	if start > stop {
+		return []string{}, nil
+	}
+	return list[start : stop+1], nil
+}
+
+// SetAdd adds members to the set at key, creating it if needed, and
+// returns how many were not already in it.
+func SetAdd(ctx context.Context, ns, key string, members ...string) (int, error) {
+	r, err := commitTyped(ctx, ns, key, transaction.EventSetAdd, typedOp{Values: members})
+	return r.Changed, err
+}
+
+// SetRemove removes members from the set at key and returns how many were
+// in it. The set is deleted once empty.
+func SetRemove(ctx context.Context, ns, key string, members ...string) (int, error) {
+	r, err := commitTyped(ctx, ns, key, transaction.EventSetRemove, typedOp{Values: members})
+	return r.Changed, err
+}
+
+// SetMembers returns the members of the set at key, sorted.
+func SetMembers(ctx context.Context, ns, key string) ([]string, error) {
+	members := []string{}
+	err := readTyped(ctx, ns, key, TypeSet, &members)
+	return members, err
+}
+
+// HashSet sets fields of the hash at key, creating it if needed, and
+// returns how many were new.
+func HashSet(ctx context.Context, ns, key string, fields map[string]string) (int, error) {
+	r, err := commitTyped(ctx, ns, key, transaction.EventHashSet, typedOp{Fields: fields})
+	return r.Changed, err
+}
+
+// HashDelete deletes fields from the hash at key and returns how many
+// existed. The hash is deleted once empty.
+func HashDelete(ctx context.Context, ns, key string, fields ...string) (int, error) {
+	r, err := commitTyped(ctx, ns, key, transaction.EventHashDelete, typedOp{Values: fields})
+	return r.Changed, err
+}
+
+// HashGetAll returns every field of the hash at key.
+func HashGetAll(ctx context.Context, ns, key string) (map[string]string, error) {
+	hash := make(map[string]string)
+	err := readTyped(ctx, ns, key, TypeHash, &hash)
+	return hash, err
+}
+
+// HashGet returns one field of the hash at key.
+func HashGet(ctx context.Context, ns, key, field string) (string, error) {
+	hash, err := HashGetAll(ctx, ns, key)
+	if err != nil {
+		return "", err
+	}
+	value, ok := hash[field]
+	if !ok {
+		return "", ErrorNoSuchField
+	}
+	return value, nil
+}
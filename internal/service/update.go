@@ -0,0 +1,124 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"melon/internal/transaction"
+	"time"
+)
+
+// Update replaces the value of key in namespace ns with what f makes of
+// it, with no other write landing in between. f is told whether the key
+// exists. The new value is logged as a plain put, and the key keeps its
+// expiry, flags and lease.
+func Update(ctx context.Context, ns, key string, f func(value string, found bool) (string, error)) (string, KeyMeta, error) {
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	value, meta, err := GetWithMeta(ctx, ns, key)
+	if err != nil && !errors.Is(err, ErrorNoSuchKey) {
+		return "", KeyMeta{}, err
+	}
+	value, err = f(value, err == nil)
+	if err != nil {
+		return "", KeyMeta{}, err
+	}
+	if err := putWithAttributes(ctx, ns, key, value, meta.ExpiresAt, meta.Flags, meta.Lease); err != nil {
+		return "", KeyMeta{}, err
+	}
+	return GetWithMeta(ctx, ns, key)
+}
+
+// putWithAttributes commits a put along with the expiry, flags and lease
+// given, if any, as one batch, so that no reader, replica or replay sees
+// the put without them. It must be called with txnMu held.
+func putWithAttributes(ctx context.Context, ns, key, value string, expires time.Time, flags uint32, lease int64) error {
+	return commitBatch(ctx, putEvents(ns, key, value, expires, flags, lease))
+}
+
+// ErrorLeased is returned when importing a key attached to a lease, which
+// only means something on the node that granted it.
+var ErrorLeased = errors.New("key is attached to a lease of another node")
+
+// ErrorBadImport is returned when an imported value is not of its type.
+var ErrorBadImport = errors.New("bad import")
+
+// Import replaces key in namespace ns with value, of the type, expiry and
+// flags of meta, as one batch. It is how a key moves to a new owner; its
+// version and timestamps start again there.
+func Import(ctx context.Context, ns, key, value string, meta KeyMeta) error {
+	if meta.Lease != 0 {
+		return ErrorLeased
+	}
+	events := []transaction.Event{{EventType: transaction.EventDelete, Namespace: ns, Key: key}}
+	switch meta.Type {
+	case TypeString:
+		events = append(events, transaction.Event{EventType: transaction.EventPut, Namespace: ns, Key: key, Value: value})
+	case TypeList, TypeSet, TypeHash:
+		e, err := wholeValueEvent(ns, key, meta.Type, value)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrorBadImport, err)
+		}
+		events = append(events, e)
+	default:
+		return fmt.Errorf("%w: unknown value type %q", ErrorBadImport, meta.Type)
+	}
+	if !meta.ExpiresAt.IsZero() {
+		events = append(events, ExpireEvent(ns, key, meta.ExpiresAt))
+	}
+	if meta.Flags != 0 {
+		events = append(events, FlagsEvent(ns, key, meta.Flags))
+	}
+	txnMu.Lock()
+	defer txnMu.Unlock()
+	if hasQuota(ns) {
+		if err := checkQuota(ns, key, value); err != nil {
+			return err
+		}
+	}
+	return commitBatch(ctx, events)
+}
+
+// wholeValueEvent returns the operation building the list, set or hash
+// value from nothing.
+func wholeValueEvent(ns, key string, vt ValueType, value string) (transaction.Event, error) {
+	e := transaction.Event{Namespace: ns, Key: key}
+	var op typedOp
+	switch vt {
+	case TypeList:
+		e.EventType = transaction.EventListPush
+		if err := decodeTyped(value, &op.Values); err != nil {
+			return e, err
+		}
+	case TypeSet:
+		e.EventType = transaction.EventSetAdd
+		if err := decodeTyped(value, &op.Values); err != nil {
+			return e, err
+		}
+	case TypeHash:
+		e.EventType = transaction.EventHashSet
+		if err := decodeTyped(value, &op.Fields); err != nil {
+			return e, err
+		}
+	}
+	b, err := json.Marshal(op)
+	e.Value = string(b)
+	return e, err
+}
+
+// putEvents returns the events that put value at key along with its
+// expiry, flags and lease, if any.
+func putEvents(ns, key, value string, expires time.Time, flags uint32, lease int64) []transaction.Event {
+	events := []transaction.Event{{EventType: transaction.EventPut, Namespace: ns, Key: key, Value: value}}
+	if !expires.IsZero() {
+		events = append(events, ExpireEvent(ns, key, expires))
+	}
+	if flags != 0 {
+		events = append(events, FlagsEvent(ns, key, flags))
+	}
+	if lease != 0 {
+		events = append(events, LeaseAttachEvent(ns, key, lease))
+	}
+	return events
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"melon/internal/transaction"
+)
+
+// ErrorWatcherDropped is returned by Watch when the watcher falls too far
+// behind the live feed; it is expected to watch again from the sequence
+// after the last event it saw.
+var ErrorWatcherDropped = errors.New("watcher fell behind")
+
+// Watch calls f with every put and delete matching match, starting with
+// those already logged from sequence from when it is not zero, then live as
+// they are written, until ctx is done or f fails. An operation on a list,
+// set or hash is passed on as a put of the whole value it left, or a delete
+// if it left the value empty, as History reports it, and the puts and
+// deletes of a batch one by one, all with the batch's sequence number.
+func Watch(ctx context.Context, from uint64, match func(transaction.Event) bool, f func(transaction.Event) error) error {
+	live, cancel := Subscribe() // Subscribe first so no event slips between backlog and feed
+	defer cancel()
+
+	wanted := func(e transaction.Event) bool {
+		return (e.EventType == transaction.EventPut || e.EventType == transaction.EventDelete || isTypedEvent(e.EventType)) && match(e)
+	}
+	deliver := func(e transaction.Event) error {
+		events, err := e.Events() // The events of a batch are sent one by one
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if !wanted(e) {
+				continue
+			}
+			if isTypedEvent(e.EventType) {
+				if e, err = foldedEvent(e); err != nil {
+					return err
+				}
+			}
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var next uint64
+	if from > 0 {
+		next = from
+		events, errs := ReadEventsFrom(from)
+		for e := range events {
+			next = e.Sequence + 1
+			if err := deliver(e); err != nil {
+				for range events { // Let the reader finish
+				}
+				return err
+			}
+		}
+		if err := <-errs; err != nil {
+			return fmt.Errorf("cannot read backlog: %w", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-live:
+			if !ok {
+				return ErrorWatcherDropped
+			}
+			if e.Sequence < next {
+				continue
+			}
+			if err := deliver(e); err != nil {
+				return err
+			}
+			next = e.Sequence + 1
+		}
+	}
+}
+
+// foldedEvent returns the version History reports for the list, set or hash
+// operation e.
+func foldedEvent(e transaction.Event) (transaction.Event, error) {
+	history, err := foldHistory(e.Namespace, e.Key)
+	if err != nil {
+		return e, err
+	}
+	for _, v := range history {
+		if v.Sequence == e.Sequence {
+			return v.Event, nil
+		}
+	}
+	return e, fmt.Errorf("event %d is missing from the history of %q", e.Sequence, e.Key)
+}
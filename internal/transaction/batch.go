@@ -0,0 +1,70 @@
+package transaction
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// batchItem is the logged form of an event within a batch.
+type batchItem struct {
+	Type      EventType `json:"type"`
+	Namespace string    `json:"namespace,omitempty"`
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+}
+
+// BatchEvent builds the event that applies events together, all or none,
+// as a single entry in the log. Only their types, namespaces, keys and
+// values are kept.
+func BatchEvent(events []Event) Event {
+	items := make([]batchItem, len(events))
+	for i, e := range events {
+		items[i] = batchItem{Type: e.EventType, Namespace: e.Namespace, Key: e.Key, Value: e.Value}
+	}
+	value, _ := json.Marshal(items)
+	return Event{EventType: EventBatch, Value: string(value)}
+}
+
+// Events returns the events of the batch e, in order, each carrying the
+// sequence number and times of e. Any other event is returned alone.
+func (e Event) Events() ([]Event, error) {
+	if e.EventType != EventBatch {
+		return []Event{e}, nil
+	}
+	var items []batchItem
+	if err := json.Unmarshal([]byte(e.Value), &items); err != nil {
+		return nil, fmt.Errorf("bad batch: %w", err)
+	}
+	events := make([]Event, len(items))
+	for i, item := range items {
+		events[i] = Event{
+			Sequence:  e.Sequence,
+			EventType: item.Type,
+			Namespace: item.Namespace,
+			Key:       item.Key,
+			Value:     item.Value,
+			CreatedAt: e.CreatedAt,
+			UpdatedAt: e.UpdatedAt,
+		}
+	}
+	return events, nil
+}
+
+// historyKeys returns the keys e is found under in the loggers' history
+// indexes: its own, or those of its events if it is a batch. Events not
+// about a key, such as grants, are under none.
+func historyKeys(e Event) []string {
+	events := batched(e)
+	keys := make([]string, 0, len(events))
+	seen := make(map[string]bool, len(events))
+	for _, e := range events {
+		if !namesKey(e.EventType) {
+			continue
+		}
+		if k := historyKey(e.Namespace, e.Key); !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
@@ -0,0 +1,385 @@
+package transaction
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Compactor is implemented by loggers that can drop events no longer needed
+// to rebuild the current state.
+type Compactor interface {
+	Compact(ctx context.Context) (CompactStats, error)
+}
+
+// Rotator is implemented by loggers that can archive their log and carry on
+// in a fresh one.
+type Rotator interface {
+	Rotate(ctx context.Context) (archive string, stats CompactStats, err error)
+}
+
+// CompactStats describes the outcome of a compaction.
+type CompactStats struct {
+	Before int `json:"events_before"`
+	After  int `json:"events_after"`
+}
+
+// isKeyEvent reports whether events of type t only matter until the next
+// put or delete of the same key.
+func isKeyEvent(t EventType) bool {
+	return t == EventPut || t == EventDelete
+}
+
+// keyUpdates are the event types that describe or change the value left by
+// the put or delete before them, and so only matter until the next put or
+// delete of the same key.
+var keyUpdates = []EventType{
+	EventExpire, EventFlags, EventLeaseAttach,
+	EventListPush, EventListPop, EventSetAdd, EventSetRemove, EventHashSet, EventHashDelete,
+}
+
+// isLeaseEvent reports whether events of type t only matter until the next
+// keep-alive or revocation of the same lease.
+func isLeaseEvent(t EventType) bool {
+	return t == EventLease || t == EventLeaseRevoke
+}
+
+func isKeyUpdate(t EventType) bool {
+	for _, u := range keyUpdates {
+		if t == u {
+			return true
+		}
+	}
+	return false
+}
+
+// compaction decides which events a compacted log keeps. Every event is
+// first passed to observe, in order, and then to keeps.
+type compaction struct {
+	// The last put or delete of every key supersedes the events before it,
+	// as does the last keep-alive or revocation of every lease.
+	last, lastLease map[string]uint64
+}
+
+func newCompaction() *compaction {
+	return &compaction{last: make(map[string]uint64), lastLease: make(map[string]uint64)}
+}
+
+// observe notes what e supersedes. The events of a batch are taken one by
+// one, at the batch's sequence number.
+func (c *compaction) observe(e Event) {
+	for _, e := range batched(e) {
+		if isKeyEvent(e.EventType) {
+			c.last[historyKey(e.Namespace, e.Key)] = e.Sequence
+		}
+		if isLeaseEvent(e.EventType) {
+			c.lastLease[e.Key] = e.Sequence
+		}
+	}
+}
+
+// keeps reports whether e is still needed, that is, not superseded. A
+// batch is kept whole while any of its events is needed.
+func (c *compaction) keeps(e Event) bool {
+	for _, e := range batched(e) {
+		if c.needed(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *compaction) needed(e Event) bool {
+	if isKeyEvent(e.EventType) || isKeyUpdate(e.EventType) {
+		if e.Sequence < c.last[historyKey(e.Namespace, e.Key)] {
+			return false
+		}
+	}
+	return !isLeaseEvent(e.EventType) || e.Sequence >= c.lastLease[e.Key]
+}
+
+// batched returns the events of e, or e alone if they cannot be decoded,
+// so that a bad batch is kept for replay to report.
+func batched(e Event) []Event {
+	events, err := e.Events()
+	if err != nil {
+		return []Event{e}
+	}
+	return events
+}
+
+// Compact rewrites the log keeping only the events needed to rebuild the
+// current state: the latest put or delete of every key and the updates made
+// to it since, such as list pushes or an expiry, the latest keep-alive or
+// revocation of every lease, and every access grant and quota. With an
+// encryptor set, every event kept is re-encrypted with the current key, so
+// that keys rotated out can then be dropped. Sequence numbers are
+// preserved, and every event dropped is superseded by a later one that is
+// kept, so a follower resuming from before the compaction skips the gaps
+// and still ends up with the same state. The history of overwritten and
+// deleted keys is lost.
+func (l *FileTransactionLogger) Compact(ctx context.Context) (CompactStats, error) {
+	return l.rewrite(ctx, "")
+}
+
+// Rotate keeps the current log as an archive named after it with a
+// timestamp suffix, then continues in a compacted copy, so that the archive
+// holds the full history up to now.
+func (l *FileTransactionLogger) Rotate(ctx context.Context) (string, CompactStats, error) {
+	archive := l.path + "." + strconv.FormatInt(time.Now().UnixNano(), 10)
+	stats, err := l.rewrite(ctx, archive)
+	if err != nil {
+		return "", stats, err
+	}
+	return archive, stats, nil
+}
+
+// rewrite replaces the log with its compacted form, first hard linking the
+// old file to archive if one is named. Writes wait until it is done.
+func (l *FileTransactionLogger) rewrite(ctx context.Context, archive string) (CompactStats, error) {
+	var stats CompactStats
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	if l.failed != nil {
+		return stats, l.failed
+	}
+	name := l.path
+
+	c := newCompaction()
+	err := l.scan(func(e Event, _ string) error {
+		stats.Before++
+		c.observe(e)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	tmp, err := os.OpenFile(name+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, logFileMode)
+	if err != nil {
+		return stats, fmt.Errorf("cannot create compacted log: %w", err)
+	}
+	defer os.Remove(tmp.Name()) // Fails harmlessly once renamed into place
+	w := bufio.NewWriter(tmp)
+	index := make(map[string][]position)
+	var offset int64
+	err = l.scan(func(e Event, line string) error {
+		if !c.keeps(e) {
+			return nil
+		}
+		if encryptor != nil {
+			line = strings.TrimSuffix(formatEvent(e), "\n") // Re-encrypted with the current key
+		}
+		for _, k := range historyKeys(e) {
+			index[k] = append(index[k], position{sequence: e.Sequence, offset: offset, length: len(line) + 1})
+		}
+		offset += int64(len(line) + 1)
+		stats.After++
+		_, err := w.WriteString(line + "\n")
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		return stats, fmt.Errorf("cannot write compacted log: %w", err)
+	}
+	tmp.Close()
+
+	if archive != "" {
+		if err := os.Link(name, archive); err != nil {
+			return stats, fmt.Errorf("cannot archive transaction log: %w", err)
+		}
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return stats, fmt.Errorf("cannot replace transaction log: %w", err)
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_APPEND, logFileMode)
+	if err != nil {
+		// Events written now would go to the old file, which is gone
+		return stats, l.failWrites(fmt.Errorf("cannot reopen transaction log: %w", err))
+	}
+
+	l.mu.Lock()
+	old := l.file
+	l.file, l.index = file, index
+	atomic.StoreInt64(&l.offset, offset)
+	l.mu.Unlock()
+	old.Close()
+	if err := syncDir(filepath.Dir(name)); err != nil {
+		return stats, fmt.Errorf("cannot sync transaction log directory: %w", err)
+	}
+	log.Info("transaction log compacted",
+		zap.String("archive", archive), zap.Int("before", stats.Before), zap.Int("after", stats.After))
+	return stats, nil
+}
+
+// failWrites stops the logger writing events for err, reporting it as a
+// failed write is. It must be called with writeMu held.
+func (l *FileTransactionLogger) failWrites(err error) error {
+	l.failed = err
+	select {
+	case l.fail <- err:
+	default: // Not running, or a failure already reported
+	}
+	return err
+}
+
+// syncDir makes renames inside dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// scan calls f with every event in the log and the line it was read from,
+// up to the last fully written event.
+func (l *FileTransactionLogger) scan(f func(e Event, line string) error) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("cannot open transaction log file: %w", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(io.LimitReader(file, atomic.LoadInt64(&l.offset)))
+	for scanner.Scan() {
+		e, err := parseEvent(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("input parse error: %w", err)
+		}
+		if err := f(e, scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+	return nil
+}
+
+// Compact drops the events superseded as the file log's Compact does. The
+// sequence numbers of the events kept are preserved.
+func (l *MemoryTransactionLogger) Compact(ctx context.Context) (CompactStats, error) {
+	var stats CompactStats
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	c := newCompaction()
+	for _, e := range l.log {
+		c.observe(e)
+	}
+	kept := make([]Event, 0, len(l.log))
+	index := make(map[string][]int)
+	for _, e := range l.log {
+		if c.keeps(e) {
+			for _, k := range historyKeys(e) {
+				index[k] = append(index[k], len(kept))
+			}
+			kept = append(kept, e)
+		}
+	}
+	stats.Before, stats.After = len(l.log), len(kept)
+	l.log, l.index = kept, index
+	log.Info("transaction log compacted", zap.Int("before", stats.Before), zap.Int("after", stats.After))
+	return stats, nil
+}
+
+// Compact deletes the rows superseded by a later put or delete of the same
+// key, including updates such as list pushes, and likewise for the
+// keep-alives and revocations of leases. As with the file log, the last
+// delete of a key is kept for followers still to see it, history of
+// overwritten and deleted keys is lost, and with an encryptor set every row
+// is first re-encrypted with its current key. Batches are always kept, and
+// so are the rows of the keys they last wrote, as a batch's row names no
+// key for the query to group it by.
+func (l *PostgresTransactionLogger) Compact(ctx context.Context) (CompactStats, error) {
+	var stats CompactStats
+	if err := l.db.SQL.QueryRow(ctx, "SELECT COUNT(*) FROM transactions").Scan(&stats.Before); err != nil {
+		return stats, fmt.Errorf("sql query error: %w", err)
+	}
+	if err := l.reencrypt(ctx); err != nil {
+		return stats, err
+	}
+	query := `DELETE FROM transactions t
+          WHERE (t.event_type IN ($1, $2) OR t.event_type = ANY($3))
+            AND t.id < (SELECT MAX(u.id) FROM transactions u
+              WHERE u.namespace = t.namespace AND u.key = t.key AND u.event_type IN ($1, $2))`
+	updates := make([]int, len(keyUpdates))
+	for i, t := range keyUpdates {
+		updates[i] = int(t)
+	}
+	tag, err := l.db.SQL.Exec(ctx, query, EventDelete, EventPut, updates)
+	if err != nil {
+		return stats, fmt.Errorf("sql delete error: %w", err)
+	}
+	leases := `DELETE FROM transactions t
+          WHERE t.event_type IN ($1, $2)
+            AND t.id < (SELECT MAX(u.id) FROM transactions u
+              WHERE u.key = t.key AND u.event_type IN ($1, $2))`
+	leaseTag, err := l.db.SQL.Exec(ctx, leases, EventLease, EventLeaseRevoke)
+	if err != nil {
+		return stats, fmt.Errorf("sql delete error: %w", err)
+	}
+	stats.After = stats.Before - int(tag.RowsAffected()) - int(leaseTag.RowsAffected())
+	log.Info("transaction log compacted", zap.Int("before", stats.Before), zap.Int("after", stats.After))
+	return stats, nil
+}
+
+// reencrypt rewrites the rows not encrypted as the encryptor would now: those
+// written in plaintext or with a key since rotated out. Each value keeps its
+// sequence number, and so its binding, but gets a fresh data key. Sealed keys must
+// match across rows for compaction to group them, so this comes first.
+func (l *PostgresTransactionLogger) reencrypt(ctx context.Context) error {
+	if encryptor == nil {
+		return nil
+	}
+	rows, err := l.db.SQL.Query(ctx, "SELECT id, namespace, key, value FROM transactions ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("sql query error: %w", err)
+	}
+	var stale []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.Sequence, &e.Namespace, &e.Key, &e.Value); err != nil {
+			rows.Close()
+			return fmt.Errorf("error reading row: %w", err)
+		}
+		if encryptor.stale(e.Key, encryptor.sealKeys) || encryptor.stale(e.Value, true) {
+			stale = append(stale, e)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+	for _, e := range stale {
+		if e, err = encryptor.openEvent(e); err != nil {
+			return fmt.Errorf("event %d: %w", e.Sequence, err)
+		}
+		sealed := encryptor.sealEvent(e)
+		if _, err := l.db.SQL.Exec(ctx, "UPDATE transactions SET key = $1, value = $2 WHERE id = $3", sealed.Key, sealed.Value, e.Sequence); err != nil {
+			return fmt.Errorf("sql update error: %w", err)
+		}
+	}
+	log.Info("transaction log re-encrypted", zap.Int("events", len(stale)))
+	return nil
+}
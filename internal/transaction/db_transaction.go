@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	_ "github.com/lib/pq" // Anonymously import the driver package
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"melon/internal/metrics"
 	"melon/pkg/driver"
 	"time"
 )
@@ -13,6 +15,7 @@ type PostgresTransactionLogger struct {
 	events chan<- Event // Write-only channel for sending events
 	errors <-chan error // Read-only channel for receiving errors
 	db     *driver.DB   // The database access interface
+	feed                // Live subscribers to written events
 }
 
 func (l *PostgresTransactionLogger) WritePut(key, value string) {
@@ -23,25 +26,32 @@ func (l *PostgresTransactionLogger) WriteDelete(key string) {
 	l.events <- Event{EventType: EventDelete, Key: key, CreatedAt: time.Now(), UpdatedAt: time.Now()}
 }
 
+func (l *PostgresTransactionLogger) WriteEvent(e Event) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = e.CreatedAt
+	l.events <- e
+}
+
 func (l *PostgresTransactionLogger) Err() <-chan error {
 	return l.errors
 }
 
+// Ping checks that the database the events are written to is reachable.
+func (l *PostgresTransactionLogger) Ping(ctx context.Context) error {
+	return l.db.Ping(ctx)
+}
+
 func (l *PostgresTransactionLogger) createTable(tableName string) error {
 	_, err := l.db.SQL.Exec(context.TODO(), "CREATE TABLE "+tableName+"(id SERIAL PRIMARY KEY, name TEXT NOT NULL)")
-	if err != nil {
-		log.Fatal(err)
-	}
 	return err
 }
 
 func (l *PostgresTransactionLogger) verifyTableExists(tableName string) (bool, error) {
 	var tableExists bool
 	err := l.db.SQL.QueryRow(context.TODO(), "SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = $1)", tableName).Scan(&tableExists)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return tableExists, nil
+	return tableExists, err
 }
 
 type PostgresDBParams struct {
@@ -80,34 +90,65 @@ func (l *PostgresTransactionLogger) Run() {
 	l.events = events
 	errors := make(chan error, 1) // Make an errors channel
 	l.errors = errors
+	metrics.LogQueueDepth.Set("postgres", func() float64 { return float64(len(events)) })
+	writeDuration := metrics.LogWriteDuration.WithLabelValues("postgres")
 	go func() {
 		query := `INSERT INTO transactions 
-			(event_type, key, value, created_at, updated_at)
-            VALUES ($1, $2, $3, $4, $5)` // The INSERT query
+			(event_type, namespace, key, value, created_at, updated_at)
+            VALUES ($1, $2, $3, $4, $5, $6) RETURNING id` // The INSERT query
+		// A follower keeps its leader's sequence numbers, see nextSequence,
+		// and moves the id sequence past them for any later insert.
+		copied := `WITH inserted AS (INSERT INTO transactions
+			(id, event_type, namespace, key, value, created_at, updated_at)
+            VALUES ($7, $1, $2, $3, $4, $5, $6) RETURNING id)
+          SELECT setval(pg_get_serial_sequence('transactions', 'id'), id) FROM inserted`
 		for e := range events { // Retrieve the next Event
-			_, err := l.db.SQL.Exec( // Execute the INSERT query
-				context.TODO(),
-				query,
-				e.EventType, e.Key, e.Value, e.CreatedAt, e.UpdatedAt)
+			span := startWrite(e, "transaction.insert", "postgres")
+			start := time.Now()
+			var err error
+			if encryptor != nil && e.Sequence == 0 { // The value is sealed bound to its sequence number
+				err = l.db.SQL.QueryRow(context.TODO(), "SELECT nextval(pg_get_serial_sequence('transactions', 'id'))").Scan(&e.Sequence)
+			}
+			sealed := encryptor.sealEvent(e)
+			args := []interface{}{e.EventType, e.Namespace, sealed.Key, sealed.Value, e.CreatedAt, e.UpdatedAt}
+			q := query
+			if e.Sequence != 0 {
+				q, args = copied, append(args, e.Sequence)
+			}
+			if err == nil {
+				err = l.db.SQL.QueryRow(context.TODO(), q, args...).Scan(&e.Sequence) // Execute the INSERT query
+			}
+			writeDuration.Observe(time.Since(start).Seconds())
+			span.SetAttributes(attribute.Int64("melon.sequence", int64(e.Sequence)))
 			if err != nil {
-				fmt.Println(err, "92")
+				span.RecordError(err)
+				span.End()
+				log.Error("cannot insert event", append(eventFields(e), zap.Error(err))...)
 				errors <- err
+				continue
 			}
+			span.End()
+			log.Debug("event written", eventFields(e)...)
+			l.publish(e)
 		}
 	}()
 }
 
 func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.ReadEventsFrom(0)
+}
+
+func (l *PostgresTransactionLogger) ReadEventsFrom(seq uint64) (<-chan Event, <-chan error) {
 	outEvent := make(chan Event)    // An unbuffered events channel
 	outError := make(chan error, 1) // A buffered errors channel
 	go func() {
 		defer close(outEvent) // Close the channels when the
 		defer close(outError) // goroutine ends
-		query := `SELECT id, event_type, key, value, created_at, updated_at FROM transactions
-          ORDER BY id`
-		rows, err := l.db.SQL.Query(context.TODO(), query) // Run query; get result set
+		query := `SELECT id, event_type, namespace, key, value, created_at, updated_at FROM transactions
+          WHERE id >= $1 ORDER BY id`
+		rows, err := l.db.SQL.Query(context.TODO(), query, seq) // Run query; get result set
 		if err != nil {
-			fmt.Println(err, "109")
+			log.Error("cannot query events", zap.Uint64("from", seq), zap.Error(err))
 			outError <- fmt.Errorf("sql query error: %w", err)
 			return
 		}
@@ -115,12 +156,16 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 		e := Event{}       // Create an empty Event
 		for rows.Next() {  // Iterate over the rows
 			err = rows.Scan(
-				&e.Sequence, &e.EventType,
+				&e.Sequence, &e.EventType, &e.Namespace,
 				&e.Key, &e.Value, &e.CreatedAt, &e.UpdatedAt) // Read the values from the row into the Event.
 			if err != nil {
 				outError <- fmt.Errorf("error reading row: %w", err)
 				return
 			}
+			if e, err = encryptor.openEvent(e); err != nil {
+				outError <- fmt.Errorf("event %d: %w", e.Sequence, err)
+				return
+			}
 			outEvent <- e // Send e to the channel
 		}
 
@@ -131,3 +176,55 @@ func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 	}()
 	return outEvent, outError
 }
+
+func (l *PostgresTransactionLogger) LastSequence() uint64 {
+	var seq uint64
+	err := l.db.SQL.QueryRow(context.TODO(), "SELECT COALESCE(MAX(id), 0) FROM transactions").Scan(&seq)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+// History relies on the transactions_namespace_key_idx index, so only the
+// rows for key are visited, along with every batch, as a batch's row names
+// no key. When keys are encrypted, rows written with a key rotated out are
+// only found again once a compaction re-encrypts them.
+func (l *PostgresTransactionLogger) History(namespace, key string) ([]Event, error) {
+	query := `SELECT id, event_type, namespace, key, value, created_at, updated_at FROM transactions
+          WHERE (namespace = $1 AND key = $2) OR event_type = $3 ORDER BY id`
+	rows, err := l.db.SQL.Query(context.TODO(), query, namespace, encryptor.sealKey(namespace, key), EventBatch)
+	if err != nil {
+		return nil, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+	history := make([]Event, 0)
+	k := historyKey(namespace, key)
+	for rows.Next() {
+		e := Event{}
+		err = rows.Scan(&e.Sequence, &e.EventType, &e.Namespace, &e.Key, &e.Value, &e.CreatedAt, &e.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error reading row: %w", err)
+		}
+		if e, err = encryptor.openEvent(e); err != nil {
+			return nil, fmt.Errorf("event %d: %w", e.Sequence, err)
+		}
+		if !containsKey(historyKeys(e), k) {
+			continue // A batch not touching key, or a grant to a principal of its name
+		}
+		history = append(history, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("transaction log read failure: %w", err)
+	}
+	return history, nil
+}
+
+func containsKey(keys []string, k string) bool {
+	for _, key := range keys {
+		if key == k {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,271 @@
+package transaction
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sealedPrefix marks a key or value stored encrypted, followed by the ID of
+// the key that sealed it, a colon, and the base64 nonce and ciphertext. A
+// value's ciphertext is its data key, followed by another colon and the
+// value sealed with that data key.
+const sealedPrefix = "\x01enc:"
+
+// dataKeySize is the size of the AES-256 key each value is sealed with.
+const dataKeySize = 32
+
+var ErrorNoEncryptionKey = errors.New("transaction log is encrypted with a key that was not given")
+
+// Encryptor encrypts the values of events, and optionally their keys, with
+// AES-GCM as they are written to a log, and decrypts them as they are read.
+// Each value is sealed with a random data key, itself wrapped with the
+// current key, and both are bound to the event's sequence number,
+// namespace and key. Events written before encryption was turned on are
+// read as they are.
+type Encryptor struct {
+	aeads    map[string]cipher.AEAD // By key ID
+	macs     map[string][]byte      // By key ID, for the nonces of sealed keys
+	current  string                 // ID of the key new events are sealed with
+	sealKeys bool
+}
+
+// ParseEncryptionKeys reads "key-id key" lines, the key being 16, 24 or 32
+// bytes in base64, for AES-128, 192 or 256. Commas may stand in for line
+// breaks, so that the keys fit in an environment variable. The first key
+// encrypts new events; the rest are kept to read events written before a
+// rotation, until a compaction has re-encrypted them.
+func ParseEncryptionKeys(data string) (ids []string, keys map[string][]byte, err error) {
+	keys = make(map[string][]byte)
+	scanner := bufio.NewScanner(strings.NewReader(strings.ReplaceAll(data, ",", "\n")))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.Contains(fields[0], ":") {
+			return nil, nil, fmt.Errorf("expected \"key-id key\", got %d fields", len(fields))
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("encryption key %q is not base64: %w", fields[0], err)
+		}
+		if _, dup := keys[fields[0]]; dup {
+			return nil, nil, fmt.Errorf("encryption key %q is given twice", fields[0])
+		}
+		ids, keys[fields[0]] = append(ids, fields[0]), key
+	}
+	if len(ids) == 0 {
+		return nil, nil, errors.New("no encryption keys given")
+	}
+	return ids, keys, nil
+}
+
+// NewEncryptor encrypts with the key named current and decrypts with any of
+// keys. If sealKeys is set, event keys are encrypted too, deterministically,
+// so that a key always encrypts the same way and can still be looked up.
+func NewEncryptor(current string, keys map[string][]byte, sealKeys bool) (*Encryptor, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("no encryption key %q", current)
+	}
+	e := &Encryptor{aeads: make(map[string]cipher.AEAD), macs: make(map[string][]byte), current: current, sealKeys: sealKeys}
+	for id, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		if e.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("encryption key %q: %w", id, err)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("melon key nonce"))
+		e.macs[id] = mac.Sum(nil)
+	}
+	return e, nil
+}
+
+// encryptor, when set, encrypts the events of every file and Postgres log;
+// see SetEncryptor.
+var encryptor *Encryptor
+
+// SetEncryptor makes the loggers encrypt events with e from now on. It must
+// be called before a logger is created.
+func SetEncryptor(e *Encryptor) {
+	encryptor = e
+}
+
+// seal encrypts s with the current key, bound to aad. Deterministic
+// sealing derives the nonce from aad and s, so that equal inputs give equal
+// output. aad is length prefixed there, or moving bytes between it and s
+// would repeat a nonce for a different plaintext.
+func (c *Encryptor) seal(s string, aad []byte, deterministic bool) string {
+	aead := c.aeads[c.current]
+	nonce := make([]byte, aead.NonceSize())
+	if deterministic {
+		mac := hmac.New(sha256.New, c.macs[c.current])
+		mac.Write(binary.AppendUvarint(nil, uint64(len(aad))))
+		mac.Write(aad)
+		mac.Write([]byte(s))
+		copy(nonce, mac.Sum(nil))
+	} else {
+		randomize(nonce)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(s), aad)
+	return sealedPrefix + c.current + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// sealEnvelope encrypts s with a data key of its own, bound to aad, and
+// stores that key wrapped by the current key alongside it, so no two values
+// share a data key and rotating keys only rewraps data keys.
+func (c *Encryptor) sealEnvelope(s string, aad []byte) string {
+	dataKey := make([]byte, dataKeySize)
+	randomize(dataKey)
+	aead := newAEAD(dataKey)
+	nonce := make([]byte, aead.NonceSize())
+	randomize(nonce)
+	sealed := aead.Seal(nonce, nonce, []byte(s), aad)
+	return c.seal(string(dataKey), aad, false) + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// open decrypts s if it was sealed by seal with aad, and returns it as it
+// is otherwise.
+func (c *Encryptor) open(s string, aad []byte) (string, error) {
+	if !strings.HasPrefix(s, sealedPrefix) {
+		return s, nil
+	}
+	if c == nil {
+		return "", ErrorNoEncryptionKey
+	}
+	id, encoded, _ := strings.Cut(strings.TrimPrefix(s, sealedPrefix), ":")
+	aead, ok := c.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrorNoEncryptionKey, id)
+	}
+	plain, err := openSealed(aead, encoded, aad)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt field sealed with key %q: %w", id, err)
+	}
+	return string(plain), nil
+}
+
+// openEnvelope decrypts s if it was sealed by sealEnvelope with aad, and
+// returns it as it is otherwise.
+func (c *Encryptor) openEnvelope(s string, aad []byte) (string, error) {
+	if !strings.HasPrefix(s, sealedPrefix) {
+		return s, nil
+	}
+	i := strings.LastIndex(s, ":")
+	wrapped, encoded := s[:i], s[i+1:]
+	if strings.Count(wrapped, ":") < 2 {
+		return "", errors.New("corrupt encrypted field")
+	}
+	dataKey, err := c.open(wrapped, aad)
+	if err != nil {
+		return "", err
+	}
+	if len(dataKey) != dataKeySize {
+		return "", errors.New("corrupt data key")
+	}
+	plain, err := openSealed(newAEAD([]byte(dataKey)), encoded, aad)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt field: %w", err)
+	}
+	return string(plain), nil
+}
+
+func openSealed(aead cipher.AEAD, encoded string, aad []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return nil, errors.New("corrupt encrypted field")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], aad)
+}
+
+// newAEAD returns AES-GCM with a key known to be of a valid size.
+func newAEAD(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+func randomize(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("cannot read random bytes: %v", err)) // The system's randomness is gone
+	}
+}
+
+// keyBinding is the additional data a sealed key is bound to, so that it
+// cannot be moved to another namespace.
+func keyBinding(namespace string) []byte {
+	return append([]byte("melon key\x00"), namespace...)
+}
+
+// valueBinding is the additional data a sealed value is bound to, so that
+// it cannot be moved to another event, namespace or key.
+func valueBinding(e Event, key string) []byte {
+	b := []byte("melon value\x00")
+	b = binary.BigEndian.AppendUint64(b, e.Sequence)
+	b = binary.AppendUvarint(b, uint64(len(e.Namespace)))
+	b = append(b, e.Namespace...)
+	return append(b, key...)
+}
+
+// sealEvent encrypts the value of e in an envelope, and its key if keys
+// are sealed. The sequence number of e must already be assigned, as the
+// value is bound to it.
+func (c *Encryptor) sealEvent(e Event) Event {
+	if c == nil {
+		return e
+	}
+	if e.Value != "" {
+		e.Value = c.sealEnvelope(e.Value, valueBinding(e, e.Key))
+	}
+	e.Key = c.sealKey(e.Namespace, e.Key)
+	return e
+}
+
+// sealKey encrypts key in namespace as it is stored, for looking it up.
+func (c *Encryptor) sealKey(namespace, key string) string {
+	if c == nil || !c.sealKeys || key == "" {
+		return key
+	}
+	return c.seal(key, keyBinding(namespace), true)
+}
+
+// openEvent decrypts whichever of the key and value of e were sealed.
+func (c *Encryptor) openEvent(e Event) (Event, error) {
+	var err error
+	if e.Key, err = c.open(e.Key, keyBinding(e.Namespace)); err != nil {
+		return e, err
+	}
+	e.Value, err = c.openEnvelope(e.Value, valueBinding(e, e.Key))
+	return e, err
+}
+
+// stale reports whether s is not stored as the encryptor would store it
+// now, given whether it should be sealed: plaintext that should be sealed,
+// sealed when it should not be, or sealed with an older key.
+func (c *Encryptor) stale(s string, sealed bool) bool {
+	if c == nil || s == "" {
+		return false
+	}
+	if !strings.HasPrefix(s, sealedPrefix) {
+		return sealed
+	}
+	return !sealed || !strings.HasPrefix(s, sealedPrefix+c.current+":")
+}
@@ -0,0 +1,77 @@
+package transaction
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testEncryptor(t *testing.T, sealKeys bool) *Encryptor {
+	t.Helper()
+	ids, keys, err := ParseEncryptionKeys("k1 " + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewEncryptor(ids[0], keys, sealKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetEncryptor(e)
+	t.Cleanup(func() { SetEncryptor(nil) })
+	return e
+}
+
+func TestEncryptedEventRoundTrip(t *testing.T) {
+	testEncryptor(t, true)
+	e := Event{Sequence: 7, EventType: EventPut, Namespace: "ns", Key: "k", Value: "secret"}
+	line := formatEvent(e)
+	if strings.Contains(line, "secret") || strings.Contains(line, `"k"`) {
+		t.Fatalf("line holds plaintext: %q", line)
+	}
+	got, err := parseEvent(strings.TrimSuffix(line, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Key != e.Key || got.Value != e.Value || got.Namespace != e.Namespace {
+		t.Errorf("got %+v, want %+v", got, e)
+	}
+	if again := formatEvent(e); again == line {
+		t.Error("sealing twice gave the same line, so the data key was reused")
+	}
+}
+
+func TestEncryptedValueIsBoundToItsEvent(t *testing.T) {
+	c := testEncryptor(t, false)
+	e := Event{Sequence: 7, EventType: EventPut, Namespace: "ns", Key: "k", Value: "secret"}
+	sealed := c.sealEvent(e)
+	for name, moved := range map[string]Event{
+		"sequence":  {Sequence: 8, Namespace: "ns", Key: "k", Value: sealed.Value},
+		"namespace": {Sequence: 7, Namespace: "other", Key: "k", Value: sealed.Value},
+		"key":       {Sequence: 7, Namespace: "ns", Key: "other", Value: sealed.Value},
+	} {
+		if _, err := c.openEvent(moved); err == nil {
+			t.Errorf("a value moved to another %s still decrypted", name)
+		}
+	}
+	if _, err := c.openEvent(sealed); err != nil {
+		t.Errorf("cannot open the value where it was sealed: %v", err)
+	}
+}
+
+func TestSealedKeyNoncesDependOnWhereNamespaceEnds(t *testing.T) {
+	c := testEncryptor(t, true)
+	nonce := func(namespace, key string) string {
+		sealed := c.sealKey(namespace, key)
+		b, err := base64.StdEncoding.DecodeString(sealed[strings.LastIndex(sealed, ":")+1:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:12])
+	}
+	if nonce("a", "bc") == nonce("ab", "c") {
+		t.Error("keys bc in namespace a and c in namespace ab were sealed with the same nonce")
+	}
+	if nonce("a", "bc") != nonce("a", "bc") {
+		t.Error("sealing a key twice gave different nonces, so it cannot be looked up")
+	}
+}
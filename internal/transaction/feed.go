@@ -0,0 +1,50 @@
+package transaction
+
+import "sync"
+
+const subscriberBuffer = 256 // Events a subscriber may fall behind before it is dropped
+
+// feed fans every event written to a log out to live subscribers. The zero
+// value is ready to use.
+type feed struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel receiving every event written from now on and
+// a function that ends the subscription. The channel is closed when the
+// subscription ends, including when the subscriber falls too far behind.
+func (f *feed) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, subscriberBuffer)
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[chan Event]struct{})
+	}
+	f.subs[ch] = struct{}{}
+	f.mu.Unlock()
+	return ch, func() { f.drop(ch) }
+}
+
+func (f *feed) drop(ch chan Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.subs[ch]; ok {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks the log writer; a subscriber whose buffer is full is
+// dropped and has to resume from its last sequence.
+func (f *feed) publish(e Event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
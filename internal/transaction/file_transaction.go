@@ -3,15 +3,31 @@ package transaction
 import (
 	"bufio"
 	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"melon/internal/metrics"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// logFileMode keeps the log, which holds every key and value, private to
+// the user melon runs as.
+const logFileMode = 0600
+
 func NewFileTransactionLogger(filename string) (TransactionLogger, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, logFileMode)
 	if err != nil {
 		return nil, fmt.Errorf("cannot open transaction log file: %w", err)
 	}
-	return &FileTransactionLogger{file: file}, nil
+	if err := file.Chmod(logFileMode); err != nil { // Logs created by older versions were world readable
+		file.Close()
+		return nil, fmt.Errorf("cannot restrict transaction log file: %w", err)
+	}
+	return &FileTransactionLogger{file: file, path: filename, index: make(map[string][]position)}, nil
 }
 
 type FileTransactionLogger struct {
@@ -19,14 +35,39 @@ type FileTransactionLogger struct {
 	errors       <-chan error // Read-only channel for receiving errors
 	lastSequence uint64       // The last used event sequence number
 	file         *os.File     // The location of the transaction log
+	path         string       // The name of file, which a compaction replaces but never moves
+	offset       int64        // The byte offset the next event will be written at
+	feed                      // Live subscribers to written events
+
+	writeMu sync.Mutex   // Held while an event is written, and throughout a compaction
+	failed  error        // Why no more events can be written, under writeMu
+	fail    chan<- error // Where a failure outside the writer is reported
+
+	mu    sync.RWMutex          // Guards file and index
+	index map[string][]position // Log positions of every event, by key
+}
+
+// position locates a single event line inside the log file.
+type position struct {
+	sequence uint64
+	offset   int64
+	length   int
 }
 
 func (l *FileTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+	l.events <- Event{EventType: EventPut, Key: key, Value: value, CreatedAt: time.Now()}
 }
 
 func (l *FileTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{EventType: EventDelete, Key: key, Value: "nil"}
+	l.events <- Event{EventType: EventDelete, Key: key, Value: "nil", CreatedAt: time.Now()}
+}
+
+func (l *FileTransactionLogger) WriteEvent(e Event) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = e.CreatedAt
+	l.events <- e
 }
 
 func (l *FileTransactionLogger) Err() <-chan error {
@@ -37,19 +78,40 @@ func (l *FileTransactionLogger) Run() {
 	events := make(chan Event, 16) // Make an events channel
 	l.events = events              // pushing anything to l.event will mean pushing to events
 	errors := make(chan error, 1)  // Make an errors channel, the buffer value of 1 allows us to send an error in a nonblocking manner.
-	l.errors = errors
+	l.errors, l.fail = errors, errors
+	if fi, err := l.file.Stat(); err == nil {
+		atomic.StoreInt64(&l.offset, fi.Size()) // Appends always land at the end of the file
+	}
+	metrics.LogQueueDepth.Set("file", func() float64 { return float64(len(events)) })
+	writeDuration := metrics.LogWriteDuration.WithLabelValues("file")
 	go func() {
 		for e := range events { // Retrieve the next Event
-
-			l.lastSequence++       // Increment sequence number
-			_, err := fmt.Fprintf( // Write the event to the log
-				l.file,
-				"%d\t%d\t%s\t%s\n",
-				l.lastSequence, e.EventType, e.Key, e.Value)
+			l.writeMu.Lock()
+			if l.failed != nil {
+				l.writeMu.Unlock()
+				log.Error("cannot write event", append(eventFields(e), zap.Error(l.failed))...)
+				return // Already reported
+			}
+			e.Sequence = nextSequence(&l.lastSequence, e.Sequence)
+			line := formatEvent(e)
+			span := startWrite(e, "transaction.write", "file")
+			start := time.Now()
+			n, err := l.file.WriteString(line) // Write the event to the log
+			writeDuration.Observe(time.Since(start).Seconds())
 			if err != nil {
+				l.writeMu.Unlock()
+				span.RecordError(err)
+				span.End()
+				log.Error("cannot write event", append(eventFields(e), zap.Error(err))...)
 				errors <- err
 				return
 			}
+			log.Debug("event written", eventFields(e)...)
+			l.addToIndex(e, atomic.LoadInt64(&l.offset), n)
+			atomic.AddInt64(&l.offset, int64(n))
+			l.writeMu.Unlock()
+			span.End()
+			l.publish(e)
 		}
 	}()
 }
@@ -59,26 +121,27 @@ func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 	outEvent := make(chan Event)        // An unbuffered Event channel
 	outError := make(chan error, 1)     // A buffered error channel
 	go func() {
-		var e Event
 		defer close(outEvent) // Close the channels when the
 		defer close(outError) // goroutine ends
 		for scanner.Scan() {
 			line := scanner.Text()
 
-			if _, err := fmt.Sscanf(line, "%d\t%d\t%s\t%s",
-				&e.Sequence, &e.EventType, &e.Key, &e.Value); err != nil {
+			e, err := parseEvent(line)
+			if err != nil {
+				log.Error("cannot parse transaction log line", zap.String("line", line), zap.Error(err))
 				outError <- fmt.Errorf("input parse error: %w", err)
-				fmt.Println(line)
 				return
 			}
 
 			// Sanity check! Are the sequence numbers in increasing order?
-			if l.lastSequence >= e.Sequence {
+			if atomic.LoadUint64(&l.lastSequence) >= e.Sequence {
 				outError <- fmt.Errorf("transaction numbers out of sequence")
 				return
 			}
-			l.lastSequence = e.Sequence // Update last used sequence #
-			outEvent <- e               // Send the event along
+			atomic.StoreUint64(&l.lastSequence, e.Sequence) // Update last used sequence #
+			l.addToIndex(e, atomic.LoadInt64(&l.offset), len(line)+1)
+			atomic.AddInt64(&l.offset, int64(len(line)+1))
+			outEvent <- e // Send the event along
 		}
 		if err := scanner.Err(); err != nil {
 			outError <- fmt.Errorf("transaction log read failure: %w", err)
@@ -87,3 +150,127 @@ func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
 	}()
 	return outEvent, outError
 }
+
+// ReadEventsFrom streams the logged events with a sequence number of at least
+// seq. It reads through its own file handle, and only up to the last fully
+// written event, so it can run alongside the writer.
+func (l *FileTransactionLogger) ReadEventsFrom(seq uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+		file, err := os.Open(l.path)
+		if err != nil {
+			outError <- fmt.Errorf("cannot open transaction log file: %w", err)
+			return
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(io.LimitReader(file, atomic.LoadInt64(&l.offset)))
+		for scanner.Scan() {
+			e, err := parseEvent(scanner.Text())
+			if err != nil {
+				outError <- fmt.Errorf("input parse error: %w", err)
+				return
+			}
+			if e.Sequence >= seq {
+				outEvent <- e
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			outError <- fmt.Errorf("transaction log read failure: %w", err)
+		}
+	}()
+	return outEvent, outError
+}
+
+// LastSequence returns the sequence number of the most recently written event.
+func (l *FileTransactionLogger) LastSequence() uint64 {
+	return atomic.LoadUint64(&l.lastSequence)
+}
+
+// History returns every logged event for key, oldest first. Each event is
+// read directly from its recorded position, so the log is never scanned.
+func (l *FileTransactionLogger) History(namespace, key string) ([]Event, error) {
+	l.mu.RLock() // Held throughout, as a compaction replaces the file
+	defer l.mu.RUnlock()
+	positions := l.index[historyKey(namespace, key)]
+
+	history := make([]Event, 0, len(positions))
+	for _, p := range positions {
+		buf := make([]byte, p.length)
+		if _, err := l.file.ReadAt(buf, p.offset); err != nil {
+			return nil, fmt.Errorf("cannot read event %d: %w", p.sequence, err)
+		}
+		e, err := parseEvent(strings.TrimSuffix(string(buf), "\n"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse event %d: %w", p.sequence, err)
+		}
+		history = append(history, e)
+	}
+	return history, nil
+}
+
+func (l *FileTransactionLogger) addToIndex(e Event, offset int64, length int) {
+	l.mu.Lock()
+	for _, k := range historyKeys(e) {
+		l.index[k] = append(l.index[k], position{sequence: e.Sequence, offset: offset, length: length})
+	}
+	l.mu.Unlock()
+}
+
+// formatEvent renders e as a single tab separated log line. Keys and values
+// are quoted so that whitespace inside them survives a replay, and
+// encrypted first if an encryptor is set. The namespace comes last, and
+// only for events outside the default namespace.
+func formatEvent(e Event) string {
+	e = encryptor.sealEvent(e)
+	if e.Namespace != "" {
+		return fmt.Sprintf("%d\t%d\t%q\t%q\t%d\t%q\n",
+			e.Sequence, e.EventType, e.Key, e.Value, e.CreatedAt.UnixNano(), e.Namespace)
+	}
+	return fmt.Sprintf("%d\t%d\t%q\t%q\t%d\n",
+		e.Sequence, e.EventType, e.Key, e.Value, e.CreatedAt.UnixNano())
+}
+
+// parseEvent reads a line written by formatEvent, decrypting it if needed.
+// Lines written before timestamps were recorded only have four unquoted
+// fields.
+func parseEvent(line string) (Event, error) {
+	var e Event
+	fields := strings.Split(line, "\t")
+	if len(fields) < 4 || len(fields) > 6 {
+		return e, fmt.Errorf("expected 4 to 6 fields, got %d", len(fields))
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("bad sequence: %w", err)
+	}
+	eventType, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("bad event type: %w", err)
+	}
+	e.Sequence = seq
+	e.EventType = EventType(eventType)
+	e.Key = unquoteField(fields[2])
+	e.Value = unquoteField(fields[3])
+	if len(fields) >= 5 {
+		nanos, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("bad timestamp: %w", err)
+		}
+		e.CreatedAt = time.Unix(0, nanos)
+		e.UpdatedAt = e.CreatedAt
+	}
+	if len(fields) == 6 {
+		e.Namespace = unquoteField(fields[5])
+	}
+	return encryptor.openEvent(e)
+}
+
+func unquoteField(s string) string {
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		return unquoted
+	}
+	return s
+}
@@ -0,0 +1,47 @@
+package transaction
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestFileCompactWhileReading(t *testing.T) {
+	l, err := NewFileTransactionLogger(filepath.Join(t.TempDir(), "transaction.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Run()
+	for i := 0; i < 50; i++ {
+		writeAll(t, l, Event{EventType: EventPut, Key: "a", Value: "v"})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			events, errs := l.ReadEventsFrom(0)
+			for range events {
+			}
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	stats, err := l.(Compactor).Compact(context.Background())
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (CompactStats{Before: 50, After: 1}) {
+		t.Errorf("got %+v, want 50 events before and 1 after", stats)
+	}
+
+	writeAll(t, l, Event{EventType: EventPut, Key: "b", Value: "w"})
+	if got, want := sequences(t, l, 0), []uint64{50, 51}; !reflect.DeepEqual(got, want) {
+		t.Errorf("read %v after compacting, want %v", got, want)
+	}
+}
@@ -0,0 +1,115 @@
+package transaction
+
+import (
+	"melon/internal/metrics"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryTransactionLogger keeps its events in memory only. It is used when
+// durability is provided elsewhere, such as by a replicated consensus log, but
+// the rest of the system still wants history, tailing and sequence numbers.
+// It should be compacted whenever the log providing durability is, or it
+// grows without bound.
+type MemoryTransactionLogger struct {
+	events chan<- Event // Write-only channel for sending events
+	errors <-chan error // Read-only channel for receiving errors
+	feed                // Live subscribers to written events
+
+	mu    sync.RWMutex
+	last  uint64           // The last used event sequence number
+	log   []Event          // Every written event, in sequence order
+	index map[string][]int // Positions in log of every event, by key
+}
+
+func NewMemoryTransactionLogger() TransactionLogger {
+	return &MemoryTransactionLogger{index: make(map[string][]int)}
+}
+
+func (l *MemoryTransactionLogger) WritePut(key, value string) {
+	l.events <- Event{EventType: EventPut, Key: key, Value: value, CreatedAt: time.Now()}
+}
+
+func (l *MemoryTransactionLogger) WriteDelete(key string) {
+	l.events <- Event{EventType: EventDelete, Key: key, CreatedAt: time.Now()}
+}
+
+func (l *MemoryTransactionLogger) WriteEvent(e Event) {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	e.UpdatedAt = e.CreatedAt
+	l.events <- e
+}
+
+func (l *MemoryTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+func (l *MemoryTransactionLogger) Run() {
+	events := make(chan Event, 16)
+	l.events = events
+	errors := make(chan error, 1)
+	l.errors = errors
+	metrics.LogQueueDepth.Set("memory", func() float64 { return float64(len(events)) })
+	writeDuration := metrics.LogWriteDuration.WithLabelValues("memory")
+	go func() {
+		for e := range events {
+			start := time.Now()
+			l.mu.Lock()
+			e.Sequence = nextSequence(&l.last, e.Sequence)
+			e.UpdatedAt = e.CreatedAt
+			span := startWrite(e, "transaction.write", "memory")
+			for _, k := range historyKeys(e) {
+				l.index[k] = append(l.index[k], len(l.log))
+			}
+			l.log = append(l.log, e)
+			l.mu.Unlock()
+			writeDuration.Observe(time.Since(start).Seconds())
+			span.End()
+			log.Debug("event written", eventFields(e)...)
+			l.publish(e)
+		}
+	}()
+}
+
+// ReadEvents has nothing to replay; a memory log always starts empty.
+func (l *MemoryTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
+	return l.ReadEventsFrom(1)
+}
+
+func (l *MemoryTransactionLogger) ReadEventsFrom(seq uint64) (<-chan Event, <-chan error) {
+	l.mu.RLock()
+	i := sort.Search(len(l.log), func(i int) bool { return l.log[i].Sequence >= seq })
+	backlog := append([]Event(nil), l.log[i:]...)
+	l.mu.RUnlock()
+
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+		for _, e := range backlog {
+			outEvent <- e
+		}
+	}()
+	return outEvent, outError
+}
+
+func (l *MemoryTransactionLogger) History(namespace, key string) ([]Event, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	positions := l.index[historyKey(namespace, key)]
+	history := make([]Event, 0, len(positions))
+	for _, i := range positions {
+		history = append(history, l.log[i])
+	}
+	return history, nil
+}
+
+func (l *MemoryTransactionLogger) LastSequence() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.last
+}
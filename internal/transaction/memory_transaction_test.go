@@ -0,0 +1,133 @@
+package transaction
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeAll writes events to l and waits until they are all logged.
+func writeAll(t *testing.T, l TransactionLogger, events ...Event) {
+	t.Helper()
+	written, cancel := l.Subscribe()
+	defer cancel()
+	for _, e := range events {
+		l.WriteEvent(e)
+	}
+	timeout := time.After(time.Second)
+	for range events {
+		select {
+		case <-written:
+		case <-timeout:
+			t.Fatal("timed out waiting for events to be written")
+		}
+	}
+}
+
+func sequences(t *testing.T, l TransactionLogger, from uint64) []uint64 {
+	t.Helper()
+	events, errs := l.ReadEventsFrom(from)
+	var seqs []uint64
+	for e := range events {
+		seqs = append(seqs, e.Sequence)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return seqs
+}
+
+func TestMemoryCompactKeepsLatestEventsAndTombstones(t *testing.T) {
+	l := NewMemoryTransactionLogger()
+	l.Run()
+	writeAll(t, l,
+		Event{EventType: EventPut, Key: "a", Value: "1"},    // 1: superseded by 3
+		Event{EventType: EventExpire, Key: "a", Value: "5"}, // 2: superseded by 3
+		Event{EventType: EventPut, Key: "a", Value: "2"},    // 3
+		Event{EventType: EventPut, Key: "b", Value: "x"},    // 4: superseded by 5
+		Event{EventType: EventDelete, Key: "b"},             // 5: kept for followers
+		Event{EventType: EventLease, Key: "7", Value: "{}"}, // 6: superseded by 7
+		Event{EventType: EventLeaseRevoke, Key: "7"},        // 7
+	)
+
+	stats, err := l.(Compactor).Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (CompactStats{Before: 7, After: 3}) {
+		t.Errorf("got %+v, want 7 events before and 3 after", stats)
+	}
+	if got, want := sequences(t, l, 0), []uint64{3, 5, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	if got, want := sequences(t, l, 4), []uint64{5, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("read from 4 got %v, want %v", got, want)
+	}
+	history, err := l.History("", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].EventType != EventDelete {
+		t.Errorf("history of b is %+v, want only its delete", history)
+	}
+
+	writeAll(t, l, Event{EventType: EventPut, Key: "c", Value: "y"})
+	if seq := l.LastSequence(); seq != 8 {
+		t.Errorf("next event got sequence %d, want 8", seq)
+	}
+}
+
+func TestWriteEventKeepsCopiedSequence(t *testing.T) {
+	l := NewMemoryTransactionLogger()
+	l.Run()
+	writeAll(t, l,
+		Event{Sequence: 3, EventType: EventPut, Key: "a", Value: "1"},
+		Event{Sequence: 9, EventType: EventPut, Key: "b", Value: "2"},
+		Event{EventType: EventPut, Key: "c", Value: "3"},
+	)
+	if got, want := sequences(t, l, 0), []uint64{3, 9, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sequences %v, want %v", got, want)
+	}
+}
+
+func TestCompactKeepsBatchWhileAnyEventIsNeeded(t *testing.T) {
+	l := NewMemoryTransactionLogger()
+	l.Run()
+	writeAll(t, l,
+		BatchEvent([]Event{{EventType: EventPut, Key: "a", Value: "1"}, {EventType: EventPut, Key: "b", Value: "1"}}),   // 1: b still needed
+		BatchEvent([]Event{{EventType: EventPut, Key: "c", Value: "1"}, {EventType: EventFlags, Key: "c", Value: "1"}}), // 2: superseded by 4
+		Event{EventType: EventPut, Key: "a", Value: "2"},                                                                // 3
+		Event{EventType: EventPut, Key: "c", Value: "2"},                                                                // 4
+	)
+	if _, err := l.(Compactor).Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sequences(t, l, 0), []uint64{1, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	for key, want := range map[string]int{"a": 2, "b": 1, "c": 1} {
+		if history, _ := l.History("", key); len(history) != want {
+			t.Errorf("history of %s has %d events, want %d", key, len(history), want)
+		}
+	}
+}
+
+func TestHistoryLeavesOutEventsNotAboutKeys(t *testing.T) {
+	l := NewMemoryTransactionLogger()
+	l.Run()
+	writeAll(t, l,
+		Event{EventType: EventPut, Key: "alice", Value: "1"},
+		Event{EventType: EventGrant, Key: "alice", Value: `{"prefix":"","permissions":"r"}`},
+		Event{EventType: EventIndex, Key: "alice", Value: "{}"},
+		Event{EventType: EventRevoke, Key: "alice", Value: `{"prefix":""}`},
+	)
+
+	history, err := l.History("", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].EventType != EventPut {
+		t.Errorf("got %+v, want only the put", history)
+	}
+}
@@ -1,21 +1,66 @@
 package transaction
 
-import "time"
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+var tracer = otel.Tracer("melon/internal/transaction")
+
+// log receives the loggers' diagnostics; see SetLogger.
+var log = zap.NewNop()
+
+// SetLogger makes the transaction loggers report to l.
+func SetLogger(l *zap.Logger) {
+	log = l.Named("transaction")
+}
 
 type TransactionLogger interface {
 	WriteDelete(key string)
 	WritePut(key, value string)
+	WriteEvent(e Event) // Log any other kind of event; Sequence is assigned by the logger unless set, see nextSequence
 	Err() <-chan error
 	ReadEvents() (<-chan Event, <-chan error)
+	ReadEventsFrom(seq uint64) (<-chan Event, <-chan error) // Logged events from seq onwards
+	History(namespace, key string) ([]Event, error)         // Every logged event for key, oldest first
+	LastSequence() uint64                                   // Sequence of the last written event
+	Subscribe() (<-chan Event, func())                      // Live feed of events as they are written
 	Run()
 }
 
+// Pinger is implemented by loggers that write to a remote store, so that
+// its reachability can be checked.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
 type EventType byte
 
 const (
-	_                     = iota // iota == 0; ignore the zero value
-	EventDelete EventType = iota // iota == 1
-	EventPut                     // iota == 2; implicitly repeat
+	_                          = iota // iota == 0; ignore the zero value
+	EventDelete      EventType = iota // iota == 1
+	EventPut                          // iota == 2; implicitly repeat
+	EventGrant                        // Key is a principal, Value an encoded access grant
+	EventRevoke                       // Key is a principal, Value an encoded key prefix
+	EventQuota                        // Value is the encoded quota of Namespace
+	EventExpire                       // Value is when Key expires in Unix nanoseconds; empty to persist it
+	EventFlags                        // Value is the client flags of Key in decimal, kept for memcached clients
+	EventListPush                     // Value is an encoded push onto the list at Key
+	EventListPop                      // Value is an encoded pop from the list at Key
+	EventSetAdd                       // Value is the encoded members added to the set at Key
+	EventSetRemove                    // Value is the encoded members removed from the set at Key
+	EventHashSet                      // Value is the encoded fields set in the hash at Key
+	EventHashDelete                   // Value is the encoded fields deleted from the hash at Key
+	EventIndex                        // Key is an index name, Value its encoded definition; empty to drop it
+	EventLease                        // Key is a lease ID, Value the encoded lease; logged on grant and every keep-alive
+	EventLeaseRevoke                  // Key is a lease ID
+	EventLeaseAttach                  // Value is the ID of the lease Key is attached to; empty to detach it
+	EventBatch                        // Value is an encoded list of events applied together; see BatchEvent
 )
 
 type Event struct {
@@ -23,6 +68,73 @@ type Event struct {
 	EventType EventType // The action taken
 	Key       string    // The key affected by this transaction
 	Value     string    // The value of a PUT the transaction
+	Namespace string    // The namespace Key belongs to; empty for the default namespace
 	CreatedAt time.Time
 	UpdatedAt time.Time
+
+	span trace.SpanContext // The span that wrote the event, for tracing the logger's write
+}
+
+// WithContext returns e carrying the span of ctx, so that the logger's
+// write of e appears in the same trace.
+func (e Event) WithContext(ctx context.Context) Event {
+	e.span = trace.SpanContextFromContext(ctx)
+	return e
+}
+
+// startWrite starts the span covering a logger's write of e, as a child of
+// the span that wrote it.
+func startWrite(e Event, name, logger string) trace.Span {
+	ctx := trace.ContextWithSpanContext(context.Background(), e.span)
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("melon.logger", logger),
+		attribute.Int64("melon.sequence", int64(e.Sequence)),
+		attribute.String("melon.key", e.Key),
+	))
+	return span
+}
+
+// eventFields describes e for logging.
+func eventFields(e Event) []zap.Field {
+	return []zap.Field{
+		zap.Uint64("sequence", e.Sequence),
+		zap.Uint8("type", uint8(e.EventType)),
+		zap.String("namespace", e.Namespace),
+		zap.String("key", e.Key),
+	}
+}
+
+// nonKeyEvents are the event types whose Key names something other than a
+// key: a principal, an index or a lease. They are left out of the history of
+// any key sharing that name.
+var nonKeyEvents = []EventType{EventGrant, EventRevoke, EventQuota, EventIndex, EventLease, EventLeaseRevoke}
+
+func namesKey(t EventType) bool {
+	for _, p := range nonKeyEvents {
+		if t == p {
+			return false
+		}
+	}
+	return true
+}
+
+// historyKey identifies key within namespace in the loggers' history indexes.
+func historyKey(namespace, key string) string {
+	if namespace == "" {
+		return key
+	}
+	return namespace + "\x00" + key
+}
+
+// nextSequence advances *last and returns the sequence number of the event
+// being written. A follower copying its leader's log sets the leader's
+// sequence on each event, which is kept so that the two logs line up even
+// where the leader's has gaps left by compaction; every other event takes
+// the one after the last.
+func nextSequence(last *uint64, seq uint64) uint64 {
+	if seq > atomic.LoadUint64(last) {
+		atomic.StoreUint64(last, seq)
+		return seq
+	}
+	return atomic.AddUint64(last, 1)
 }
@@ -61,3 +61,8 @@ func NewDatabase(ctx context.Context, dsn string) (*pgxpool.Pool, error) {
 	return conn, nil
 
 }
+
+// Ping checks that the database can still be reached.
+func (d *DB) Ping(ctx context.Context) error {
+	return testDb(ctx, d.SQL)
+}
@@ -0,0 +1,5 @@
+// Package melonpb holds the protocol buffer messages and gRPC stubs of the
+// melon key-value API.
+package melonpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative melon.proto
@@ -3,6 +3,10 @@ package stability_patterns
 import (
 	"context"
 	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.uber.org/zap"
+	"melon/internal/logging"
 	"sync"
 	"time"
 )
@@ -10,32 +14,95 @@ import (
 type Circuit func(context.Context) (string, error)
 
 func Breaker(circuit Circuit, failureThreshold uint) Circuit {
-	var consecutiveFailures int = 0
-	var lastAttempt = time.Now()
-	var m sync.RWMutex
+	b := NewCircuitBreaker(failureThreshold)
 	return func(ctx context.Context) (string, error) {
-		m.RLock() // Establish a "read lock"
-		d := consecutiveFailures - int(failureThreshold)
-		if d >= 0 {
-			shouldRetryAt := lastAttempt.Add(time.Second * 2 << d) // exponential backoff
-			if !time.Now().After(shouldRetryAt) {
-				m.RUnlock()
-				return "", errors.New("service unreachable")
-			}
-		}
-		m.RUnlock()                   // Release read lock
-		response, err := circuit(ctx) // Issue request proper
-		m.Lock()                      // Lock around shared resources
-		defer m.Unlock()
-		lastAttempt = time.Now() // Record time of attempt
-		// Circuit returned an error,
-		// so we count the failure
-		// and return
-		if err != nil {
-			consecutiveFailures++
-			return response, err
+		return b.Do(ctx, circuit)
+	}
+}
+
+var ErrorServiceUnreachable = errors.New("service unreachable")
+
+// BreakerState is whether a circuit breaker is letting calls through.
+type BreakerState int
+
+const (
+	BreakerClosed   BreakerState = iota // Calls go through
+	BreakerOpen                         // Calls fail fast until the backoff expires
+	BreakerHalfOpen                     // The next call is a trial; success closes the breaker
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	}
+	return "half-open"
+}
+
+// CircuitBreaker is the state behind Breaker. Holding it directly lets one
+// breaker guard calls that differ, such as every request to a backend, and
+// lets its state be observed.
+type CircuitBreaker struct {
+	failureThreshold    uint
+	m                   sync.RWMutex
+	consecutiveFailures int
+	lastAttempt         time.Time
+}
+
+func NewCircuitBreaker(failureThreshold uint) *CircuitBreaker {
+	return &CircuitBreaker{failureThreshold: failureThreshold, lastAttempt: time.Now()}
+}
+
+// Do calls circuit unless the breaker is open.
+func (b *CircuitBreaker) Do(ctx context.Context, circuit Circuit) (string, error) {
+	ctx, span := tracer.Start(ctx, "circuit_breaker")
+	defer span.End()
+	b.m.RLock() // Establish a "read lock"
+	state := b.state(time.Now())
+	b.m.RUnlock() // Release read lock
+	span.SetAttributes(attribute.String("state", state.String()))
+	if state == BreakerOpen {
+		span.SetStatus(codes.Error, ErrorServiceUnreachable.Error())
+		return "", ErrorServiceUnreachable
+	}
+	response, err := circuit(ctx) // Issue request proper
+	b.m.Lock()                    // Lock around shared resources
+	defer b.m.Unlock()
+	b.lastAttempt = time.Now() // Record time of attempt
+	// Circuit returned an error,
+	// so we count the failure
+	// and return
+	if err != nil {
+		b.consecutiveFailures++
+		if b.consecutiveFailures == int(b.failureThreshold) {
+			logging.Ctx(ctx, log).Warn("circuit breaker opened", zap.Int("failures", b.consecutiveFailures), zap.Error(err))
 		}
-		consecutiveFailures = 0 // Reset failures counter
-		return response, nil
+		return response, err
+	}
+	if b.consecutiveFailures > 0 && b.consecutiveFailures >= int(b.failureThreshold) {
+		logging.Ctx(ctx, log).Info("circuit breaker closed")
+	}
+	b.consecutiveFailures = 0 // Reset failures counter
+	return response, nil
+}
+
+// State reports whether calls would currently go through.
+func (b *CircuitBreaker) State() BreakerState {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.state(time.Now())
+}
+
+func (b *CircuitBreaker) state(now time.Time) BreakerState {
+	d := b.consecutiveFailures - int(b.failureThreshold)
+	if d < 0 {
+		return BreakerClosed
+	}
+	shouldRetryAt := b.lastAttempt.Add(time.Second * 2 << d) // exponential backoff
+	if !now.After(shouldRetryAt) {
+		return BreakerOpen
 	}
+	return BreakerHalfOpen
 }
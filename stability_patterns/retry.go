@@ -2,20 +2,42 @@ package stability_patterns
 
 import (
 	"context"
-	"log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"melon/internal/logging"
 	"time"
 )
 
+// log receives the patterns' diagnostics; see SetLogger.
+var log = zap.NewNop()
+
+// SetLogger makes the stability patterns report to l. A logger carried by
+// the context of a call is preferred.
+func SetLogger(l *zap.Logger) {
+	log = l.Named("stability")
+}
+
+var tracer = otel.Tracer("melon/stability_patterns")
+
 type Effector func(context.Context) (string, error)
 
 func Retry(effector Effector, retries int, delay time.Duration) Effector {
 	return func(ctx context.Context) (string, error) {
 		for r := 0; ; r++ {
-			response, err := effector(ctx)
+			attemptCtx, span := tracer.Start(ctx, "retry.attempt", trace.WithAttributes(attribute.Int("attempt", r+1)))
+			response, err := effector(attemptCtx)
+			if err != nil {
+				span.SetStatus(codes.Error, err.Error())
+			}
+			span.End()
 			if err == nil || r >= retries {
 				return response, err
 			}
-			log.Printf("Attempt %d failed; retrying in %v", r+1, delay)
+			logging.Ctx(ctx, log).Warn("attempt failed; retrying",
+				zap.Int("attempt", r+1), zap.Duration("delay", delay), zap.Error(err))
 			select {
 			case <-time.After(delay):
 			case <-ctx.Done():
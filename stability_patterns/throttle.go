@@ -1,41 +1,144 @@
 package stability_patterns
 
 import (
+	"container/list"
 	"context"
 	"fmt"
+	"go.opentelemetry.io/otel/trace"
 	"sync"
 	"time"
 )
 
+// tokenBucket holds up to max tokens, gaining refill tokens every d. Tokens
+// are added lazily when the bucket is used, so no goroutine is needed to
+// refill it.
+type tokenBucket struct {
+	tokens uint
+	last   time.Time // When tokens was last brought up to date
+}
+
+func newTokenBucket(max uint, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: max, last: now}
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(now time.Time, max, refill uint, d time.Duration) {
+	intervals := now.Sub(b.last) / d
+	if intervals <= 0 {
+		return
+	}
+	b.last = b.last.Add(intervals * d)
+	if uint64(intervals)*uint64(refill) >= uint64(max-b.tokens) {
+		b.tokens = max
+		b.last = now // A full bucket earns nothing until a token is taken
+		return
+	}
+	b.tokens += uint(intervals) * refill
+}
+
+// take removes a token, or reports how long until one is available.
+func (b *tokenBucket) take(now time.Time, max, refill uint, d time.Duration) (bool, time.Duration) {
+	b.refill(now, max, refill, d)
+	if b.tokens == 0 {
+		return false, b.last.Add(d).Sub(now)
+	}
+	b.tokens--
+	return true, 0
+}
+
 func Throttle(e Effector, max uint, refill uint, d time.Duration) Effector {
-	var tokens = max
-	var once sync.Once
+	var m sync.Mutex
+	bucket := newTokenBucket(max, time.Now())
 	return func(ctx context.Context) (string, error) {
 		if ctx.Err() != nil {
 			return "", ctx.Err()
 		}
-		once.Do(func() {
-			ticker := time.NewTicker(d)
-			go func() {
-				defer ticker.Stop()
-				for {
-					select {
-					case <-ctx.Done():
-						return
-					case <-ticker.C:
-						t := tokens + refill // refill tokens after some number of times
-						if t > max {
-							t = max
-						}
-						tokens = t
-					}
-				}
-			}()
-		})
-		if tokens <= 0 {
+		m.Lock()
+		ok, _ := bucket.take(time.Now(), max, refill, d)
+		m.Unlock()
+		if !ok {
+			trace.SpanFromContext(ctx).AddEvent("throttled")
 			return "", fmt.Errorf("too many calls")
 		}
-		tokens--
 		return e(ctx)
 	}
 }
+
+// KeyedThrottle keeps a separate token bucket per key, such as per client.
+// Buckets that have refilled completely are indistinguishable from new ones
+// and are dropped; beyond maxKeys the least recently used bucket is dropped
+// too, so memory stays bounded however many keys are seen.
+type KeyedThrottle struct {
+	max, refill uint
+	d           time.Duration
+	maxKeys     int
+
+	m       sync.Mutex
+	buckets map[string]*list.Element // Key to its entry in lru
+	lru     *list.List               // *keyedBucket, most recently used first
+}
+
+type keyedBucket struct {
+	key string
+	*tokenBucket
+}
+
+// NewKeyedThrottle allows each key max calls at once, refilling refill
+// calls every d, while tracking at most maxKeys keys.
+func NewKeyedThrottle(max, refill uint, d time.Duration, maxKeys int) *KeyedThrottle {
+	return &KeyedThrottle{
+		max:     max,
+		refill:  refill,
+		d:       d,
+		maxKeys: maxKeys,
+		buckets: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Allow takes a token from key's bucket. If the bucket is empty it returns
+// false and how long until the next token arrives.
+func (t *KeyedThrottle) Allow(key string) (bool, time.Duration) {
+	now := time.Now()
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.evictIdle(now)
+	el, ok := t.buckets[key]
+	if ok {
+		t.lru.MoveToFront(el)
+	} else {
+		if len(t.buckets) >= t.maxKeys {
+			t.remove(t.lru.Back())
+		}
+		el = t.lru.PushFront(&keyedBucket{key: key, tokenBucket: newTokenBucket(t.max, now)})
+		t.buckets[key] = el
+	}
+	return el.Value.(*keyedBucket).take(now, t.max, t.refill, t.d)
+}
+
+// Len returns the number of keys being tracked.
+func (t *KeyedThrottle) Len() int {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return len(t.buckets)
+}
+
+// evictIdle drops full buckets from the back of the LRU list, stopping at
+// the first that is still refilling.
+func (t *KeyedThrottle) evictIdle(now time.Time) {
+	for el := t.lru.Back(); el != nil; el = t.lru.Back() {
+		b := el.Value.(*keyedBucket)
+		b.refill(now, t.max, t.refill, t.d)
+		if b.tokens < t.max {
+			return
+		}
+		t.remove(el)
+	}
+}
+
+func (t *KeyedThrottle) remove(el *list.Element) {
+	if el != nil {
+		t.lru.Remove(el)
+		delete(t.buckets, el.Value.(*keyedBucket).key)
+	}
+}